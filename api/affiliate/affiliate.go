@@ -0,0 +1,138 @@
+// Package affiliate rewrites outbound vendor links through the affiliate
+// or referral programme configured for the vendor's domain.
+package affiliate
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/metrics"
+)
+
+// Rule rewrites the links to Domain and its subdomains, in one country or,
+// without CountryId, in every country without a rule of its own. Params
+// are set on the link's query, a Template holding {url} wraps the link,
+// escaped, in a tracking link instead.
+type Rule struct {
+	RuleId    string            `json:"rule_id"`
+	CountryId string            `json:"country_id,omitempty"`
+	Domain    string            `json:"domain"`
+	Params    map[string]string `json:"params"`
+	Template  string            `json:"template,omitempty"`
+	Enabled   bool              `json:"enabled"`
+}
+
+// Apply rewrites rawURL by the rule.
+func (rule Rule) Apply(rawURL string) string {
+	if rule.Template != "" {
+		return strings.ReplaceAll(rule.Template, "{url}", url.QueryEscape(rawURL))
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	q := u.Query()
+	for name, value := range rule.Params {
+		q.Set(name, value)
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// Matches reports whether rawURL points to the rule's domain.
+func (rule Rule) Matches(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	return host == rule.Domain || strings.HasSuffix(host, "."+rule.Domain)
+}
+
+// Load reads the enabled rules.
+func Load(ctx context.Context, db *pgxpool.Pool) ([]Rule, error) {
+	rows, err := db.Query(metrics.WithQueryName(ctx, "list_affiliate_rules"),
+		`select rule_id::text,coalesce(country_id::text,''),domain,params,coalesce(template,''),enabled
+		from helpschool.affiliate_rules where enabled`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rules []Rule
+	for rows.Next() {
+		var rule Rule
+		if err := rows.Scan(&rule.RuleId, &rule.CountryId, &rule.Domain, &rule.Params, &rule.Template, &rule.Enabled); err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// Rewriter applies the rules, reloading them at most every ttl.
+type Rewriter struct {
+	db  *pgxpool.Pool
+	ttl time.Duration
+
+	mu     sync.Mutex
+	rules  []Rule
+	loaded time.Time
+}
+
+// NewRewriter creates a Rewriter reading the rules from db.
+func NewRewriter(db *pgxpool.Pool, ttl time.Duration) *Rewriter {
+	return &Rewriter{db: db, ttl: ttl}
+}
+
+// Invalidate makes the next Rewrite reload the rules.
+func (rw *Rewriter) Invalidate() {
+	rw.mu.Lock()
+	rw.loaded = time.Time{}
+	rw.mu.Unlock()
+}
+
+func (rw *Rewriter) current(ctx context.Context) []Rule {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if time.Since(rw.loaded) > rw.ttl {
+		rules, err := Load(ctx, rw.db)
+		if err != nil {
+			// keep the rules we have, links stay usable without them
+			slog.ErrorContext(ctx, "load affiliate rules failed", "err", err)
+		} else {
+			rw.rules = rules
+		}
+		rw.loaded = time.Now()
+	}
+	return rw.rules
+}
+
+// Find returns the rule for the domain of rawURL in countryId, a rule of
+// the country winning over one for every country.
+func (rw *Rewriter) Find(ctx context.Context, countryId, rawURL string) (Rule, bool) {
+	var match Rule
+	found := false
+	for _, rule := range rw.current(ctx) {
+		if rule.CountryId != "" && rule.CountryId != countryId || !rule.Matches(rawURL) {
+			continue
+		}
+		if !found || rule.CountryId != "" {
+			match, found = rule, true
+		}
+	}
+	return match, found
+}
+
+// Rewrite returns rawURL rewritten by the rule Find returns, links without
+// a rule are returned as they are.
+func (rw *Rewriter) Rewrite(ctx context.Context, countryId, rawURL string) string {
+	if rule, ok := rw.Find(ctx, countryId, rawURL); ok {
+		return rule.Apply(rawURL)
+	}
+	return rawURL
+}
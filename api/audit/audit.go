@@ -0,0 +1,220 @@
+// Package audit tells the audit triggers in the database who is changing
+// rows. The actor of a request, its user, client IP, request ID and the
+// reason given in the X-Audit-Reason header, is set on the connection a
+// query runs on as the settings helpschool.audit_user, audit_ip,
+// audit_request and audit_reason, which the triggers copy into
+// audit_events. Run links the events into the hash chain afterwards.
+package audit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/metrics"
+)
+
+// ReasonHeader carries the reason for a change, e.g. a support ticket.
+const ReasonHeader = "X-Audit-Reason"
+
+// Actor is who changes rows in a request.
+type Actor struct {
+	UserId    string
+	IP        string
+	RequestId string
+	Reason    string
+}
+
+type ctxKey struct{}
+
+// actor is shared by the contexts derived from a request context, so the
+// user resolved by the auth layer is seen by every later query.
+type actor struct {
+	mu sync.Mutex
+	Actor
+}
+
+// WithActor returns ctx with the actor of its changes.
+func WithActor(ctx context.Context, a Actor) context.Context {
+	return context.WithValue(ctx, ctxKey{}, &actor{Actor: a})
+}
+
+// FromContext returns the actor of ctx, the zero Actor outside requests.
+func FromContext(ctx context.Context) Actor {
+	if a, ok := ctx.Value(ctxKey{}).(*actor); ok {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return a.Actor
+	}
+	return Actor{}
+}
+
+// SetUserID records the authenticated user for the rest of the request.
+func SetUserID(ctx context.Context, userId string) {
+	if a, ok := ctx.Value(ctxKey{}).(*actor); ok {
+		a.mu.Lock()
+		a.UserId = userId
+		a.mu.Unlock()
+	}
+}
+
+// truncateIP keeps the network of an address, /24 for IPv4 and /48 for
+// IPv6: enough to tell where changes came from without pointing at a
+// person.
+func truncateIP(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return ""
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// Proxies are the load balancers and proxies in front of the api, whose
+// X-Forwarded-For entries are believed.
+type Proxies []*net.IPNet
+
+// ProxiesFromEnv reads the trusted proxies from $TRUSTED_PROXIES, a comma
+// separated list of addresses and CIDR ranges. Without it no proxy is
+// trusted and the client is the peer.
+func ProxiesFromEnv() (Proxies, error) {
+	var proxies Proxies
+	for _, v := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("parse $TRUSTED_PROXIES: %s", err)
+		}
+		proxies = append(proxies, network)
+	}
+	return proxies, nil
+}
+
+func (p Proxies) trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	for _, network := range p {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware starts the actor of a request. It must run after
+// middleware.RequestID.
+func (p Proxies) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(WithActor(r.Context(), Actor{
+			IP:        truncateIP(p.clientIP(r)),
+			RequestId: middleware.GetReqID(r.Context()),
+			Reason:    r.Header.Get(ReasonHeader),
+		})))
+	})
+}
+
+// clientIP is the peer's address or, when the peer is a trusted proxy, the
+// last address in X-Forwarded-For that is not one. Addresses before it are
+// sent by the client and could be anything.
+func (p Proxies) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && p.trusted(ip); i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" {
+			break
+		}
+		ip = hop
+	}
+	return ip
+}
+
+// Sessions sets the actor of the context a pooled connection is acquired
+// with on the connection. Install BeforeAcquire as the pool's hook.
+type Sessions struct {
+	actors sync.Map // *pgx.Conn to the Actor set on it
+}
+
+// BeforeAcquire sets the actor of ctx on conn unless it is set already.
+// Connections the actor cannot be set on are not used.
+func (s *Sessions) BeforeAcquire(ctx context.Context, conn *pgx.Conn) bool {
+	a := FromContext(ctx)
+	if current, ok := s.actors.Load(conn); ok && current.(Actor) == a {
+		return true
+	}
+	s.actors.Range(func(c, _ interface{}) bool {
+		// forget the connections the pool closed
+		if c.(*pgx.Conn).IsClosed() {
+			s.actors.Delete(c)
+		}
+		return true
+	})
+	if _, err := conn.Exec(metrics.WithQueryName(ctx, "set_audit_actor"),
+		`select set_config('helpschool.audit_user',$1,false),set_config('helpschool.audit_ip',$2,false),
+			set_config('helpschool.audit_request',$3,false),set_config('helpschool.audit_reason',$4,false)`,
+		a.UserId, a.IP, a.RequestId, a.Reason); err != nil {
+		s.actors.Delete(conn)
+		return false
+	}
+	s.actors.Store(conn, a)
+	return true
+}
+
+// chainBatch is how many events one call to audit_chain links.
+const chainBatch = 1000
+
+// Chain links the events appended since the last call into the hash chain
+// and returns how many it linked.
+func Chain(ctx context.Context, db *pgxpool.Pool) (int, error) {
+	total := 0
+	for {
+		var n int
+		if err := db.QueryRow(metrics.WithQueryName(ctx, "chain_audit_events"),
+			"select helpschool.audit_chain($1)", chainBatch).Scan(&n); err != nil {
+			return total, err
+		}
+		total += n
+		if n < chainBatch {
+			return total, nil
+		}
+	}
+}
+
+// Run chains the audit events every interval until ctx is done.
+func Run(ctx context.Context, db *pgxpool.Pool, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if _, err := Chain(ctx, db); err != nil {
+			slog.ErrorContext(ctx, "chain audit events failed", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package audit
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTruncateIP(t *testing.T) {
+	for addr, want := range map[string]string{
+		"203.0.113.57":          "203.0.113.0",
+		"::ffff:203.0.113.57":   "203.0.113.0",
+		"2001:db8:1234:5678::1": "2001:db8:1234::",
+		"not an address":        "",
+		"":                      "",
+	} {
+		if got := truncateIP(addr); got != want {
+			t.Errorf("truncateIP(%q) = %q, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8, 192.0.2.1")
+	proxies, err := ProxiesFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name, remote, forwarded, want string
+		proxies                       Proxies
+	}{
+		{"no proxy trusted", "10.0.0.1:1234", "198.51.100.7", "10.0.0.1", nil},
+		{"untrusted peer", "198.51.100.9:1234", "198.51.100.7", "198.51.100.9", proxies},
+		{"trusted peer", "10.0.0.1:1234", "198.51.100.7", "198.51.100.7", proxies},
+		{"spoofed entries", "10.0.0.1:1234", "1.2.3.4, 198.51.100.7", "198.51.100.7", proxies},
+		{"proxy chain", "10.0.0.1:1234", "198.51.100.7, 192.0.2.1, 10.1.2.3", "198.51.100.7", proxies},
+		{"no header", "10.0.0.1:1234", "", "10.0.0.1", proxies},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remote
+		if c.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", c.forwarded)
+		}
+		if got := c.proxies.clientIP(r); got != c.want {
+			t.Errorf("%s: clientIP = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestProxiesFromEnv(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8,not-a-range")
+	if _, err := ProxiesFromEnv(); err == nil {
+		t.Error("ProxiesFromEnv accepted an invalid range")
+	}
+}
@@ -1,12 +1,11 @@
 package auth
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
 	"fmt"
-	"net/http"
-	"strings"
 
-	"github.com/auth0/go-jwt-middleware"
 	"github.com/form3tech-oss/jwt-go"
 )
 
@@ -17,56 +16,33 @@ type JSONWebKeys struct {
 	Use string   `json:"use"`
 	N   string   `json:"n"`
 	E   string   `json:"e"`
+	Crv string   `json:"crv"`
+	X   string   `json:"x"`
+	Y   string   `json:"y"`
 	X5c []string `json:"x5c"`
 }
 
-// NewMiddleware creates a middleware checking JWT tokens using provided Auth0 endpoints
-func NewMiddleware(aud, iss string) *jwtmiddleware.JWTMiddleware {
-	return jwtmiddleware.New(jwtmiddleware.Options{
-		ValidationKeyGetter: func(token *jwt.Token) (interface{}, error) {
-			if !token.Claims.(jwt.MapClaims).VerifyAudience(aud, false) {
-				return token, fmt.Errorf("invalid token audience")
-			}
-			if !token.Claims.(jwt.MapClaims).VerifyIssuer(iss, false) {
-				return token, fmt.Errorf("invalid token issuer")
-			}
-
-			cert, err := getCert(token, iss)
-			if err != nil {
-				return nil, fmt.Errorf("load cert: %s", err)
-			}
-
-			result, err := jwt.ParseRSAPublicKeyFromPEM(cert)
-			if err != nil {
-				return nil, fmt.Errorf("parse cert: %s", err)
-			}
-			return result, nil
-		},
-		SigningMethod: jwt.SigningMethodRS256,
-	})
-}
-
-func getCert(token *jwt.Token, issuer string) ([]byte, error) {
-	resp, err := http.Get(strings.TrimSuffix(issuer, "/") + "/.well-known/jwks.json")
+// getKey looks up the key the token was signed with and checks it matches
+// the token's algorithm, so an RSA key can never verify an HMAC token.
+func getKey(token *jwt.Token, keys *JWKS) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	// the key getter is not handed the request context
+	key, err := keys.Key(context.Background(), kid)
 	if err != nil {
-		return nil, fmt.Errorf("load JWK: %s", err)
-	}
-	if resp.Body != nil {
-		defer resp.Body.Close()
+		return nil, fmt.Errorf("load key: %s", err)
 	}
 
-	var payload struct {
-		Keys []JSONWebKeys `json:"keys"`
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
-		return nil, fmt.Errorf("parse JWK JSON: %s", err)
-	}
-
-	for _, key := range payload.Keys {
-		if token.Header["kid"] == key.Kid {
-			return []byte("-----BEGIN CERTIFICATE-----\n" + key.X5c[0] + "\n-----END CERTIFICATE-----"), nil
+	switch token.Method {
+	case jwt.SigningMethodRS256:
+		if _, ok := key.(*rsa.PublicKey); ok {
+			return key, nil
 		}
+	case jwt.SigningMethodES256:
+		if _, ok := key.(*ecdsa.PublicKey); ok {
+			return key, nil
+		}
+	default:
+		return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
 	}
-
-	return nil, fmt.Errorf("unable to find matching key")
+	return nil, fmt.Errorf("key %q does not match signing method %v", kid, token.Header["alg"])
 }
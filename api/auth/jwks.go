@@ -0,0 +1,246 @@
+package auth
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/venkata6/helpschool/api/tracing"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// ErrUnknownKey is returned when no key in the set matches the token kid,
+// even after refetching the set.
+var ErrUnknownKey = errors.New("unable to find matching key")
+
+// JWKS is a cached JSON Web Key Set. Keys are kept for TTL and refreshed in
+// the background by Start; a token signed with an unknown kid triggers an
+// immediate refetch, at most once every MinRefreshInterval, so rotated keys
+// are picked up without letting bogus tokens hammer the identity provider.
+// A key set without URL is static and never fetched.
+type JWKS struct {
+	URL                string
+	Client             *http.Client
+	TTL                time.Duration
+	MinRefreshInterval time.Duration
+
+	mu          sync.RWMutex
+	keys        map[string]interface{}
+	fetchedAt   time.Time  // last successful fetch, for TTL
+	attemptedAt time.Time  // last fetch, failed or not, for MinRefreshInterval
+	fetchMu     sync.Mutex // serializes fetches
+}
+
+// NewJWKS creates a key set loaded from url using client. A nil client
+// falls back to the traced default client.
+func NewJWKS(url string, client *http.Client) *JWKS {
+	if client == nil {
+		client = tracing.HTTPClient
+	}
+	return &JWKS{
+		URL:                url,
+		Client:             client,
+		TTL:                time.Hour,
+		MinRefreshInterval: time.Minute,
+	}
+}
+
+// NewStaticJWKS creates a key set holding fixed keys, indexed by kid.
+func NewStaticJWKS(keys map[string]interface{}) *JWKS {
+	return &JWKS{keys: keys}
+}
+
+// JWKSURL returns the conventional key set location of an issuer.
+func JWKSURL(issuer string) string {
+	return strings.TrimSuffix(issuer, "/") + "/.well-known/jwks.json"
+}
+
+// Start refreshes the key set every TTL until ctx is done.
+func (s *JWKS) Start(ctx context.Context) {
+	if s.URL == "" {
+		return
+	}
+	ticker := time.NewTicker(s.TTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Refresh(ctx); err != nil {
+				slog.Warn("refresh JWKS", "url", s.URL, "err", err)
+			}
+		}
+	}
+}
+
+// Key returns the public key (*rsa.PublicKey or *ecdsa.PublicKey) for kid.
+func (s *JWKS) Key(ctx context.Context, kid string) (interface{}, error) {
+	s.mu.RLock()
+	key, ok := s.keys[kid]
+	stale := time.Since(s.fetchedAt) > s.TTL
+	s.mu.RUnlock()
+	if ok && (!stale || s.URL == "") {
+		return key, nil
+	}
+	if s.URL == "" {
+		return nil, ErrUnknownKey
+	}
+
+	if err := s.refreshIfAllowed(ctx); err != nil && !ok {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if key, ok := s.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrUnknownKey
+}
+
+func (s *JWKS) refreshIfAllowed(ctx context.Context) error {
+	s.fetchMu.Lock()
+	defer s.fetchMu.Unlock()
+	s.mu.RLock()
+	recent := time.Since(s.attemptedAt) < s.MinRefreshInterval
+	s.mu.RUnlock()
+	if recent {
+		return nil
+	}
+	return s.fetch(ctx)
+}
+
+// Refresh unconditionally refetches the key set.
+func (s *JWKS) Refresh(ctx context.Context) error {
+	s.fetchMu.Lock()
+	defer s.fetchMu.Unlock()
+	return s.fetch(ctx)
+}
+
+// fetch loads the key set. The attempt is recorded before the request so
+// that an identity provider that is down is not retried on every token.
+func (s *JWKS) fetch(ctx context.Context) (err error) {
+	s.mu.Lock()
+	s.attemptedAt = time.Now()
+	s.mu.Unlock()
+
+	ctx, span := tracing.Tracer().Start(ctx, "auth.fetchJWKS")
+	defer func() {
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		return fmt.Errorf("load JWK: %s", err)
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return fmt.Errorf("load JWK: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("load JWK: unexpected status %s", resp.Status)
+	}
+
+	var payload struct {
+		Keys []JSONWebKeys `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return fmt.Errorf("parse JWK JSON: %s", err)
+	}
+
+	keys := make(map[string]interface{}, len(payload.Keys))
+	for _, jwk := range payload.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			slog.Warn("skipping JWK", "kid", jwk.Kid, "err", err)
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.fetchedAt = time.Now()
+	s.mu.Unlock()
+	return nil
+}
+
+// PublicKey decodes the key, preferring the x5c certificate chain and
+// falling back to the raw RSA (n, e) or EC (crv, x, y) parameters.
+func (k JSONWebKeys) PublicKey() (interface{}, error) {
+	if len(k.X5c) > 0 {
+		der, err := base64.StdEncoding.DecodeString(k.X5c[0])
+		if err != nil {
+			return nil, fmt.Errorf("decode x5c: %s", err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("parse x5c: %s", err)
+		}
+		return cert.PublicKey, nil
+	}
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("decode n: %s", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("decode e: %s", err)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("decode x: %s", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("decode y: %s", err)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	if s == "" {
+		return nil, errors.New("missing value")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// idp serves a key set that tests can rotate or break, counting requests.
+type idp struct {
+	mu       sync.Mutex
+	keys     map[string]*rsa.PublicKey
+	status   int
+	requests int
+}
+
+func (p *idp) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.requests++
+	if p.status != 0 {
+		w.WriteHeader(p.status)
+		return
+	}
+	var keys []JSONWebKeys
+	for kid, pub := range p.keys {
+		keys = append(keys, JSONWebKeys{Kty: "RSA", Kid: kid, Use: "sig",
+			N: base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())})
+	}
+	json.NewEncoder(w).Encode(map[string][]JSONWebKeys{"keys": keys})
+}
+
+func (p *idp) set(keys map[string]*rsa.PublicKey, status int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys, p.status = keys, status
+}
+
+func (p *idp) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.requests
+}
+
+func newKey(t *testing.T) *rsa.PublicKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &key.PublicKey
+}
+
+func newIdP(t *testing.T, keys map[string]*rsa.PublicKey) (*idp, *JWKS) {
+	t.Helper()
+	p := &idp{keys: keys}
+	srv := httptest.NewServer(p)
+	t.Cleanup(srv.Close)
+	return p, NewJWKS(srv.URL, srv.Client())
+}
+
+func TestJWKSKey(t *testing.T) {
+	pub := newKey(t)
+	p, jwks := newIdP(t, map[string]*rsa.PublicKey{"a": pub})
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		key, err := jwks.Key(ctx, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := key.(*rsa.PublicKey); !ok || !got.Equal(pub) {
+			t.Fatalf("Key(a) = %v, want the served key", key)
+		}
+	}
+	if n := p.count(); n != 1 {
+		t.Errorf("fetched %d times, want 1", n)
+	}
+}
+
+func TestJWKSRotation(t *testing.T) {
+	p, jwks := newIdP(t, map[string]*rsa.PublicKey{"a": newKey(t)})
+	jwks.MinRefreshInterval = 0
+	ctx := context.Background()
+	if _, err := jwks.Key(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := newKey(t)
+	p.set(map[string]*rsa.PublicKey{"b": rotated}, 0)
+	key, err := jwks.Key(ctx, "b")
+	if err != nil {
+		t.Fatalf("Key(b) after rotation: %v", err)
+	}
+	if !key.(*rsa.PublicKey).Equal(rotated) {
+		t.Error("Key(b) is not the rotated key")
+	}
+	if _, err := jwks.Key(ctx, "a"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Key(a) after rotation = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestJWKSUnknownKidThrottled(t *testing.T) {
+	p, jwks := newIdP(t, map[string]*rsa.PublicKey{"a": newKey(t)})
+	ctx := context.Background()
+	if _, err := jwks.Key(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := jwks.Key(ctx, "bogus"); !errors.Is(err, ErrUnknownKey) {
+			t.Fatalf("Key(bogus) = %v, want ErrUnknownKey", err)
+		}
+	}
+	if n := p.count(); n != 1 {
+		t.Errorf("fetched %d times for unknown kids, want 1", n)
+	}
+}
+
+func TestJWKSFailingIdPThrottled(t *testing.T) {
+	p, jwks := newIdP(t, nil)
+	p.set(nil, http.StatusInternalServerError)
+	ctx := context.Background()
+
+	if _, err := jwks.Key(ctx, "a"); err == nil {
+		t.Fatal("Key(a) with a failing identity provider succeeded")
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := jwks.Key(ctx, "a"); err == nil {
+			t.Fatal("Key(a) with a failing identity provider succeeded")
+		}
+	}
+	if n := p.count(); n != 1 {
+		t.Errorf("fetched %d times from a failing identity provider, want 1", n)
+	}
+
+	pub := newKey(t)
+	p.set(map[string]*rsa.PublicKey{"a": pub}, 0)
+	jwks.MinRefreshInterval = time.Nanosecond
+	time.Sleep(time.Millisecond)
+	if _, err := jwks.Key(ctx, "a"); err != nil {
+		t.Errorf("Key(a) once the identity provider is back: %v", err)
+	}
+}
+
+func TestJWKSStaleKeyKeptWhenRefreshFails(t *testing.T) {
+	p, jwks := newIdP(t, map[string]*rsa.PublicKey{"a": newKey(t)})
+	ctx := context.Background()
+	if _, err := jwks.Key(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	p.set(nil, http.StatusServiceUnavailable)
+	jwks.TTL, jwks.MinRefreshInterval = 0, 0
+	if _, err := jwks.Key(ctx, "a"); err != nil {
+		t.Errorf("Key(a) with a stale set and a failing refresh = %v, want the cached key", err)
+	}
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidLink is returned for magic link tokens with a bad signature,
+// another purpose or a past expiry.
+var ErrInvalidLink = errors.New("invalid or expired link")
+
+// Magic link purposes, a token signed for one purpose is not accepted for another.
+const (
+	LinkGuestDonation  = "guest-donation"
+	LinkClaimDonations = "claim-donations"
+)
+
+// MagicLinks signs and verifies the tokens of emailed links that stand in
+// for a sign in, such as the link to manage a guest pledge. A token is the
+// base64url encoded purpose, subject and expiry followed by their HMAC-SHA256.
+type MagicLinks struct {
+	secret []byte
+}
+
+func NewMagicLinks(secret []byte) *MagicLinks {
+	return &MagicLinks{secret: secret}
+}
+
+// MagicLinksFromEnv uses $MAGIC_LINK_SECRET. Without it a random secret is
+// generated unless required, links then stop working when the server restarts.
+func MagicLinksFromEnv(required bool) (*MagicLinks, error) {
+	if secret := os.Getenv("MAGIC_LINK_SECRET"); secret != "" {
+		if len(secret) < 32 {
+			return nil, errors.New("MAGIC_LINK_SECRET must be at least 32 characters")
+		}
+		return NewMagicLinks([]byte(secret)), nil
+	}
+	if required {
+		return nil, errors.New("MAGIC_LINK_SECRET is not set")
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	slog.Warn("no $MAGIC_LINK_SECRET, emailed links will not survive a restart")
+	return NewMagicLinks(secret), nil
+}
+
+// Sign returns a token for subject, valid for purpose until expires.
+func (m *MagicLinks) Sign(purpose, subject string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString(
+		[]byte(purpose + "\n" + subject + "\n" + strconv.FormatInt(expires.Unix(), 10)))
+	return payload + "." + m.mac(payload)
+}
+
+// Verify checks the signature, purpose and expiry of token and returns its subject.
+func (m *MagicLinks) Verify(purpose, token string) (string, error) {
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(m.mac(payload))) {
+		return "", ErrInvalidLink
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", ErrInvalidLink
+	}
+	parts := strings.SplitN(string(raw), "\n", 3)
+	if len(parts) != 3 || parts[0] != purpose {
+		return "", ErrInvalidLink
+	}
+	expires, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", ErrInvalidLink
+	}
+	return parts[1], nil
+}
+
+func (m *MagicLinks) mac(payload string) string {
+	h := hmac.New(sha256.New, m.secret)
+	h.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
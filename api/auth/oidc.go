@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// DiscoveryDocument holds the fields of an OpenID Provider configuration
+// (/.well-known/openid-configuration) we rely on.
+type DiscoveryDocument struct {
+	Issuer        string   `json:"issuer"`
+	JWKSURI       string   `json:"jwks_uri"`
+	TokenEndpoint string   `json:"token_endpoint,omitempty"`
+	Algorithms    []string `json:"id_token_signing_alg_values_supported,omitempty"`
+}
+
+// DiscoveryURL returns the OpenID configuration location of an issuer.
+func DiscoveryURL(issuer string) string {
+	return strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+}
+
+// Discover loads the OpenID configuration of issuer and checks it really
+// describes that issuer.
+func Discover(ctx context.Context, client *http.Client, issuer string) (*DiscoveryDocument, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, DiscoveryURL(issuer), nil)
+	if err != nil {
+		return nil, fmt.Errorf("discovery: %s", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("discovery: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery: unexpected status %s", resp.Status)
+	}
+
+	var doc DiscoveryDocument
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("discovery: parse JSON: %s", err)
+	}
+	if strings.TrimSuffix(doc.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		return nil, fmt.Errorf("discovery: issuer mismatch, got %q want %q", doc.Issuer, issuer)
+	}
+	if doc.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery: missing jwks_uri")
+	}
+	return &doc, nil
+}
@@ -0,0 +1,294 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/auth0/go-jwt-middleware"
+	"github.com/form3tech-oss/jwt-go"
+	"github.com/venkata6/helpschool/api/tracing"
+)
+
+// ClaimMapping names the token claims holding the user's profile. Providers
+// disagree here: Auth0 uses namespaced custom claims, Keycloak puts roles in
+// realm_access.roles, Google has no roles at all. Nested claims are written
+// with dots.
+type ClaimMapping struct {
+	Email string `json:"email"`
+	Name  string `json:"name"`
+	Roles string `json:"roles"`
+}
+
+// ProviderConfig describes one trusted identity provider. Audience is
+// required, it is what the provider puts in the aud claim of tokens for
+// this api.
+type ProviderConfig struct {
+	Issuer   string       `json:"issuer"`
+	Audience string       `json:"audience"`
+	Claims   ClaimMapping `json:"claims"`
+}
+
+// Provider is a trusted issuer whose key set is located through OIDC
+// discovery the first time a token from it is verified. A failed discovery
+// is retried at most once every MinRefreshInterval, so that tokens naming an
+// issuer that is down do not hammer it.
+type Provider struct {
+	ProviderConfig
+	MinRefreshInterval time.Duration
+	client             *http.Client
+
+	mu          sync.RWMutex
+	keys        *JWKS
+	attemptedAt time.Time  // last failed discovery, for MinRefreshInterval
+	err         error      // error of the last failed discovery
+	discoverMu  sync.Mutex // serializes discoveries
+}
+
+func NewProvider(cfg ProviderConfig, client *http.Client) *Provider {
+	if client == nil {
+		client = tracing.HTTPClient
+	}
+	if cfg.Claims.Email == "" {
+		cfg.Claims.Email = "email"
+	}
+	if cfg.Claims.Name == "" {
+		cfg.Claims.Name = "name"
+	}
+	return &Provider{ProviderConfig: cfg, MinRefreshInterval: time.Minute, client: client}
+}
+
+func (p *Provider) jwks(ctx context.Context) (*JWKS, error) {
+	p.mu.RLock()
+	keys := p.keys
+	p.mu.RUnlock()
+	if keys != nil {
+		return keys, nil
+	}
+
+	p.discoverMu.Lock()
+	defer p.discoverMu.Unlock()
+	p.mu.RLock()
+	keys, recent, err := p.keys, time.Since(p.attemptedAt) < p.MinRefreshInterval, p.err
+	p.mu.RUnlock()
+	if keys != nil {
+		return keys, nil
+	}
+	if recent {
+		return nil, err
+	}
+
+	doc, err := Discover(ctx, p.client, p.Issuer)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		p.attemptedAt, p.err = time.Now(), err
+		return nil, err
+	}
+	p.keys = NewJWKS(doc.JWKSURI, p.client)
+	go p.keys.Start(context.Background())
+	return p.keys, nil
+}
+
+// Roles with special powers, as named by the identity providers' role claims.
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+)
+
+// Identity is the authenticated user as described by a verified token.
+type Identity struct {
+	Issuer  string
+	Subject string
+	Email   string
+	Name    string
+	Roles   []string
+}
+
+// HasRole reports whether the identity was granted role.
+func (i *Identity) HasRole(role string) bool {
+	if i == nil {
+		return false
+	}
+	for _, r := range i.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Provider) identity(claims jwt.MapClaims) *Identity {
+	id := &Identity{Issuer: p.Issuer}
+	id.Subject, _ = claims["sub"].(string)
+	id.Email, _ = claimValue(claims, p.Claims.Email).(string)
+	id.Name, _ = claimValue(claims, p.Claims.Name).(string)
+	if p.Claims.Roles != "" {
+		switch roles := claimValue(claims, p.Claims.Roles).(type) {
+		case string:
+			id.Roles = strings.Fields(roles)
+		case []interface{}:
+			for _, role := range roles {
+				if s, ok := role.(string); ok {
+					id.Roles = append(id.Roles, s)
+				}
+			}
+		}
+	}
+	return id
+}
+
+// claimValue resolves a claim name, falling back to a dotted path into
+// nested objects when no claim has the literal name.
+func claimValue(claims jwt.MapClaims, name string) interface{} {
+	if v, ok := claims[name]; ok {
+		return v
+	}
+	var cur interface{} = map[string]interface{}(claims)
+	for _, part := range strings.Split(name, ".") {
+		obj, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		cur = obj[part]
+	}
+	return cur
+}
+
+// Verifier accepts tokens from any of its trusted providers. The unverified
+// iss claim only selects the provider; the signature is then checked against
+// that provider's keys.
+type Verifier struct {
+	providers map[string]*Provider
+	jwt       *jwtmiddleware.JWTMiddleware
+}
+
+func NewVerifier(providers ...*Provider) *Verifier {
+	v := &Verifier{providers: map[string]*Provider{}}
+	for _, p := range providers {
+		v.Add(p)
+	}
+	v.jwt = jwtmiddleware.New(jwtmiddleware.Options{
+		ValidationKeyGetter: v.validationKey,
+	})
+	return v
+}
+
+// Add trusts one more provider.
+func (v *Verifier) Add(p *Provider) {
+	v.providers[strings.TrimSuffix(p.Issuer, "/")] = p
+}
+
+func (v *Verifier) provider(claims jwt.MapClaims) (*Provider, error) {
+	iss, _ := claims["iss"].(string)
+	p, ok := v.providers[strings.TrimSuffix(iss, "/")]
+	if !ok {
+		return nil, fmt.Errorf("untrusted token issuer %q", iss)
+	}
+	return p, nil
+}
+
+func (v *Verifier) validationKey(token *jwt.Token) (interface{}, error) {
+	claims := token.Claims.(jwt.MapClaims)
+	p, err := v.provider(claims)
+	if err != nil {
+		return token, err
+	}
+	// tokens the provider issued to other clients are not for this api
+	if !claims.VerifyAudience(p.Audience, true) {
+		return token, fmt.Errorf("invalid token audience")
+	}
+	// the key getter is not handed the request context
+	keys, err := p.jwks(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("load keys: %s", err)
+	}
+	return getKey(token, keys)
+}
+
+type identityKey struct{}
+
+// Handler rejects requests without a valid token and stores the caller's
+// Identity in the request context.
+func (v *Verifier) Handler(next http.Handler) http.Handler {
+	return v.jwt.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := r.Context().Value(v.jwt.Options.UserProperty).(*jwt.Token)
+		if !ok {
+			http.Error(w, "no JWT token", http.StatusUnauthorized)
+			return
+		}
+		claims := token.Claims.(jwt.MapClaims)
+		p, err := v.provider(claims)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		ctx := context.WithValue(r.Context(), identityKey{}, p.identity(claims))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}))
+}
+
+// IdentityFromContext returns the identity stored by Verifier.Handler.
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(*Identity)
+	return id, ok
+}
+
+// DefaultProviders is the Auth0 tenant the site has used from the start.
+var DefaultProviders = []ProviderConfig{{
+	Issuer:   "https://helpschool.us.auth0.com/",
+	Audience: "https://helpschool/api",
+	Claims:   ClaimMapping{Email: "https://example.com/email"},
+}}
+
+// ProvidersFromEnv reads the trusted providers from $AUTH_PROVIDERS, a JSON
+// array of ProviderConfig, e.g.
+//
+//	[{"issuer": "https://sso.example.org/realms/helpschool", "audience": "helpschool-api",
+//	  "claims": {"roles": "realm_access.roles"}}]
+//
+// DefaultProviders is used when the variable is not set.
+func ProvidersFromEnv() ([]ProviderConfig, error) {
+	raw := os.Getenv("AUTH_PROVIDERS")
+	if raw == "" {
+		return DefaultProviders, nil
+	}
+	var cfgs []ProviderConfig
+	if err := json.Unmarshal([]byte(raw), &cfgs); err != nil {
+		return nil, fmt.Errorf("parse $AUTH_PROVIDERS: %s", err)
+	}
+	for _, cfg := range cfgs {
+		if cfg.Issuer == "" {
+			return nil, fmt.Errorf("parse $AUTH_PROVIDERS: provider without issuer")
+		}
+		if cfg.Audience == "" {
+			return nil, fmt.Errorf("parse $AUTH_PROVIDERS: provider %s without audience", cfg.Issuer)
+		}
+		slog.Info("trusting identity provider", "issuer", cfg.Issuer)
+	}
+	return cfgs, nil
+}
+
+// RequireRole rejects callers holding none of roles. It must run after
+// Verifier.Handler.
+func RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if id, ok := IdentityFromContext(r.Context()); ok {
+				for _, role := range roles {
+					if id.HasRole(role) {
+						next.ServeHTTP(w, r)
+						return
+					}
+				}
+			}
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestProviderFailingDiscoveryThrottled(t *testing.T) {
+	var requests, up atomic.Int32
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if up.Load() == 0 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(DiscoveryDocument{Issuer: srv.URL, JWKSURI: srv.URL + "/jwks"})
+	}))
+	t.Cleanup(srv.Close)
+	p := NewProvider(ProviderConfig{Issuer: srv.URL, Audience: "api"}, srv.Client())
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		if _, err := p.jwks(ctx); err == nil {
+			t.Fatal("jwks with a failing discovery succeeded")
+		}
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("discovered %d times from a failing identity provider, want 1", n)
+	}
+
+	up.Store(1)
+	p.MinRefreshInterval = 0
+	keys, err := p.jwks(ctx)
+	if err != nil {
+		t.Fatalf("jwks once the identity provider is back: %v", err)
+	}
+	if keys.URL != srv.URL+"/jwks" {
+		t.Errorf("jwks URL = %q, want the discovered one", keys.URL)
+	}
+}
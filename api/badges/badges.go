@@ -0,0 +1,96 @@
+package badges
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/metrics"
+)
+
+// Badge is earned by the users selected by Query, which returns one user_id
+// column. Badges are only ever awarded, a badge stays once earned.
+type Badge struct {
+	Id          string
+	Name        string
+	Description string
+	Query       string
+}
+
+// delivered are the confirmed pledges of signed in donors that reached the school.
+const delivered = `(select * from helpschool.users_donations
+	where status = 'Delivered' and confirmed_date is not null and user_id is not null) as d`
+
+// Definitions lists every badge. Adding a badge here is enough, the next
+// Recompute awards it to the donors who already qualify.
+var Definitions = []Badge{
+	{
+		Id:          "first-delivery",
+		Name:        "First delivery",
+		Description: "A donation reached a school",
+		Query:       `select distinct d.user_id from ` + delivered,
+	},
+	{
+		Id:          "ten-schools",
+		Name:        "10 schools",
+		Description: "Donations reached 10 different schools",
+		Query:       `select d.user_id from ` + delivered + ` group by d.user_id having count(distinct d.school_id) >= 10`,
+	},
+	{
+		Id:          "full-need",
+		Name:        "Full need",
+		Description: "Single-handedly completed everything a school asked for an item",
+		Query: `select distinct d.user_id from ` + delivered + `
+			inner join helpschool.school_supplies as ss on ss.school_id = d.school_id and ss.supply_id = d.supply_id
+				and ss.bundle_id is not distinct from d.bundle_id
+			where ss.quantity > 0
+			group by d.user_id, ss.school_id, ss.supply_id, ss.bundle_id, ss.quantity having sum(d.quantity) >= ss.quantity`,
+	},
+}
+
+// Lookup returns the definition of a badge id.
+func Lookup(id string) (Badge, bool) {
+	for _, b := range Definitions {
+		if b.Id == id {
+			return b, true
+		}
+	}
+	return Badge{}, false
+}
+
+// Recompute awards every badge to the users who qualify and do not have it
+// yet, erased users excepted.
+func Recompute(ctx context.Context, db *pgxpool.Pool) error {
+	for _, b := range Definitions {
+		tag, err := db.Exec(metrics.WithQueryName(ctx, "award_badge"),
+			`INSERT INTO helpschool.user_badges( user_id,badge)
+				select q.user_id, $1 from (`+b.Query+`) as q(user_id)
+				inner join helpschool.users as u on u.id = q.user_id and u.erased_date is null
+				on conflict do nothing`, b.Id)
+		if err != nil {
+			return fmt.Errorf("award badge %s: %s", b.Id, err)
+		}
+		if tag.RowsAffected() > 0 {
+			slog.InfoContext(ctx, "badges awarded", "badge", b.Id, "count", tag.RowsAffected())
+		}
+	}
+	return nil
+}
+
+// Run recomputes the badges every interval until ctx is done.
+func Run(ctx context.Context, db *pgxpool.Pool, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := Recompute(ctx, db); err != nil {
+			slog.ErrorContext(ctx, "recompute badges failed", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
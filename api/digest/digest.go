@@ -0,0 +1,124 @@
+package digest
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/lock"
+	"github.com/venkata6/helpschool/api/mail"
+	"github.com/venkata6/helpschool/api/metrics"
+)
+
+// unread lists, per participant and thread, the visible messages of others
+// newer than what the participant read and was last emailed about. Users opt
+// out with the notification preference "message_digest": false.
+const unread = `with participants as (
+		select thread_id, donor_id as user_id from helpschool.message_threads
+		union
+		select t.thread_id, a.user_id from helpschool.message_threads as t
+		inner join helpschool.teacher_affiliations as a on a.school_id = t.school_id and a.status = 'approved'
+	)
+	select p.user_id,u.user_email,t.thread_id,t.subject,count(*)
+	from participants as p
+	inner join helpschool.users as u on u.id = p.user_id
+	inner join helpschool.message_threads as t on t.thread_id = p.thread_id
+	inner join helpschool.messages as m on m.thread_id = p.thread_id and m.author_id <> p.user_id and m.status = 'visible'
+	left join helpschool.message_reads as r on r.thread_id = p.thread_id and r.user_id = p.user_id
+	where u.user_email is not null and coalesce(u.notification_prefs->>'message_digest','true') <> 'false'
+		and m.created_date > greatest(coalesce(r.read_date,'-infinity'), coalesce(r.notified_date,'-infinity'))
+	group by p.user_id,u.user_email,t.thread_id,t.subject
+	order by p.user_id,max(m.created_date) desc`
+
+type thread struct {
+	id      string
+	subject string
+	count   int
+}
+
+// Send emails every participant with unread messages one digest of them.
+func Send(ctx context.Context, db *pgxpool.Pool, mailer mail.Sender, publicURL string) error {
+	rows, err := db.Query(metrics.WithQueryName(ctx, "list_unread_messages"), unread)
+	if err != nil {
+		return err
+	}
+	emails := map[string]string{}
+	threads := map[string][]thread{}
+	var users []string
+	for rows.Next() {
+		var userId, email string
+		var t thread
+		if err := rows.Scan(&userId, &email, &t.id, &t.subject, &t.count); err != nil {
+			rows.Close()
+			return err
+		}
+		if _, ok := emails[userId]; !ok {
+			users = append(users, userId)
+			emails[userId] = email
+		}
+		threads[userId] = append(threads[userId], t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	publicURL = strings.TrimSuffix(publicURL, "/")
+	for _, userId := range users {
+		var body strings.Builder
+		body.WriteString("You have unread messages on helpschool:\n\n")
+		ids := make([]string, 0, len(threads[userId]))
+		for _, t := range threads[userId] {
+			fmt.Fprintf(&body, "%s (%d new)\n%s/web/#/messages/%s\n\n", t.subject, t.count, publicURL, t.id)
+			ids = append(ids, t.id)
+		}
+		body.WriteString("To stop these emails turn off message digests in your profile.")
+		if err := mailer.Send(ctx, mail.Message{
+			To:      emails[userId],
+			Subject: "Unread messages on helpschool",
+			Body:    body.String(),
+		}); err != nil {
+			slog.ErrorContext(ctx, "send message digest failed", "user_id", userId, "err", err)
+			continue
+		}
+		if _, err := db.Exec(metrics.WithQueryName(ctx, "mark_threads_notified"),
+			`INSERT INTO helpschool.message_reads( thread_id,user_id,notified_date)
+				select unnest($2::uuid[]), $1, now()
+				on conflict (thread_id,user_id) do update set notified_date = excluded.notified_date`,
+			userId, ids); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockKey is the advisory lock held while digests are sent, so that of
+// several api instances only one sends them.
+const lockKey = 0x646967657374 // "digest"
+
+// Run sends digests now and then every interval until ctx is done, skipping
+// the runs another instance is doing.
+func Run(ctx context.Context, db *pgxpool.Pool, mailer mail.Sender, publicURL string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		ran, err := lock.With(ctx, db, lockKey, "digest", func() {
+			if err := Send(ctx, db, mailer, publicURL); err != nil {
+				slog.ErrorContext(ctx, "send message digests failed", "err", err)
+			}
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "lock digest failed", "err", err)
+		} else if !ran {
+			slog.DebugContext(ctx, "digests sent by another instance")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package dto
+
+// AffiliateRules rewrites the links to Domain in CountryId, or in every
+// country without one, by setting Params on them or wrapping them in
+// Template at its {url}.
+type AffiliateRules struct {
+	RuleId    string            `json:"rule_id"`
+	CountryId string            `json:"country_id,omitempty"`
+	Domain    string            `json:"domain"`
+	Params    map[string]string `json:"params"`
+	Template  string            `json:"template,omitempty"`
+	Enabled   bool              `json:"enabled"`
+}
+
+// AffiliateReports counts the click-throughs to a vendor domain and the
+// pledges made within a week of them.
+type AffiliateReports struct {
+	Domain           string  `json:"domain"`
+	Clicks           int     `json:"clicks"`
+	RewrittenClicks  int     `json:"rewritten_clicks"`
+	Pledges          int     `json:"pledges"`
+	ConfirmedPledges int     `json:"confirmed_pledges"`
+	Quantity         int     `json:"quantity"`
+	ConversionRate   float64 `json:"conversion_rate"`
+}
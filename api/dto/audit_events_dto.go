@@ -0,0 +1,33 @@
+package dto
+
+import "time"
+
+// AuditEvents is a change of a row: the columns it changed Before and
+// After, who made it and why. Hash chains the event to the one before it.
+type AuditEvents struct {
+	EventId    int64                  `json:"event_id"`
+	OccurredAt time.Time              `json:"occurred_at"`
+	UserId     string                 `json:"user_id,omitempty"`
+	IP         string                 `json:"ip,omitempty"`
+	RequestId  string                 `json:"request_id,omitempty"`
+	Reason     string                 `json:"reason,omitempty"`
+	Entity     string                 `json:"entity"`
+	EntityId   string                 `json:"entity_id"`
+	Action     string                 `json:"action"`
+	Before     map[string]interface{} `json:"before"`
+	After      map[string]interface{} `json:"after"`
+	PrevHash   string                 `json:"prev_hash"`
+	Hash       string                 `json:"hash,omitempty"`
+}
+
+// AuditChains is the result of walking the hash chain of the audit log.
+// BrokenAt is the first event whose hashes do not match, HeadHash the hash
+// of the last chained event, to be kept elsewhere so that removing events
+// from the end is noticed too. Unchained events are not linked yet.
+type AuditChains struct {
+	Intact    bool   `json:"intact"`
+	Events    int64  `json:"events"`
+	Unchained int64  `json:"unchained"`
+	BrokenAt  *int64 `json:"broken_at"`
+	HeadHash  string `json:"head_hash"`
+}
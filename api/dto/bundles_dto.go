@@ -0,0 +1,46 @@
+package dto
+
+import "time"
+
+// Bundles is a kit of catalog items, Items holding the quantity of each in
+// one bundle.
+type Bundles struct {
+	BundleId    string        `json:"bundle_id"`
+	Title       string        `json:"title"`
+	Description string        `json:"description"`
+	Items       []BundleItems `json:"items"`
+}
+
+type BundleItems struct {
+	ItemId   string `json:"item_id"`
+	Title    string `json:"title"`
+	UnitId   string `json:"unit_id"`
+	Quantity int    `json:"quantity"`
+}
+
+// SchoolBundles is a school's need for Quantity bundles. A bundle counts as
+// pledged or fulfilled once every component of it is, Progress is
+// FulfilledCount over Quantity.
+type SchoolBundles struct {
+	SchoolId       string             `json:"school_id"`
+	BundleId       string             `json:"bundle_id"`
+	Title          string             `json:"title"`
+	Quantity       int                `json:"quantity"`
+	PledgedCount   int                `json:"pledged_count"`
+	FulfilledCount int                `json:"fulfilled_count"`
+	Progress       float64            `json:"progress"`
+	PostedDate     time.Time          `json:"posted_date"`
+	Components     []BundleComponents `json:"components"`
+}
+
+// BundleComponents is the need a bundle need expanded into for one item,
+// PerBundle of it in every bundle.
+type BundleComponents struct {
+	SupplyId       string `json:"supply_id"`
+	ItemId         string `json:"item_id"`
+	Title          string `json:"title"`
+	PerBundle      int    `json:"per_bundle"`
+	Quantity       int    `json:"quantity"`
+	PledgedCount   int    `json:"pledged_count"`
+	FulfilledCount int    `json:"fulfilled_count"`
+}
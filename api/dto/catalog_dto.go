@@ -0,0 +1,30 @@
+package dto
+
+// Categories is a node of the supply category tree.
+type Categories struct {
+	CategoryId string        `json:"category_id"`
+	ParentId   string        `json:"parent_id,omitempty"`
+	Slug       string        `json:"slug"`
+	Name       string        `json:"name"`
+	Children   []*Categories `json:"children,omitempty"`
+}
+
+// Units is a unit of measure needs are counted in.
+type Units struct {
+	UnitId string `json:"unit_id"`
+	Name   string `json:"name"`
+}
+
+// CatalogItems is a canonical item the vendor listings in supplies map to.
+// A variant has ParentItemId set and its size, grade or language in Variant.
+type CatalogItems struct {
+	ItemId       string            `json:"item_id"`
+	ParentItemId string            `json:"parent_item_id,omitempty"`
+	CategoryId   string            `json:"category_id,omitempty"`
+	UnitId       string            `json:"unit_id"`
+	PackSize     int               `json:"pack_size"`
+	Title        string            `json:"title"`
+	Description  string            `json:"description"`
+	Variant      map[string]string `json:"variant,omitempty"`
+	Listings     int               `json:"listings"`
+}
@@ -0,0 +1,31 @@
+package dto
+
+import "time"
+
+// DonorProfiles is the public impact of a donor who opted in, computed
+// from their confirmed, delivered and not anonymous donations.
+type DonorProfiles struct {
+	Handle         string        `json:"handle"`
+	DisplayName    string        `json:"display_name"`
+	MemberSince    time.Time     `json:"member_since"`
+	ItemsDelivered int           `json:"items_delivered"`
+	SchoolsHelped  int           `json:"schools_helped"`
+	StatesReached  int           `json:"states_reached"`
+	Schools        []DonorSchool `json:"schools"`
+	States         []string      `json:"states"`
+	Badges         []DonorBadge  `json:"badges"`
+}
+
+type DonorSchool struct {
+	SchoolId       string `json:"school_id"`
+	Name           string `json:"name"`
+	Place          string `json:"place"`
+	ItemsDelivered int    `json:"items_delivered"`
+}
+
+type DonorBadge struct {
+	Id          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	AwardedDate time.Time `json:"awarded_date"`
+}
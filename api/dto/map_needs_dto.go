@@ -0,0 +1,36 @@
+package dto
+
+// MapNeeds is a GeoJSON FeatureCollection of schools with open needs,
+// clustered by zoom level.
+type MapNeeds struct {
+	Type     string           `json:"type"`
+	Bbox     []float64        `json:"bbox,omitempty"`
+	Features []MapNeedFeature `json:"features"`
+}
+
+// MapNeedFeature is a school, or a cluster of nearby schools, as a GeoJSON
+// Point Feature.
+type MapNeedFeature struct {
+	Type       string         `json:"type"`
+	Id         string         `json:"id"`
+	Geometry   MapNeedPoint   `json:"geometry"`
+	Properties MapNeedSummary `json:"properties"`
+}
+
+// MapNeedPoint is a GeoJSON Point, Coordinates are longitude then latitude.
+type MapNeedPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+// MapNeedSummary sums the open needs of a feature. Value is the remaining
+// quantity times the supply price, needs without a price are left out.
+type MapNeedSummary struct {
+	Cluster   bool     `json:"cluster"`
+	SchoolId  string   `json:"school_id,omitempty"`
+	Name      string   `json:"name,omitempty"`
+	Schools   int      `json:"schools"`
+	Needs     int      `json:"needs"`
+	Remaining int      `json:"remaining"`
+	Value     *float64 `json:"value"`
+}
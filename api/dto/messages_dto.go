@@ -0,0 +1,40 @@
+package dto
+
+import "time"
+
+// Message statuses, held messages wait for a moderator.
+const (
+	MessageVisible = "visible"
+	MessageHeld    = "held"
+	MessageRemoved = "removed"
+)
+
+// MessageThreads is a conversation between a donor and the verified teachers
+// of a school, about one of its needs or a donation.
+type MessageThreads struct {
+	ThreadId        string     `json:"thread_id"`
+	SchoolId        string     `json:"school_id"`
+	SchoolName      string     `json:"school_name"`
+	SupplyId        string     `json:"supply_id,omitempty"`
+	Title           string     `json:"title,omitempty"`
+	DonationId      string     `json:"donation_id,omitempty"`
+	DonorId         string     `json:"donor_id"`
+	DonorName       string     `json:"donor_name"`
+	Subject         string     `json:"subject"`
+	Unread          int        `json:"unread"`
+	CreatedDate     time.Time  `json:"created_date"`
+	LastMessageDate time.Time  `json:"last_message_date"`
+	Messages        []Messages `json:"messages,omitempty"`
+}
+
+type Messages struct {
+	MessageId     string    `json:"message_id"`
+	ThreadId      string    `json:"thread_id"`
+	AuthorId      string    `json:"author_id"`
+	AuthorName    string    `json:"author_name"`
+	Body          string    `json:"body"`
+	AttachmentUrl string    `json:"attachment_url,omitempty"`
+	Status        string    `json:"status"`
+	FilterReasons string    `json:"filter_reasons,omitempty"`
+	CreatedDate   time.Time `json:"created_date"`
+}
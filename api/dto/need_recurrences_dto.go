@@ -0,0 +1,17 @@
+package dto
+
+// NeedRecurrences re-opens a school's need for Quantity of a supply every
+// year on OpenDay of OpenMonth, needed within NeededWithinDays when set.
+// LastOpened is the date it last re-opened the need, YYYY-MM-DD.
+type NeedRecurrences struct {
+	RecurrenceId     string `json:"recurrence_id"`
+	SchoolId         string `json:"school_id"`
+	SupplyId         string `json:"supply_id"`
+	Title            string `json:"title"`
+	Quantity         int    `json:"quantity"`
+	ExtraInfo        string `json:"extra_info"`
+	OpenMonth        int    `json:"open_month"`
+	OpenDay          int    `json:"open_day"`
+	NeededWithinDays *int   `json:"needed_within_days"`
+	LastOpened       string `json:"last_opened,omitempty"`
+}
@@ -0,0 +1,30 @@
+package dto
+
+import "time"
+
+// PrivacyRequests is an export or erasure of personal data, HandledBy the
+// admin who made it for the subject. Emails are only kept hashed.
+type PrivacyRequests struct {
+	RequestId   string    `json:"request_id"`
+	Kind        string    `json:"kind"`
+	UserId      string    `json:"user_id,omitempty"`
+	EmailHash   string    `json:"email_hash,omitempty"`
+	HandledBy   string    `json:"handled_by,omitempty"`
+	Note        string    `json:"note,omitempty"`
+	CreatedDate time.Time `json:"created_date"`
+}
+
+// PrivacySubjects is what is kept about an email: the accounts with it and
+// the guest pledges and teacher requests made with it.
+type PrivacySubjects struct {
+	Accounts        []PrivacyAccounts `json:"accounts"`
+	GuestPledges    int               `json:"guest_pledges"`
+	TeacherRequests int               `json:"teacher_requests"`
+}
+
+type PrivacyAccounts struct {
+	UserId      string     `json:"user_id"`
+	Name        string     `json:"name"`
+	CreatedDate time.Time  `json:"created_date"`
+	ErasedDate  *time.Time `json:"erased_date"`
+}
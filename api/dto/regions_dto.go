@@ -0,0 +1,24 @@
+package dto
+
+// Regions is a node of the location tree: a country, state, district or any
+// region below one. ChildCount and SchoolCount let clients expand the tree
+// lazily, Children and Schools are only filled within the requested depth.
+type Regions struct {
+	RegionId    string          `json:"region_id"`
+	ParentId    string          `json:"parent_id,omitempty"`
+	Level       string          `json:"level"`
+	Name        string          `json:"name"`
+	GovtId      string          `json:"govt_id,omitempty"`
+	Depth       int             `json:"depth"`
+	ChildCount  int             `json:"child_count"`
+	SchoolCount int             `json:"school_count"`
+	Children    []*Regions      `json:"children,omitempty"`
+	Schools     []RegionSchools `json:"schools,omitempty"`
+}
+
+// RegionSchools is a school as a leaf of the location tree.
+type RegionSchools struct {
+	SchoolId string `json:"school_id"`
+	Name     string `json:"name"`
+	Place    string `json:"place"`
+}
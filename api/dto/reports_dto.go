@@ -0,0 +1,14 @@
+package dto
+
+import "time"
+
+// TransparencyReports is a published monthly transparency report: its
+// totals and where to download it as JSON, with the totals per state, or
+// as a CSV of the states.
+type TransparencyReports struct {
+	Month       string           `json:"month"`
+	Totals      map[string]int64 `json:"totals"`
+	JsonUrl     string           `json:"json_url"`
+	CsvUrl      string           `json:"csv_url"`
+	PublishedAt time.Time        `json:"published_at"`
+}
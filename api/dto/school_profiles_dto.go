@@ -0,0 +1,57 @@
+package dto
+
+import "time"
+
+// SchoolProfiles is the public page of a school.
+type SchoolProfiles struct {
+	SchoolId         string          `json:"school_id"`
+	Name             string          `json:"name"`
+	Place            string          `json:"place"`
+	Address          string          `json:"address"`
+	DistrictId       string          `json:"district_id"`
+	DistrictName     string          `json:"district_name"`
+	StateId          string          `json:"state_id"`
+	StateName        string          `json:"state_name"`
+	CountryId        string          `json:"country_id"`
+	CountryName      string          `json:"country_name"`
+	VerifiedTeachers []string        `json:"verified_teachers"`
+	OpenNeeds        []SchoolNeed    `json:"open_needs"`
+	FulfilledNeeds   []SchoolNeed    `json:"fulfilled_needs"`
+	Photos           []SchoolUpdates `json:"photos"`
+	ThankYouNotes    []SchoolUpdates `json:"thank_you_notes"`
+	Stats            SchoolStats     `json:"stats"`
+}
+
+// SchoolNeed is a school_supplies row with its progress, FulfilledCount
+// over Quantity. BundleId is set on the needs for the items of a bundle,
+// NeededBy on needs with a deadline.
+type SchoolNeed struct {
+	SupplyId       string    `json:"supply_id"`
+	BundleId       string    `json:"bundle_id,omitempty"`
+	Title          string    `json:"title"`
+	Url            string    `json:"url"`
+	Quantity       int       `json:"quantity"`
+	FulfilledCount int       `json:"fulfilled_count"`
+	Progress       float64   `json:"progress"`
+	PostedDate     time.Time `json:"posted_date"`
+	ModifiedDate   time.Time `json:"modified_date"`
+	NeededBy       string    `json:"needed_by,omitempty"`
+}
+
+type SchoolStats struct {
+	ItemsReceived  int `json:"items_received"`
+	DonorsCount    int `json:"donors_count"`
+	NeedsFulfilled int `json:"needs_fulfilled"`
+}
+
+// SchoolUpdates is a delivery photo or thank-you note posted by a teacher.
+type SchoolUpdates struct {
+	UpdateId    string    `json:"update_id"`
+	SchoolId    string    `json:"school_id"`
+	SupplyId    string    `json:"supply_id,omitempty"`
+	Title       string    `json:"title,omitempty"`
+	AuthorName  string    `json:"author_name"`
+	Body        string    `json:"body"`
+	PhotoUrl    string    `json:"photo_url,omitempty"`
+	CreatedDate time.Time `json:"created_date"`
+}
@@ -12,4 +12,9 @@ type SchoolSupplies struct {
 	FulfilledCount string `json:"fulfilled_count"`
 	ExtraInfo      string `json:"extra_info"`
 	PostedDate	   time.Time `json:"posted_date"`
+	DistanceKm     float64   `json:"distance_km,omitempty"`
+	ItemId         string    `json:"item_id"`
+	BundleId       string    `json:"bundle_id,omitempty"`
+	NeededBy       string    `json:"needed_by,omitempty"`
+	Status         string    `json:"status"`
 }
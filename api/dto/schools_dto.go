@@ -1,11 +1,15 @@
 package dto
 
 type Schools struct {
-	Name       string `json:"name"`
-	Place      string `json:"place"`
-	SchoolId   string `json:"school_id"`
-	Address    string `json:"address"`
-	DistrictId string `json:"district_id"`
-	GovtId     string `json:"govt_id"`
-	ExtraInfo  string `json:"extra_info"`
+	Name       string   `json:"name"`
+	Place      string   `json:"place"`
+	SchoolId   string   `json:"school_id"`
+	Address    string   `json:"address"`
+	DistrictId string   `json:"district_id"`
+	GovtId     string   `json:"govt_id"`
+	ExtraInfo  string   `json:"extra_info"`
+	PostalCode string   `json:"postal_code,omitempty"`
+	Latitude   *float64 `json:"latitude,omitempty"`
+	Longitude  *float64 `json:"longitude,omitempty"`
+	DistanceKm float64  `json:"distance_km,omitempty"`
 }
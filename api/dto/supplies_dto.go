@@ -1,10 +1,14 @@
 package dto
 
 type Supplies struct {
-	SupplyId    string `json:"supply_id"`
-	Title       string `json:"title"`
-	CountryId   string `json:"country_id"`
-	Url         string `json:"url"`
-	Description string `json:"description"`
-	ExtraInfo   string `json:"extra_info"`
+	SupplyId    string   `json:"supply_id"`
+	Title       string   `json:"title"`
+	CountryId   string   `json:"country_id"`
+	Url         string   `json:"url"`
+	Description string   `json:"description"`
+	ExtraInfo   string   `json:"extra_info"`
+	Price       *float64 `json:"price,omitempty"`
+	ItemId      string   `json:"item_id"`
+	CategoryId  string   `json:"category_id,omitempty"`
+	UnitId      string   `json:"unit_id"`
 }
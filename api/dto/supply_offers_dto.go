@@ -0,0 +1,25 @@
+package dto
+
+import "time"
+
+// SupplyOffers is a vendor's offer for a supply. Total is the price with
+// shipping, Deliverable tells whether the offer is in stock and ships to
+// the postal code asked about, Best marks the offer to buy from. GoUrl
+// leads to the vendor through the click-through redirect.
+type SupplyOffers struct {
+	OfferId         string    `json:"offer_id"`
+	SupplyId        string    `json:"supply_id"`
+	Vendor          string    `json:"vendor"`
+	Url             string    `json:"url"`
+	GoUrl           string    `json:"go_url"`
+	Price           *float64  `json:"price"`
+	Currency        string    `json:"currency"`
+	ShippingCost    float64   `json:"shipping_cost"`
+	ShippingDays    *int      `json:"shipping_days"`
+	DeliveryRegions []string  `json:"delivery_regions"`
+	InStock         bool      `json:"in_stock"`
+	LastChecked     time.Time `json:"last_checked"`
+	Total           *float64  `json:"total"`
+	Deliverable     bool      `json:"deliverable"`
+	Best            bool      `json:"best"`
+}
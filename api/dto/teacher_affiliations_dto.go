@@ -0,0 +1,36 @@
+package dto
+
+import "time"
+
+// Ways a teacher can prove they work at a school.
+const (
+	AffiliationStaffId     = "staff_id"
+	AffiliationSchoolEmail = "school_email"
+	AffiliationMailedCode  = "mailed_code"
+)
+
+// Affiliation statuses. A pending affiliation waits for evidence, a
+// submitted one for a moderator.
+const (
+	AffiliationPending   = "pending"
+	AffiliationSubmitted = "submitted"
+	AffiliationApproved  = "approved"
+	AffiliationRejected  = "rejected"
+)
+
+type TeacherAffiliations struct {
+	AffiliationId string     `json:"affiliation_id"`
+	UserId        string     `json:"user_id"`
+	TeacherName   string     `json:"teacher_name,omitempty"`
+	TeacherEmail  string     `json:"teacher_email,omitempty"`
+	SchoolId      string     `json:"school_id"`
+	SchoolName    string     `json:"school_name"`
+	Method        string     `json:"method"`
+	Status        string     `json:"status"`
+	SchoolEmail   string     `json:"school_email,omitempty"`
+	HasEvidence   bool       `json:"has_evidence"`
+	CodeVerified  bool       `json:"code_verified"`
+	ReviewNote    string     `json:"review_note,omitempty"`
+	CreatedDate   time.Time  `json:"created_date"`
+	ReviewedDate  *time.Time `json:"reviewed_date,omitempty"`
+}
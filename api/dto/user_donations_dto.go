@@ -2,16 +2,41 @@ package dto
 
 import "time"
 
+// Donation statuses, a pledge starts as Ordered.
+const (
+	DonationOrdered   = "Ordered"
+	DonationShipped   = "Shipped"
+	DonationDelivered = "Delivered"
+	DonationCancelled = "Cancelled"
+)
+
+// AnonymousDonor is shown in public donor lists instead of the name of
+// donors who asked for it and of guest donors.
+const AnonymousDonor = "Anonymous"
+
 type UserDonations struct {
-	UserEmail 			string `json:"user_email"`
-	UserId    			string `json:"user_id"`
-	UserName 			string `json:"user_name"`
-	SchoolId       		string `json:"school_id"`
-	SupplyId       		string `json:"supply_id"`
-	Quantity       		string `json:"quantity"`
-	Status		   		string `json:"status"`
-	TrackingUrl		   	string `json:"tracking_url"`
-	CreatedDate		   	string `json:"created_date"`
-	ExtraInfo      		string `json:"extra_info"`
-	ModifiedDate	   	time.Time `json:"modified_date"`
+	DonationId   string    `json:"donation_id"`
+	UserId       string    `json:"user_id"`
+	SchoolId     string    `json:"school_id"`
+	SchoolName   string    `json:"school_name"`
+	SupplyId     string    `json:"supply_id"`
+	BundleId     string    `json:"bundle_id,omitempty"`
+	Title        string    `json:"title"`
+	Quantity     int       `json:"quantity"`
+	Status       string    `json:"status"`
+	TrackingUrl  string    `json:"tracking_url"`
+	ExtraInfo    string    `json:"extra_info"`
+	Anonymous    bool      `json:"anonymous"`
+	CreatedDate  time.Time `json:"created_date"`
+	ModifiedDate time.Time `json:"modified_date"`
+}
+
+// Donor is a pledge as shown in a school's public donor list.
+type Donor struct {
+	DonorName   string    `json:"donor_name"`
+	SupplyId    string    `json:"supply_id"`
+	Title       string    `json:"title"`
+	Quantity    int       `json:"quantity"`
+	Status      string    `json:"status"`
+	CreatedDate time.Time `json:"created_date"`
 }
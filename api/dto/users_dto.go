@@ -0,0 +1,15 @@
+package dto
+
+import "time"
+
+type Users struct {
+	UserId            string          `json:"user_id"`
+	Email             string          `json:"email"`
+	Name              string          `json:"name"`
+	DisplayName       string          `json:"display_name"`
+	PreferredLanguage string          `json:"preferred_language"`
+	NotificationPrefs map[string]bool `json:"notification_prefs"`
+	Handle            string          `json:"handle"`
+	PublicProfile     bool            `json:"public_profile"`
+	CreatedDate       time.Time       `json:"created_date"`
+}
@@ -0,0 +1,67 @@
+package filter
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Reasons reported by Check.
+const (
+	ReasonProfanity = "profanity"
+	ReasonContact   = "contact"
+)
+
+// ContactRemoved replaces phone numbers and email addresses.
+const ContactRemoved = "[contact details removed]"
+
+// Result is the outcome of checking a message.
+type Result struct {
+	Text    string   // the message with contact details removed when not allowed
+	Held    bool     // the message waits for a moderator before others see it
+	Reasons []string // why the message was held or changed
+}
+
+var (
+	// phone numbers: 8 or more digits, optionally grouped by spaces, dots,
+	// dashes or parentheses and led by a country code
+	phonePattern = regexp.MustCompile(`\+?\(?\d(?:[\s.\-()]*\d){7,}`)
+	emailPattern = regexp.MustCompile(`(?i)[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,}`)
+	wordPattern  = regexp.MustCompile(`[\p{L}\p{N}]+`)
+	datePattern  = regexp.MustCompile(`^\d{4}[\-./]\d{1,2}[\-./]\d{1,2}$|^\d{1,2}[\-./]\d{1,2}[\-./]\d{4}$`)
+)
+
+// profanity is matched against whole words, case insensitively. The list is
+// deliberately short, anything it misses can be taken down by moderators.
+var profanity = map[string]bool{
+	"arse": true, "asshole": true, "bastard": true, "bitch": true, "bollocks": true, "bullshit": true,
+	"crap": true, "cunt": true, "dick": true, "fuck": true, "fucking": true, "motherfucker": true,
+	"piss": true, "prick": true, "shit": true, "slut": true, "twat": true, "wanker": true, "whore": true,
+}
+
+// Check filters the text of a message. Profanity holds the message for
+// review. Phone numbers and email addresses are removed unless
+// allowContact, that is once the donor has a confirmed donation with the school.
+func Check(text string, allowContact bool) Result {
+	res := Result{Text: strings.TrimSpace(text)}
+	for _, word := range wordPattern.FindAllString(res.Text, -1) {
+		if profanity[strings.ToLower(word)] {
+			res.Held = true
+			res.Reasons = append(res.Reasons, ReasonProfanity)
+			break
+		}
+	}
+	if !allowContact {
+		cleaned := emailPattern.ReplaceAllString(res.Text, ContactRemoved)
+		cleaned = phonePattern.ReplaceAllStringFunc(cleaned, func(number string) string {
+			if datePattern.MatchString(number) {
+				return number
+			}
+			return ContactRemoved
+		})
+		if cleaned != res.Text {
+			res.Text = cleaned
+			res.Reasons = append(res.Reasons, ReasonContact)
+		}
+	}
+	return res
+}
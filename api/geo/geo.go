@@ -0,0 +1,178 @@
+package geo
+
+import (
+	"archive/zip"
+	"bufio"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+//go:embed postal_codes.tsv
+var bundled string
+
+// Point is a WGS84 coordinate in degrees.
+type Point struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// Centroids maps postal codes to the centre of their area. Codes are kept
+// without spaces, the first country in the file wins when codes collide.
+type Centroids map[string]Point
+
+// Load reads centroids in the GeoNames postal code format: tab separated
+// country, postal code, place, five admin columns, latitude and longitude.
+// Lines starting with # are comments.
+func Load(r io.Reader) (Centroids, error) {
+	centroids := Centroids{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		cols := strings.Split(text, "\t")
+		if len(cols) < 11 {
+			return nil, fmt.Errorf("line %d: expected at least 11 columns", line)
+		}
+		lat, err := strconv.ParseFloat(cols[9], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: latitude: %s", line, err)
+		}
+		lng, err := strconv.ParseFloat(cols[10], 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: longitude: %s", line, err)
+		}
+		code := normalizeCode(cols[1])
+		if _, ok := centroids[code]; !ok {
+			centroids[code] = Point{Lat: lat, Lng: lng}
+		}
+	}
+	return centroids, scanner.Err()
+}
+
+// FromEnv loads $POSTAL_CODES_FILE, a GeoNames country file such as
+// IN.txt or the IN.zip it is published in. Without it the bundled sample,
+// which only knows the head post offices of a few cities, is loaded unless
+// required.
+func FromEnv(required bool) (Centroids, error) {
+	path := os.Getenv("POSTAL_CODES_FILE")
+	if path == "" {
+		if required {
+			return nil, errors.New("POSTAL_CODES_FILE is not set")
+		}
+		slog.Warn("no $POSTAL_CODES_FILE, only the sample postal codes are located")
+		return Load(strings.NewReader(bundled))
+	}
+	if strings.EqualFold(filepath.Ext(path), ".zip") {
+		return loadZip(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Load(f)
+}
+
+// loadZip loads the centroids of a GeoNames zip archive, the country file
+// being its only .txt file besides readme.txt.
+func loadZip(path string) (Centroids, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+	for _, file := range archive.File {
+		if !strings.EqualFold(filepath.Ext(file.Name), ".txt") || strings.EqualFold(file.Name, "readme.txt") {
+			continue
+		}
+		f, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		centroids, err := Load(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file.Name, err)
+		}
+		return centroids, nil
+	}
+	return nil, fmt.Errorf("%s: no postal code file in the archive", path)
+}
+
+func normalizeCode(code string) string {
+	return strings.ToUpper(strings.Join(strings.Fields(code), ""))
+}
+
+// Lookup returns the centroid of a postal code.
+func (c Centroids) Lookup(code string) (Point, bool) {
+	p, ok := c[normalizeCode(code)]
+	return p, ok
+}
+
+// postalCodePattern finds Indian PIN codes, also written as "560 001", and
+// five digit codes.
+var postalCodePattern = regexp.MustCompile(`\b(\d{3} ?\d{3}|\d{5})\b`)
+
+// PostalCodeFrom returns the last postal code in a free text address.
+func PostalCodeFrom(address string) string {
+	codes := postalCodePattern.FindAllString(address, -1)
+	if len(codes) == 0 {
+		return ""
+	}
+	return normalizeCode(codes[len(codes)-1])
+}
+
+// Locate returns the centroid of postalCode or, without it, of the postal
+// code found in address.
+func (c Centroids) Locate(postalCode, address string) (Point, string, bool) {
+	if postalCode == "" {
+		postalCode = PostalCodeFrom(address)
+	}
+	if postalCode == "" {
+		return Point{}, "", false
+	}
+	p, ok := c.Lookup(postalCode)
+	return p, normalizeCode(postalCode), ok
+}
+
+var errPoint = errors.New(`expected "lat,lng" in degrees`)
+
+// ParsePoint parses "lat,lng".
+func ParsePoint(s string) (Point, error) {
+	latText, lngText, ok := strings.Cut(s, ",")
+	if !ok {
+		return Point{}, errPoint
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(latText), 64)
+	if err != nil {
+		return Point{}, errPoint
+	}
+	lng, err := strconv.ParseFloat(strings.TrimSpace(lngText), 64)
+	if err != nil {
+		return Point{}, errPoint
+	}
+	return NewPoint(lat, lng)
+}
+
+// NewPoint validates a coordinate, NaN and infinities are not one.
+func NewPoint(lat, lng float64) (Point, error) {
+	if !finite(lat) || !finite(lng) || lat < -90 || lat > 90 || lng < -180 || lng > 180 {
+		return Point{}, errors.New("coordinates out of range")
+	}
+	return Point{Lat: lat, Lng: lng}, nil
+}
+
+func finite(f float64) bool {
+	return !math.IsNaN(f) && !math.IsInf(f, 0)
+}
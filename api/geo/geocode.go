@@ -0,0 +1,82 @@
+package geo
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/metrics"
+	"github.com/venkata6/helpschool/api/pii"
+)
+
+// GeocodedByPostalCode marks coordinates taken from a postal code centroid.
+const GeocodedByPostalCode = "postal_code"
+
+type pending struct {
+	id, postalCode, address string
+	encrypted               bool
+}
+
+// Geocode fills in the coordinates of schools and teacher requests that
+// have none from the postal code, given or found in the address. Rows
+// whose postal code is unknown are left alone. It returns how many
+// schools and requests were located. Encrypted request addresses are
+// decrypted with c.
+func Geocode(ctx context.Context, db *pgxpool.Pool, centroids Centroids, c *pii.Cipher) (int, int, error) {
+	schools, err := geocode(ctx, db, centroids, c,
+		`select school_id::text,coalesce(postal_code,''),coalesce(address,''),false from helpschool.schools
+			where latitude is null or longitude is null`,
+		`update helpschool.schools set latitude = $2, longitude = $3, postal_code = $4, geocoded_by = '`+
+			GeocodedByPostalCode+`', modified_date = now() where school_id::text = $1`)
+	if err != nil {
+		return 0, 0, err
+	}
+	requests, err := geocode(ctx, db, centroids, c,
+		`select id::text,coalesce(zipcode,''),coalesce(address,''),pii_key_id is not null from helpschool.teacher_requests
+			where latitude is null or longitude is null`,
+		`update helpschool.teacher_requests set latitude = $2, longitude = $3,
+			zipcode = coalesce(nullif(zipcode,''),$4) where id::text = $1`)
+	return schools, requests, err
+}
+
+func geocode(ctx context.Context, db *pgxpool.Pool, centroids Centroids, c *pii.Cipher, selectSQL, updateSQL string) (int, error) {
+	rows, err := db.Query(metrics.WithQueryName(ctx, "list_ungeocoded"), selectSQL)
+	if err != nil {
+		return 0, err
+	}
+	var todo []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.postalCode, &p.address, &p.encrypted); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		todo = append(todo, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	located := 0
+	for _, p := range todo {
+		// teacher_requests.zipcode defaults to '0'
+		if p.postalCode == "0" {
+			p.postalCode = ""
+		}
+		if p.encrypted {
+			if p.address, err = c.Decrypt(ctx, pii.TeacherRequests.AAD("address"), p.address); err != nil {
+				return located, err
+			}
+		}
+		point, code, ok := centroids.Locate(p.postalCode, p.address)
+		if !ok {
+			continue
+		}
+		if _, err := db.Exec(metrics.WithQueryName(ctx, "set_geocode"), updateSQL,
+			p.id, point.Lat, point.Lng, code); err != nil {
+			return located, err
+		}
+		located++
+	}
+	return located, nil
+}
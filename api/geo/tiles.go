@@ -0,0 +1,78 @@
+package geo
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+const (
+	// MaxZoom is the deepest zoom level of web mercator tiles served.
+	MaxZoom = 20
+	// MaxClusterZoom is the deepest zoom level at which points are clustered.
+	MaxClusterZoom = 15
+
+	tileSize = 256 // pixels
+	cellSize = 64  // pixels, the side of a cluster cell
+)
+
+// maxLat is the latitude web mercator is cut off at.
+const maxLat = 85.0511287798
+
+// Bounds is a box of longitudes and latitudes in degrees.
+type Bounds struct {
+	West, South, East, North float64
+}
+
+// ParseBounds parses "west,south,east,north", the order of a GeoJSON bbox.
+func ParseBounds(s string) (Bounds, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return Bounds{}, errors.New(`expected "west,south,east,north" in degrees`)
+	}
+	var v [4]float64
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return Bounds{}, errors.New(`expected "west,south,east,north" in degrees`)
+		}
+		v[i] = f
+	}
+	b := Bounds{West: v[0], South: v[1], East: v[2], North: v[3]}
+	if b.South > b.North || b.South < -90 || b.North > 90 || b.West < -180 || b.East > 180 {
+		return Bounds{}, errors.New("bbox out of range")
+	}
+	return b, nil
+}
+
+// errZoom is the error of zoom levels beyond MaxZoom. Messages are kept
+// literal so that the i18n catalogs can translate them.
+var errZoom = errors.New("zoom must be between 0 and 20")
+
+// TileBounds returns the bounds of web mercator tile x, y at zoom z.
+func TileBounds(z, x, y int) (Bounds, error) {
+	if z < 0 || z > MaxZoom {
+		return Bounds{}, errZoom
+	}
+	n := 1 << uint(z)
+	if x < 0 || x >= n || y < 0 || y >= n {
+		return Bounds{}, errors.New("tile out of range")
+	}
+	lng := func(x int) float64 { return float64(x)/float64(n)*360 - 180 }
+	lat := func(y int) float64 {
+		return math.Atan(math.Sinh(math.Pi*(1-2*float64(y)/float64(n)))) * 180 / math.Pi
+	}
+	return Bounds{West: lng(x), South: lat(y + 1), East: lng(x + 1), North: lat(y)}, nil
+}
+
+// Cell returns the cluster cell of p at zoom: a square of cellSize pixels
+// on the web mercator map at that zoom.
+func Cell(p Point, zoom int) [2]int {
+	lat := math.Max(-maxLat, math.Min(maxLat, p.Lat))
+	scale := float64(tileSize) * math.Pow(2, float64(zoom)) / cellSize
+	x := (p.Lng + 180) / 360 * scale
+	sin := math.Sin(lat * math.Pi / 180)
+	y := (0.5 - math.Log((1+sin)/(1-sin))/(4*math.Pi)) * scale
+	return [2]int{int(math.Floor(x)), int(math.Floor(y))}
+}
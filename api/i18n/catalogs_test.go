@@ -0,0 +1,114 @@
+package i18n
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// messageSources are the files whose errors reach clients: the handlers,
+// the request bindings and the packages whose errors they render.
+var messageSources = []string{
+	"../service/*.go",
+	"../request/*.go",
+	"../export/*.go",
+	"../privacy/*.go",
+	"../geo/*.go",
+	"../auth/magiclink.go",
+	"../util/*.go",
+}
+
+// configError matches the errors about the server's environment, which are
+// only logged at start.
+var configError = regexp.MustCompile(`^[A-Z][A-Z0-9_]+ `)
+
+// messages returns the literal messages of errors.New calls and of the
+// StatusText of error responses in the message sources, and the positions
+// of errors.New calls with a message built at run time, which no catalog
+// can translate.
+func messages(t *testing.T) (map[string]string, []string) {
+	t.Helper()
+	fset := token.NewFileSet()
+	found := map[string]string{}
+	var dynamic []string
+	for _, pattern := range messageSources {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range files {
+			if strings.HasSuffix(name, "_test.go") {
+				continue
+			}
+			f, err := parser.ParseFile(fset, name, nil, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			literal := func(e ast.Expr) {
+				lit, ok := e.(*ast.BasicLit)
+				if !ok || lit.Kind != token.STRING {
+					dynamic = append(dynamic, fset.Position(e.Pos()).String())
+					return
+				}
+				message, err := strconv.Unquote(lit.Value)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !configError.MatchString(message) {
+					found[message] = fset.Position(lit.Pos()).String()
+				}
+			}
+			ast.Inspect(f, func(n ast.Node) bool {
+				switch n := n.(type) {
+				case *ast.CallExpr:
+					if sel, ok := n.Fun.(*ast.SelectorExpr); ok && len(n.Args) == 1 {
+						if pkg, ok := sel.X.(*ast.Ident); ok && pkg.Name == "errors" && sel.Sel.Name == "New" {
+							literal(n.Args[0])
+						}
+					}
+				case *ast.KeyValueExpr:
+					if key, ok := n.Key.(*ast.Ident); ok && key.Name == "StatusText" {
+						literal(n.Value)
+					}
+				}
+				return true
+			})
+		}
+	}
+	return found, dynamic
+}
+
+func TestCatalogsTranslateEveryMessage(t *testing.T) {
+	found, dynamic := messages(t)
+	if len(found) == 0 {
+		t.Fatal("no messages found, are the message sources right?")
+	}
+	for _, pos := range dynamic {
+		t.Errorf("%s: error message built at run time, use a literal the catalogs can translate", pos)
+	}
+
+	keys := make([]string, 0, len(found))
+	for message := range found {
+		keys = append(keys, message)
+	}
+	sort.Strings(keys)
+	for _, tag := range Supported[1:] {
+		base, _ := tag.Base()
+		catalog, ok := catalogs[base.String()]
+		if !ok {
+			t.Errorf("no catalog for %s", tag)
+			continue
+		}
+		for _, message := range keys {
+			if translated, ok := catalog[message]; !ok || translated == "" {
+				t.Errorf("%s: %q is not translated in catalogs/%s.json", found[message], message, base)
+			}
+		}
+	}
+}
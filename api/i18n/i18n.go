@@ -0,0 +1,140 @@
+// Package i18n negotiates the language of a request and translates API
+// messages through the message catalogs in catalogs/, one JSON object per
+// language mapping the English message to its translation. Messages
+// missing from a catalog are answered in English.
+package i18n
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+
+	"golang.org/x/text/language"
+)
+
+// Supported are the languages with a catalog, English first as the default.
+var Supported = []language.Tag{language.English, language.Tamil, language.Hindi, language.Telugu}
+
+// collations are the ICU collations sorting names in each language.
+var collations = map[string]string{
+	"en": "en-US-x-icu",
+	"ta": "ta-IN-x-icu",
+	"hi": "hi-IN-x-icu",
+	"te": "te-IN-x-icu",
+}
+
+//go:embed catalogs/*.json
+var catalogFS embed.FS
+
+// catalogs maps a base language to its messages.
+var catalogs = map[string]map[string]string{}
+
+func init() {
+	files, err := catalogFS.ReadDir("catalogs")
+	if err != nil {
+		panic(err)
+	}
+	for _, f := range files {
+		data, err := catalogFS.ReadFile("catalogs/" + f.Name())
+		if err != nil {
+			panic(err)
+		}
+		messages := map[string]string{}
+		if err := json.Unmarshal(data, &messages); err != nil {
+			panic("i18n: " + f.Name() + ": " + err.Error())
+		}
+		catalogs[strings.TrimSuffix(f.Name(), path.Ext(f.Name()))] = messages
+	}
+}
+
+var matcher = language.NewMatcher(Supported)
+
+// Locale is the outcome of negotiating a request's language.
+type Locale struct {
+	// Tag is the supported language messages are answered in.
+	Tag language.Tag
+	// Chain lists the client's languages by preference, each followed by
+	// its base language, and English last. Translated names fall back
+	// along it.
+	Chain []string
+}
+
+// Default is the locale of requests without a language preference.
+var Default = Negotiate("")
+
+// Negotiate picks the locale for an Accept-Language header value.
+func Negotiate(acceptLanguage string) Locale {
+	prefs, _, err := language.ParseAcceptLanguage(acceptLanguage)
+	if err != nil {
+		prefs = nil
+	}
+	_, index, _ := matcher.Match(prefs...)
+	locale := Locale{Tag: Supported[index]}
+	seen := map[string]bool{}
+	add := func(tag string) {
+		if !seen[tag] {
+			seen[tag] = true
+			locale.Chain = append(locale.Chain, tag)
+		}
+	}
+	for _, pref := range prefs {
+		add(pref.String())
+		base, _ := pref.Base()
+		add(base.String())
+	}
+	add("en")
+	return locale
+}
+
+// Base is the base language of the locale, the key of its catalog.
+func (l Locale) Base() string {
+	base, _ := l.Tag.Base()
+	return base.String()
+}
+
+// Collation is the quoted name of the collation sorting text for the
+// locale, to be used in ORDER BY ... COLLATE.
+func (l Locale) Collation() string {
+	return `"` + collations[l.Base()] + `"`
+}
+
+type ctxKey struct{}
+
+// WithLocale returns ctx carrying locale.
+func WithLocale(ctx context.Context, locale Locale) context.Context {
+	return context.WithValue(ctx, ctxKey{}, locale)
+}
+
+// FromContext returns the locale of the request, Default without one.
+func FromContext(ctx context.Context) Locale {
+	if locale, ok := ctx.Value(ctxKey{}).(Locale); ok {
+		return locale
+	}
+	return Default
+}
+
+// T translates an English message to the language of the request.
+func T(ctx context.Context, message string) string {
+	if translated, ok := catalogs[FromContext(ctx).Base()][message]; ok {
+		return translated
+	}
+	return message
+}
+
+// Middleware negotiates the language of each request from its lang query
+// parameter or, without it, its Accept-Language header.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept := r.Header.Get("Accept-Language")
+		if lang := r.URL.Query().Get("lang"); lang != "" {
+			accept = lang
+		}
+		locale := Negotiate(accept)
+		w.Header().Set("Content-Language", locale.Tag.String())
+		w.Header().Add("Vary", "Accept-Language")
+		next.ServeHTTP(w, r.WithContext(WithLocale(r.Context(), locale)))
+	})
+}
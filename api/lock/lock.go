@@ -0,0 +1,34 @@
+// Package lock keeps background jobs to one api instance at a time with
+// Postgres advisory locks.
+package lock
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/metrics"
+)
+
+// With runs fn unless another instance holds the advisory lock key, and
+// reports whether it ran. name labels the lock queries.
+func With(ctx context.Context, db *pgxpool.Pool, key int64, name string, fn func()) (bool, error) {
+	conn, err := db.Acquire(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Release()
+	var locked bool
+	if err := conn.QueryRow(metrics.WithQueryName(ctx, "lock_"+name),
+		"select pg_try_advisory_lock($1)", key).Scan(&locked); err != nil || !locked {
+		return false, err
+	}
+	defer func() {
+		// a lock left behind goes with the connection, which is then closed
+		if _, err := conn.Exec(metrics.WithQueryName(context.Background(), "unlock_"+name),
+			"select pg_advisory_unlock($1)", key); err != nil {
+			conn.Conn().Close(context.Background())
+		}
+	}()
+	fn()
+	return true, nil
+}
@@ -0,0 +1,93 @@
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Config selects the verbosity and output format of the logger.
+type Config struct {
+	Level  slog.Level
+	Format string // "json" or "text"
+}
+
+// ConfigFromEnv reads $LOG_LEVEL (debug, info, warn, error) and
+// $LOG_FORMAT (json, text). JSON at info level is the default.
+func ConfigFromEnv() Config {
+	cfg := Config{Level: slog.LevelInfo, Format: "json"}
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		_ = cfg.Level.UnmarshalText([]byte(level))
+	}
+	if format := strings.ToLower(os.Getenv("LOG_FORMAT")); format == "text" {
+		cfg.Format = format
+	}
+	return cfg
+}
+
+// New builds a logger writing to w. Emails and phone numbers are redacted
+// from every attribute before they are written.
+func New(w io.Writer, cfg Config) *slog.Logger {
+	opts := &slog.HandlerOptions{Level: cfg.Level, ReplaceAttr: redactAttr}
+	var h slog.Handler
+	if cfg.Format == "text" {
+		h = slog.NewTextHandler(w, opts)
+	} else {
+		h = slog.NewJSONHandler(w, opts)
+	}
+	return slog.New(h)
+}
+
+type ctxKey struct{}
+
+// requestInfo is shared by every logger derived from a request context, so
+// the user ID resolved by the auth layer shows up in later log lines too.
+type requestInfo struct {
+	mu     sync.Mutex
+	userID string
+}
+
+func (i *requestInfo) user() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.userID
+}
+
+// SetUserID records the authenticated user for the rest of the request.
+func SetUserID(ctx context.Context, userID string) {
+	if info, ok := ctx.Value(ctxKey{}).(*requestInfo); ok {
+		info.mu.Lock()
+		info.userID = userID
+		info.mu.Unlock()
+	}
+}
+
+// FromContext returns the default logger annotated with the request ID,
+// trace ID, chi route pattern and user ID found in ctx.
+func FromContext(ctx context.Context) *slog.Logger {
+	l := slog.Default()
+	if reqID := middleware.GetReqID(ctx); reqID != "" {
+		l = l.With("request_id", reqID)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		l = l.With("trace_id", sc.TraceID().String())
+	}
+	if rctx := chi.RouteContext(ctx); rctx != nil {
+		if pattern := rctx.RoutePattern(); pattern != "" {
+			l = l.With("route", pattern)
+		}
+	}
+	if info, ok := ctx.Value(ctxKey{}).(*requestInfo); ok {
+		if userID := info.user(); userID != "" {
+			l = l.With("user_id", userID)
+		}
+	}
+	return l
+}
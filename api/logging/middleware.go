@@ -0,0 +1,44 @@
+package logging
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/middleware"
+)
+
+// Middleware attaches request scoped logging state to the context and writes
+// one access log line per request. It replaces chi's middleware.Logger and
+// must run after middleware.RequestID.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(context.WithValue(r.Context(), ctxKey{}, &requestInfo{}))
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		start := time.Now()
+
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		l := FromContext(r.Context())
+		attrs := []interface{}{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", status,
+			"bytes", ww.BytesWritten(),
+			"duration_ms", time.Since(start).Milliseconds(),
+			"remote_addr", r.RemoteAddr,
+		}
+		switch {
+		case status >= 500:
+			l.Error("request", attrs...)
+		case status >= 400:
+			l.Warn("request", attrs...)
+		default:
+			l.Info("request", attrs...)
+		}
+	})
+}
@@ -0,0 +1,55 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+// PgxLogger adapts pgx's logger interface to slog. Statements are logged at
+// debug level, statements slower than SlowQuery at warn level and failures at
+// error level. Query arguments are only logged at debug level, redacted.
+type PgxLogger struct {
+	SlowQuery time.Duration
+}
+
+func NewPgxLogger(slowQuery time.Duration) *PgxLogger {
+	return &PgxLogger{SlowQuery: slowQuery}
+}
+
+func (l *PgxLogger) Log(ctx context.Context, level pgx.LogLevel, msg string, data map[string]interface{}) {
+	logger := FromContext(ctx).With("component", "pgx")
+	elapsed, _ := data["time"].(time.Duration)
+
+	lvl := slog.LevelDebug
+	switch {
+	case level == pgx.LogLevelError:
+		lvl = slog.LevelError
+	case level == pgx.LogLevelWarn:
+		lvl = slog.LevelWarn
+	case l.SlowQuery > 0 && elapsed >= l.SlowQuery:
+		lvl = slog.LevelWarn
+		msg = "slow " + msg
+	}
+	if !logger.Enabled(ctx, lvl) {
+		return
+	}
+
+	attrs := make([]slog.Attr, 0, len(data))
+	for k, v := range data {
+		switch k {
+		case "args":
+			if lvl == slog.LevelDebug {
+				attrs = append(attrs, slog.String(k, fmt.Sprint(v)))
+			}
+		case "time":
+			attrs = append(attrs, slog.Float64("duration_ms", float64(elapsed)/float64(time.Millisecond)))
+		default:
+			attrs = append(attrs, slog.Any(k, v))
+		}
+	}
+	logger.LogAttrs(ctx, lvl, msg, attrs...)
+}
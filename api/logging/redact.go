@@ -0,0 +1,68 @@
+package logging
+
+import (
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+var (
+	emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+	// at least 8 digits, optionally with a leading + and spaces or dashes in
+	// between; redactPhones skips those that are part of a longer token
+	phonePattern = regexp.MustCompile(`\+?\d(?:[\s\-]?\d){7,}`)
+)
+
+const redacted = "[REDACTED]"
+
+// Redact masks email addresses and phone numbers found in s.
+func Redact(s string) string {
+	s = emailPattern.ReplaceAllString(s, "[EMAIL]")
+	return redactPhones(s)
+}
+
+// redactPhones masks the phone numbers of s that stand on their own, not
+// the digits of UUIDs, hex strings, numeric path segments or dotted
+// numbers such as versions and addresses.
+func redactPhones(s string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range phonePattern.FindAllStringIndex(s, -1) {
+		start, end := m[0], m[1]
+		if start > 0 && (isWordByte(s[start-1]) || strings.IndexByte("-_/.", s[start-1]) >= 0) ||
+			end < len(s) && (isWordByte(s[end]) || strings.IndexByte("-_", s[end]) >= 0) {
+			continue
+		}
+		b.WriteString(s[last:start])
+		b.WriteString("[PHONE]")
+		last = end
+	}
+	if last == 0 {
+		return s
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+func isWordByte(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// redactAttr is a slog.HandlerOptions.ReplaceAttr hook. Attributes whose key
+// names PII are dropped entirely, other strings are scrubbed of emails and
+// phone numbers.
+func redactAttr(_ []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	if strings.Contains(key, "email") || strings.Contains(key, "phone") || key == "address" {
+		return slog.String(a.Key, redacted)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Redact(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, Redact(err.Error()))
+		}
+	}
+	return a
+}
@@ -0,0 +1,21 @@
+package logging
+
+import "testing"
+
+func TestRedact(t *testing.T) {
+	for in, want := range map[string]string{
+		"call +91 98450 12345 today":                        "call [PHONE] today",
+		"phone 080-2222-3333.":                              "phone [PHONE].",
+		"write to teacher@example.org":                      "write to [EMAIL]",
+		"9845012345":                                        "[PHONE]",
+		"/api/schools/123e4567-e89b-12d3-a456-426614174000": "/api/schools/123e4567-e89b-12d3-a456-426614174000",
+		"/api/teacher-requests/12345678":                    "/api/teacher-requests/12345678",
+		"trace 4bf92f3577b34da6a3ce929d0e0e4736":            "trace 4bf92f3577b34da6a3ce929d0e0e4736",
+		"id 1234567890abcdef":                               "id 1234567890abcdef",
+		"version 1.20240131":                                "version 1.20240131",
+	} {
+		if got := Redact(in); got != want {
+			t.Errorf("Redact(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers email.
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// SMTPSender sends through an SMTP relay using PLAIN auth when a username
+// is configured.
+type SMTPSender struct {
+	Addr     string // host:port
+	From     string
+	Username string
+	Password string
+}
+
+func (s *SMTPSender) Send(_ context.Context, msg Message) error {
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return fmt.Errorf("smtp addr: %s", err)
+	}
+	var auth smtp.Auth
+	if s.Username != "" {
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	body := strings.Join([]string{
+		"From: " + s.From,
+		"To: " + msg.To,
+		"Subject: " + msg.Subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		msg.Body,
+	}, "\r\n")
+	if err := smtp.SendMail(s.Addr, auth, s.From, []string{msg.To}, []byte(body)); err != nil {
+		return fmt.Errorf("send mail: %s", err)
+	}
+	return nil
+}
+
+// LogSender logs the recipient and subject of messages instead of sending
+// them, for local development. Bodies hold codes and links, so they are
+// never logged.
+type LogSender struct{}
+
+func (LogSender) Send(ctx context.Context, msg Message) error {
+	slog.InfoContext(ctx, "mail not sent, no $SMTP_ADDR configured", "to", msg.To, "subject", msg.Subject)
+	return nil
+}
+
+// FromEnv returns an SMTPSender configured by $SMTP_ADDR, $SMTP_FROM,
+// $SMTP_USERNAME and $SMTP_PASSWORD. Without $SMTP_ADDR it returns a
+// LogSender, unless required.
+func FromEnv(required bool) (Sender, error) {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		if required {
+			return nil, errors.New("SMTP_ADDR is not set")
+		}
+		return LogSender{}, nil
+	}
+	from := os.Getenv("SMTP_FROM")
+	if from == "" {
+		from = "no-reply@helpschool.org"
+	}
+	return &SMTPSender{
+		Addr:     addr,
+		From:     from,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+	}, nil
+}
@@ -0,0 +1,202 @@
+// Package needs keeps the needs of schools current: needs past their
+// needed_by date expire, the school's teachers are asked to renew or close
+// them, and recurring needs re-open every year.
+package needs
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/lock"
+	"github.com/venkata6/helpschool/api/mail"
+	"github.com/venkata6/helpschool/api/metrics"
+)
+
+// Need statuses, only open needs are listed to donors.
+const (
+	Open    = "open"
+	Expired = "expired"
+	Closed  = "closed"
+)
+
+// Recur re-opens the needs of recurrences whose day has come this year
+// since they were last opened, with the template's quantity and nothing
+// fulfilled yet.
+func Recur(ctx context.Context, db *pgxpool.Pool) (int64, error) {
+	tag, err := db.Exec(metrics.WithQueryName(ctx, "open_recurring_needs"),
+		`with due as (
+			select r.*, make_date(extract(year from current_date)::int, r.open_month, r.open_day) as opens
+			from helpschool.need_recurrences as r
+		), opened as (
+			INSERT INTO helpschool.school_supplies( school_id,supply_id,quantity,fulfilled_count,extra_info,item_id,needed_by,status,recurrence_id)
+			select d.school_id, d.supply_id, d.quantity, 0, d.extra_info, s.item_id, d.opens + d.needed_within_days, $1, d.recurrence_id
+			from due as d inner join helpschool.supplies as s on s.supply_id = d.supply_id
+			where d.opens <= current_date and (d.last_opened is null or d.last_opened < d.opens)
+			on conflict (school_id,supply_id) where bundle_id is null do update
+				set quantity = excluded.quantity, fulfilled_count = 0,
+					extra_info = coalesce(excluded.extra_info, school_supplies.extra_info),
+					needed_by = excluded.needed_by, status = excluded.status, expired_date = null,
+					expiry_notified_date = null, recurrence_id = excluded.recurrence_id,
+					created_date = now(), modified_date = now()
+			returning recurrence_id
+		)
+		update helpschool.need_recurrences set last_opened = current_date
+		where recurrence_id in (select recurrence_id from opened)`, Open)
+	return tag.RowsAffected(), err
+}
+
+// Expire marks the open needs past their needed_by date that are not yet
+// fulfilled as expired.
+func Expire(ctx context.Context, db *pgxpool.Pool) (int64, error) {
+	tag, err := db.Exec(metrics.WithQueryName(ctx, "expire_school_supplies"),
+		`update helpschool.school_supplies set status = $2, expired_date = now(), modified_date = now()
+		where status = $1 and needed_by < current_date and quantity > coalesce(fulfilled_count,0)`, Open, Expired)
+	return tag.RowsAffected(), err
+}
+
+// expiredNeeds lists, per approved teacher, the expired needs of their
+// schools nobody was told about yet. Teachers opt out with the
+// notification preference "need_expiry": false.
+const expiredNeeds = `select u.user_email,ss.school_id::text,ss.supply_id::text,coalesce(ss.bundle_id::text,''),
+		s.name,su.title,ss.needed_by
+	from helpschool.school_supplies as ss
+	inner join helpschool.schools as s on s.school_id = ss.school_id
+	inner join helpschool.supplies as su on su.supply_id = ss.supply_id
+	inner join helpschool.teacher_affiliations as a on a.school_id = ss.school_id and a.status = 'approved'
+	inner join helpschool.users as u on u.id = a.user_id
+	where ss.status = $1 and ss.expiry_notified_date is null
+		and u.user_email is not null and coalesce(u.notification_prefs->>'need_expiry','true') <> 'false'
+	order by u.user_email, s.name, su.title`
+
+type need struct {
+	schoolId   string
+	supplyId   string
+	bundleId   string
+	schoolName string
+	title      string
+	neededBy   time.Time
+}
+
+func (n need) key() string {
+	return n.schoolId + "/" + n.supplyId + "/" + n.bundleId
+}
+
+// Notify emails the teachers of schools with newly expired needs a list
+// of them to renew or close. A need is marked notified once every teacher
+// of its school was mailed, so a failed mail is sent again on the next
+// run, to the teachers already told too.
+func Notify(ctx context.Context, db *pgxpool.Pool, mailer mail.Sender, publicURL string) error {
+	rows, err := db.Query(metrics.WithQueryName(ctx, "list_expired_needs"), expiredNeeds, Expired)
+	if err != nil {
+		return err
+	}
+	needs := map[string][]need{}
+	var emails []string
+	for rows.Next() {
+		var email string
+		var n need
+		if err := rows.Scan(&email, &n.schoolId, &n.supplyId, &n.bundleId, &n.schoolName, &n.title, &n.neededBy); err != nil {
+			rows.Close()
+			return err
+		}
+		if _, ok := needs[email]; !ok {
+			emails = append(emails, email)
+		}
+		needs[email] = append(needs[email], n)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	publicURL = strings.TrimSuffix(publicURL, "/")
+	mailed := map[string]need{}
+	failed := map[string]bool{}
+	for _, email := range emails {
+		var body strings.Builder
+		body.WriteString("These needs passed the date they were needed by and are no longer shown to donors:\n\n")
+		for _, n := range needs[email] {
+			fmt.Fprintf(&body, "%s for %s, needed by %s\n%s/web/#/schools/%s\n\n",
+				n.title, n.schoolName, n.neededBy.Format("2 Jan 2006"), publicURL, n.schoolId)
+		}
+		body.WriteString("Renew a need with a new date if the school still needs it, or close it.\n" +
+			"To stop these emails turn off need expiry notices in your profile.")
+		if err := mailer.Send(ctx, mail.Message{
+			To:      email,
+			Subject: "Needs to renew on helpschool",
+			Body:    body.String(),
+		}); err != nil {
+			slog.ErrorContext(ctx, "send need expiry notice failed", "err", err)
+			for _, n := range needs[email] {
+				failed[n.key()] = true
+			}
+			continue
+		}
+		for _, n := range needs[email] {
+			mailed[n.key()] = n
+		}
+	}
+	var schoolIds, supplyIds, bundleIds []string
+	for key, n := range mailed {
+		if !failed[key] {
+			schoolIds = append(schoolIds, n.schoolId)
+			supplyIds = append(supplyIds, n.supplyId)
+			bundleIds = append(bundleIds, n.bundleId)
+		}
+	}
+	if len(schoolIds) == 0 {
+		return nil
+	}
+	_, err = db.Exec(metrics.WithQueryName(ctx, "mark_expired_needs_notified"),
+		`update helpschool.school_supplies as ss set expiry_notified_date = now()
+		from unnest($2::uuid[], $3::uuid[], $4::text[]) as n(school_id, supply_id, bundle_id)
+		where ss.status = $1 and ss.expiry_notified_date is null and ss.school_id = n.school_id
+			and ss.supply_id = n.supply_id and ss.bundle_id is not distinct from nullif(n.bundle_id,'')::uuid`,
+		Expired, schoolIds, supplyIds, bundleIds)
+	return err
+}
+
+// lockKey is the advisory lock held while the needs are kept, so that of
+// several api instances only one does it at a time.
+const lockKey = 0x6e65656473 // "needs"
+
+// keep re-opens recurring needs, expires needs and notifies teachers.
+func keep(ctx context.Context, db *pgxpool.Pool, mailer mail.Sender, publicURL string) {
+	if n, err := Recur(ctx, db); err != nil {
+		slog.ErrorContext(ctx, "open recurring needs failed", "err", err)
+	} else if n > 0 {
+		slog.InfoContext(ctx, "recurring needs opened", "count", n)
+	}
+	if n, err := Expire(ctx, db); err != nil {
+		slog.ErrorContext(ctx, "expire needs failed", "err", err)
+	} else if n > 0 {
+		slog.InfoContext(ctx, "needs expired", "count", n)
+	}
+	if err := Notify(ctx, db, mailer, publicURL); err != nil {
+		slog.ErrorContext(ctx, "notify expired needs failed", "err", err)
+	}
+}
+
+// Run re-opens recurring needs, expires needs and notifies teachers every
+// interval until ctx is done, skipping the runs another instance is doing.
+func Run(ctx context.Context, db *pgxpool.Pool, mailer mail.Sender, publicURL string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		ran, err := lock.With(ctx, db, lockKey, "needs", func() { keep(ctx, db, mailer, publicURL) })
+		if err != nil {
+			slog.ErrorContext(ctx, "lock needs failed", "err", err)
+		} else if !ran {
+			slog.DebugContext(ctx, "needs kept by another instance")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package opendata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/metrics"
+)
+
+// Version is the version of the schema of the datasets, the major version
+// being the one in /api/open-data/v1. Columns are only added within it.
+const Version = "1.0"
+
+// Column describes a column of a dataset in the data dictionary. Types are
+// string, integer and number.
+type Column struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+// Formats are the formats datasets are served in.
+var Formats = []string{"csv", "json", "columnar"}
+
+// Dataset is a table of the feed.
+type Dataset struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Files       map[string]string `json:"files"`
+	Columns     []Column          `json:"columns"`
+	Rows        [][]interface{}   `json:"-"`
+}
+
+// Release is the feed built at a point in time. Cells aggregating fewer
+// than K schools, or pledges of fewer than K donors, are suppressed.
+type Release struct {
+	Version     string     `json:"version"`
+	GeneratedAt time.Time  `json:"generated_at"`
+	K           int        `json:"k"`
+	Suppression string     `json:"suppression"`
+	License     string     `json:"license"`
+	Datasets    []*Dataset `json:"datasets"`
+}
+
+// Dataset returns the dataset called name, or nil.
+func (r *Release) Dataset(name string) *Dataset {
+	for _, d := range r.Datasets {
+		if d.Name == name {
+			return d
+		}
+	}
+	return nil
+}
+
+// Names are the column names of the dataset.
+func (d *Dataset) Names() []string {
+	names := make([]string, len(d.Columns))
+	for i, c := range d.Columns {
+		names[i] = c.Name
+	}
+	return names
+}
+
+// WriteColumnar writes the dataset column by column, the layout of
+// columnar formats such as Parquet, as JSON: every column with its type
+// and its values in row order.
+func (d *Dataset) WriteColumnar(w io.Writer, r *Release) error {
+	type column struct {
+		Column
+		Values []interface{} `json:"values"`
+	}
+	columns := make([]column, len(d.Columns))
+	for i, c := range d.Columns {
+		columns[i] = column{Column: c, Values: make([]interface{}, len(d.Rows))}
+		for j, row := range d.Rows {
+			columns[i].Values[j] = row[i]
+		}
+	}
+	return json.NewEncoder(w).Encode(struct {
+		Dataset     string    `json:"dataset"`
+		Version     string    `json:"version"`
+		GeneratedAt time.Time `json:"generated_at"`
+		Rows        int       `json:"rows"`
+		Columns     []column  `json:"columns"`
+	}{d.Name, r.Version, r.GeneratedAt, len(d.Rows), columns})
+}
+
+var districtColumns = []Column{
+	{"country", "string", "name of the country"},
+	{"state_govt_id", "string", "government code of the state, empty if unknown"},
+	{"state", "string", "name of the state"},
+	{"district_govt_id", "string", "government code of the district, empty if unknown"},
+	{"district", "string", "name of the district"},
+	{"category", "string", "slug of the top-level supply category, uncategorized for items without one"},
+	{"year", "integer", "year the needs were posted in"},
+	{"schools", "integer", "schools that posted needs; null when fewer than k"},
+	{"needs_posted", "integer", "needs posted; null when the cell is suppressed"},
+	{"quantity_needed", "integer", "units needed; null when the cell is suppressed"},
+	{"quantity_fulfilled", "integer", "units delivered; null when the cell is suppressed"},
+	{"fulfilment_rate", "number", "quantity_fulfilled / quantity_needed; null when the cell is suppressed"},
+	{"donors", "integer", "distinct donors who pledged; null when fewer than k or the cell is suppressed"},
+	{"quantity_pledged", "integer", "units pledged, delivered or not; null when donors is"},
+	{"suppressed", "string", "empty, schools when the whole cell is suppressed, donors when only the pledge columns are"},
+}
+
+// byDistrict adds up the needs per district, top-level category and year,
+// and the pledges for them. Categories are mapped to their root.
+const byDistrict = `with recursive roots as (
+		select category_id, category_id as root_id from helpschool.supply_categories where parent_id is null
+		union all
+		select c.category_id, r.root_id from helpschool.supply_categories as c
+		inner join roots as r on r.category_id = c.parent_id
+	), needs as (
+		select ss.school_id, ss.supply_id, ss.bundle_id, ss.quantity, coalesce(ss.fulfilled_count,0) as fulfilled,
+			sc.district_id, coalesce(rc.slug,'uncategorized') as category, extract(year from ss.created_date)::int as year
+		from helpschool.school_supplies as ss
+		inner join helpschool.schools as sc on sc.school_id = ss.school_id
+		left join helpschool.catalog_items as i on i.item_id = ss.item_id
+		left join roots as r on r.category_id = i.category_id
+		left join helpschool.supply_categories as rc on rc.category_id = r.root_id
+	), cells as (
+		select district_id, category, year, count(distinct school_id) as schools, count(*) as needs,
+			sum(quantity) as quantity, sum(fulfilled) as fulfilled
+		from needs group by district_id, category, year
+	), pledges as (
+		select n.district_id, n.category, n.year,
+			count(distinct coalesce(d.user_id::text, d.guest_email)) as donors, sum(coalesce(d.quantity,0)) as quantity
+		from needs as n
+		inner join helpschool.users_donations as d on d.school_id = n.school_id and d.supply_id = n.supply_id
+			and d.bundle_id is not distinct from n.bundle_id
+		where d.confirmed_date is not null and d.status <> 'Cancelled'
+		group by n.district_id, n.category, n.year
+	)
+	select co.name,coalesce(st.govt_id,''),st.name,coalesce(di.govt_id,''),di.name,c.category,c.year,
+		c.schools,c.needs,c.quantity,c.fulfilled,coalesce(p.donors,0),coalesce(p.quantity,0)
+	from cells as c
+	inner join helpschool.districts as di on di.district_id = c.district_id
+	inner join helpschool.states as st on st.state_id = di.state_id
+	inner join helpschool.countries as co on co.country_id = st.country_id
+	left join pledges as p on p.district_id = c.district_id and p.category = c.category and p.year = c.year
+	order by co.name,st.name,di.name,c.year,c.category`
+
+// Build reads the datasets from the database, suppressing small cells.
+func Build(ctx context.Context, db *pgxpool.Pool, k int) (*Release, error) {
+	release := &Release{Version: Version, GeneratedAt: time.Now().UTC(), K: k, License: "CC-BY-4.0",
+		Suppression: fmt.Sprintf("cells of needs-by-district with fewer than %d schools have no measures, "+
+			"and their pledge columns are empty when fewer than %d donors pledged", k, k)}
+
+	districts := &Dataset{Name: "needs-by-district",
+		Description: "needs, deliveries and pledges per district, top-level supply category and year",
+		Columns:     districtColumns, Rows: [][]interface{}{}}
+	rows, err := db.Query(metrics.WithQueryName(ctx, "open_data_by_district"), byDistrict)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var country, stateId, state, districtId, district, category string
+		var year int
+		var schools, needs, quantity, fulfilled, donors, pledged int64
+		if err := rows.Scan(&country, &stateId, &state, &districtId, &district, &category, &year,
+			&schools, &needs, &quantity, &fulfilled, &donors, &pledged); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		row := []interface{}{country, stateId, state, districtId, district, category, year,
+			nil, nil, nil, nil, nil, nil, nil, "schools"}
+		if schools >= int64(k) {
+			row[7], row[8], row[9], row[10] = schools, needs, quantity, fulfilled
+			if quantity > 0 {
+				row[11] = float64(fulfilled) / float64(quantity)
+			}
+			row[14] = ""
+			if donors == 0 || donors >= int64(k) {
+				row[12], row[13] = donors, pledged
+			} else {
+				row[14] = "donors"
+			}
+		}
+		districts.Rows = append(districts.Rows, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	release.Datasets = []*Dataset{districts}
+	for _, d := range release.Datasets {
+		d.Files = map[string]string{}
+		for _, format := range Formats {
+			d.Files[format] = "/api/open-data/v1/" + d.Name + "." + format
+		}
+	}
+	return release, nil
+}
+
+// Feed keeps the latest release, built again when it is older than ttl.
+type Feed struct {
+	db  *pgxpool.Pool
+	k   int
+	ttl time.Duration
+
+	mu      sync.Mutex
+	release *Release
+}
+
+func NewFeed(db *pgxpool.Pool, k int, ttl time.Duration) *Feed {
+	return &Feed{db: db, k: k, ttl: ttl}
+}
+
+// Release returns the latest release, building it if it is missing or
+// stale.
+func (f *Feed) Release(ctx context.Context) (*Release, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.release != nil && time.Since(f.release.GeneratedAt) < f.ttl {
+		return f.release, nil
+	}
+	release, err := Build(ctx, f.db, f.k)
+	if err != nil {
+		return nil, err
+	}
+	f.release = release
+	return release, nil
+}
@@ -0,0 +1,182 @@
+package pii
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// KeyProvider keeps the key encryption keys, as a KMS does: data keys are
+// wrapped and unwrapped by it and the keys themselves never leave it. A
+// KMS implementation calls its encrypt and decrypt operations with the key
+// id. The provider also holds the key of the blind indexes, which is not
+// rotated since every index would have to be recomputed.
+type KeyProvider interface {
+	// CurrentKeyID names the key new data keys are wrapped with.
+	CurrentKeyID() string
+	Wrap(ctx context.Context, keyId string, dataKey []byte) ([]byte, error)
+	Unwrap(ctx context.Context, keyId string, wrapped []byte) ([]byte, error)
+	IndexKey(ctx context.Context) ([]byte, error)
+}
+
+// ErrUnknownKey is returned for data wrapped with a key the provider does
+// not have.
+var ErrUnknownKey = errors.New("unknown key id")
+
+// keyFile is the JSON of a LocalKeys file, keys being base64 encoded
+// 32 byte AES keys.
+type keyFile struct {
+	Current  string            `json:"current"`
+	Keys     map[string]string `json:"keys"`
+	IndexKey string            `json:"index_key"`
+}
+
+// LocalKeys is a KeyProvider reading its keys from a file. To rotate, add
+// a key to the file, make it current and restart, the rotation job then
+// re-encrypts the old values. Old keys are removed once none is left.
+type LocalKeys struct {
+	path     string
+	current  string
+	keys     map[string]cipher.AEAD
+	indexKey []byte
+}
+
+func decodeKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("keys must be 32 bytes, base64 encoded")
+	}
+	return key, nil
+}
+
+// LoadLocalKeys reads a key file.
+func LoadLocalKeys(path string) (*LocalKeys, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f keyFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("parse %s: %s", path, err)
+	}
+	l := &LocalKeys{path: path, current: f.Current, keys: map[string]cipher.AEAD{}}
+	for id, encoded := range f.Keys {
+		if id == "" || strings.Contains(id, ".") {
+			return nil, fmt.Errorf("key id %q must not be empty or contain dots", id)
+		}
+		key, err := decodeKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %s", id, err)
+		}
+		if l.keys[id], err = newGCM(key); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := l.keys[f.Current]; !ok {
+		return nil, fmt.Errorf("current key %q is not in %s", f.Current, path)
+	}
+	if l.indexKey, err = decodeKey(f.IndexKey); err != nil {
+		return nil, fmt.Errorf("index_key: %s", err)
+	}
+	return l, nil
+}
+
+// LocalKeysFromEnv reads the key file $PII_KEY_FILE. Without it the keys
+// are kept in data/pii-keys.json, created on first use, unless required.
+func LocalKeysFromEnv(required bool) (*LocalKeys, error) {
+	path := os.Getenv("PII_KEY_FILE")
+	if path == "" {
+		if required {
+			return nil, errors.New("PII_KEY_FILE is not set")
+		}
+		path = filepath.Join("data", "pii-keys.json")
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			if err := writeKeyFile(path); err != nil {
+				return nil, err
+			}
+			slog.Warn("no $PII_KEY_FILE, created development keys, values encrypted with them are lost with the file", "path", path)
+		}
+	}
+	return LoadLocalKeys(path)
+}
+
+func writeKeyFile(path string) error {
+	keys := make([]byte, 64)
+	if _, err := rand.Read(keys); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(keyFile{
+		Current:  "dev",
+		Keys:     map[string]string{"dev": base64.StdEncoding.EncodeToString(keys[:32])},
+		IndexKey: base64.StdEncoding.EncodeToString(keys[32:]),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o600)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Path is the key file the keys were read from. Encrypted values cannot be
+// read again without it, so it must be backed up.
+func (l *LocalKeys) Path() string {
+	return l.path
+}
+
+func (l *LocalKeys) CurrentKeyID() string {
+	return l.current
+}
+
+func (l *LocalKeys) Wrap(_ context.Context, keyId string, dataKey []byte) ([]byte, error) {
+	return seal(l.keys[keyId], dataKey, []byte(keyId))
+}
+
+func (l *LocalKeys) Unwrap(_ context.Context, keyId string, wrapped []byte) ([]byte, error) {
+	return open(l.keys[keyId], wrapped, []byte(keyId))
+}
+
+func (l *LocalKeys) IndexKey(context.Context) ([]byte, error) {
+	return l.indexKey, nil
+}
+
+// seal encrypts with a random nonce, which it puts in front.
+func seal(aead cipher.AEAD, plaintext, additional []byte) ([]byte, error) {
+	if aead == nil {
+		return nil, ErrUnknownKey
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+func open(aead cipher.AEAD, sealed, additional []byte) ([]byte, error) {
+	if aead == nil {
+		return nil, ErrUnknownKey
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	n := aead.NonceSize()
+	return aead.Open(nil, sealed[:n], sealed[n:], additional)
+}
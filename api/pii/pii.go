@@ -0,0 +1,184 @@
+package pii
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// ErrCiphertext is returned by Decrypt for values it did not encrypt.
+var ErrCiphertext = errors.New("malformed ciphertext")
+
+// Cipher encrypts the values of personal data columns with envelope
+// encryption: values are sealed with AES-256-GCM under a data key, and the
+// data key, wrapped by the KeyProvider, is stored with them. A Cipher makes
+// one data key per key encryption key, on first use, and keeps the data
+// keys it unwrapped, so the provider is asked once per key and not per
+// value.
+//
+// An encrypted value reads "v1.<key id>.<wrapped data key>.<sealed value>",
+// the column name being authenticated with it so values cannot be moved
+// from one column to another.
+type Cipher struct {
+	keys     KeyProvider
+	indexKey []byte
+
+	mu      sync.Mutex
+	current *dataKey
+	opened  map[string]*dataKey // by key id and wrapped key
+}
+
+type dataKey struct {
+	keyId   string
+	wrapped string
+	key     []byte
+}
+
+func NewCipher(ctx context.Context, keys KeyProvider) (*Cipher, error) {
+	indexKey, err := keys.IndexKey(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{keys: keys, indexKey: indexKey, opened: map[string]*dataKey{}}, nil
+}
+
+// KeyID is the id of the key values are encrypted under now.
+func (c *Cipher) KeyID() string {
+	return c.keys.CurrentKeyID()
+}
+
+// currentKey returns the data key of the current key, made and wrapped on
+// first use and again after the current key changed.
+func (c *Cipher) currentKey(ctx context.Context) (*dataKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keyId := c.keys.CurrentKeyID()
+	if c.current != nil && c.current.keyId == keyId {
+		return c.current, nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	wrapped, err := c.keys.Wrap(ctx, keyId, key)
+	if err != nil {
+		return nil, err
+	}
+	c.current = &dataKey{keyId: keyId, wrapped: base64.RawURLEncoding.EncodeToString(wrapped), key: key}
+	c.opened[keyId+"."+c.current.wrapped] = c.current
+	return c.current, nil
+}
+
+// openKey returns the data key wrapped by keyId.
+func (c *Cipher) openKey(ctx context.Context, keyId, wrapped string) (*dataKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if k, ok := c.opened[keyId+"."+wrapped]; ok {
+		return k, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, ErrCiphertext
+	}
+	key, err := c.keys.Unwrap(ctx, keyId, raw)
+	if err != nil {
+		return nil, err
+	}
+	k := &dataKey{keyId: keyId, wrapped: wrapped, key: key}
+	c.opened[keyId+"."+wrapped] = k
+	return k, nil
+}
+
+// Encrypt encrypts a value of column. Empty values stay empty, so that
+// they are stored as null.
+func (c *Cipher) Encrypt(ctx context.Context, column, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	k, err := c.currentKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newGCM(k.key)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(aead, []byte(value), []byte(column))
+	if err != nil {
+		return "", err
+	}
+	return "v1." + k.keyId + "." + k.wrapped + "." + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts a value Encrypt returned for column.
+func (c *Cipher) Decrypt(ctx context.Context, column, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	parts := strings.Split(value, ".")
+	if len(parts) != 4 || parts[0] != "v1" {
+		return "", ErrCiphertext
+	}
+	k, err := c.openKey(ctx, parts[1], parts[2])
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return "", ErrCiphertext
+	}
+	aead, err := newGCM(k.key)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(aead, sealed, []byte(column))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Kinds of blind indexes, values are normalized by kind before indexing.
+const (
+	Email = "email"
+	Phone = "phone"
+)
+
+// normalize makes the values that are equal for a person index alike:
+// emails in lower case, phone numbers as their digits and a leading +.
+func normalize(kind, value string) string {
+	value = strings.TrimSpace(value)
+	switch kind {
+	case Email:
+		return strings.ToLower(value)
+	case Phone:
+		var b strings.Builder
+		for i, r := range value {
+			if unicode.IsDigit(r) || (r == '+' && i == 0) {
+				b.WriteRune(r)
+			}
+		}
+		return b.String()
+	}
+	return value
+}
+
+// Index returns the blind index of a value, an HMAC of it that allows
+// looking up equal values without decrypting them. Empty values have an
+// empty index.
+func (c *Cipher) Index(kind, value string) string {
+	value = normalize(kind, value)
+	if value == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, c.indexKey)
+	mac.Write([]byte(kind + "\n" + value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
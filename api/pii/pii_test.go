@@ -0,0 +1,147 @@
+package pii
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeKeys writes a key file holding keys with current as current key,
+// and returns its path.
+func writeKeys(t *testing.T, current string, keys map[string]string, indexKey string) string {
+	t.Helper()
+	b, err := json.Marshal(keyFile{Current: current, Keys: keys, IndexKey: indexKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func randomKey(t *testing.T) string {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func newTestCipher(t *testing.T, path string) *Cipher {
+	t.Helper()
+	keys, err := LoadLocalKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewCipher(context.Background(), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	c := newTestCipher(t, writeKeys(t, "k1", map[string]string{"k1": randomKey(t)}, randomKey(t)))
+	ctx := context.Background()
+
+	sealed, err := c.Encrypt(ctx, "email", "teacher@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(sealed, "v1.k1.") || strings.Contains(sealed, "teacher") {
+		t.Fatalf("Encrypt = %q, want a v1 value under k1 without the plaintext", sealed)
+	}
+	again, err := c.Encrypt(ctx, "email", "teacher@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == sealed {
+		t.Error("Encrypt is deterministic, want a fresh nonce per value")
+	}
+
+	plain, err := c.Decrypt(ctx, "email", sealed)
+	if err != nil || plain != "teacher@example.org" {
+		t.Errorf("Decrypt = %q, %v", plain, err)
+	}
+	if _, err := c.Decrypt(ctx, "phone", sealed); err == nil {
+		t.Error("Decrypt of a value moved to another column succeeded")
+	}
+	if _, err := c.Decrypt(ctx, "email", "plain text"); !errors.Is(err, ErrCiphertext) {
+		t.Errorf("Decrypt of plain text = %v, want ErrCiphertext", err)
+	}
+
+	if sealed, err := c.Encrypt(ctx, "email", ""); err != nil || sealed != "" {
+		t.Errorf("Encrypt of empty = %q, %v, want empty", sealed, err)
+	}
+}
+
+func TestDecryptAfterRotation(t *testing.T) {
+	k1, index := randomKey(t), randomKey(t)
+	old := newTestCipher(t, writeKeys(t, "k1", map[string]string{"k1": k1}, index))
+	ctx := context.Background()
+	sealed, err := old.Encrypt(ctx, "phone", "+91 98450 12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := newTestCipher(t, writeKeys(t, "k2", map[string]string{"k1": k1, "k2": randomKey(t)}, index))
+	if plain, err := rotated.Decrypt(ctx, "phone", sealed); err != nil || plain != "+91 98450 12345" {
+		t.Errorf("Decrypt under the old key = %q, %v", plain, err)
+	}
+	resealed, err := rotated.Encrypt(ctx, "phone", "+91 98450 12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(resealed, "v1.k2.") {
+		t.Errorf("Encrypt after rotation = %q, want a value under k2", resealed)
+	}
+
+	retired := newTestCipher(t, writeKeys(t, "k2", map[string]string{"k2": randomKey(t)}, index))
+	if _, err := retired.Decrypt(ctx, "phone", sealed); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Decrypt under a removed key = %v, want ErrUnknownKey", err)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	c := newTestCipher(t, writeKeys(t, "k1", map[string]string{"k1": randomKey(t)}, randomKey(t)))
+
+	if c.Index(Email, " Teacher@Example.org") != c.Index(Email, "teacher@example.org") {
+		t.Error("emails differing in case have different indexes")
+	}
+	if c.Index(Phone, "+91 98450-12345") != c.Index(Phone, "+919845012345") {
+		t.Error("phone numbers differing in punctuation have different indexes")
+	}
+	if c.Index(Email, "a@example.org") == c.Index(Phone, "a@example.org") {
+		t.Error("indexes of different kinds collide")
+	}
+	if c.Index(Email, " ") != "" {
+		t.Error("index of a blank value is not empty")
+	}
+
+	other := newTestCipher(t, writeKeys(t, "k1", map[string]string{"k1": randomKey(t)}, randomKey(t)))
+	if c.Index(Email, "a@example.org") == other.Index(Email, "a@example.org") {
+		t.Error("indexes under different index keys are equal")
+	}
+}
+
+func TestLoadLocalKeys(t *testing.T) {
+	for name, path := range map[string]string{
+		"missing current": writeKeys(t, "k2", map[string]string{"k1": randomKey(t)}, randomKey(t)),
+		"short key":       writeKeys(t, "k1", map[string]string{"k1": "c2hvcnQ="}, randomKey(t)),
+		"dotted id":       writeKeys(t, "k.1", map[string]string{"k.1": randomKey(t)}, randomKey(t)),
+		"no index key":    writeKeys(t, "k1", map[string]string{"k1": randomKey(t)}, ""),
+	} {
+		if _, err := LoadLocalKeys(path); err == nil {
+			t.Errorf("%s: LoadLocalKeys succeeded", name)
+		}
+	}
+}
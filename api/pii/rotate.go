@@ -0,0 +1,142 @@
+package pii
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/metrics"
+)
+
+// Column is an encrypted column, Index the kind of its blind index, kept
+// in <column>_bidx, or "" for none.
+type Column struct {
+	Name  string
+	Index string
+}
+
+// Table is a table with encrypted columns. Its pii_key_id column names
+// the key a row is encrypted under, rows from before encryption have none.
+type Table struct {
+	Name    string
+	Id      string
+	Columns []Column
+}
+
+// AAD is what the values of column are encrypted with, so that they only
+// decrypt in their own column.
+func (t Table) AAD(column string) string {
+	return t.Name + "." + column
+}
+
+// TeacherRequests keeps the teacher's phone, email and address encrypted.
+var TeacherRequests = Table{Name: "teacher_requests", Id: "id", Columns: []Column{
+	{Name: "teacher_phone", Index: Phone},
+	{Name: "teacher_email", Index: Email},
+	{Name: "address"},
+}}
+
+// Tables lists every table with encrypted columns.
+var Tables = []Table{TeacherRequests}
+
+// Rotate encrypts up to batch rows of t under the current key: rows under
+// an older key and rows not encrypted yet. It returns how many it did.
+func Rotate(ctx context.Context, db *pgxpool.Pool, c *Cipher, t Table, batch int) (int, error) {
+	keyId := c.KeyID()
+	selects := []string{t.Id + "::text", "coalesce(pii_key_id,'')"}
+	sets := []string{"pii_key_id = $3"}
+	for i, col := range t.Columns {
+		selects = append(selects, "coalesce("+col.Name+",'')")
+		sets = append(sets, fmt.Sprintf("%s = nullif($%d,'')", col.Name, 4+2*i))
+		if col.Index != "" {
+			sets = append(sets, fmt.Sprintf("%s_bidx = nullif($%d,'')", col.Name, 5+2*i))
+		}
+	}
+	rows, err := db.Query(metrics.WithQueryName(ctx, "list_rotated_rows"),
+		`select `+strings.Join(selects, ",")+` from helpschool.`+t.Name+`
+		where pii_key_id is distinct from $1 order by `+t.Id+` limit $2`, keyId, batch)
+	if err != nil {
+		return 0, err
+	}
+	var todo [][]string
+	for rows.Next() {
+		values := make([]string, len(selects))
+		dst := make([]interface{}, len(values))
+		for i := range values {
+			dst[i] = &values[i]
+		}
+		if err := rows.Scan(dst...); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		todo = append(todo, values)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	// rows changed since they were read are left for the next batch
+	update := `update helpschool.` + t.Name + ` set ` + strings.Join(sets, ", ") + `
+		where ` + t.Id + `::text = $1 and pii_key_id is not distinct from nullif($2,'')`
+	for _, values := range todo {
+		args := []interface{}{values[0], values[1], keyId}
+		for i, col := range t.Columns {
+			value := values[2+i]
+			if values[1] != "" {
+				if value, err = c.Decrypt(ctx, t.AAD(col.Name), value); err != nil {
+					return 0, fmt.Errorf("decrypt %s %s: %w", t.Name, values[0], err)
+				}
+			}
+			sealed, err := c.Encrypt(ctx, t.AAD(col.Name), value)
+			if err != nil {
+				return 0, err
+			}
+			args = append(args, sealed, c.Index(col.Index, value))
+		}
+		if _, err := db.Exec(metrics.WithQueryName(ctx, "rotate_row"), update, args...); err != nil {
+			return 0, err
+		}
+	}
+	return len(todo), nil
+}
+
+// RotateAll encrypts every row of every table under the current key.
+func RotateAll(ctx context.Context, db *pgxpool.Pool, c *Cipher) error {
+	const batch = 500
+	for _, t := range Tables {
+		for {
+			n, err := Rotate(ctx, db, c, t, batch)
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				slog.InfoContext(ctx, "re-encrypted rows", "table", t.Name, "key_id", c.KeyID(), "count", n)
+			}
+			if n < batch {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// Run re-encrypts rows under the current key every interval until ctx is
+// done, which after a rotation moves every row to the new key.
+func Run(ctx context.Context, db *pgxpool.Pool, c *Cipher, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := RotateAll(ctx, db, c); err != nil {
+			slog.ErrorContext(ctx, "re-encrypt rows failed", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package privacy
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/metrics"
+	"github.com/venkata6/helpschool/api/pii"
+	"github.com/venkata6/helpschool/api/storage"
+)
+
+// Kinds of requests logged in privacy_requests.
+const (
+	KindExport  = "export"
+	KindErasure = "erasure"
+)
+
+// ErrNoSubject is returned for a Subject with neither user nor email.
+var ErrNoSubject = errors.New("user_id or email is required")
+
+// Subject is whose personal data a request is about: an account, the
+// guest pledges and teacher requests made with an email, or both. The
+// email must have been proven to belong to the subject, the email claim
+// of an identity provider does not, so users asking for themselves are
+// subjects by their account only and get guest pledges once claimed.
+type Subject struct {
+	UserId string
+	Email  string
+}
+
+// resolve checks s names someone and lower cases its email.
+func resolve(s Subject) (Subject, error) {
+	if s.UserId == "" && s.Email == "" {
+		return s, ErrNoSubject
+	}
+	s.Email = strings.ToLower(strings.TrimSpace(s.Email))
+	return s, nil
+}
+
+// args are the query arguments of a subject, the user as $1, the email as
+// $2 and its blind index as $3, any may be null.
+func (s Subject) args(c *pii.Cipher) []interface{} {
+	var userId, email, emailIndex interface{}
+	if s.UserId != "" {
+		userId = s.UserId
+	}
+	if s.Email != "" {
+		email = s.Email
+		emailIndex = c.Index(pii.Email, s.Email)
+	}
+	return []interface{}{userId, email, emailIndex}
+}
+
+// teacherRequestsOf matches the teacher requests made with the email $2,
+// by the blind index $3 or, for rows not encrypted yet, by the email.
+const teacherRequestsOf = `(teacher_email_bidx = $3::text or (pii_key_id is null and lower(teacher_email) = $2::text))`
+
+// exports are the files of an export, the personal data in every table
+// keeping it. Queries join subject, the user_id and email asked for. The
+// encrypted columns of a table are decrypted.
+var exports = []struct {
+	file, sql string
+	table     *pii.Table
+}{
+	{"account.json", `select u.* from helpschool.users as u, subject where u.id = subject.user_id`, nil},
+	{"pledges.json", `select d.* from helpschool.users_donations as d, subject
+		where d.user_id = subject.user_id or (d.user_id is null and lower(d.guest_email) = subject.email)
+		order by d.created_date`, nil},
+	{"badges.json", `select b.* from helpschool.user_badges as b, subject where b.user_id = subject.user_id`, nil},
+	{"teacher_affiliations.json", `select a.affiliation_id,a.school_id,a.method,a.status,a.evidence_key,a.school_email,
+			a.review_note,a.reviewed_date,a.created_date
+		from helpschool.teacher_affiliations as a, subject where a.user_id = subject.user_id`, nil},
+	{"teacher_requests.json", `select r.* from helpschool.teacher_requests as r, subject
+		where r.teacher_email_bidx = subject.email_bidx or (r.pii_key_id is null and lower(r.teacher_email) = subject.email)
+		order by r.id`, &pii.TeacherRequests},
+	{"message_threads.json", `select t.* from helpschool.message_threads as t, subject
+		where t.donor_id = subject.user_id order by t.created_date`, nil},
+	{"messages.json", `select m.* from helpschool.messages as m, subject
+		where m.author_id = subject.user_id order by m.created_date`, nil},
+	{"school_updates.json", `select u.* from helpschool.school_updates as u, subject
+		where u.author_id = subject.user_id order by u.created_date`, nil},
+	{"activity.json", `select e.occurred_at,e.ip,e.request_id,e.reason,e.entity,e.entity_id,e.action
+		from helpschool.audit_events as e, subject where e.user_id = subject.user_id order by e.event_id`, nil},
+}
+
+// decrypt replaces the encrypted columns of t in the rows of doc with
+// their plaintext and drops the blind indexes and key id.
+func decrypt(ctx context.Context, c *pii.Cipher, t pii.Table, doc []byte) ([]byte, error) {
+	var rows []map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	if err := dec.Decode(&rows); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		encrypted := row["pii_key_id"] != nil
+		for _, col := range t.Columns {
+			value, _ := row[col.Name].(string)
+			if encrypted && value != "" {
+				plaintext, err := c.Decrypt(ctx, t.AAD(col.Name), value)
+				if err != nil {
+					return nil, err
+				}
+				row[col.Name] = plaintext
+			}
+			if col.Index != "" {
+				delete(row, col.Name+"_bidx")
+			}
+		}
+		delete(row, "pii_key_id")
+	}
+	return json.MarshalIndent(rows, "", "    ")
+}
+
+// files selects the storage keys of the uploads of the user $1.
+const files = `select evidence_key from helpschool.teacher_affiliations where user_id = $1 and evidence_key is not null
+	union all
+	select attachment_key from helpschool.messages where author_id = $1 and attachment_key is not null
+	union all
+	select photo_key from helpschool.school_updates where author_id = $1 and photo_key is not null`
+
+const readme = `Your personal data on helpschool.
+
+Every JSON file holds the rows kept about you in one table, uploads you
+made are in files/. activity.json lists the changes made while you were
+signed in, with the network they were made from.
+`
+
+// Export writes a zip of the personal data of s to w.
+func Export(ctx context.Context, db *pgxpool.Pool, store storage.Store, c *pii.Cipher, s Subject, w io.Writer) error {
+	s, err := resolve(s)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(w)
+	f, err := zw.Create("README.txt")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(f, readme); err != nil {
+		return err
+	}
+	for _, export := range exports {
+		var doc []byte
+		if err := db.QueryRow(metrics.WithQueryName(ctx, "export_personal_data"),
+			`with subject as (select $1::uuid as user_id, $2::text as email, $3::text as email_bidx)
+			select jsonb_pretty(coalesce(jsonb_agg(to_jsonb(t)),'[]'::jsonb)) from (`+export.sql+`) as t`,
+			s.args(c)...).Scan(&doc); err != nil {
+			return err
+		}
+		if export.table != nil {
+			if doc, err = decrypt(ctx, c, *export.table, doc); err != nil {
+				return err
+			}
+		}
+		f, err := zw.Create(export.file)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(doc); err != nil {
+			return err
+		}
+	}
+
+	if s.UserId != "" {
+		var keys []string
+		rows, err := db.Query(metrics.WithQueryName(ctx, "list_personal_files"), files, s.UserId)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var key string
+			if err := rows.Scan(&key); err != nil {
+				rows.Close()
+				return err
+			}
+			keys = append(keys, key)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := copyFile(ctx, store, zw, key); err != nil {
+				return err
+			}
+		}
+	}
+	return zw.Close()
+}
+
+func copyFile(ctx context.Context, store storage.Store, zw *zip.Writer, key string) error {
+	src, err := store.Open(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := zw.Create(path.Join("files", key))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// purgeTeacherRequests clears what identifies the teacher of a request,
+// the district, place and zip code are kept.
+const purgeTeacherRequests = `update helpschool.teacher_requests set teacher_name = '', teacher_phone = null,
+	teacher_email = null, address = null, photo_link = null, teacher_phone_bidx = null, teacher_email_bidx = null,
+	pii_purged_date = now()`
+
+// erase pseudonymizes or removes the personal data of a subject, the user
+// $1 and the email $2 with blind index $3, giving guest pledges the
+// pseudonym $4. Pledges keep
+// their school, supply, quantity and dates so that totals do not change,
+// and the guest pledges of one donor still count as one donor.
+const erase = `with users as (
+		update helpschool.users set user_email = null, user_name = null, display_name = null, handle = null,
+			public_profile = false, extra_info = null, notification_prefs = '{}'::jsonb, issuer = 'erased',
+			subject = id::text, erased_date = now(), modified_date = now()
+		where id = $1::uuid returning 1
+	), pledges as (
+		update helpschool.users_donations set anonymous = true, tracking_url = null, extra_info = null,
+			guest_email = case when guest_email is not null then $4::text end, modified_date = now()
+		where user_id = $1::uuid or (user_id is null and lower(guest_email) = $2::text) returning 1
+	), badges as (
+		delete from helpschool.user_badges where user_id = $1::uuid returning 1
+	), reads as (
+		delete from helpschool.message_reads where user_id = $1::uuid returning 1
+	), affiliations as (
+		update helpschool.teacher_affiliations set school_email = null, evidence_key = null, review_note = null,
+			code_hash = null, modified_date = now()
+		where user_id = $1::uuid returning 1
+	), threads as (
+		update helpschool.message_threads set subject = '[erased]' where donor_id = $1::uuid returning 1
+	), messages as (
+		update helpschool.messages set body = '[erased]', attachment_key = null, modified_date = now()
+		where author_id = $1::uuid returning 1
+	), requests as (
+		` + purgeTeacherRequests + ` where ` + teacherRequestsOf + ` returning 1
+	)
+	select (select count(*) from users),(select count(*) from pledges),(select count(*) from requests)`
+
+// Erase removes the personal data of s, deleting its uploads but for the
+// photos posted on school profiles, which belong to the school.
+func Erase(ctx context.Context, db *pgxpool.Pool, store storage.Store, c *pii.Cipher, s Subject) error {
+	s, err := resolve(s)
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var keys []string
+	if s.UserId != "" {
+		if err := tx.QueryRow(metrics.WithQueryName(ctx, "list_erased_files"),
+			`select coalesce(array_agg(k),'{}') from (
+				select evidence_key as k from helpschool.teacher_affiliations where user_id = $1 and evidence_key is not null
+				union all
+				select attachment_key from helpschool.messages where author_id = $1 and attachment_key is not null) as f`,
+			s.UserId).Scan(&keys); err != nil {
+			return err
+		}
+	}
+	var users, pledges, requests int
+	if err := tx.QueryRow(metrics.WithQueryName(ctx, "erase_personal_data"), erase,
+		append(s.args(c), "erased-"+uuid.New().String()+"@invalid")...).Scan(&users, &pledges, &requests); err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "erased personal data", "users", users, "pledges", pledges, "teacher_requests", requests)
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := store.Delete(ctx, key); err != nil {
+			slog.ErrorContext(ctx, "delete erased file failed", "key", key, "err", err)
+		}
+	}
+	return nil
+}
+
+// Log records a handled request, by handledBy when an admin acted for the
+// subject. Emails are kept hashed.
+func Log(ctx context.Context, db *pgxpool.Pool, s Subject, kind, handledBy, note string) error {
+	var userId, emailHash, admin interface{}
+	if s.UserId != "" {
+		userId = s.UserId
+	}
+	if email := strings.ToLower(strings.TrimSpace(s.Email)); email != "" {
+		sum := sha256.Sum256([]byte(email))
+		emailHash = hex.EncodeToString(sum[:])
+	}
+	if handledBy != "" {
+		admin = handledBy
+	}
+	_, err := db.Exec(metrics.WithQueryName(ctx, "create_privacy_request"),
+		`INSERT INTO helpschool.privacy_requests( kind,user_id,email_hash,handled_by,note)
+			VALUES ( $1, $2, $3, $4, nullif($5,''))`, kind, userId, emailHash, admin, note)
+	return err
+}
+
+// Purge clears the personal data of the teacher requests older than
+// retention.
+func Purge(ctx context.Context, db *pgxpool.Pool, retention time.Duration) (int64, error) {
+	tag, err := db.Exec(metrics.WithQueryName(ctx, "purge_teacher_requests"),
+		purgeTeacherRequests+` where pii_purged_date is null and created_date < $1`, time.Now().Add(-retention))
+	return tag.RowsAffected(), err
+}
+
+// Run purges old teacher requests every interval until ctx is done.
+func Run(ctx context.Context, db *pgxpool.Pool, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if n, err := Purge(ctx, db, retention); err != nil {
+			slog.ErrorContext(ctx, "purge teacher requests failed", "err", err)
+		} else if n > 0 {
+			slog.InfoContext(ctx, "purged teacher requests", "count", n)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package request
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// AffiliateRulesRequest adds a rule or, with only some fields, changes one.
+// An empty Template removes it.
+type AffiliateRulesRequest struct {
+	CountryId string            `json:"country_id"`
+	Domain    string            `json:"domain"`
+	Params    map[string]string `json:"params"`
+	Template  *string           `json:"template"`
+	Enabled   *bool             `json:"enabled"`
+}
+
+func (a *AffiliateRulesRequest) Bind(r *http.Request) error {
+	a.Domain = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(a.Domain)), "www.")
+	if a.Template != nil && *a.Template != "" && !strings.Contains(*a.Template, "{url}") {
+		return errors.New("template must contain {url}")
+	}
+	return nil
+}
+
+// SchoolAffiliateLinksRequest turns affiliate links off or on for a school.
+type SchoolAffiliateLinksRequest struct {
+	Disabled bool `json:"disabled"`
+}
+
+func (a *SchoolAffiliateLinksRequest) Bind(r *http.Request) error {
+	return nil
+}
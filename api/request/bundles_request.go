@@ -0,0 +1,41 @@
+package request
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// BundlesRequest defines a bundle of catalog items, with the quantity of
+// each in one bundle.
+type BundlesRequest struct {
+	Title       string               `json:"title"`
+	Description string               `json:"description"`
+	Items       []BundleItemsRequest `json:"items"`
+}
+
+type BundleItemsRequest struct {
+	ItemId   string `json:"item_id"`
+	Quantity int    `json:"quantity"`
+}
+
+func (a *BundlesRequest) Bind(r *http.Request) error {
+	if a.Title == "" {
+		return errors.New("empty title")
+	}
+	if len(a.Items) == 0 {
+		return errors.New("a bundle needs items")
+	}
+	seen := map[string]bool{}
+	for _, item := range a.Items {
+		id := strings.ToLower(item.ItemId)
+		if seen[id] {
+			return errors.New("an item is listed twice")
+		}
+		seen[id] = true
+		if item.Quantity <= 0 {
+			return errors.New("quantity must be positive")
+		}
+	}
+	return nil
+}
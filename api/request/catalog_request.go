@@ -0,0 +1,65 @@
+package request
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+)
+
+var slugPattern = regexp.MustCompile(`^[a-z0-9-]{1,64}$`)
+
+// variantAttributes are the attributes variants of an item differ in.
+var variantAttributes = map[string]bool{"size": true, "grade": true, "language": true}
+
+// CategoriesRequest adds a category, below ParentId when given.
+type CategoriesRequest struct {
+	ParentId string `json:"parent_id"`
+	Slug     string `json:"slug"`
+	Name     string `json:"name"`
+}
+
+func (a *CategoriesRequest) Bind(r *http.Request) error {
+	if !slugPattern.MatchString(a.Slug) {
+		return errors.New("slug must be 1 to 64 lower case letters, digits or -")
+	}
+	if a.Name == "" {
+		return errors.New("empty name")
+	}
+	return nil
+}
+
+// CatalogItemsRequest adds a canonical item, or with ParentItemId a variant
+// of one. UnitId defaults to piece and PackSize to 1.
+type CatalogItemsRequest struct {
+	ParentItemId string            `json:"parent_item_id"`
+	CategoryId   string            `json:"category_id"`
+	UnitId       string            `json:"unit_id"`
+	PackSize     int               `json:"pack_size"`
+	Title        string            `json:"title"`
+	Description  string            `json:"description"`
+	Variant      map[string]string `json:"variant"`
+}
+
+func (a *CatalogItemsRequest) Bind(r *http.Request) error {
+	if a.Title == "" {
+		return errors.New("empty title")
+	}
+	if a.UnitId == "" {
+		a.UnitId = "piece"
+	}
+	if a.PackSize == 0 {
+		a.PackSize = 1
+	}
+	if a.PackSize < 0 {
+		return errors.New("pack_size must be positive")
+	}
+	for attribute := range a.Variant {
+		if !variantAttributes[attribute] {
+			return errors.New("variant attributes are size, grade and language")
+		}
+	}
+	if len(a.Variant) > 0 && a.ParentItemId == "" {
+		return errors.New("a variant needs its parent_item_id")
+	}
+	return nil
+}
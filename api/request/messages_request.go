@@ -0,0 +1,28 @@
+package request
+
+import "net/http"
+
+// MessageThreadsRequest starts a thread with its first message. A donor
+// asks a school about SchoolId and optionally one of its needs, SupplyId.
+// With DonationId the thread is about a confirmed donation, started by its
+// donor or, to say thank you, by a teacher of the school.
+type MessageThreadsRequest struct {
+	SchoolId   string `json:"school_id"`
+	SupplyId   string `json:"supply_id"`
+	DonationId string `json:"donation_id"`
+	Subject    string `json:"subject"`
+	Body       string `json:"body"`
+}
+
+func (a *MessageThreadsRequest) Bind(r *http.Request) error {
+	return nil
+}
+
+// MessageModerationRequest approves (visible) or takes down (removed) a message.
+type MessageModerationRequest struct {
+	Status string `json:"status"`
+}
+
+func (a *MessageModerationRequest) Bind(r *http.Request) error {
+	return nil
+}
@@ -0,0 +1,29 @@
+package request
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// PrivacyRequestsRequest is an admin acting on a data subject's request,
+// the subject being an account, an email or both.
+type PrivacyRequestsRequest struct {
+	UserId string `json:"user_id"`
+	Email  string `json:"email"`
+	Note   string `json:"note"`
+}
+
+func (a *PrivacyRequestsRequest) Bind(r *http.Request) error {
+	a.Email = strings.TrimSpace(a.Email)
+	if a.UserId == "" && a.Email == "" {
+		return errors.New("user_id or email is required")
+	}
+	if a.Email != "" && !strings.Contains(a.Email, "@") {
+		return errors.New("invalid email")
+	}
+	if a.Note == "" {
+		return errors.New("note the request being handled")
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package request
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+)
+
+var levelPattern = regexp.MustCompile(`^[a-z_]+$`)
+
+// RegionsRequest adds a region under ParentId, e.g. a block of a district.
+// Level names the kind of region in lower case: block, taluk, municipality.
+type RegionsRequest struct {
+	ParentId string `json:"parent_id"`
+	Level    string `json:"level"`
+	Name     string `json:"name"`
+	GovtId   string `json:"govt_id"`
+}
+
+func (a *RegionsRequest) Bind(r *http.Request) error {
+	if a.Name == "" {
+		return errors.New("empty name")
+	}
+	if !levelPattern.MatchString(a.Level) {
+		return errors.New("level must be lower case letters, like block or taluk")
+	}
+	return nil
+}
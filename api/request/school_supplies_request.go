@@ -1,15 +1,78 @@
 package request
 
-import "net/http"
+import (
+	"errors"
+	"net/http"
+	"time"
+)
 
+// SchoolSuppliesRequest posts a need for Quantity of a supply, or with
+// BundleId instead for Quantity bundles. The need expires after NeededBy,
+// a date like 2024-06-30, when given.
 type SchoolSuppliesRequest struct {
 	SchoolId       string `json:"school_id"`
 	SupplyId       string `json:"supply_id"`
+	BundleId       string `json:"bundle_id"`
 	Quantity       string `json:"quantity"`
 	FulfilledCount string `json:"fulfilled_count"`
 	ExtraInfo      string `json:"extra_info"`
+	NeededBy       string `json:"needed_by"`
 }
 
 func (a *SchoolSuppliesRequest) Bind(r *http.Request) error {
+	return checkNeededBy(a.NeededBy)
+}
+
+// NeedRenewalsRequest re-opens an expired or closed need, until NeededBy
+// or, without it, with no deadline.
+type NeedRenewalsRequest struct {
+	NeededBy string `json:"needed_by"`
+}
+
+func (a *NeedRenewalsRequest) Bind(r *http.Request) error {
+	return checkNeededBy(a.NeededBy)
+}
+
+func checkNeededBy(neededBy string) error {
+	if neededBy == "" {
+		return nil
+	}
+	date, err := time.Parse("2006-01-02", neededBy)
+	if err != nil {
+		return errors.New("needed_by must be a date like 2024-06-30")
+	}
+	if date.Before(time.Now().Truncate(24 * time.Hour)) {
+		return errors.New("needed_by is in the past")
+	}
+	return nil
+}
+
+// NeedRecurrencesRequest re-opens a need for Quantity of a supply every
+// year on OpenDay of OpenMonth, needed within NeededWithinDays when given.
+type NeedRecurrencesRequest struct {
+	SupplyId         string `json:"supply_id"`
+	Quantity         int    `json:"quantity"`
+	ExtraInfo        string `json:"extra_info"`
+	OpenMonth        int    `json:"open_month"`
+	OpenDay          int    `json:"open_day"`
+	NeededWithinDays *int   `json:"needed_within_days"`
+}
+
+func (a *NeedRecurrencesRequest) Bind(r *http.Request) error {
+	if a.Quantity <= 0 {
+		return errors.New("quantity must be positive")
+	}
+	if a.OpenMonth < 1 || a.OpenMonth > 12 {
+		return errors.New("open_month must be 1 to 12")
+	}
+	if a.OpenDay == 0 {
+		a.OpenDay = 1
+	}
+	if a.OpenDay < 1 || a.OpenDay > 28 {
+		return errors.New("open_day must be 1 to 28")
+	}
+	if a.NeededWithinDays != nil && *a.NeededWithinDays <= 0 {
+		return errors.New("needed_within_days must be positive")
+	}
 	return nil
 }
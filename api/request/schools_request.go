@@ -9,6 +9,13 @@ type SchoolsRequest struct {
 	DistrictId 	string `json:"district_id"`
 	GovtId		string `json:"govt_id"`
 	ExtraInfo   string `json:"extra_info"`
+	// optional, a region below the district such as a block, the district
+	// is then the one it is in
+	RegionId	string `json:"region_id"`
+	// optional, exact coordinates win over the centroid of the postal code
+	PostalCode	string   `json:"postal_code"`
+	Latitude	*float64 `json:"latitude"`
+	Longitude	*float64 `json:"longitude"`
 
 }
 
@@ -1,15 +1,34 @@
 package request
 
-import "net/http"
+import (
+	"errors"
+	"net/http"
+)
 
 type SuppliesRequest struct {
-	Title       string `json:"title"`
-	CountryId   string `json:"country_id"`
-	Url         string `json:"url"`
-	Description string `json:"description"`
-	ExtraInfo   string `json:"extra_info"`
+	Title       string   `json:"title"`
+	CountryId   string   `json:"country_id"`
+	Url         string   `json:"url"`
+	Description string   `json:"description"`
+	ExtraInfo   string   `json:"extra_info"`
+	Price       *float64 `json:"price"`
+	// the canonical item this is a listing of, without it a new item is
+	// made from the title and description in CategoryId, counted in UnitId
+	ItemId     string `json:"item_id"`
+	CategoryId string `json:"category_id"`
+	UnitId     string `json:"unit_id"`
 }
 
+// Bind checks the request. Url becomes the first offer of the supply, so it
+// is checked like the urls of offers.
 func (a *SuppliesRequest) Bind(r *http.Request) error {
+	if a.Url != "" {
+		if _, err := ParseVendorURL(a.Url); err != nil {
+			return err
+		}
+	}
+	if a.Price != nil && *a.Price < 0 {
+		return errors.New("price must not be negative")
+	}
 	return nil
 }
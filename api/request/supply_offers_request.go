@@ -0,0 +1,70 @@
+package request
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var regionPattern = regexp.MustCompile(`^[0-9A-Z]{1,10}$`)
+
+var errURL = errors.New("url must be an http or https link")
+
+// ParseVendorURL parses the link to a vendor, which donors are sent to and
+// so must be an http or https link with a host.
+func ParseVendorURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errURL
+	}
+	return u, nil
+}
+
+// SupplyOffersRequest adds an offer or, with only some fields, updates
+// one. Vendor defaults to the host of Url, DeliveryRegions are postal code
+// prefixes and left empty for the whole country.
+type SupplyOffersRequest struct {
+	Vendor          *string  `json:"vendor"`
+	Url             *string  `json:"url"`
+	Price           *float64 `json:"price"`
+	Currency        *string  `json:"currency"`
+	ShippingCost    *float64 `json:"shipping_cost"`
+	ShippingDays    *int     `json:"shipping_days"`
+	DeliveryRegions []string `json:"delivery_regions"`
+	InStock         *bool    `json:"in_stock"`
+}
+
+func (a *SupplyOffersRequest) Bind(r *http.Request) error {
+	if a.Url != nil {
+		u, err := ParseVendorURL(*a.Url)
+		if err != nil {
+			return err
+		}
+		if a.Vendor == nil || *a.Vendor == "" {
+			vendor := strings.TrimPrefix(u.Hostname(), "www.")
+			a.Vendor = &vendor
+		}
+	}
+	if (a.Price != nil && *a.Price < 0) || (a.ShippingCost != nil && *a.ShippingCost < 0) {
+		return errors.New("price must not be negative")
+	}
+	if a.ShippingDays != nil && *a.ShippingDays < 0 {
+		return errors.New("shipping_days must not be negative")
+	}
+	if a.Currency != nil {
+		if len(*a.Currency) != 3 {
+			return errors.New("currency must be a 3 letter code")
+		}
+		currency := strings.ToUpper(*a.Currency)
+		a.Currency = &currency
+	}
+	for i, region := range a.DeliveryRegions {
+		a.DeliveryRegions[i] = strings.ToUpper(strings.ReplaceAll(region, " ", ""))
+		if !regionPattern.MatchString(a.DeliveryRegions[i]) {
+			return errors.New("delivery_regions must be postal code prefixes")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package request
+
+import "net/http"
+
+type TeacherAffiliationsRequest struct {
+	SchoolId    string `json:"school_id"`
+	Method      string `json:"method"`
+	SchoolEmail string `json:"school_email"`
+}
+
+func (a *TeacherAffiliationsRequest) Bind(r *http.Request) error {
+	return nil
+}
+
+type AffiliationCodeRequest struct {
+	Code string `json:"code"`
+}
+
+func (a *AffiliationCodeRequest) Bind(r *http.Request) error {
+	return nil
+}
+
+type AffiliationReviewRequest struct {
+	Decision string `json:"decision"` // approve or reject
+	Note     string `json:"note"`
+}
+
+func (a *AffiliationReviewRequest) Bind(r *http.Request) error {
+	return nil
+}
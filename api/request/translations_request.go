@@ -0,0 +1,24 @@
+package request
+
+import (
+	"errors"
+	"golang.org/x/text/language"
+	"net/http"
+)
+
+// TranslationsRequest maps language tags like "ta" or "hi-IN" to the
+// translated text, an empty text removes the translation.
+type TranslationsRequest map[string]string
+
+func (a *TranslationsRequest) Bind(r *http.Request) error {
+	canonical := TranslationsRequest{}
+	for lang, text := range *a {
+		tag, err := language.Parse(lang)
+		if err != nil {
+			return errors.New("invalid language")
+		}
+		canonical[tag.String()] = text
+	}
+	*a = canonical
+	return nil
+}
@@ -4,18 +4,45 @@ import (
 	"net/http"
 )
 
+// UserDonationsRequest pledges a donation, the donor is the authenticated
+// caller. With BundleId instead of SupplyId Quantity bundles are pledged.
+// Status, TrackingUrl and Anonymous are used to update an existing pledge.
 type UserDonationsRequest struct {
-	UserEmail 			string `json:"user_email"`
-	UserId    			string `json:"user_id"`
-	UserName 			string `json:"user_name"`
-	SchoolId       		string `json:"school_id"`
-	SupplyId       		string `json:"supply_id"`
-	Quantity       		string `json:"quantity"`
-	Status		   		string `json:"status"`
-	TrackingUrl		   	string `json:"tracking_url"`
-	ExtraInfo      		string `json:"extra_info"`
+	SchoolId    string `json:"school_id"`
+	SupplyId    string `json:"supply_id"`
+	BundleId    string `json:"bundle_id"`
+	Quantity    int    `json:"quantity"`
+	Status      string `json:"status"`
+	TrackingUrl string `json:"tracking_url"`
+	ExtraInfo   string `json:"extra_info"`
+	Anonymous   *bool  `json:"anonymous"`
 }
 
 func (a *UserDonationsRequest) Bind(r *http.Request) error {
 	return nil
 }
+
+// GuestDonationsRequest pledges a donation without an account, a link to
+// confirm and manage the pledge is sent to Email.
+type GuestDonationsRequest struct {
+	Email     string `json:"email"`
+	SchoolId  string `json:"school_id"`
+	SupplyId  string `json:"supply_id"`
+	Quantity  int    `json:"quantity"`
+	ExtraInfo string `json:"extra_info"`
+	Anonymous bool   `json:"anonymous"`
+}
+
+func (a *GuestDonationsRequest) Bind(r *http.Request) error {
+	return nil
+}
+
+// ClaimDonationsRequest asks for a link, sent to Email, that moves the guest
+// pledges made with that address into the caller's account.
+type ClaimDonationsRequest struct {
+	Email string `json:"email"`
+}
+
+func (a *ClaimDonationsRequest) Bind(r *http.Request) error {
+	return nil
+}
@@ -0,0 +1,16 @@
+package request
+
+import "net/http"
+
+// UsersRequest is a partial profile update, fields left out are not changed.
+type UsersRequest struct {
+	DisplayName       *string         `json:"display_name"`
+	PreferredLanguage *string         `json:"preferred_language"`
+	NotificationPrefs map[string]bool `json:"notification_prefs"`
+	Handle            *string         `json:"handle"`
+	PublicProfile     *bool           `json:"public_profile"`
+}
+
+func (a *UsersRequest) Bind(r *http.Request) error {
+	return nil
+}
@@ -0,0 +1,24 @@
+package response
+
+import (
+	"github.com/venkata6/helpschool/api/dto"
+	"net/http"
+)
+
+type AffiliateRulesResponse struct {
+	*dto.AffiliateRules
+}
+
+func (rd AffiliateRulesResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+type AffiliateReportsResponse struct {
+	*dto.AffiliateReports
+}
+
+func (rd AffiliateReportsResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
@@ -0,0 +1,24 @@
+package response
+
+import (
+	"github.com/venkata6/helpschool/api/dto"
+	"net/http"
+)
+
+type AuditEventsResponse struct {
+	*dto.AuditEvents
+}
+
+func (rd AuditEventsResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+type AuditChainsResponse struct {
+	*dto.AuditChains
+}
+
+func (rd AuditChainsResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
@@ -0,0 +1,24 @@
+package response
+
+import (
+	"github.com/venkata6/helpschool/api/dto"
+	"net/http"
+)
+
+type BundlesResponse struct {
+	*dto.Bundles
+}
+
+func (rd BundlesResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+type SchoolBundlesResponse struct {
+	*dto.SchoolBundles
+}
+
+func (rd SchoolBundlesResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
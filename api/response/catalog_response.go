@@ -0,0 +1,33 @@
+package response
+
+import (
+	"github.com/venkata6/helpschool/api/dto"
+	"net/http"
+)
+
+type CategoriesResponse struct {
+	*dto.Categories
+}
+
+func (rd CategoriesResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+type UnitsResponse struct {
+	*dto.Units
+}
+
+func (rd UnitsResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+type CatalogItemsResponse struct {
+	*dto.CatalogItems
+}
+
+func (rd CatalogItemsResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
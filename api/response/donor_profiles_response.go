@@ -0,0 +1,15 @@
+package response
+
+import (
+	"github.com/venkata6/helpschool/api/dto"
+	"net/http"
+)
+
+type DonorProfilesResponse struct {
+	*dto.DonorProfiles
+}
+
+func (rd DonorProfilesResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
@@ -0,0 +1,15 @@
+package response
+
+import (
+	"github.com/venkata6/helpschool/api/dto"
+	"net/http"
+)
+
+type MapNeedsResponse struct {
+	*dto.MapNeeds
+}
+
+func (rd MapNeedsResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
@@ -0,0 +1,24 @@
+package response
+
+import (
+	"github.com/venkata6/helpschool/api/dto"
+	"net/http"
+)
+
+type MessageThreadsResponse struct {
+	*dto.MessageThreads
+}
+
+func (rd MessageThreadsResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+type MessagesResponse struct {
+	*dto.Messages
+}
+
+func (rd MessagesResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
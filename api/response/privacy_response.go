@@ -0,0 +1,24 @@
+package response
+
+import (
+	"github.com/venkata6/helpschool/api/dto"
+	"net/http"
+)
+
+type PrivacyRequestsResponse struct {
+	*dto.PrivacyRequests
+}
+
+func (rd PrivacyRequestsResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
+
+type PrivacySubjectsResponse struct {
+	*dto.PrivacySubjects
+}
+
+func (rd PrivacySubjectsResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
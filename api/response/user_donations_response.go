@@ -13,3 +13,12 @@ func (rd UserDonationsResponse) Render(w http.ResponseWriter, r *http.Request) e
 	// Pre-processing before a response is marshalled and sent across the wire
 	return nil
 }
+
+type DonorResponse struct {
+	*dto.Donor
+}
+
+func (rd DonorResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	// Pre-processing before a response is marshalled and sent across the wire
+	return nil
+}
@@ -0,0 +1,355 @@
+package service
+
+import (
+	"errors"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/affiliate"
+	"github.com/venkata6/helpschool/api/dto"
+	"github.com/venkata6/helpschool/api/logging"
+	"github.com/venkata6/helpschool/api/metrics"
+	"github.com/venkata6/helpschool/api/request"
+	"github.com/venkata6/helpschool/api/response"
+	"github.com/venkata6/helpschool/api/util"
+	"net/http"
+	"time"
+)
+
+// ClickCookie remembers the last offer a browser clicked through to,
+// pledges made within clickWindow are attributed to the click.
+const (
+	ClickCookie = "helpschool_click"
+	clickWindow = 7 * 24 * time.Hour
+)
+
+// attributedClick selects the click in clickParam when it was made within
+// a week on an offer for the same item as the supply in supplyParam.
+func attributedClick(clickParam, supplyParam string) string {
+	return `(select c.click_id from helpschool.offer_clicks as c
+		inner join helpschool.supply_offers as o on o.offer_id = c.offer_id
+		inner join helpschool.supplies as cs on cs.supply_id = o.supply_id
+		where c.click_id = ` + clickParam + `::uuid and c.created_date > now() - interval '7 days'
+			and cs.item_id = (select item_id from helpschool.supplies where supply_id = ` + supplyParam + `))`
+}
+
+// clickOf returns the click remembered by the request, nil without one.
+func clickOf(r *http.Request) interface{} {
+	cookie, err := r.Cookie(ClickCookie)
+	if err != nil {
+		return nil
+	}
+	clickId, err := uuid.Parse(cookie.Value)
+	if err != nil {
+		return nil
+	}
+	return clickId
+}
+
+type AffiliateService interface {
+	GoToOffer(w http.ResponseWriter, r *http.Request)
+	GetAffiliateRules(w http.ResponseWriter, r *http.Request)
+	CreateAffiliateRules(w http.ResponseWriter, r *http.Request)
+	UpdateAffiliateRules(w http.ResponseWriter, r *http.Request)
+	UpdateSchoolAffiliateLinks(w http.ResponseWriter, r *http.Request)
+	GetAffiliateReports(w http.ResponseWriter, r *http.Request)
+}
+
+type AffiliateServiceInternal struct {
+	db       *pgxpool.Pool
+	rewriter *affiliate.Rewriter
+}
+
+func NewAffiliateService(db *pgxpool.Pool, rewriter *affiliate.Rewriter) AffiliateService {
+	return &AffiliateServiceInternal{db: db, rewriter: rewriter}
+}
+
+// GoToOffer logs a click-through to an offer and redirects to the vendor,
+// through the affiliate rule for it when the link names a school in school
+// that did not opt out.
+func (a *AffiliateServiceInternal) GoToOffer(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	offerId, err := uuid.Parse(chi.URLParam(r, "offerId"))
+	if err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	var schoolId interface{}
+	if v := r.URL.Query().Get("school"); v != "" {
+		if id, err := uuid.Parse(v); err == nil {
+			schoolId = id
+		}
+	}
+
+	var target, countryId string
+	var disabled bool
+	err = a.db.QueryRow(metrics.WithQueryName(ctx, "get_offer_link"),
+		`select o.url,s.country_id::text,
+			coalesce((select affiliate_links_disabled from helpschool.schools where school_id = $2),false)
+		from helpschool.supply_offers as o
+		inner join helpschool.supplies as s on s.supply_id = o.supply_id
+		where o.offer_id = $1`, offerId, schoolId).Scan(&target, &countryId, &disabled)
+	if errors.Is(err, pgx.ErrNoRows) {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	// offers stored before urls were checked are never redirected to
+	if _, err := request.ParseVendorURL(target); err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+
+	// without a school the link may be one of a school that turned affiliate
+	// links off, so only links of schools that did not are rewritten
+	var ruleId interface{}
+	if schoolId != nil && !disabled {
+		if rule, ok := a.rewriter.Find(ctx, countryId, target); ok {
+			target = rule.Apply(target)
+			ruleId = rule.RuleId
+		}
+	}
+	var clickId string
+	if err := a.db.QueryRow(metrics.WithQueryName(ctx, "create_offer_click"),
+		`INSERT INTO helpschool.offer_clicks( offer_id,school_id,rule_id)
+			VALUES ( $1, (select school_id from helpschool.schools where school_id = $2), $3::uuid)
+			returning click_id::text`, offerId, schoolId, ruleId).Scan(&clickId); err != nil {
+		// losing a click must not keep the donor from the vendor
+		logging.FromContext(ctx).Error("log offer click failed", "err", err)
+	} else {
+		http.SetCookie(w, &http.Cookie{
+			Name:     ClickCookie,
+			Value:    clickId,
+			Path:     "/",
+			MaxAge:   int(clickWindow.Seconds()),
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
+
+const selectAffiliateRules = `select rule_id::text,coalesce(country_id::text,''),domain,params,coalesce(template,''),enabled
+	from helpschool.affiliate_rules`
+
+func scanAffiliateRule(row pgx.Row) (*dto.AffiliateRules, error) {
+	rule := &dto.AffiliateRules{}
+	err := row.Scan(&rule.RuleId, &rule.CountryId, &rule.Domain, &rule.Params, &rule.Template, &rule.Enabled)
+	return rule, err
+}
+
+// GetAffiliateRules lists every rule, the disabled ones included.
+func (a *AffiliateServiceInternal) GetAffiliateRules(w http.ResponseWriter, r *http.Request) {
+	list := []render.Renderer{}
+	err := forEachRow(metrics.WithQueryName(r.Context(), "list_all_affiliate_rules"), a.db,
+		selectAffiliateRules+` order by domain, country_id nulls first`, nil,
+		func(rows pgx.Rows) error {
+			rule, err := scanAffiliateRule(rows)
+			if err != nil {
+				return err
+			}
+			list = append(list, response.AffiliateRulesResponse{AffiliateRules: rule})
+			return nil
+		})
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+// CreateAffiliateRules adds the rule for a domain in a country, or in
+// every country without country_id.
+func (a *AffiliateServiceInternal) CreateAffiliateRules(w http.ResponseWriter, r *http.Request) {
+	data := &request.AffiliateRulesRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	if data.Domain == "" {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("empty domain")))
+		return
+	}
+	if data.Params == nil {
+		data.Params = map[string]string{}
+	}
+	if len(data.Params) == 0 && (data.Template == nil || *data.Template == "") {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("a rule needs params or a template")))
+		return
+	}
+	var countryId interface{}
+	if data.CountryId != "" {
+		id, err := uuid.Parse(data.CountryId)
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(errors.New("invalid country_id")))
+			return
+		}
+		countryId = id
+	}
+
+	rule, err := scanAffiliateRule(a.db.QueryRow(metrics.WithQueryName(r.Context(), "create_affiliate_rule"),
+		`INSERT INTO helpschool.affiliate_rules( country_id,domain,params,template,enabled)
+			VALUES ( $1, $2, $3, nullif($4,''), coalesce($5,true))
+			returning rule_id::text,coalesce(country_id::text,''),domain,params,coalesce(template,''),enabled`,
+		countryId, data.Domain, data.Params, data.Template, data.Enabled))
+	if sqlState(err) == uniqueViolation {
+		render.Render(w, r, util.ErrConflict(errors.New("the domain already has a rule in this country")))
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("create affiliate rule failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	a.rewriter.Invalidate()
+	w.WriteHeader(http.StatusCreated)
+	if err := render.Render(w, r, response.AffiliateRulesResponse{AffiliateRules: rule}); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+// UpdateAffiliateRules changes the params, template or enabled of a rule.
+func (a *AffiliateServiceInternal) UpdateAffiliateRules(w http.ResponseWriter, r *http.Request) {
+	ruleId, err := uuid.Parse(chi.URLParam(r, "ruleId"))
+	if err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	data := &request.AffiliateRulesRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	var params interface{}
+	if data.Params != nil {
+		params = data.Params
+	}
+
+	rule, err := scanAffiliateRule(a.db.QueryRow(metrics.WithQueryName(r.Context(), "update_affiliate_rule"),
+		`update helpschool.affiliate_rules set params = coalesce($2,params),
+			template = case when $3::text is null then template else nullif($3,'') end,
+			enabled = coalesce($4,enabled), modified_date = now()
+		where rule_id = $1
+		returning rule_id::text,coalesce(country_id::text,''),domain,params,coalesce(template,''),enabled`,
+		ruleId, params, data.Template, data.Enabled))
+	if errors.Is(err, pgx.ErrNoRows) {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("update affiliate rule failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	a.rewriter.Invalidate()
+	if err := render.Render(w, r, response.AffiliateRulesResponse{AffiliateRules: rule}); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+// UpdateSchoolAffiliateLinks lets the teachers of a school, or moderators,
+// turn affiliate links off for the school's needs.
+func (a *AffiliateServiceInternal) UpdateSchoolAffiliateLinks(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	schoolId, err := uuid.Parse(chi.URLParam(r, "schoolId"))
+	if err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	data := &request.SchoolAffiliateLinksRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	if allowed, err := canManageSchool(r.Context(), a.db, user.UserId, schoolId.String()); err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	} else if !allowed {
+		render.Render(w, r, util.ErrForbidden)
+		return
+	}
+
+	tag, err := a.db.Exec(metrics.WithQueryName(r.Context(), "update_school_affiliate_links"),
+		`update helpschool.schools set affiliate_links_disabled = $2, modified_date = now() where school_id = $1`,
+		schoolId, data.Disabled)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("update school affiliate links failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	render.DefaultResponder(w, r, render.M{"status": "updated", "affiliate_links_disabled": data.Disabled})
+}
+
+// GetAffiliateReports counts clicks and the pledges attributed to them per
+// vendor, for clicks from from (30 days ago by default) through the day
+// to (today by default).
+func (a *AffiliateServiceInternal) GetAffiliateReports(w http.ResponseWriter, r *http.Request) {
+	to := time.Now()
+	from := to.AddDate(0, 0, -30)
+	for _, param := range []struct {
+		name string
+		dst  *time.Time
+		err  error
+	}{
+		{"from", &from, errors.New("from must be a date like 2024-01-31")},
+		{"to", &to, errors.New("to must be a date like 2024-01-31")},
+	} {
+		if v := r.URL.Query().Get(param.name); v != "" {
+			t, err := time.Parse("2006-01-02", v)
+			if err != nil {
+				render.Render(w, r, util.ErrInvalidRequest(param.err))
+				return
+			}
+			*param.dst = t
+		}
+	}
+
+	list := []render.Renderer{}
+	err := forEachRow(metrics.WithQueryName(r.Context(), "report_affiliate_clicks"), a.db,
+		`select o.vendor,count(distinct c.click_id),count(distinct c.click_id) filter (where c.rule_id is not null),
+			count(d.donation_id),count(d.confirmed_date),coalesce(sum(d.quantity),0)
+		from helpschool.offer_clicks as c
+		inner join helpschool.supply_offers as o on o.offer_id = c.offer_id
+		left join helpschool.users_donations as d on d.click_id = c.click_id
+		where c.created_date >= $1 and c.created_date < $2::timestamptz + interval '1 day'
+		group by o.vendor order by 2 desc`, []interface{}{from, to},
+		func(rows pgx.Rows) error {
+			report := &dto.AffiliateReports{}
+			if err := rows.Scan(&report.Domain, &report.Clicks, &report.RewrittenClicks, &report.Pledges,
+				&report.ConfirmedPledges, &report.Quantity); err != nil {
+				return err
+			}
+			if report.Clicks > 0 {
+				report.ConversionRate = float64(report.Pledges) / float64(report.Clicks)
+			}
+			list = append(list, response.AffiliateReportsResponse{AffiliateReports: report})
+			return nil
+		})
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
@@ -0,0 +1,142 @@
+package service
+
+import (
+	"errors"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/dto"
+	"github.com/venkata6/helpschool/api/metrics"
+	"github.com/venkata6/helpschool/api/response"
+	"github.com/venkata6/helpschool/api/util"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type AuditEventsService interface {
+	GetAuditEvents(w http.ResponseWriter, r *http.Request)
+	VerifyAuditEvents(w http.ResponseWriter, r *http.Request)
+}
+
+type AuditEventsServiceInternal struct {
+	db *pgxpool.Pool
+}
+
+func NewAuditEventsService(db *pgxpool.Pool) AuditEventsService {
+	return &AuditEventsServiceInternal{db: db}
+}
+
+// GetAuditEvents lists audit events newest first, filtered by entity,
+// entity_id, action, user_id, request_id and the dates from and to. Pages
+// continue with before, the event_id of the last event of the page.
+func (a *AuditEventsServiceInternal) GetAuditEvents(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var entity, entityId, action, requestId, userId, from, to, before interface{}
+	for param, dst := range map[string]*interface{}{
+		"entity": &entity, "entity_id": &entityId, "action": &action, "request_id": &requestId,
+	} {
+		if v := q.Get(param); v != "" {
+			*dst = v
+		}
+	}
+	if v := q.Get("user_id"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(errors.New("invalid user_id")))
+			return
+		}
+		userId = id
+	}
+	for _, param := range []struct {
+		name string
+		dst  *interface{}
+		err  error
+	}{
+		{"from", &from, errors.New("from must be a date like 2024-01-31")},
+		{"to", &to, errors.New("to must be a date like 2024-01-31")},
+	} {
+		if v := q.Get(param.name); v != "" {
+			t, err := time.Parse("2006-01-02", v)
+			if err != nil {
+				render.Render(w, r, util.ErrInvalidRequest(param.err))
+				return
+			}
+			*param.dst = t
+		}
+	}
+	if v := q.Get("before"); v != "" {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(errors.New("invalid before")))
+			return
+		}
+		before = id
+	}
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			render.Render(w, r, util.ErrInvalidRequest(errors.New("limit must be 1 to 500")))
+			return
+		}
+		limit = n
+	}
+
+	list := []render.Renderer{}
+	err := forEachRow(metrics.WithQueryName(r.Context(), "list_audit_events"), a.db,
+		`select event_id,occurred_at,coalesce(user_id::text,''),coalesce(ip,''),coalesce(request_id,''),coalesce(reason,''),
+			entity,entity_id,action,before,after,coalesce(encode(prev_hash,'hex'),''),coalesce(encode(hash,'hex'),'')
+		from helpschool.audit_events
+		where ($1::text is null or entity = $1) and ($2::text is null or entity_id = $2)
+			and ($3::text is null or action = $3) and ($4::text is null or request_id = $4)
+			and ($5::uuid is null or user_id = $5)
+			and ($6::timestamptz is null or occurred_at >= $6) and ($7::timestamptz is null or occurred_at < $7 + interval '1 day')
+			and ($8::bigint is null or event_id < $8)
+		order by event_id desc limit $9`,
+		[]interface{}{entity, entityId, action, requestId, userId, from, to, before, limit},
+		func(rows pgx.Rows) error {
+			event := &dto.AuditEvents{}
+			if err := rows.Scan(&event.EventId, &event.OccurredAt, &event.UserId, &event.IP, &event.RequestId,
+				&event.Reason, &event.Entity, &event.EntityId, &event.Action, &event.Before, &event.After,
+				&event.PrevHash, &event.Hash); err != nil {
+				return err
+			}
+			list = append(list, response.AuditEventsResponse{AuditEvents: event})
+			return nil
+		})
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+// VerifyAuditEvents recomputes the hash chain of the audit log and reports
+// the first event that was edited, or follows a removed one.
+func (a *AuditEventsServiceInternal) VerifyAuditEvents(w http.ResponseWriter, r *http.Request) {
+	chain := &dto.AuditChains{}
+	err := a.db.QueryRow(metrics.WithQueryName(r.Context(), "verify_audit_events"),
+		`select count(*),min(event_id) filter (where broken),
+			coalesce((select encode(hash,'hex') from helpschool.audit_events
+				where chain_seq is not null order by chain_seq desc limit 1),''),
+			(select count(*) from helpschool.audit_events where hash is null)
+		from (select event_id,
+				prev_hash is distinct from lag(hash) over (order by chain_seq)
+				or hash <> helpschool.audit_event_hash(prev_hash, e) as broken
+			from helpschool.audit_events as e where chain_seq is not null) as c`).
+		Scan(&chain.Events, &chain.BrokenAt, &chain.HeadHash, &chain.Unchained)
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	chain.Intact = chain.BrokenAt == nil
+	if err := render.Render(w, r, response.AuditChainsResponse{AuditChains: chain}); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
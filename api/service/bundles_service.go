@@ -0,0 +1,239 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/dto"
+	"github.com/venkata6/helpschool/api/i18n"
+	"github.com/venkata6/helpschool/api/logging"
+	"github.com/venkata6/helpschool/api/metrics"
+	"github.com/venkata6/helpschool/api/request"
+	"github.com/venkata6/helpschool/api/response"
+	"github.com/venkata6/helpschool/api/util"
+	"net/http"
+)
+
+type BundlesService interface {
+	GetBundles(w http.ResponseWriter, r *http.Request)
+	CreateBundles(w http.ResponseWriter, r *http.Request)
+	GetSchoolBundles(w http.ResponseWriter, r *http.Request)
+}
+
+type BundlesServiceInternal struct {
+	db *pgxpool.Pool
+}
+
+func NewBundlesService(db *pgxpool.Pool) BundlesService {
+	return &BundlesServiceInternal{db: db}
+}
+
+var (
+	errUnknownBundle  = errors.New("unknown bundle_id")
+	errUnlistedBundle = errors.New("every item of the bundle needs a supply listing it")
+)
+
+// bundleListing selects the supply a school's need for the item bi.item_id
+// of a bundle is posted for: the listing with the item's id, which every
+// item created with its supply has, or else the oldest one.
+const bundleListing = `(select s.supply_id from helpschool.supplies as s where s.item_id = bi.item_id
+	order by s.supply_id = bi.item_id desc, s.created_date limit 1)`
+
+// expandSchoolBundle posts or updates the need of a school for quantity
+// bundles and the component needs it expands into, per-bundle quantity
+// times quantity of every item of the bundle. It returns errUnknownBundle
+// and errUnlistedBundle for bundles that cannot be posted.
+func expandSchoolBundle(ctx context.Context, db *pgxpool.Pool, schoolId, bundleId uuid.UUID, quantity int, extraInfo string) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var items, listed int
+	if err := tx.QueryRow(metrics.WithQueryName(ctx, "count_bundle_listings"),
+		`select count(*),count(`+bundleListing+`) from helpschool.bundle_items as bi where bi.bundle_id = $1`,
+		bundleId).Scan(&items, &listed); err != nil {
+		return err
+	}
+	if items == 0 {
+		return errUnknownBundle
+	}
+	if listed < items {
+		return errUnlistedBundle
+	}
+
+	if _, err := tx.Exec(metrics.WithQueryName(ctx, "upsert_school_bundle"),
+		`INSERT INTO helpschool.school_bundles( school_id,bundle_id,quantity,extra_info)
+			VALUES ( $1, $2, $3, nullif($4,'')::jsonb)
+			on conflict (school_id,bundle_id) do update
+				set quantity = excluded.quantity, extra_info = excluded.extra_info, modified_date = now()`,
+		schoolId, bundleId, quantity, extraInfo); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(metrics.WithQueryName(ctx, "upsert_bundle_school_supplies"),
+		`INSERT INTO helpschool.school_supplies( school_id,supply_id,quantity,fulfilled_count,item_id,bundle_id)
+			select $1, `+bundleListing+`, $3 * bi.quantity, 0, bi.item_id, bi.bundle_id
+			from helpschool.bundle_items as bi where bi.bundle_id = $2
+			on conflict (school_id,bundle_id,supply_id) where bundle_id is not null do update
+				set quantity = excluded.quantity, modified_date = now()`,
+		schoolId, bundleId, quantity); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// GetBundles lists the bundles with their items, titles in the language of
+// the request.
+func (a *BundlesServiceInternal) GetBundles(w http.ResponseWriter, r *http.Request) {
+	locale := i18n.FromContext(r.Context())
+	var bundles []*dto.Bundles
+	err := forEachRow(metrics.WithQueryName(r.Context(), "list_bundles"), a.db,
+		`select b.bundle_id::text,helpschool.localized(b.title_translations,b.title,$1),coalesce(b.description,''),
+			i.item_id::text,helpschool.localized(i.title_translations,i.title,$1),i.unit_id,bi.quantity
+		from helpschool.bundles as b
+		inner join helpschool.bundle_items as bi on bi.bundle_id = b.bundle_id
+		inner join helpschool.catalog_items as i on i.item_id = bi.item_id
+		order by helpschool.localized(b.title_translations,b.title,$1) collate `+locale.Collation()+`, b.bundle_id,
+			helpschool.localized(i.title_translations,i.title,$1) collate `+locale.Collation(),
+		[]interface{}{locale.Chain},
+		func(rows pgx.Rows) error {
+			bundle := &dto.Bundles{}
+			item := dto.BundleItems{}
+			if err := rows.Scan(&bundle.BundleId, &bundle.Title, &bundle.Description,
+				&item.ItemId, &item.Title, &item.UnitId, &item.Quantity); err != nil {
+				return err
+			}
+			if n := len(bundles); n > 0 && bundles[n-1].BundleId == bundle.BundleId {
+				bundle = bundles[n-1]
+			} else {
+				bundles = append(bundles, bundle)
+			}
+			bundle.Items = append(bundle.Items, item)
+			return nil
+		})
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	list := []render.Renderer{}
+	for _, bundle := range bundles {
+		list = append(list, response.BundlesResponse{Bundles: bundle})
+	}
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+// CreateBundles defines a bundle of catalog items.
+func (a *BundlesServiceInternal) CreateBundles(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	data := &request.BundlesRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	itemIds := make([]string, len(data.Items))
+	quantities := make([]int32, len(data.Items))
+	for i, item := range data.Items {
+		id, err := uuid.Parse(item.ItemId)
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(errors.New("invalid item_id")))
+			return
+		}
+		itemIds[i] = id.String()
+		quantities[i] = int32(item.Quantity)
+	}
+
+	var bundleId string
+	err := a.db.QueryRow(metrics.WithQueryName(r.Context(), "create_bundle"),
+		`with b as (INSERT INTO helpschool.bundles( title,description,created_by)
+				VALUES ( $1, nullif($2,''), $3) returning bundle_id),
+			i as (INSERT INTO helpschool.bundle_items( bundle_id,item_id,quantity)
+				select b.bundle_id, t.item_id, t.quantity from b, unnest($4::uuid[], $5::int[]) as t(item_id, quantity))
+			select bundle_id::text from b`,
+		data.Title, data.Description, user.UserId, itemIds, quantities).Scan(&bundleId)
+	if sqlState(err) == foreignKeyViolation {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("unknown item_id")))
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("create bundle failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	render.DefaultResponder(w, r, render.M{"status": "created", "bundle_id": bundleId})
+}
+
+// GetSchoolBundles lists the bundle needs of a school with their progress,
+// a bundle being only as far as its least pledged or delivered component.
+func (a *BundlesServiceInternal) GetSchoolBundles(w http.ResponseWriter, r *http.Request) {
+	schoolId, err := uuid.Parse(chi.URLParam(r, "schoolId"))
+	if err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+
+	chain := i18n.FromContext(r.Context()).Chain
+	var bundles []*dto.SchoolBundles
+	err = forEachRow(metrics.WithQueryName(r.Context(), "list_school_bundles"), a.db,
+		`select sb.school_id::text,sb.bundle_id::text,helpschool.localized(b.title_translations,b.title,$2),sb.quantity,
+			sb.created_date,ss.supply_id::text,ss.item_id::text,helpschool.localized(su.title_translations,su.title,$2),
+			bi.quantity,ss.quantity,coalesce(ss.fulfilled_count,0),
+			(select coalesce(sum(d.quantity),0) from helpschool.users_donations as d
+				where d.school_id = ss.school_id and d.supply_id = ss.supply_id and d.bundle_id = ss.bundle_id
+					and d.confirmed_date is not null and d.status <> $3)
+		from helpschool.school_bundles as sb
+		inner join helpschool.bundles as b on b.bundle_id = sb.bundle_id
+		inner join helpschool.school_supplies as ss on ss.school_id = sb.school_id and ss.bundle_id = sb.bundle_id
+		inner join helpschool.bundle_items as bi on bi.bundle_id = ss.bundle_id and bi.item_id = ss.item_id
+		inner join helpschool.supplies as su on su.supply_id = ss.supply_id
+		where sb.school_id = $1 and sb.quantity > 0
+		order by sb.created_date desc, sb.bundle_id`, []interface{}{schoolId, chain, dto.DonationCancelled},
+		func(rows pgx.Rows) error {
+			bundle := &dto.SchoolBundles{}
+			component := dto.BundleComponents{}
+			if err := rows.Scan(&bundle.SchoolId, &bundle.BundleId, &bundle.Title, &bundle.Quantity, &bundle.PostedDate,
+				&component.SupplyId, &component.ItemId, &component.Title, &component.PerBundle, &component.Quantity,
+				&component.FulfilledCount, &component.PledgedCount); err != nil {
+				return err
+			}
+			if n := len(bundles); n > 0 && bundles[n-1].BundleId == bundle.BundleId {
+				bundle = bundles[n-1]
+			} else {
+				bundle.PledgedCount, bundle.FulfilledCount = bundle.Quantity, bundle.Quantity
+				bundles = append(bundles, bundle)
+			}
+			bundle.Components = append(bundle.Components, component)
+			if pledged := component.PledgedCount / component.PerBundle; pledged < bundle.PledgedCount {
+				bundle.PledgedCount = pledged
+			}
+			if fulfilled := component.FulfilledCount / component.PerBundle; fulfilled < bundle.FulfilledCount {
+				bundle.FulfilledCount = fulfilled
+			}
+			return nil
+		})
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	list := []render.Renderer{}
+	for _, bundle := range bundles {
+		bundle.Progress = float64(bundle.FulfilledCount) / float64(bundle.Quantity)
+		list = append(list, response.SchoolBundlesResponse{SchoolBundles: bundle})
+	}
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
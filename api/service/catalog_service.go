@@ -0,0 +1,249 @@
+package service
+
+import (
+	"errors"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/dto"
+	"github.com/venkata6/helpschool/api/i18n"
+	"github.com/venkata6/helpschool/api/logging"
+	"github.com/venkata6/helpschool/api/metrics"
+	"github.com/venkata6/helpschool/api/request"
+	"github.com/venkata6/helpschool/api/response"
+	"github.com/venkata6/helpschool/api/util"
+	"net/http"
+)
+
+type CatalogService interface {
+	GetCategories(w http.ResponseWriter, r *http.Request)
+	CreateCategories(w http.ResponseWriter, r *http.Request)
+	GetUnits(w http.ResponseWriter, r *http.Request)
+	GetCatalogItems(w http.ResponseWriter, r *http.Request)
+	CreateCatalogItems(w http.ResponseWriter, r *http.Request)
+}
+
+type CatalogServiceInternal struct {
+	db *pgxpool.Pool
+}
+
+func NewCatalogService(db *pgxpool.Pool) CatalogService {
+	return &CatalogServiceInternal{db: db}
+}
+
+// categoryTree selects the ids of the category given by slug or id in the
+// text parameter param, and of all categories below it.
+func categoryTree(param string) string {
+	return `with recursive tree(category_id) as (
+			select category_id from helpschool.supply_categories where slug = ` + param + ` or category_id::text = ` + param + `
+			union all
+			select c.category_id from helpschool.supply_categories as c inner join tree as t on c.parent_id = t.category_id
+		) select category_id from tree`
+}
+
+// GetCategories returns the category tree with names in the language of
+// the request.
+func (a *CatalogServiceInternal) GetCategories(w http.ResponseWriter, r *http.Request) {
+	locale := i18n.FromContext(r.Context())
+	nodes := map[string]*dto.Categories{}
+	var all []*dto.Categories
+	err := forEachRow(metrics.WithQueryName(r.Context(), "list_supply_categories"), a.db,
+		`select category_id::text,coalesce(parent_id::text,''),slug,helpschool.localized(name_translations,name,$1)
+		from helpschool.supply_categories
+		order by position, helpschool.localized(name_translations,name,$1) collate `+locale.Collation(),
+		[]interface{}{locale.Chain},
+		func(rows pgx.Rows) error {
+			category := &dto.Categories{}
+			if err := rows.Scan(&category.CategoryId, &category.ParentId, &category.Slug, &category.Name); err != nil {
+				return err
+			}
+			nodes[category.CategoryId] = category
+			all = append(all, category)
+			return nil
+		})
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+
+	list := []render.Renderer{}
+	for _, category := range all {
+		if parent, ok := nodes[category.ParentId]; ok {
+			parent.Children = append(parent.Children, category)
+		} else {
+			list = append(list, response.CategoriesResponse{Categories: category})
+		}
+	}
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+// CreateCategories adds a category to the tree.
+func (a *CatalogServiceInternal) CreateCategories(w http.ResponseWriter, r *http.Request) {
+	data := &request.CategoriesRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	var parentId interface{}
+	if data.ParentId != "" {
+		id, err := uuid.Parse(data.ParentId)
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(errors.New("invalid parent_id")))
+			return
+		}
+		parentId = id
+	}
+
+	var categoryId string
+	err := a.db.QueryRow(metrics.WithQueryName(r.Context(), "create_supply_category"),
+		`INSERT INTO helpschool.supply_categories( parent_id,slug,name,position)
+			VALUES ( $1, $2, $3, (select coalesce(max(position),0) + 1 from helpschool.supply_categories
+				where parent_id is not distinct from $1::uuid))
+			returning category_id::text`, parentId, data.Slug, data.Name).Scan(&categoryId)
+	switch sqlState(err) {
+	case "":
+	case uniqueViolation:
+		render.Render(w, r, util.ErrConflict(errors.New("slug is already taken")))
+		return
+	case foreignKeyViolation:
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("unknown parent_id")))
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("create supply category failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	render.DefaultResponder(w, r, render.M{"status": "created", "category_id": categoryId})
+}
+
+// GetUnits returns the units of measure.
+func (a *CatalogServiceInternal) GetUnits(w http.ResponseWriter, r *http.Request) {
+	list := []render.Renderer{}
+	err := forEachRow(metrics.WithQueryName(r.Context(), "list_supply_units"), a.db,
+		`select unit_id,helpschool.localized(name_translations,name,$1) from helpschool.supply_units order by unit_id`,
+		[]interface{}{i18n.FromContext(r.Context()).Chain},
+		func(rows pgx.Rows) error {
+			unit := &dto.Units{}
+			if err := rows.Scan(&unit.UnitId, &unit.Name); err != nil {
+				return err
+			}
+			list = append(list, response.UnitsResponse{Units: unit})
+			return nil
+		})
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+// GetCatalogItems lists canonical items, of a category and the categories
+// below it with category, or the variants of an item with parent.
+func (a *CatalogServiceInternal) GetCatalogItems(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var category, parentId interface{}
+	if v := q.Get("category"); v != "" {
+		category = v
+	}
+	if v := q.Get("parent"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(errors.New("invalid parent")))
+			return
+		}
+		parentId = id
+	}
+
+	locale := i18n.FromContext(r.Context())
+	list := []render.Renderer{}
+	err := forEachRow(metrics.WithQueryName(r.Context(), "list_catalog_items"), a.db,
+		`select i.item_id::text,coalesce(i.parent_item_id::text,''),coalesce(i.category_id::text,''),i.unit_id,i.pack_size,
+			helpschool.localized(i.title_translations,i.title,$1),coalesce(i.description,''),i.variant,
+			(select count(*) from helpschool.supplies as s where s.item_id = i.item_id)
+		from helpschool.catalog_items as i
+		where ($2::text is null or i.category_id in (`+categoryTree("$2")+`))
+			and ($3::uuid is null and i.parent_item_id is null or i.parent_item_id = $3)
+		order by helpschool.localized(i.title_translations,i.title,$1) collate `+locale.Collation()+` limit 500`,
+		[]interface{}{locale.Chain, category, parentId},
+		func(rows pgx.Rows) error {
+			item := &dto.CatalogItems{}
+			if err := rows.Scan(&item.ItemId, &item.ParentItemId, &item.CategoryId, &item.UnitId, &item.PackSize,
+				&item.Title, &item.Description, &item.Variant, &item.Listings); err != nil {
+				return err
+			}
+			list = append(list, response.CatalogItemsResponse{CatalogItems: item})
+			return nil
+		})
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+// CreateCatalogItems adds a canonical item or a variant of one. Variants
+// inherit the category of their parent unless given.
+func (a *CatalogServiceInternal) CreateCatalogItems(w http.ResponseWriter, r *http.Request) {
+	data := &request.CatalogItemsRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	var parentId, categoryId interface{}
+	if data.ParentItemId != "" {
+		id, err := uuid.Parse(data.ParentItemId)
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(errors.New("invalid parent_item_id")))
+			return
+		}
+		parentId = id
+	}
+	if data.CategoryId != "" {
+		id, err := uuid.Parse(data.CategoryId)
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(errors.New("invalid category_id")))
+			return
+		}
+		categoryId = id
+	}
+	if data.Variant == nil {
+		data.Variant = map[string]string{}
+	}
+
+	var itemId string
+	err := a.db.QueryRow(metrics.WithQueryName(r.Context(), "create_catalog_item"),
+		`INSERT INTO helpschool.catalog_items( parent_item_id,category_id,unit_id,pack_size,title,description,variant)
+			VALUES ( $1,
+				coalesce($2::uuid, (select category_id from helpschool.catalog_items where item_id = $1)),
+				$3, $4, $5, nullif($6,''), $7)
+			returning item_id::text`,
+		parentId, categoryId, data.UnitId, data.PackSize, data.Title, data.Description, data.Variant).Scan(&itemId)
+	switch sqlState(err) {
+	case "":
+	case uniqueViolation:
+		render.Render(w, r, util.ErrConflict(errors.New("the item already has this variant")))
+		return
+	case foreignKeyViolation:
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("unknown parent_item_id, category_id or unit_id")))
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("create catalog item failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	render.DefaultResponder(w, r, render.M{"status": "created", "item_id": itemId})
+}
@@ -1,11 +1,13 @@
 package service
 
 import (
-	"context"
 	"github.com/go-chi/render"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/venkata6/helpschool/api/dto"
+	"github.com/venkata6/helpschool/api/i18n"
+	"github.com/venkata6/helpschool/api/logging"
+	"github.com/venkata6/helpschool/api/metrics"
 	"github.com/venkata6/helpschool/api/request"
 	"github.com/venkata6/helpschool/api/response"
 	"github.com/venkata6/helpschool/api/util"
@@ -35,11 +37,12 @@ func (a *CountriesServiceInternal) CreateCountries(w http.ResponseWriter, r *htt
 		return
 	}
 
-	if _, err := a.db.Exec(context.Background(), `INSERT INTO helpschool.countries( country_id,name)
+	if _, err := a.db.Exec(metrics.WithQueryName(r.Context(), "create_country"), `INSERT INTO helpschool.countries( country_id,name)
 					VALUES ( $1, $2)`, uuid.New(), data.Name); err == nil {
 		w.WriteHeader(http.StatusCreated)
 		render.DefaultResponder(w, r, render.M{"status": "created"})
 	} else {
+		logging.FromContext(r.Context()).Error("create country failed", "err", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		render.DefaultResponder(w, r, render.M{"status": "not created"})
 	}
@@ -47,12 +50,16 @@ func (a *CountriesServiceInternal) CreateCountries(w http.ResponseWriter, r *htt
 func (a *CountriesServiceInternal) GetCountries(w http.ResponseWriter, r *http.Request) {
 
 	var count int
-	rowCount, err := a.db.Query(context.Background(), "select count(*) as count from  helpschool.countries")
+	rowCount, err := a.db.Query(metrics.WithQueryName(r.Context(), "count_countries"), "select count(*) as count from  helpschool.countries")
 	for rowCount.Next() {
 		_ = rowCount.Scan(&count)
 		//checkErr(err)
 	}
-	rows, err := a.db.Query(context.Background(), "select name,country_id from helpschool.countries")
+	// names in the language of the request, sorted the way it sorts
+	locale := i18n.FromContext(r.Context())
+	rows, err := a.db.Query(metrics.WithQueryName(r.Context(), "list_countries"), "select helpschool.localized(g.name_translations,c.name,$1),c.country_id "+
+		"from helpschool.countries as c left join helpschool.regions as g on g.region_id = c.country_id "+
+		"order by helpschool.localized(g.name_translations,c.name,$1) collate "+locale.Collation(), locale.Chain)
 	defer rows.Close()
 
 	countries := make([]response.CountryResponse, count)
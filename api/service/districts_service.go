@@ -1,13 +1,15 @@
 package service
 
 import (
-	"context"
 	"errors"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/venkata6/helpschool/api/dto"
+	"github.com/venkata6/helpschool/api/i18n"
+	"github.com/venkata6/helpschool/api/logging"
+	"github.com/venkata6/helpschool/api/metrics"
 	"github.com/venkata6/helpschool/api/request"
 	"github.com/venkata6/helpschool/api/response"
 	"github.com/venkata6/helpschool/api/util"
@@ -41,13 +43,14 @@ func (a *DistrictsServiceInternal) CreateDistricts(w http.ResponseWriter, r *htt
 		return
 	}
 	stateId, _ := uuid.Parse(data.StateId)
-	if _, err := a.db.Exec(context.Background(),
+	if _, err := a.db.Exec(metrics.WithQueryName(r.Context(), "create_district"),
 		`INSERT INTO helpschool.districts( district_id,name,state_id,govt_id,extra_info)
 					VALUES ( $1, $2, $3, $4, $5)`, uuid.New(), data.Name,
 		stateId, data.GovtId, data.ExtraInfo); err == nil {
 		w.WriteHeader(http.StatusCreated)
 		render.DefaultResponder(w, r, render.M{"status": "created"})
 	} else {
+		logging.FromContext(r.Context()).Error("create district failed", "err", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		render.DefaultResponder(w, r, render.M{"status": "not created"})
 	}
@@ -57,13 +60,18 @@ func (a *DistrictsServiceInternal) GetDistricts(w http.ResponseWriter, r *http.R
 	var count int
 	stateId := chi.URLParam(r, "stateId")
 
-	rowCount, err := a.db.Query(context.Background(), "select count(*) as count from  helpschool.districts where state_id = $1", stateId)
+	rowCount, err := a.db.Query(metrics.WithQueryName(r.Context(), "count_districts"), "select count(*) as count from  helpschool.districts where state_id = $1", stateId)
 	for rowCount.Next() {
 		_ = rowCount.Scan(&count)
 		//checkErr(err)
 	}
 	if count > 0 && err == nil {
-		rows, err := a.db.Query(context.Background(), "select name,district_id,state_id,govt_id,extra_info from helpschool.districts where state_id = $1", stateId)
+		// names in the language of the request, sorted the way it sorts
+		locale := i18n.FromContext(r.Context())
+		rows, err := a.db.Query(metrics.WithQueryName(r.Context(), "list_districts"), "select helpschool.localized(g.name_translations,d.name,$2),"+
+			"d.district_id,d.state_id,d.govt_id,d.extra_info from helpschool.districts as d "+
+			"left join helpschool.regions as g on g.region_id = d.district_id where d.state_id = $1 "+
+			"order by helpschool.localized(g.name_translations,d.name,$2) collate "+locale.Collation(), stateId, locale.Chain)
 		defer rows.Close()
 
 		districts := make([]response.DistrictsResponse, count)
@@ -0,0 +1,132 @@
+package service
+
+import (
+	"errors"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/badges"
+	"github.com/venkata6/helpschool/api/dto"
+	"github.com/venkata6/helpschool/api/metrics"
+	"github.com/venkata6/helpschool/api/response"
+	"github.com/venkata6/helpschool/api/util"
+	"net/http"
+	"strings"
+)
+
+type DonorProfilesService interface {
+	GetDonorProfiles(w http.ResponseWriter, r *http.Request)
+}
+
+type DonorProfilesServiceInternal struct {
+	db *pgxpool.Pool
+}
+
+func NewDonorProfilesService(db *pgxpool.Pool) DonorProfilesService {
+	return &DonorProfilesServiceInternal{db: db}
+}
+
+// publicDeliveries selects the donations shown on public profiles, anonymous
+// pledges are never tied to a donor publicly.
+const publicDeliveries = `d.user_id = $1 and d.status = 'Delivered' and d.confirmed_date is not null and not d.anonymous`
+
+// GetDonorProfiles returns the public profile of a donor by handle, donors
+// who did not opt in are not found.
+func (a *DonorProfilesServiceInternal) GetDonorProfiles(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var userId string
+	profile := &dto.DonorProfiles{Schools: []dto.DonorSchool{}, States: []string{}, Badges: []dto.DonorBadge{}}
+	err := a.db.QueryRow(metrics.WithQueryName(ctx, "get_donor_profile"),
+		`select id,handle,coalesce(nullif(display_name,''),nullif(user_name,''),handle),created_date
+			from helpschool.users where handle = $1 and public_profile`,
+		strings.ToLower(chi.URLParam(r, "handle"))).Scan(&userId, &profile.Handle, &profile.DisplayName, &profile.MemberSince)
+	if errors.Is(err, pgx.ErrNoRows) {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+
+	rows, err := a.db.Query(metrics.WithQueryName(ctx, "list_donor_schools"),
+		`select s.school_id,s.name,coalesce(s.place,''),sum(coalesce(d.quantity,0)) from helpschool.users_donations as d
+			inner join helpschool.schools as s on s.school_id = d.school_id
+			where `+publicDeliveries+`
+			group by s.school_id,s.name,s.place order by max(d.modified_date) desc`, userId)
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	for rows.Next() {
+		school := dto.DonorSchool{}
+		if err := rows.Scan(&school.SchoolId, &school.Name, &school.Place, &school.ItemsDelivered); err != nil {
+			rows.Close()
+			render.Render(w, r, util.ErrInternal(err))
+			return
+		}
+		profile.Schools = append(profile.Schools, school)
+		profile.ItemsDelivered += school.ItemsDelivered
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		render.Render(w, r, util.ErrInternal(rows.Err()))
+		return
+	}
+	profile.SchoolsHelped = len(profile.Schools)
+
+	rows, err = a.db.Query(metrics.WithQueryName(ctx, "list_donor_states"),
+		`select distinct st.name from helpschool.users_donations as d
+			inner join helpschool.schools as s on s.school_id = d.school_id
+			inner join helpschool.districts as di on di.district_id = s.district_id
+			inner join helpschool.states as st on st.state_id = di.state_id
+			where `+publicDeliveries+` order by st.name`, userId)
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	for rows.Next() {
+		var state string
+		if err := rows.Scan(&state); err != nil {
+			rows.Close()
+			render.Render(w, r, util.ErrInternal(err))
+			return
+		}
+		profile.States = append(profile.States, state)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		render.Render(w, r, util.ErrInternal(rows.Err()))
+		return
+	}
+	profile.StatesReached = len(profile.States)
+
+	rows, err = a.db.Query(metrics.WithQueryName(ctx, "list_donor_badges"),
+		"select badge,awarded_date from helpschool.user_badges where user_id = $1 order by awarded_date", userId)
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		badge := dto.DonorBadge{}
+		if err := rows.Scan(&badge.Id, &badge.AwardedDate); err != nil {
+			render.Render(w, r, util.ErrInternal(err))
+			return
+		}
+		// badges that are no longer defined are not shown
+		if def, ok := badges.Lookup(badge.Id); ok {
+			badge.Name, badge.Description = def.Name, def.Description
+			profile.Badges = append(profile.Badges, badge)
+		}
+	}
+	if rows.Err() != nil {
+		render.Render(w, r, util.ErrInternal(rows.Err()))
+		return
+	}
+
+	if err := render.Render(w, r, response.DonorProfilesResponse{DonorProfiles: profile}); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
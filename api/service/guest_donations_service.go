@@ -0,0 +1,341 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/audit"
+	"github.com/venkata6/helpschool/api/auth"
+	"github.com/venkata6/helpschool/api/logging"
+	"github.com/venkata6/helpschool/api/mail"
+	"github.com/venkata6/helpschool/api/metrics"
+	"github.com/venkata6/helpschool/api/needs"
+	"github.com/venkata6/helpschool/api/request"
+	"github.com/venkata6/helpschool/api/response"
+	"github.com/venkata6/helpschool/api/util"
+	"net/http"
+	netmail "net/mail"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// MagicTokenHeader carries the token of an emailed link. The web site reads
+// the token from the link's fragment so it never shows up in access logs.
+const MagicTokenHeader = "X-Magic-Token"
+
+const (
+	guestLinkTTL = 90 * 24 * time.Hour
+	claimLinkTTL = 24 * time.Hour
+)
+
+type GuestDonationsService interface {
+	CreateGuestDonations(w http.ResponseWriter, r *http.Request)
+	GetGuestDonations(w http.ResponseWriter, r *http.Request)
+	ConfirmGuestDonations(w http.ResponseWriter, r *http.Request)
+	UpdateGuestDonations(w http.ResponseWriter, r *http.Request)
+
+	// claiming guest pledges into an account
+	RequestClaim(w http.ResponseWriter, r *http.Request)
+	ClaimGuestDonations(w http.ResponseWriter, r *http.Request)
+}
+
+type GuestDonationsServiceInternal struct {
+	db        *pgxpool.Pool
+	links     *auth.MagicLinks
+	mailer    mail.Sender
+	publicURL string
+}
+
+// NewGuestDonationsService creates the service, emailed links point to the
+// web site below publicURL.
+func NewGuestDonationsService(db *pgxpool.Pool, links *auth.MagicLinks, mailer mail.Sender, publicURL string) GuestDonationsService {
+	return &GuestDonationsServiceInternal{db: db, links: links, mailer: mailer, publicURL: strings.TrimSuffix(publicURL, "/")}
+}
+
+func normalizeEmail(email string) (string, error) {
+	addr, err := netmail.ParseAddress(strings.TrimSpace(email))
+	if err != nil || addr.Name != "" {
+		return "", errors.New("invalid email")
+	}
+	return strings.ToLower(addr.Address), nil
+}
+
+// Rate limits of the mails anyone can have sent: guest pledges per client
+// network, and mails per recipient, whoever asked for them.
+const (
+	guestPledgesPerHour = 20
+	mailsPerRecipient   = 5
+)
+
+// rateLimited counts the hits of a request on limits and answers 429 when
+// one of them is over.
+func (a *GuestDonationsServiceInternal) rateLimited(w http.ResponseWriter, r *http.Request, limits ...rateLimit) bool {
+	for _, limit := range limits {
+		ok, err := allow(r.Context(), a.db, limit.key, limit.hits, limit.window)
+		if err != nil {
+			render.Render(w, r, util.ErrInternal(err))
+			return true
+		}
+		if !ok {
+			render.Render(w, r, util.ErrTooManyRequests(errRateLimited))
+			return true
+		}
+	}
+	return false
+}
+
+func (a *GuestDonationsServiceInternal) link(page, token string) string {
+	return a.publicURL + "/web/#/" + page + "?token=" + url.QueryEscape(token)
+}
+
+// CreateGuestDonations pledges a donation with only an email address and
+// mails the donor a link to confirm and manage it.
+func (a *GuestDonationsServiceInternal) CreateGuestDonations(w http.ResponseWriter, r *http.Request) {
+	data := &request.GuestDonationsRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	email, err := normalizeEmail(data.Email)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	schoolId, err := uuid.Parse(data.SchoolId)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("invalid SchoolId")))
+		return
+	}
+	supplyId, err := uuid.Parse(data.SupplyId)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("invalid SupplyId")))
+		return
+	}
+	if data.Quantity <= 0 {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("quantity must be positive")))
+		return
+	}
+	if a.rateLimited(w, r,
+		rateLimit{rateKey("guest-pledge-ip", audit.FromContext(r.Context()).IP), guestPledgesPerHour, time.Hour},
+		rateLimit{rateKey("mail-to", email), mailsPerRecipient, maxRateWindow}) {
+		return
+	}
+
+	ctx := r.Context()
+	var donationId, schoolName, title string
+	err = a.db.QueryRow(metrics.WithQueryName(ctx, "create_guest_donation"),
+		`with d as (INSERT INTO helpschool.users_donations( guest_email,school_id,supply_id,quantity,extra_info,anonymous,click_id)
+				select $1::text, $2::uuid, $3::uuid, $4::integer, nullif($5,'')::jsonb, $6::boolean, `+attributedClick("$7", "$3")+`
+				where `+openNeed("$2", "$3", "$8")+` returning donation_id,school_id,supply_id)
+			select d.donation_id,s.name,su.title from d
+			inner join helpschool.schools as s on s.school_id = d.school_id
+			inner join helpschool.supplies as su on su.supply_id = d.supply_id`,
+		email, schoolId, supplyId, data.Quantity, data.ExtraInfo, data.Anonymous, clickOf(r), needs.Open).Scan(&donationId, &schoolName, &title)
+	if errors.Is(err, pgx.ErrNoRows) {
+		render.Render(w, r, util.ErrInvalidRequest(errNeedNotOpen))
+		return
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("create guest donation failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+
+	token := a.links.Sign(auth.LinkGuestDonation, donationId, time.Now().Add(guestLinkTTL))
+	if err := a.mailer.Send(ctx, mail.Message{
+		To:      email,
+		Subject: "Confirm your helpschool pledge",
+		Body: fmt.Sprintf("Thank you for pledging %d x %s to %s.\n\n"+
+			"Open this link to confirm the pledge, and later to update its shipping status:\n%s\n\n"+
+			"If you did not make this pledge, ignore this email.",
+			data.Quantity, title, schoolName, a.link("pledge", token)),
+	}); err != nil {
+		// the pledge is only kept when the link could be sent, it is mailed
+		// once stored so that it never points to a pledge that is not
+		if _, derr := a.db.Exec(metrics.WithQueryName(ctx, "delete_unsent_guest_donation"),
+			`delete from helpschool.users_donations where donation_id = $1 and confirmed_date is null`,
+			donationId); derr != nil {
+			logging.FromContext(ctx).Error("delete unsent guest donation failed", "err", derr)
+		}
+		render.Render(w, r, util.ErrInternal(fmt.Errorf("send guest donation link: %w", err)))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	render.DefaultResponder(w, r, render.M{"status": "created", "donation_id": donationId})
+}
+
+// guestDonationId returns the pledge of the request's magic link token.
+func (a *GuestDonationsServiceInternal) guestDonationId(r *http.Request) (uuid.UUID, error) {
+	subject, err := a.links.Verify(auth.LinkGuestDonation, r.Header.Get(MagicTokenHeader))
+	if err != nil {
+		return uuid.UUID{}, err
+	}
+	return uuid.Parse(subject)
+}
+
+// GetGuestDonations returns the guest pledge of the link.
+func (a *GuestDonationsServiceInternal) GetGuestDonations(w http.ResponseWriter, r *http.Request) {
+	donationId, err := a.guestDonationId(r)
+	if err != nil {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	donation, err := scanDonation(a.db.QueryRow(metrics.WithQueryName(r.Context(), "get_guest_donation"),
+		selectDonations+"where d.donation_id = $1 and d.user_id is null", donationId))
+	if errors.Is(err, pgx.ErrNoRows) {
+		// claimed pledges are managed from the account
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if err := render.Render(w, r, response.UserDonationsResponse{UserDonations: donation}); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+// ConfirmGuestDonations confirms the guest pledge of the link, only
+// confirmed pledges are listed publicly.
+func (a *GuestDonationsServiceInternal) ConfirmGuestDonations(w http.ResponseWriter, r *http.Request) {
+	donationId, err := a.guestDonationId(r)
+	if err != nil {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	var confirmedBefore bool
+	err = a.db.QueryRow(metrics.WithQueryName(r.Context(), "confirm_guest_donation"),
+		`update helpschool.users_donations as d set confirmed_date = coalesce(d.confirmed_date, now())
+			from helpschool.users_donations as old
+			where d.donation_id = $1 and d.user_id is null and old.donation_id = d.donation_id
+			returning old.confirmed_date is not null`, donationId).Scan(&confirmedBefore)
+	if errors.Is(err, pgx.ErrNoRows) {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if !confirmedBefore {
+		metrics.PledgesCreated.Inc()
+	}
+	render.DefaultResponder(w, r, render.M{"status": "confirmed"})
+}
+
+// UpdateGuestDonations changes the status, tracking url or anonymity of the
+// guest pledge of the link.
+func (a *GuestDonationsServiceInternal) UpdateGuestDonations(w http.ResponseWriter, r *http.Request) {
+	donationId, err := a.guestDonationId(r)
+	if err != nil {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	data := &request.UserDonationsRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	if data.Status != "" && !donationStatuses[data.Status] {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("unknown status")))
+		return
+	}
+
+	err = updateDonation(r.Context(), a.db, donationId, "", data)
+	if errors.Is(err, pgx.ErrNoRows) {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if errors.Is(err, errUnconfirmedPledge) {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("update guest donation failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	render.DefaultResponder(w, r, render.M{"status": "updated"})
+}
+
+// RequestClaim mails a link that moves the guest pledges of an email
+// address into the caller's account, proving the caller owns the address.
+// The response is the same whether or not there are pledges to claim.
+func (a *GuestDonationsServiceInternal) RequestClaim(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	data := &request.ClaimDonationsRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	email, err := normalizeEmail(data.Email)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	ctx := r.Context()
+	var pledges int
+	if err := a.db.QueryRow(metrics.WithQueryName(ctx, "count_guest_donations"),
+		"select count(*) from helpschool.users_donations where user_id is null and lower(guest_email) = $1",
+		email).Scan(&pledges); err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if pledges > 0 {
+		if a.rateLimited(w, r, rateLimit{rateKey("mail-to", email), mailsPerRecipient, maxRateWindow}) {
+			return
+		}
+		token := a.links.Sign(auth.LinkClaimDonations, user.UserId+" "+email, time.Now().Add(claimLinkTTL))
+		if err := a.mailer.Send(ctx, mail.Message{
+			To:      email,
+			Subject: "Add your helpschool pledges to your account",
+			Body: fmt.Sprintf("Open this link while signed in to add the %d pledge(s) made with this address "+
+				"to your helpschool account:\n%s\n\nThe link expires in 24 hours. If you did not ask for it, ignore this email.",
+				pledges, a.link("claim", token)),
+		}); err != nil {
+			logging.FromContext(ctx).Error("send claim link failed", "err", err)
+			render.Render(w, r, util.ErrInternal(err))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+	render.DefaultResponder(w, r, render.M{"status": "sent"})
+}
+
+// ClaimGuestDonations moves the guest pledges of the link's email address
+// into the caller's account. The link only works for the account that asked for it.
+func (a *GuestDonationsServiceInternal) ClaimGuestDonations(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	subject, err := a.links.Verify(auth.LinkClaimDonations, r.Header.Get(MagicTokenHeader))
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	userId, email, _ := strings.Cut(subject, " ")
+	if userId != user.UserId {
+		render.Render(w, r, util.ErrForbidden)
+		return
+	}
+
+	tag, err := a.db.Exec(metrics.WithQueryName(r.Context(), "claim_guest_donations"),
+		`update helpschool.users_donations set user_id = $1, guest_email = null,
+			confirmed_date = coalesce(confirmed_date, now()), modified_date = now()
+			where user_id is null and lower(guest_email) = $2`, user.UserId, email)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("claim guest donations failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	render.DefaultResponder(w, r, render.M{"status": "claimed", "claimed": tag.RowsAffected()})
+}
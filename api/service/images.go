@@ -0,0 +1,61 @@
+package service
+
+import (
+	"bytes"
+	"errors"
+	"github.com/go-chi/render"
+	"github.com/venkata6/helpschool/api/storage"
+	"github.com/venkata6/helpschool/api/util"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+)
+
+// maxImageSize bounds uploaded photos, request bodies are limited to it
+// plus room for the other form fields.
+const maxImageSize = 5 << 20
+
+var errImageType = errors.New("photo must be a JPEG, PNG or WebP image of at most 5MB")
+
+// imageTypes maps the accepted sniffed content types to file extensions.
+var imageTypes = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+// sniffImage checks the content of an uploaded image, the type the client
+// claims is ignored. It returns the image and the file extension of its
+// type, images over maxImageSize are rejected rather than cut.
+func sniffImage(file io.Reader) (io.Reader, string, error) {
+	body, err := io.ReadAll(io.LimitReader(file, maxImageSize+1))
+	if err != nil || len(body) > maxImageSize {
+		return nil, "", errImageType
+	}
+	ext, ok := imageTypes[http.DetectContentType(body)]
+	if !ok {
+		return nil, "", errImageType
+	}
+	return bytes.NewReader(body), ext, nil
+}
+
+// serveImage streams a stored image. Unless the caller set a Cache-Control
+// header the response is not cached.
+func serveImage(w http.ResponseWriter, r *http.Request, store storage.Store, key string) {
+	f, err := store.Open(r.Context(), key)
+	if errors.Is(err, storage.ErrNotFound) {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", mime.TypeByExtension(path.Ext(key)))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", "private, no-store")
+	}
+	_, _ = io.Copy(w, f)
+}
@@ -0,0 +1,250 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/dto"
+	"github.com/venkata6/helpschool/api/geo"
+	"github.com/venkata6/helpschool/api/metrics"
+	"github.com/venkata6/helpschool/api/response"
+	"github.com/venkata6/helpschool/api/util"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// defaultMapZoom is used when the feed is asked for without a zoom, it
+// shows a country.
+const defaultMapZoom = 5
+
+type MapService interface {
+	GetMapNeeds(w http.ResponseWriter, r *http.Request)
+	GetMapNeedsTile(w http.ResponseWriter, r *http.Request)
+}
+
+type MapServiceInternal struct {
+	db *pgxpool.Pool
+}
+
+func NewMapService(db *pgxpool.Pool) MapService {
+	return &MapServiceInternal{db: db}
+}
+
+// mapFilter narrows the feed, nil fields match everything.
+type mapFilter struct {
+	stateId, districtId, supplyId interface{}
+	bounds                        *geo.Bounds
+}
+
+// GetMapNeeds returns the schools with open needs as GeoJSON, clustered
+// for zoom and filtered by state_id, district_id, supply_id and bbox
+// ("west,south,east,north").
+func (a *MapServiceInternal) GetMapNeeds(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter, err := parseMapFilter(r)
+	if err == nil && q.Get("bbox") != "" {
+		var bounds geo.Bounds
+		if bounds, err = geo.ParseBounds(q.Get("bbox")); err == nil {
+			filter.bounds = &bounds
+		}
+	}
+	zoom := defaultMapZoom
+	if err == nil && q.Get("zoom") != "" {
+		if zoom, err = strconv.Atoi(q.Get("zoom")); err == nil && (zoom < 0 || zoom > geo.MaxZoom) {
+			err = errors.New("zoom out of range")
+		}
+	}
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	a.renderMapNeeds(w, r, filter, zoom)
+}
+
+// GetMapNeedsTile returns the GeoJSON of web mercator tile {z}/{x}/{y},
+// filtered like GetMapNeeds.
+func (a *MapServiceInternal) GetMapNeedsTile(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseMapFilter(r)
+	var z, x, y int
+	if err == nil {
+		z, err = strconv.Atoi(chi.URLParam(r, "z"))
+	}
+	if err == nil {
+		x, err = strconv.Atoi(chi.URLParam(r, "x"))
+	}
+	if err == nil {
+		y, err = strconv.Atoi(chi.URLParam(r, "y"))
+	}
+	var bounds geo.Bounds
+	if err == nil {
+		bounds, err = geo.TileBounds(z, x, y)
+	}
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	filter.bounds = &bounds
+	a.renderMapNeeds(w, r, filter, z)
+}
+
+func parseMapFilter(r *http.Request) (mapFilter, error) {
+	var filter mapFilter
+	for _, f := range []struct {
+		name string
+		dst  *interface{}
+		err  error
+	}{
+		{"state_id", &filter.stateId, errors.New("invalid state_id")},
+		{"district_id", &filter.districtId, errors.New("invalid district_id")},
+		{"supply_id", &filter.supplyId, errors.New("invalid supply_id")},
+	} {
+		if v := r.URL.Query().Get(f.name); v != "" {
+			id, err := uuid.Parse(v)
+			if err != nil {
+				return filter, f.err
+			}
+			*f.dst = id
+		}
+	}
+	return filter, nil
+}
+
+// mapSchool is a school with open needs, the unit features are built of.
+type mapSchool struct {
+	id, name  string
+	point     geo.Point
+	needs     int
+	remaining int
+	value     *float64
+}
+
+// renderMapNeeds answers with the feed, or 304 Not Modified when the
+// client's If-None-Match still holds.
+func (a *MapServiceInternal) renderMapNeeds(w http.ResponseWriter, r *http.Request, filter mapFilter, zoom int) {
+	var west, south, east, north interface{}
+	if filter.bounds != nil {
+		west, south, east, north = filter.bounds.West, filter.bounds.South, filter.bounds.East, filter.bounds.North
+	}
+	var schools []mapSchool
+	err := forEachRow(metrics.WithQueryName(r.Context(), "list_map_needs"), a.db,
+		`select s.school_id::text,s.name,s.latitude,s.longitude,count(*),
+			sum(ss.quantity - coalesce(ss.fulfilled_count,0)),
+			sum((ss.quantity - coalesce(ss.fulfilled_count,0)) * su.price)::float8
+		from helpschool.school_supplies as ss
+		inner join helpschool.supplies as su on su.supply_id = ss.supply_id
+		inner join helpschool.schools as s on s.school_id = ss.school_id
+		inner join helpschool.districts as d on d.district_id = s.district_id
+		where ss.quantity > coalesce(ss.fulfilled_count,0) and ss.status = 'open' and s.latitude is not null and s.longitude is not null
+			and ($1::uuid is null or d.state_id = $1) and ($2::uuid is null or s.district_id = $2)
+			and ($3::uuid is null or ss.supply_id = $3)
+			and ($4::float8 is null or (s.latitude between $5 and $7
+				and case when $4 <= $6 then s.longitude between $4 and $6
+					else s.longitude >= $4 or s.longitude <= $6 end))
+		group by s.school_id,s.name,s.latitude,s.longitude
+		order by s.school_id`,
+		[]interface{}{filter.stateId, filter.districtId, filter.supplyId, west, south, east, north},
+		func(rows pgx.Rows) error {
+			var school mapSchool
+			if err := rows.Scan(&school.id, &school.name, &school.point.Lat, &school.point.Lng,
+				&school.needs, &school.remaining, &school.value); err != nil {
+				return err
+			}
+			schools = append(schools, school)
+			return nil
+		})
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+
+	needs := &dto.MapNeeds{Type: "FeatureCollection", Features: clusterMapSchools(schools, zoom)}
+	if filter.bounds != nil {
+		needs.Bbox = []float64{filter.bounds.West, filter.bounds.South, filter.bounds.East, filter.bounds.North}
+	}
+	body, err := json.Marshal(response.MapNeedsResponse{MapNeeds: needs})
+	if err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/geo+json")
+	w.Write(body)
+}
+
+// clusterMapSchools merges the schools sharing a cluster cell at zoom into
+// one feature at their mean position. Past geo.MaxClusterZoom, and for
+// cells holding one school, every school is its own feature.
+func clusterMapSchools(schools []mapSchool, zoom int) []dto.MapNeedFeature {
+	features := []dto.MapNeedFeature{}
+	cells := map[[2]int][]mapSchool{}
+	var order [][2]int
+	for _, school := range schools {
+		cell := geo.Cell(school.point, zoom)
+		if zoom > geo.MaxClusterZoom {
+			// unclustered, every school gets a cell of its own
+			cell = [2]int{len(order), -1}
+		}
+		if _, ok := cells[cell]; !ok {
+			order = append(order, cell)
+		}
+		cells[cell] = append(cells[cell], school)
+	}
+
+	for _, cell := range order {
+		members := cells[cell]
+		if len(members) == 1 {
+			school := members[0]
+			features = append(features, dto.MapNeedFeature{
+				Type:     "Feature",
+				Id:       school.id,
+				Geometry: dto.MapNeedPoint{Type: "Point", Coordinates: [2]float64{school.point.Lng, school.point.Lat}},
+				Properties: dto.MapNeedSummary{SchoolId: school.id, Name: school.name, Schools: 1,
+					Needs: school.needs, Remaining: school.remaining, Value: school.value},
+			})
+			continue
+		}
+		summary := dto.MapNeedSummary{Cluster: true, Schools: len(members)}
+		var lat, lng float64
+		for _, school := range members {
+			lat += school.point.Lat
+			lng += school.point.Lng
+			summary.Needs += school.needs
+			summary.Remaining += school.remaining
+			if school.value != nil {
+				value := *school.value
+				if summary.Value != nil {
+					value += *summary.Value
+				}
+				summary.Value = &value
+			}
+		}
+		features = append(features, dto.MapNeedFeature{
+			Type: "Feature",
+			Id:   "cluster/" + strconv.Itoa(zoom) + "/" + strconv.Itoa(cell[0]) + "/" + strconv.Itoa(cell[1]),
+			Geometry: dto.MapNeedPoint{Type: "Point",
+				Coordinates: [2]float64{lng / float64(len(members)), lat / float64(len(members))}},
+			Properties: summary,
+		})
+	}
+
+	// the largest needs first
+	sort.SliceStable(features, func(i, j int) bool {
+		return features[i].Properties.Remaining > features[j].Properties.Remaining
+	})
+	return features
+}
@@ -0,0 +1,549 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/auth"
+	"github.com/venkata6/helpschool/api/dto"
+	"github.com/venkata6/helpschool/api/filter"
+	"github.com/venkata6/helpschool/api/logging"
+	"github.com/venkata6/helpschool/api/metrics"
+	"github.com/venkata6/helpschool/api/request"
+	"github.com/venkata6/helpschool/api/response"
+	"github.com/venkata6/helpschool/api/storage"
+	"github.com/venkata6/helpschool/api/util"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+type MessagesService interface {
+	GetMessageThreads(w http.ResponseWriter, r *http.Request)
+	CreateMessageThreads(w http.ResponseWriter, r *http.Request)
+	GetMessages(w http.ResponseWriter, r *http.Request)
+	CreateMessages(w http.ResponseWriter, r *http.Request)
+	GetMessageAttachment(w http.ResponseWriter, r *http.Request)
+
+	// moderation
+	ListHeldMessages(w http.ResponseWriter, r *http.Request)
+	ModerateMessages(w http.ResponseWriter, r *http.Request)
+}
+
+type MessagesServiceInternal struct {
+	db    *pgxpool.Pool
+	store storage.Store
+}
+
+func NewMessagesService(db *pgxpool.Pool, store storage.Store) MessagesService {
+	return &MessagesServiceInternal{db: db, store: store}
+}
+
+const (
+	maxSubjectLength = 256
+	maxMessageLength = 4000
+)
+
+// Sides of a thread the caller can be on.
+const (
+	sideDonor     = "donor"
+	sideSchool    = "school"
+	sideModerator = "moderator"
+)
+
+var errNoThread = errors.New("no such thread")
+
+const selectThreads = `select t.thread_id,t.school_id,s.name,coalesce(t.supply_id::text,''),coalesce(su.title,''),
+	coalesce(t.donation_id::text,''),t.donor_id,coalesce(nullif(d.display_name,''),nullif(d.user_name,''),'Donor'),
+	t.subject,t.created_date,t.last_message_date
+	from helpschool.message_threads as t
+	inner join helpschool.schools as s on s.school_id = t.school_id
+	inner join helpschool.users as d on d.id = t.donor_id
+	left join helpschool.supplies as su on su.supply_id = t.supply_id `
+
+func scanThread(row pgx.Row) (*dto.MessageThreads, error) {
+	thread := &dto.MessageThreads{}
+	err := row.Scan(&thread.ThreadId, &thread.SchoolId, &thread.SchoolName, &thread.SupplyId, &thread.Title,
+		&thread.DonationId, &thread.DonorId, &thread.DonorName, &thread.Subject, &thread.CreatedDate,
+		&thread.LastMessageDate)
+	return thread, err
+}
+
+// thread loads a thread and the caller's side of it. Callers who are not
+// part of the thread get errNoThread, as for unknown threads.
+func (a *MessagesServiceInternal) thread(ctx context.Context, threadId string, user *dto.Users) (*dto.MessageThreads, string, error) {
+	if _, err := uuid.Parse(threadId); err != nil {
+		return nil, "", errNoThread
+	}
+	thread, err := scanThread(a.db.QueryRow(metrics.WithQueryName(ctx, "get_message_thread"),
+		selectThreads+"where t.thread_id = $1", threadId))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, "", errNoThread
+	} else if err != nil {
+		return nil, "", err
+	}
+	if thread.DonorId == user.UserId {
+		return thread, sideDonor, nil
+	}
+	if teacher, err := isVerifiedTeacher(ctx, a.db, user.UserId, thread.SchoolId); err != nil {
+		return nil, "", err
+	} else if teacher {
+		return thread, sideSchool, nil
+	}
+	if identity, _ := auth.IdentityFromContext(ctx); identity.HasRole(auth.RoleModerator) || identity.HasRole(auth.RoleAdmin) {
+		return thread, sideModerator, nil
+	}
+	return nil, "", errNoThread
+}
+
+// allowContact reports whether contact details may be shared in a thread,
+// once the donor has a confirmed donation with the school.
+func (a *MessagesServiceInternal) allowContact(ctx context.Context, thread *dto.MessageThreads) (bool, error) {
+	var allowed bool
+	err := a.db.QueryRow(metrics.WithQueryName(ctx, "donor_has_confirmed_donation"),
+		`select exists (select 1 from helpschool.users_donations where user_id = $1 and school_id = $2
+			and confirmed_date is not null and status <> $3)`,
+		thread.DonorId, thread.SchoolId, dto.DonationCancelled).Scan(&allowed)
+	return allowed, err
+}
+
+// GetMessageThreads lists the threads of the caller, as a donor or as a
+// teacher of the school, with the number of unread messages.
+func (a *MessagesServiceInternal) GetMessageThreads(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	threads := []render.Renderer{}
+	err := forEachRow(metrics.WithQueryName(r.Context(), "list_message_threads"), a.db,
+		`select t.thread_id,t.school_id,s.name,coalesce(t.supply_id::text,''),coalesce(su.title,''),
+			coalesce(t.donation_id::text,''),t.donor_id,coalesce(nullif(d.display_name,''),nullif(d.user_name,''),'Donor'),
+			t.subject,t.created_date,t.last_message_date,
+			(select count(*) from helpschool.messages as m
+				left join helpschool.message_reads as mr on mr.thread_id = m.thread_id and mr.user_id = $1
+				where m.thread_id = t.thread_id and m.author_id <> $1 and m.status = 'visible'
+				and m.created_date > coalesce(mr.read_date,'-infinity'))
+		from helpschool.message_threads as t
+		inner join helpschool.schools as s on s.school_id = t.school_id
+		inner join helpschool.users as d on d.id = t.donor_id
+		left join helpschool.supplies as su on su.supply_id = t.supply_id
+		where t.donor_id = $1 or t.school_id in (select school_id from helpschool.teacher_affiliations
+			where user_id = $1 and status = 'approved')
+		order by t.last_message_date desc limit 200`, []interface{}{user.UserId},
+		func(rows pgx.Rows) error {
+			thread := &dto.MessageThreads{}
+			if err := rows.Scan(&thread.ThreadId, &thread.SchoolId, &thread.SchoolName, &thread.SupplyId, &thread.Title,
+				&thread.DonationId, &thread.DonorId, &thread.DonorName, &thread.Subject, &thread.CreatedDate,
+				&thread.LastMessageDate, &thread.Unread); err != nil {
+				return err
+			}
+			threads = append(threads, response.MessageThreadsResponse{MessageThreads: thread})
+			return nil
+		})
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if err := render.RenderList(w, r, threads); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+// CreateMessageThreads starts a thread with its first message.
+func (a *MessagesServiceInternal) CreateMessageThreads(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	data := &request.MessageThreadsRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	data.Subject = strings.TrimSpace(data.Subject)
+	if data.Subject == "" || utf8.RuneCountInString(data.Subject) > maxSubjectLength {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("subject must be 1 to 256 characters")))
+		return
+	}
+	if strings.TrimSpace(data.Body) == "" || utf8.RuneCountInString(data.Body) > maxMessageLength {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("body must be 1 to 4000 characters")))
+		return
+	}
+
+	ctx := r.Context()
+	thread := &dto.MessageThreads{Subject: data.Subject}
+	if data.DonationId != "" {
+		donationId, err := uuid.Parse(data.DonationId)
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(errors.New("invalid DonationId")))
+			return
+		}
+		// guest pledges have no account to message
+		err = a.db.QueryRow(metrics.WithQueryName(ctx, "get_donation_for_thread"),
+			`select donation_id,school_id,supply_id,user_id from helpschool.users_donations
+				where donation_id = $1 and user_id is not null and confirmed_date is not null`, donationId).
+			Scan(&thread.DonationId, &thread.SchoolId, &thread.SupplyId, &thread.DonorId)
+		if errors.Is(err, pgx.ErrNoRows) {
+			render.Render(w, r, util.ErrInvalidRequest(errors.New("no confirmed donation with this id")))
+			return
+		} else if err != nil {
+			render.Render(w, r, util.ErrInternal(err))
+			return
+		}
+		if thread.DonorId != user.UserId {
+			if allowed, err := canManageSchool(ctx, a.db, user.UserId, thread.SchoolId); err != nil {
+				render.Render(w, r, util.ErrInternal(err))
+				return
+			} else if !allowed {
+				render.Render(w, r, util.ErrForbidden)
+				return
+			}
+		}
+	} else {
+		schoolId, err := uuid.Parse(data.SchoolId)
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(errors.New("invalid SchoolId")))
+			return
+		}
+		thread.SchoolId, thread.DonorId = schoolId.String(), user.UserId
+		if data.SupplyId != "" {
+			supplyId, err := uuid.Parse(data.SupplyId)
+			if err != nil {
+				render.Render(w, r, util.ErrInvalidRequest(errors.New("invalid SupplyId")))
+				return
+			}
+			thread.SupplyId = supplyId.String()
+		}
+		var exists bool
+		if err := a.db.QueryRow(metrics.WithQueryName(ctx, "school_need_exists"),
+			`select exists (select 1 from helpschool.schools as s
+				left join helpschool.school_supplies as ss on ss.school_id = s.school_id and ss.supply_id::text = $2
+				where s.school_id = $1 and ($2 = '' or ss.supply_id is not null))`,
+			schoolId, thread.SupplyId).Scan(&exists); err != nil {
+			render.Render(w, r, util.ErrInternal(err))
+			return
+		}
+		if !exists {
+			render.Render(w, r, util.ErrInvalidRequest(errors.New("unknown school or need")))
+			return
+		}
+	}
+
+	allowContact, err := a.allowContact(ctx, thread)
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	checked := filter.Check(data.Body, allowContact)
+	subject := filter.Check(data.Subject, allowContact)
+
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	defer tx.Rollback(ctx)
+	if err := tx.QueryRow(metrics.WithQueryName(ctx, "create_message_thread"),
+		`INSERT INTO helpschool.message_threads( school_id,supply_id,donation_id,donor_id,subject)
+			VALUES ( $1, nullif($2,'')::uuid, nullif($3,'')::uuid, $4, $5) returning thread_id`,
+		thread.SchoolId, thread.SupplyId, thread.DonationId, thread.DonorId, subject.Text).Scan(&thread.ThreadId); err != nil {
+		logging.FromContext(ctx).Error("create message thread failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	messageId, status, err := insertMessage(ctx, tx, thread.ThreadId, user.UserId, checked, subject.Held, "")
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("create message failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	render.DefaultResponder(w, r, render.M{"status": "created", "thread_id": thread.ThreadId,
+		"message_id": messageId, "message_status": status, "filter_reasons": checked.Reasons})
+}
+
+// insertMessage stores a filtered message, held also when forceHeld, and
+// marks the thread as read by its author.
+func insertMessage(ctx context.Context, tx pgx.Tx, threadId, authorId string, checked filter.Result, forceHeld bool,
+	attachmentKey string) (string, string, error) {
+	status := dto.MessageVisible
+	if checked.Held || forceHeld {
+		status = dto.MessageHeld
+	}
+	var messageId string
+	if err := tx.QueryRow(metrics.WithQueryName(ctx, "create_message"),
+		`INSERT INTO helpschool.messages( thread_id,author_id,body,attachment_key,status,filter_reasons)
+			VALUES ( $1, $2, $3, nullif($4,''), $5, nullif($6,'')) returning message_id`,
+		threadId, authorId, checked.Text, attachmentKey, status, strings.Join(checked.Reasons, ",")).
+		Scan(&messageId); err != nil {
+		return "", "", err
+	}
+	if _, err := tx.Exec(metrics.WithQueryName(ctx, "touch_message_thread"),
+		"update helpschool.message_threads set last_message_date = now() where thread_id = $1", threadId); err != nil {
+		return "", "", err
+	}
+	if _, err := tx.Exec(metrics.WithQueryName(ctx, "mark_thread_read"),
+		`INSERT INTO helpschool.message_reads( thread_id,user_id,read_date) VALUES ( $1, $2, now())
+			on conflict (thread_id,user_id) do update set read_date = excluded.read_date`, threadId, authorId); err != nil {
+		return "", "", err
+	}
+	return messageId, status, nil
+}
+
+const selectMessages = `select m.message_id,m.thread_id,m.author_id,
+	coalesce(nullif(u.display_name,''),nullif(u.user_name,''),'User'),m.body,m.attachment_key is not null,m.status,
+	coalesce(m.filter_reasons,''),m.created_date
+	from helpschool.messages as m
+	inner join helpschool.users as u on u.id = m.author_id `
+
+func scanMessage(row pgx.Row) (*dto.Messages, error) {
+	message := &dto.Messages{}
+	var hasAttachment bool
+	err := row.Scan(&message.MessageId, &message.ThreadId, &message.AuthorId, &message.AuthorName, &message.Body,
+		&hasAttachment, &message.Status, &message.FilterReasons, &message.CreatedDate)
+	if hasAttachment {
+		message.AttachmentUrl = "/api/messages/" + message.ThreadId + "/messages/" + message.MessageId + "/attachment"
+	}
+	return message, err
+}
+
+// GetMessages returns a thread with its messages and marks it as read.
+// Held messages are only shown to their author and moderators, removed
+// ones only to moderators.
+func (a *MessagesServiceInternal) GetMessages(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	ctx := r.Context()
+	thread, side, err := a.thread(ctx, chi.URLParam(r, "threadId"), user)
+	if errors.Is(err, errNoThread) {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+
+	thread.Messages = []dto.Messages{}
+	err = forEachRow(metrics.WithQueryName(ctx, "list_messages"), a.db,
+		selectMessages+`where m.thread_id = $1 and (m.status = 'visible' or $3
+			or (m.status = 'held' and m.author_id = $2)) order by m.created_date`,
+		[]interface{}{thread.ThreadId, user.UserId, side == sideModerator},
+		func(rows pgx.Rows) error {
+			message, err := scanMessage(rows)
+			if err == nil {
+				thread.Messages = append(thread.Messages, *message)
+			}
+			return err
+		})
+	if err == nil && side != sideModerator {
+		_, err = a.db.Exec(metrics.WithQueryName(ctx, "mark_thread_read"),
+			`INSERT INTO helpschool.message_reads( thread_id,user_id,read_date) VALUES ( $1, $2, now())
+				on conflict (thread_id,user_id) do update set read_date = excluded.read_date`,
+			thread.ThreadId, user.UserId)
+	}
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if err := render.Render(w, r, response.MessageThreadsResponse{MessageThreads: thread}); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+// CreateMessages posts a message to a thread, as a multipart form with the
+// field "body" and optionally an image in "attachment".
+func (a *MessagesServiceInternal) CreateMessages(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	ctx := r.Context()
+	thread, side, err := a.thread(ctx, chi.URLParam(r, "threadId"), user)
+	if errors.Is(err, errNoThread) {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if side == sideModerator {
+		render.Render(w, r, util.ErrForbidden)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageSize+1<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("expected a multipart form of at most 5MB")))
+		return
+	}
+	body := r.FormValue("body")
+	if strings.TrimSpace(body) == "" || utf8.RuneCountInString(body) > maxMessageLength {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("body must be 1 to 4000 characters")))
+		return
+	}
+	var attachment io.Reader
+	var ext string
+	file, _, err := r.FormFile("attachment")
+	if err == nil {
+		defer file.Close()
+		if attachment, ext, err = sniffImage(file); err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(err))
+			return
+		}
+	} else if !errors.Is(err, http.ErrMissingFile) {
+		render.Render(w, r, util.ErrInvalidRequest(errImageType))
+		return
+	}
+
+	allowContact, err := a.allowContact(ctx, thread)
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	checked := filter.Check(body, allowContact)
+
+	var attachmentKey string
+	if attachment != nil {
+		attachmentKey = path.Join("messages", thread.ThreadId, uuid.New().String()+ext)
+		if err := a.store.Put(ctx, attachmentKey, attachment); err != nil {
+			logging.FromContext(ctx).Error("store message attachment failed", "err", err)
+			render.Render(w, r, util.ErrInternal(err))
+			return
+		}
+	}
+
+	tx, err := a.db.Begin(ctx)
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	defer tx.Rollback(ctx)
+	messageId, status, err := insertMessage(ctx, tx, thread.ThreadId, user.UserId, checked, false, attachmentKey)
+	if err == nil {
+		err = tx.Commit(ctx)
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("create message failed", "err", err)
+		if attachmentKey != "" {
+			_ = a.store.Delete(ctx, attachmentKey)
+		}
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	render.DefaultResponder(w, r, render.M{"status": "created", "message_id": messageId,
+		"message_status": status, "filter_reasons": checked.Reasons})
+}
+
+// GetMessageAttachment serves the image attached to a message to the
+// participants of its thread.
+func (a *MessagesServiceInternal) GetMessageAttachment(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	ctx := r.Context()
+	thread, side, err := a.thread(ctx, chi.URLParam(r, "threadId"), user)
+	if errors.Is(err, errNoThread) {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	var key string
+	err = a.db.QueryRow(metrics.WithQueryName(ctx, "get_message_attachment"),
+		`select attachment_key from helpschool.messages
+			where message_id::text = $1 and thread_id = $2 and attachment_key is not null
+			and (status = 'visible' or $4 or (status = 'held' and author_id = $3))`,
+		chi.URLParam(r, "messageId"), thread.ThreadId, user.UserId, side == sideModerator).Scan(&key)
+	if errors.Is(err, pgx.ErrNoRows) {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	serveImage(w, r, a.store, key)
+}
+
+// ListHeldMessages lists messages for moderators, by default the ones held
+// by the content filter.
+func (a *MessagesServiceInternal) ListHeldMessages(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = dto.MessageHeld
+	}
+	messages := []render.Renderer{}
+	err := forEachRow(metrics.WithQueryName(r.Context(), "list_moderated_messages"), a.db,
+		selectMessages+"where m.status = $1 order by m.created_date limit 200", []interface{}{status},
+		func(rows pgx.Rows) error {
+			message, err := scanMessage(rows)
+			if err == nil {
+				messages = append(messages, response.MessagesResponse{Messages: message})
+			}
+			return err
+		})
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if err := render.RenderList(w, r, messages); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+// ModerateMessages approves a held message or takes a message down.
+func (a *MessagesServiceInternal) ModerateMessages(w http.ResponseWriter, r *http.Request) {
+	moderator, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	messageId, err := uuid.Parse(chi.URLParam(r, "messageId"))
+	if err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	data := &request.MessageModerationRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	if data.Status != dto.MessageVisible && data.Status != dto.MessageRemoved {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("status must be visible or removed")))
+		return
+	}
+	tag, err := a.db.Exec(metrics.WithQueryName(r.Context(), "moderate_message"),
+		`update helpschool.messages set status = $2, moderated_by = $3, modified_date = now()
+			where message_id = $1`, messageId, data.Status, moderator.UserId)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("moderate message failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	render.DefaultResponder(w, r, render.M{"status": data.Status})
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"errors"
+	"github.com/venkata6/helpschool/api/geo"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultRadiusKm = 25
+	maxRadiusKm     = 200
+)
+
+// earthDistance is the distance in meters of a school s from the point
+// ($1, $2), within earthWithin of $3 meters. earth_box uses the index on
+// schools, the exact distance check drops the corners of the box.
+const (
+	earthDistance = `earth_distance(ll_to_earth($1,$2), ll_to_earth(s.latitude,s.longitude))`
+	earthWithin   = `s.latitude is not null and s.longitude is not null
+		and earth_box(ll_to_earth($1,$2), $3) @> ll_to_earth(s.latitude,s.longitude)
+		and ` + earthDistance + ` <= $3`
+)
+
+// parseNear reads the location of a "near me" query: lat and lng, or near
+// holding "lat,lng" or a postal code, and radius in km. ok is false when
+// the request has no location.
+func parseNear(r *http.Request, centroids geo.Centroids) (point geo.Point, radiusMeters float64, ok bool, err error) {
+	q := r.URL.Query()
+	switch {
+	case q.Get("lat") != "" || q.Get("lng") != "":
+		point, err = geo.ParsePoint(q.Get("lat") + "," + q.Get("lng"))
+	case q.Get("near") != "":
+		if point, err = geo.ParsePoint(q.Get("near")); err != nil {
+			var found bool
+			if point, found = centroids.Lookup(q.Get("near")); found {
+				err = nil
+			} else {
+				err = errors.New(`near must be "lat,lng" or a known postal code`)
+			}
+		}
+	default:
+		return geo.Point{}, 0, false, nil
+	}
+	if err != nil {
+		return geo.Point{}, 0, true, err
+	}
+
+	radius := float64(defaultRadiusKm)
+	if v := q.Get("radius"); v != "" {
+		if radius, err = strconv.ParseFloat(v, 64); err != nil || math.IsNaN(radius) || math.IsInf(radius, 0) || radius <= 0 || radius > maxRadiusKm {
+			return geo.Point{}, 0, true, errors.New("radius must be a number of km up to 200")
+		}
+	}
+	return point, radius * 1000, true, nil
+}
@@ -0,0 +1,158 @@
+package service
+
+import (
+	"errors"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/dto"
+	"github.com/venkata6/helpschool/api/i18n"
+	"github.com/venkata6/helpschool/api/logging"
+	"github.com/venkata6/helpschool/api/metrics"
+	"github.com/venkata6/helpschool/api/request"
+	"github.com/venkata6/helpschool/api/response"
+	"github.com/venkata6/helpschool/api/util"
+	"net/http"
+)
+
+type NeedRecurrencesService interface {
+	GetNeedRecurrences(w http.ResponseWriter, r *http.Request)
+	CreateNeedRecurrences(w http.ResponseWriter, r *http.Request)
+	DeleteNeedRecurrences(w http.ResponseWriter, r *http.Request)
+}
+
+type NeedRecurrencesServiceInternal struct {
+	db *pgxpool.Pool
+}
+
+func NewNeedRecurrencesService(db *pgxpool.Pool) NeedRecurrencesService {
+	return &NeedRecurrencesServiceInternal{db: db}
+}
+
+// schoolOfRoute returns the school in the route when the authenticated
+// user manages it, after answering the request otherwise.
+func (a *NeedRecurrencesServiceInternal) schoolOfRoute(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return uuid.UUID{}, false
+	}
+	schoolId, err := uuid.Parse(chi.URLParam(r, "schoolId"))
+	if err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return uuid.UUID{}, false
+	}
+	if allowed, err := canManageSchool(r.Context(), a.db, user.UserId, schoolId.String()); err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return uuid.UUID{}, false
+	} else if !allowed {
+		render.Render(w, r, util.ErrForbidden)
+		return uuid.UUID{}, false
+	}
+	return schoolId, true
+}
+
+// GetNeedRecurrences lists the recurring needs of a school for its
+// teachers and moderators.
+func (a *NeedRecurrencesServiceInternal) GetNeedRecurrences(w http.ResponseWriter, r *http.Request) {
+	schoolId, ok := a.schoolOfRoute(w, r)
+	if !ok {
+		return
+	}
+	list := []render.Renderer{}
+	err := forEachRow(metrics.WithQueryName(r.Context(), "list_need_recurrences"), a.db,
+		`select n.recurrence_id::text,n.school_id::text,n.supply_id::text,helpschool.localized(su.title_translations,su.title,$2),
+			n.quantity,coalesce(n.extra_info::text,''),n.open_month,n.open_day,n.needed_within_days,
+			coalesce(to_char(n.last_opened,'YYYY-MM-DD'),'')
+		from helpschool.need_recurrences as n
+		inner join helpschool.supplies as su on su.supply_id = n.supply_id
+		where n.school_id = $1 order by n.open_month, n.open_day`,
+		[]interface{}{schoolId, i18n.FromContext(r.Context()).Chain},
+		func(rows pgx.Rows) error {
+			recurrence := &dto.NeedRecurrences{}
+			if err := rows.Scan(&recurrence.RecurrenceId, &recurrence.SchoolId, &recurrence.SupplyId, &recurrence.Title,
+				&recurrence.Quantity, &recurrence.ExtraInfo, &recurrence.OpenMonth, &recurrence.OpenDay,
+				&recurrence.NeededWithinDays, &recurrence.LastOpened); err != nil {
+				return err
+			}
+			list = append(list, response.NeedRecurrencesResponse{NeedRecurrences: recurrence})
+			return nil
+		})
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+// CreateNeedRecurrences makes a need of a school recur every year, or
+// changes when it recurs. The first time it re-opens is the next open day,
+// today counting as already opened.
+func (a *NeedRecurrencesServiceInternal) CreateNeedRecurrences(w http.ResponseWriter, r *http.Request) {
+	schoolId, ok := a.schoolOfRoute(w, r)
+	if !ok {
+		return
+	}
+	user, _ := UserFromContext(r.Context())
+	data := &request.NeedRecurrencesRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	supplyId, err := uuid.Parse(data.SupplyId)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("invalid SupplyId")))
+		return
+	}
+
+	var recurrenceId string
+	err = a.db.QueryRow(metrics.WithQueryName(r.Context(), "upsert_need_recurrence"),
+		`INSERT INTO helpschool.need_recurrences( school_id,supply_id,quantity,extra_info,open_month,open_day,needed_within_days,last_opened,created_by)
+			VALUES ( $1, $2, $3, nullif($4,'')::jsonb, $5, $6, $7, current_date, $8)
+			on conflict (school_id,supply_id) do update
+				set quantity = excluded.quantity, extra_info = excluded.extra_info, open_month = excluded.open_month,
+					open_day = excluded.open_day, needed_within_days = excluded.needed_within_days
+			returning recurrence_id::text`,
+		schoolId, supplyId, data.Quantity, data.ExtraInfo, data.OpenMonth, data.OpenDay, data.NeededWithinDays,
+		user.UserId).Scan(&recurrenceId)
+	if sqlState(err) == foreignKeyViolation {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("unknown SupplyId")))
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("create need recurrence failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	render.DefaultResponder(w, r, render.M{"status": "created", "recurrence_id": recurrenceId})
+}
+
+// DeleteNeedRecurrences stops a need from recurring, the need itself stays.
+func (a *NeedRecurrencesServiceInternal) DeleteNeedRecurrences(w http.ResponseWriter, r *http.Request) {
+	schoolId, ok := a.schoolOfRoute(w, r)
+	if !ok {
+		return
+	}
+	recurrenceId, err := uuid.Parse(chi.URLParam(r, "recurrenceId"))
+	if err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	tag, err := a.db.Exec(metrics.WithQueryName(r.Context(), "delete_need_recurrence"),
+		`delete from helpschool.need_recurrences where recurrence_id = $1 and school_id = $2`, recurrenceId, schoolId)
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	render.DefaultResponder(w, r, render.M{"status": "deleted"})
+}
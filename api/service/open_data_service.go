@@ -0,0 +1,80 @@
+package service
+
+import (
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/venkata6/helpschool/api/export"
+	"github.com/venkata6/helpschool/api/logging"
+	"github.com/venkata6/helpschool/api/opendata"
+	"github.com/venkata6/helpschool/api/util"
+	"net/http"
+)
+
+type OpenDataService interface {
+	GetOpenDataDictionary(w http.ResponseWriter, r *http.Request)
+	GetOpenDataset(w http.ResponseWriter, r *http.Request)
+}
+
+type OpenDataServiceInternal struct {
+	feed *opendata.Feed
+}
+
+func NewOpenDataService(feed *opendata.Feed) OpenDataService {
+	return &OpenDataServiceInternal{feed: feed}
+}
+
+// GetOpenDataDictionary describes the datasets of the open-data feed: their
+// columns, files and how small cells are suppressed.
+func (a *OpenDataServiceInternal) GetOpenDataDictionary(w http.ResponseWriter, r *http.Request) {
+	release, err := a.feed.Release(r.Context())
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	render.DefaultResponder(w, r, release)
+}
+
+// GetOpenDataset serves a dataset, as in /api/open-data/v1/needs-by-district.csv,
+// as CSV, JSON rows or JSON columns.
+func (a *OpenDataServiceInternal) GetOpenDataset(w http.ResponseWriter, r *http.Request) {
+	format := exportFormat(r)
+	if format != "csv" && format != "json" && format != "columnar" {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	release, err := a.feed.Release(r.Context())
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	dataset := release.Dataset(chi.URLParam(r, "dataset"))
+	if dataset == nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Header().Set("X-Data-Version", release.Version)
+	switch format {
+	case "columnar":
+		w.Header().Set("Content-Type", export.Formats["json"])
+		err = dataset.WriteColumnar(w, release)
+	case "csv", "json":
+		w.Header().Set("Content-Type", export.Formats[format])
+		var out export.Writer
+		if out, err = export.New(format, w, dataset.Names()); err == nil {
+			for _, row := range dataset.Rows {
+				if err = out.Write(row...); err != nil {
+					break
+				}
+			}
+			if err == nil {
+				err = out.Close()
+			}
+		}
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("write open dataset failed", "dataset", dataset.Name, "err", err)
+	}
+}
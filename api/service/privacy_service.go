@@ -0,0 +1,230 @@
+package service
+
+import (
+	"errors"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/dto"
+	"github.com/venkata6/helpschool/api/logging"
+	"github.com/venkata6/helpschool/api/metrics"
+	"github.com/venkata6/helpschool/api/pii"
+	"github.com/venkata6/helpschool/api/privacy"
+	"github.com/venkata6/helpschool/api/request"
+	"github.com/venkata6/helpschool/api/response"
+	"github.com/venkata6/helpschool/api/storage"
+	"github.com/venkata6/helpschool/api/util"
+	"net/http"
+	"strings"
+)
+
+type PrivacyService interface {
+	ExportMe(w http.ResponseWriter, r *http.Request)
+	EraseMe(w http.ResponseWriter, r *http.Request)
+	GetPrivacyRequests(w http.ResponseWriter, r *http.Request)
+	GetPrivacySubjects(w http.ResponseWriter, r *http.Request)
+	ExportPrivacySubjects(w http.ResponseWriter, r *http.Request)
+	ErasePrivacySubjects(w http.ResponseWriter, r *http.Request)
+}
+
+type PrivacyServiceInternal struct {
+	db     *pgxpool.Pool
+	store  storage.Store
+	cipher *pii.Cipher
+}
+
+func NewPrivacyService(db *pgxpool.Pool, store storage.Store, cipher *pii.Cipher) PrivacyService {
+	return &PrivacyServiceInternal{db: db, store: store, cipher: cipher}
+}
+
+// export streams the zip of the personal data of s, logging the request.
+func (a *PrivacyServiceInternal) export(w http.ResponseWriter, r *http.Request, s privacy.Subject, handledBy, note string) {
+	ctx := r.Context()
+	if err := privacy.Log(ctx, a.db, s, privacy.KindExport, handledBy, note); err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="helpschool-personal-data.zip"`)
+	w.Header().Set("Cache-Control", "private, no-store")
+	if err := privacy.Export(ctx, a.db, a.store, a.cipher, s, w); err != nil {
+		// the response is under way, the client gets a broken zip
+		logging.FromContext(ctx).Error("export personal data failed", "err", err)
+	}
+}
+
+// erase erases the personal data of s and logs the request.
+func (a *PrivacyServiceInternal) erase(w http.ResponseWriter, r *http.Request, s privacy.Subject, handledBy, note string) bool {
+	ctx := r.Context()
+	if err := privacy.Erase(ctx, a.db, a.store, a.cipher, s); err != nil {
+		logging.FromContext(ctx).Error("erase personal data failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
+		return false
+	}
+	if err := privacy.Log(ctx, a.db, s, privacy.KindErasure, handledBy, note); err != nil {
+		// the erasure is done, a missing log entry must not undo the answer
+		logging.FromContext(ctx).Error("log erasure failed", "err", err)
+	}
+	return true
+}
+
+// ExportMe streams a zip of the caller's personal data, what is kept by
+// their account. Rows kept by email only are not theirs until the email is
+// proven, by claiming guest pledges or through an admin.
+func (a *PrivacyServiceInternal) ExportMe(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	a.export(w, r, privacy.Subject{UserId: user.UserId}, "", "")
+}
+
+// EraseMe erases the caller's personal data kept by their account, the
+// account is left pseudonymized and signing in again starts a new one.
+func (a *PrivacyServiceInternal) EraseMe(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	if a.erase(w, r, privacy.Subject{UserId: user.UserId}, "", "") {
+		render.DefaultResponder(w, r, render.M{"status": "deleted"})
+	}
+}
+
+// GetPrivacyRequests lists the handled exports and erasures, newest first,
+// optionally of one user.
+func (a *PrivacyServiceInternal) GetPrivacyRequests(w http.ResponseWriter, r *http.Request) {
+	var userId interface{}
+	if v := r.URL.Query().Get("user_id"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(errors.New("invalid user_id")))
+			return
+		}
+		userId = id
+	}
+	list := []render.Renderer{}
+	err := forEachRow(metrics.WithQueryName(r.Context(), "list_privacy_requests"), a.db,
+		`select request_id::text,kind,coalesce(user_id::text,''),coalesce(email_hash,''),coalesce(handled_by::text,''),
+			coalesce(note,''),created_date
+		from helpschool.privacy_requests where ($1::uuid is null or user_id = $1)
+		order by created_date desc limit 500`, []interface{}{userId},
+		func(rows pgx.Rows) error {
+			req := &dto.PrivacyRequests{}
+			if err := rows.Scan(&req.RequestId, &req.Kind, &req.UserId, &req.EmailHash, &req.HandledBy,
+				&req.Note, &req.CreatedDate); err != nil {
+				return err
+			}
+			list = append(list, response.PrivacyRequestsResponse{PrivacyRequests: req})
+			return nil
+		})
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+// GetPrivacySubjects finds what is kept about an email, for an admin to
+// tell whom a request is about.
+func (a *PrivacyServiceInternal) GetPrivacySubjects(w http.ResponseWriter, r *http.Request) {
+	email := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("email")))
+	if email == "" {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("email is required")))
+		return
+	}
+	ctx := r.Context()
+	subjects := &dto.PrivacySubjects{Accounts: []dto.PrivacyAccounts{}}
+	err := forEachRow(metrics.WithQueryName(ctx, "find_privacy_accounts"), a.db,
+		`select id::text,coalesce(nullif(display_name,''),user_name,''),created_date,erased_date
+		from helpschool.users where lower(user_email) = $1 order by created_date`, []interface{}{email},
+		func(rows pgx.Rows) error {
+			var account dto.PrivacyAccounts
+			if err := rows.Scan(&account.UserId, &account.Name, &account.CreatedDate, &account.ErasedDate); err != nil {
+				return err
+			}
+			subjects.Accounts = append(subjects.Accounts, account)
+			return nil
+		})
+	if err == nil {
+		err = a.db.QueryRow(metrics.WithQueryName(ctx, "count_privacy_records"),
+			`select (select count(*) from helpschool.users_donations where user_id is null and lower(guest_email) = $1),
+				(select count(*) from helpschool.teacher_requests
+					where teacher_email_bidx = $2 or (pii_key_id is null and lower(teacher_email) = $1))`,
+			email, a.cipher.Index(pii.Email, email)).
+			Scan(&subjects.GuestPledges, &subjects.TeacherRequests)
+	}
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if err := render.Render(w, r, response.PrivacySubjectsResponse{PrivacySubjects: subjects}); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+// subjectOf reads the subject of an admin's request.
+func subjectOf(data *request.PrivacyRequestsRequest) (privacy.Subject, error) {
+	s := privacy.Subject{Email: data.Email}
+	if data.UserId != "" {
+		id, err := uuid.Parse(data.UserId)
+		if err != nil {
+			return s, errors.New("invalid user_id")
+		}
+		s.UserId = id.String()
+	}
+	return s, nil
+}
+
+// ExportPrivacySubjects streams the zip of the personal data of a user or
+// an email for an admin answering their request, as in
+// /api/privacy-requests/export?user_id=&email=&note=.
+func (a *PrivacyServiceInternal) ExportPrivacySubjects(w http.ResponseWriter, r *http.Request) {
+	admin, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+	data := &request.PrivacyRequestsRequest{UserId: q.Get("user_id"), Email: q.Get("email"), Note: q.Get("note")}
+	if err := data.Bind(r); err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	s, err := subjectOf(data)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	a.export(w, r, s, admin.UserId, data.Note)
+}
+
+// ErasePrivacySubjects erases the personal data of a user or an email for
+// an admin answering their request.
+func (a *PrivacyServiceInternal) ErasePrivacySubjects(w http.ResponseWriter, r *http.Request) {
+	admin, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	data := &request.PrivacyRequestsRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	s, err := subjectOf(data)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	if a.erase(w, r, s, admin.UserId, data.Note) {
+		render.DefaultResponder(w, r, render.M{"status": "deleted"})
+	}
+}
@@ -0,0 +1,48 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/metrics"
+	"time"
+)
+
+// maxRateWindow is the longest window of a rate limit, rows of
+// helpschool.rate_limits older than it are dropped.
+const maxRateWindow = 24 * time.Hour
+
+var errRateLimited = errors.New("too many requests, try again later")
+
+// rateLimit allows hits on key per window.
+type rateLimit struct {
+	key    string
+	hits   int
+	window time.Duration
+}
+
+// rateKey names the counter of kind for value, hashed so that addresses
+// are not kept.
+func rateKey(kind, value string) string {
+	sum := sha256.Sum256([]byte(kind + ":" + value))
+	return kind + ":" + hex.EncodeToString(sum[:])
+}
+
+// allow counts a hit on key and reports whether it is within limit hits per
+// window, which is at most maxRateWindow. Counters live in the database so
+// that they hold across instances.
+func allow(ctx context.Context, db *pgxpool.Pool, key string, limit int, window time.Duration) (bool, error) {
+	var hits int
+	err := db.QueryRow(metrics.WithQueryName(ctx, "count_rate_limit_hit"),
+		`with expired as (
+			delete from helpschool.rate_limits where window_start < now() - $3::float8 * interval '1 second' and key <> $1
+		)
+		INSERT INTO helpschool.rate_limits( key,window_start,hits) VALUES ( $1, now(), 1)
+			on conflict (key) do update set
+				hits = case when rate_limits.window_start > now() - $2::float8 * interval '1 second' then rate_limits.hits + 1 else 1 end,
+				window_start = case when rate_limits.window_start > now() - $2::float8 * interval '1 second' then rate_limits.window_start else now() end
+			returning hits`, key, window.Seconds(), maxRateWindow.Seconds()).Scan(&hits)
+	return hits <= limit, err
+}
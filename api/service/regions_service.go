@@ -0,0 +1,178 @@
+package service
+
+import (
+	"errors"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/dto"
+	"github.com/venkata6/helpschool/api/i18n"
+	"github.com/venkata6/helpschool/api/logging"
+	"github.com/venkata6/helpschool/api/metrics"
+	"github.com/venkata6/helpschool/api/request"
+	"github.com/venkata6/helpschool/api/response"
+	"github.com/venkata6/helpschool/api/util"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultTreeDepth = 1
+	maxTreeDepth     = 6
+)
+
+// managedLevels are the regions kept in their own tables and routes, they
+// are mirrored into regions by triggers and not created here.
+var managedLevels = map[string]bool{"country": true, "state": true, "district": true}
+
+type RegionsService interface {
+	GetRegionTree(w http.ResponseWriter, r *http.Request)
+	CreateRegions(w http.ResponseWriter, r *http.Request)
+}
+
+type RegionsServiceInternal struct {
+	db *pgxpool.Pool
+}
+
+func NewRegionsService(db *pgxpool.Pool) RegionsService {
+	return &RegionsServiceInternal{db: db}
+}
+
+// GetRegionTree returns the regions below root, or the countries without
+// it, depth levels deep (1 by default). Clients expand a node later by
+// asking for it as root. With schools=true the schools of every returned
+// region are listed as its leaves.
+func (a *RegionsServiceInternal) GetRegionTree(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	q := r.URL.Query()
+	var root interface{}
+	if v := q.Get("root"); v != "" {
+		rootId, err := uuid.Parse(v)
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(errors.New("invalid root")))
+			return
+		}
+		var exists bool
+		if err := a.db.QueryRow(metrics.WithQueryName(ctx, "region_exists"),
+			`select exists(select 1 from helpschool.regions where region_id = $1)`, rootId).Scan(&exists); err != nil {
+			render.Render(w, r, util.ErrInternal(err))
+			return
+		}
+		if !exists {
+			render.Render(w, r, util.ErrNotFound)
+			return
+		}
+		root = rootId
+	}
+	depth := defaultTreeDepth
+	if v := q.Get("depth"); v != "" {
+		var err error
+		if depth, err = strconv.Atoi(v); err != nil || depth < 1 || depth > maxTreeDepth {
+			render.Render(w, r, util.ErrInvalidRequest(errors.New("depth must be between 1 and 6")))
+			return
+		}
+	}
+
+	// depth is counted from root, the countries are at depth 1 without one.
+	// Names are in the language of the request, sorted the way it sorts.
+	locale := i18n.FromContext(ctx)
+	nodes := map[string]*dto.Regions{}
+	var ids []string
+	top := []*dto.Regions{}
+	err := forEachRow(metrics.WithQueryName(ctx, "list_region_tree"), a.db,
+		`select r.region_id::text,coalesce(r.parent_id::text,''),r.level,
+			helpschool.localized(r.name_translations,r.name,$3),coalesce(r.govt_id,''),
+			p.depth + case when $1::uuid is null then 1 else 0 end,
+			(select count(*) from helpschool.regions as c where c.parent_id = r.region_id),
+			(select count(*) from helpschool.region_paths as sp
+				inner join helpschool.schools as s on s.region_id = sp.descendant_id
+				where sp.ancestor_id = r.region_id)
+		from helpschool.region_paths as p
+		inner join helpschool.regions as a on a.region_id = p.ancestor_id
+		inner join helpschool.regions as r on r.region_id = p.descendant_id
+		where case when $1::uuid is null then a.parent_id is null and p.depth < $2
+			else p.ancestor_id = $1 and p.depth between 1 and $2 end
+		order by 6, helpschool.localized(r.name_translations,r.name,$3) collate `+locale.Collation(),
+		[]interface{}{root, depth, locale.Chain},
+		func(rows pgx.Rows) error {
+			node := &dto.Regions{}
+			if err := rows.Scan(&node.RegionId, &node.ParentId, &node.Level, &node.Name, &node.GovtId,
+				&node.Depth, &node.ChildCount, &node.SchoolCount); err != nil {
+				return err
+			}
+			// rows come parents first
+			if parent, ok := nodes[node.ParentId]; ok {
+				parent.Children = append(parent.Children, node)
+			} else {
+				top = append(top, node)
+			}
+			nodes[node.RegionId] = node
+			ids = append(ids, node.RegionId)
+			return nil
+		})
+	if err == nil && q.Get("schools") == "true" && len(ids) > 0 {
+		err = forEachRow(metrics.WithQueryName(ctx, "list_region_schools"), a.db,
+			`select school_id::text,name,coalesce(place,''),region_id::text from helpschool.schools
+			where region_id = any($1::uuid[]) order by name`, []interface{}{ids},
+			func(rows pgx.Rows) error {
+				var school dto.RegionSchools
+				var regionId string
+				if err := rows.Scan(&school.SchoolId, &school.Name, &school.Place, &regionId); err != nil {
+					return err
+				}
+				nodes[regionId].Schools = append(nodes[regionId].Schools, school)
+				return nil
+			})
+	}
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+
+	list := []render.Renderer{}
+	for _, node := range top {
+		list = append(list, response.RegionsResponse{Regions: node})
+	}
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+// CreateRegions adds a region below an existing one, for the levels a
+// country has below its districts.
+func (a *RegionsServiceInternal) CreateRegions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	data := &request.RegionsRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	if managedLevels[data.Level] {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("countries, states and districts are created through their own routes")))
+		return
+	}
+	parentId, err := uuid.Parse(data.ParentId)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("invalid parent_id")))
+		return
+	}
+
+	var regionId string
+	err = a.db.QueryRow(metrics.WithQueryName(ctx, "create_region"),
+		`INSERT INTO helpschool.regions( parent_id,level,name,govt_id)
+			select region_id, $2, $3, nullif($4,'') from helpschool.regions where region_id = $1
+			returning region_id::text`, parentId, data.Level, data.Name, data.GovtId).Scan(&regionId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("unknown parent_id")))
+		return
+	}
+	if err != nil {
+		logging.FromContext(ctx).Error("create region failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	render.DefaultResponder(w, r, render.M{"status": "created", "region_id": regionId})
+}
@@ -0,0 +1,225 @@
+package service
+
+import (
+	"errors"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/dto"
+	"github.com/venkata6/helpschool/api/export"
+	"github.com/venkata6/helpschool/api/logging"
+	"github.com/venkata6/helpschool/api/metrics"
+	"github.com/venkata6/helpschool/api/response"
+	"github.com/venkata6/helpschool/api/storage"
+	"github.com/venkata6/helpschool/api/transparency"
+	"github.com/venkata6/helpschool/api/util"
+	"io"
+	"net/http"
+	"time"
+)
+
+type ReportsService interface {
+	ExportNeeds(w http.ResponseWriter, r *http.Request)
+	ExportPledges(w http.ResponseWriter, r *http.Request)
+	ExportDeliveries(w http.ResponseWriter, r *http.Request)
+	GetTransparencyReports(w http.ResponseWriter, r *http.Request)
+	GetTransparencyReport(w http.ResponseWriter, r *http.Request)
+}
+
+type ReportsServiceInternal struct {
+	db    *pgxpool.Pool
+	store storage.Store
+}
+
+func NewReportsService(db *pgxpool.Pool, store storage.Store) ReportsService {
+	return &ReportsServiceInternal{db: db, store: store}
+}
+
+// reportLocation joins the school of the row aliased x with its district,
+// state and country, and keeps the schools in the region $1, if given.
+const reportLocation = `
+	inner join helpschool.schools as sc on sc.school_id = x.school_id
+	inner join helpschool.districts as di on di.district_id = sc.district_id
+	inner join helpschool.states as st on st.state_id = di.state_id
+	inner join helpschool.countries as c on c.country_id = st.country_id
+	where ($1::uuid is null or sc.region_id in (select descendant_id from helpschool.region_paths where ancestor_id = $1))`
+
+// exportFormat is the extension of the path, as in /api/reports/needs.xlsx,
+// or else the format parameter, csv by default.
+func exportFormat(r *http.Request) string {
+	if format, _ := r.Context().Value(middleware.URLFormatCtxKey).(string); format != "" {
+		return format
+	}
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format
+	}
+	return "csv"
+}
+
+// reportFilters reads the region and the dates from and to of a report,
+// either may be left out.
+func reportFilters(r *http.Request) (region, from, to interface{}, err error) {
+	q := r.URL.Query()
+	if v := q.Get("region"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			return nil, nil, nil, errors.New("invalid region")
+		}
+		region = id
+	}
+	for _, param := range []struct {
+		name string
+		dst  *interface{}
+		err  error
+	}{
+		{"from", &from, errors.New("from must be a date like 2024-01-31")},
+		{"to", &to, errors.New("to must be a date like 2024-01-31")},
+	} {
+		if v := q.Get(param.name); v != "" {
+			t, err := time.Parse("2006-01-02", v)
+			if err != nil {
+				return nil, nil, nil, param.err
+			}
+			*param.dst = t
+		}
+	}
+	return region, from, to, nil
+}
+
+// exportReport streams the rows of sql as the file name in the format of
+// the request. Its columns must be text, integers, timestamps or null.
+// sql takes the region, from and to filters as $1, $2 and $3.
+func (a *ReportsServiceInternal) exportReport(w http.ResponseWriter, r *http.Request, name string, columns []string, sql string) {
+	format := exportFormat(r)
+	contentType, ok := export.Formats[format]
+	if !ok {
+		render.Render(w, r, util.ErrInvalidRequest(export.ErrUnknownFormat))
+		return
+	}
+	region, from, to, err := reportFilters(r)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	ctx := metrics.WithQueryName(r.Context(), "export_"+name)
+	rows, err := a.db.Query(ctx, sql, region, from, to)
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+"."+format+`"`)
+	out, err := export.New(format, w, columns)
+	for err == nil && rows.Next() {
+		var values []interface{}
+		if values, err = rows.Values(); err == nil {
+			err = out.Write(values...)
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	if err == nil {
+		err = out.Close()
+	}
+	if err != nil {
+		// the response is under way, the client gets a truncated file
+		logging.FromContext(r.Context()).Error("export report failed", "report", name, "err", err)
+	}
+}
+
+// ExportNeeds exports the needs posted between from and to by the schools
+// in region.
+func (a *ReportsServiceInternal) ExportNeeds(w http.ResponseWriter, r *http.Request) {
+	a.exportReport(w, r, "needs", []string{"country", "state", "district", "school_id", "school", "supply_id",
+		"supply", "bundle_id", "quantity", "fulfilled_count", "status", "needed_by", "posted_date"},
+		`select c.name,st.name,di.name,sc.school_id::text,sc.name,x.supply_id::text,su.title,x.bundle_id::text,
+			x.quantity,coalesce(x.fulfilled_count,0),x.status,x.needed_by::text,x.created_date
+		from helpschool.school_supplies as x
+		inner join helpschool.supplies as su on su.supply_id = x.supply_id`+reportLocation+`
+			and ($2::timestamptz is null or x.created_date >= $2) and ($3::timestamptz is null or x.created_date < $3 + interval '1 day')
+		order by x.created_date`)
+}
+
+// ExportPledges exports the confirmed pledges made between from and to for
+// the schools in region. Donors are not named.
+func (a *ReportsServiceInternal) ExportPledges(w http.ResponseWriter, r *http.Request) {
+	a.exportReport(w, r, "pledges", []string{"donation_id", "pledged_date", "country", "state", "district",
+		"school_id", "school", "supply_id", "supply", "bundle_id", "quantity", "status", "delivered_date"},
+		`select x.donation_id::text,x.created_date,c.name,st.name,di.name,sc.school_id::text,sc.name,
+			x.supply_id::text,su.title,x.bundle_id::text,coalesce(x.quantity,0),x.status,x.delivered_date
+		from helpschool.users_donations as x
+		inner join helpschool.supplies as su on su.supply_id = x.supply_id`+reportLocation+`
+			and x.confirmed_date is not null
+			and ($2::timestamptz is null or x.created_date >= $2) and ($3::timestamptz is null or x.created_date < $3 + interval '1 day')
+		order by x.created_date`)
+}
+
+// ExportDeliveries exports the pledges delivered between from and to to
+// the schools in region.
+func (a *ReportsServiceInternal) ExportDeliveries(w http.ResponseWriter, r *http.Request) {
+	a.exportReport(w, r, "deliveries", []string{"donation_id", "delivered_date", "country", "state", "district",
+		"school_id", "school", "supply_id", "supply", "bundle_id", "quantity"},
+		`select x.donation_id::text,x.delivered_date,c.name,st.name,di.name,sc.school_id::text,sc.name,
+			x.supply_id::text,su.title,x.bundle_id::text,coalesce(x.quantity,0)
+		from helpschool.users_donations as x
+		inner join helpschool.supplies as su on su.supply_id = x.supply_id`+reportLocation+`
+			and x.confirmed_date is not null and x.delivered_date is not null
+			and ($2::timestamptz is null or x.delivered_date >= $2) and ($3::timestamptz is null or x.delivered_date < $3 + interval '1 day')
+		order by x.delivered_date`)
+}
+
+// GetTransparencyReports lists the published monthly transparency reports,
+// newest first.
+func (a *ReportsServiceInternal) GetTransparencyReports(w http.ResponseWriter, r *http.Request) {
+	list := []render.Renderer{}
+	err := forEachRow(metrics.WithQueryName(r.Context(), "list_transparency_reports"), a.db,
+		`select to_char(month,'YYYY-MM'),totals,created_date from helpschool.transparency_reports order by month desc`,
+		nil,
+		func(rows pgx.Rows) error {
+			report := &dto.TransparencyReports{}
+			if err := rows.Scan(&report.Month, &report.Totals, &report.PublishedAt); err != nil {
+				return err
+			}
+			report.JsonUrl = "/api/transparency-reports/" + report.Month + ".json"
+			report.CsvUrl = "/api/transparency-reports/" + report.Month + ".csv"
+			list = append(list, response.TransparencyReportsResponse{TransparencyReports: report})
+			return nil
+		})
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+// GetTransparencyReport serves the report of a month, such as
+// /api/transparency-reports/2024-05.csv, as JSON or CSV.
+func (a *ReportsServiceInternal) GetTransparencyReport(w http.ResponseWriter, r *http.Request) {
+	month, err := time.Parse("2006-01", chi.URLParam(r, "month"))
+	format := exportFormat(r)
+	if err != nil || (format != "json" && format != "csv") {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	f, err := a.store.Open(r.Context(), transparency.Key(month, format))
+	if errors.Is(err, storage.ErrNotFound) {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", export.Formats[format])
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	_, _ = io.Copy(w, f)
+}
@@ -0,0 +1,322 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/dto"
+	"github.com/venkata6/helpschool/api/logging"
+	"github.com/venkata6/helpschool/api/metrics"
+	"github.com/venkata6/helpschool/api/needs"
+	"github.com/venkata6/helpschool/api/response"
+	"github.com/venkata6/helpschool/api/storage"
+	"github.com/venkata6/helpschool/api/util"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+type SchoolProfilesService interface {
+	GetSchoolProfiles(w http.ResponseWriter, r *http.Request)
+	CreateSchoolUpdates(w http.ResponseWriter, r *http.Request)
+	GetSchoolUpdatePhoto(w http.ResponseWriter, r *http.Request)
+
+	// moderation
+	HideSchoolUpdates(w http.ResponseWriter, r *http.Request)
+}
+
+type SchoolProfilesServiceInternal struct {
+	db    *pgxpool.Pool
+	store storage.Store
+}
+
+func NewSchoolProfilesService(db *pgxpool.Pool, store storage.Store) SchoolProfilesService {
+	return &SchoolProfilesServiceInternal{db: db, store: store}
+}
+
+const maxUpdateLength = 4000
+
+// forEachRow runs the query and calls scan for every row.
+func forEachRow(ctx context.Context, db *pgxpool.Pool, sql string, args []interface{}, scan func(pgx.Rows) error) error {
+	rows, err := db.Query(ctx, sql, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// GetSchoolProfiles returns the public page of a school: where it is, who
+// teaches there, what it needs and what it received.
+func (a *SchoolProfilesServiceInternal) GetSchoolProfiles(w http.ResponseWriter, r *http.Request) {
+	schoolId, err := uuid.Parse(chi.URLParam(r, "schoolId"))
+	if err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	ctx := r.Context()
+	profile := &dto.SchoolProfiles{VerifiedTeachers: []string{}, OpenNeeds: []dto.SchoolNeed{},
+		FulfilledNeeds: []dto.SchoolNeed{}, Photos: []dto.SchoolUpdates{}, ThankYouNotes: []dto.SchoolUpdates{}}
+	err = a.db.QueryRow(metrics.WithQueryName(ctx, "get_school_profile"),
+		`select s.school_id,s.name,coalesce(s.place,''),coalesce(s.address,''),d.district_id,d.name,st.state_id,st.name,
+			c.country_id,c.name
+		from helpschool.schools as s
+		inner join helpschool.districts as d on d.district_id = s.district_id
+		inner join helpschool.states as st on st.state_id = d.state_id
+		inner join helpschool.countries as c on c.country_id = st.country_id
+		where s.school_id = $1`, schoolId).Scan(&profile.SchoolId, &profile.Name, &profile.Place, &profile.Address,
+		&profile.DistrictId, &profile.DistrictName, &profile.StateId, &profile.StateName, &profile.CountryId,
+		&profile.CountryName)
+	if errors.Is(err, pgx.ErrNoRows) {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+
+	err = forEachRow(metrics.WithQueryName(ctx, "list_school_teachers"), a.db,
+		`select coalesce(nullif(u.display_name,''),nullif(u.user_name,''),'Teacher')
+		from helpschool.teacher_affiliations as a
+		inner join helpschool.users as u on u.id = a.user_id
+		where a.school_id = $1 and a.status = 'approved' order by a.reviewed_date`, []interface{}{schoolId},
+		func(rows pgx.Rows) error {
+			var name string
+			err := rows.Scan(&name)
+			profile.VerifiedTeachers = append(profile.VerifiedTeachers, name)
+			return err
+		})
+	if err == nil {
+		err = forEachRow(metrics.WithQueryName(ctx, "list_school_needs"), a.db,
+			`select ss.supply_id,su.title,su.url,ss.quantity,coalesce(ss.fulfilled_count,0),ss.created_date,
+				coalesce(ss.modified_date,ss.created_date),coalesce(ss.bundle_id::text,''),
+				coalesce(to_char(ss.needed_by,'YYYY-MM-DD'),'')
+			from helpschool.school_supplies as ss
+			inner join helpschool.supplies as su on su.supply_id = ss.supply_id
+			where ss.school_id = $1 and (ss.status = $2 or ss.quantity <= coalesce(ss.fulfilled_count,0))
+			order by ss.created_date desc`, []interface{}{schoolId, needs.Open},
+			func(rows pgx.Rows) error {
+				need := dto.SchoolNeed{}
+				if err := rows.Scan(&need.SupplyId, &need.Title, &need.Url, &need.Quantity, &need.FulfilledCount,
+					&need.PostedDate, &need.ModifiedDate, &need.BundleId, &need.NeededBy); err != nil {
+					return err
+				}
+				profile.Stats.ItemsReceived += need.FulfilledCount
+				if need.Quantity > 0 {
+					need.Progress = float64(need.FulfilledCount) / float64(need.Quantity)
+				}
+				if need.Quantity > 0 && need.FulfilledCount >= need.Quantity {
+					need.Progress = 1
+					profile.FulfilledNeeds = append(profile.FulfilledNeeds, need)
+				} else {
+					profile.OpenNeeds = append(profile.OpenNeeds, need)
+				}
+				return nil
+			})
+	}
+	if err == nil {
+		err = a.db.QueryRow(metrics.WithQueryName(ctx, "count_school_donors"),
+			`select count(distinct coalesce(user_id::text,lower(guest_email))) from helpschool.users_donations
+			where school_id = $1 and status = 'Delivered' and confirmed_date is not null`, schoolId).
+			Scan(&profile.Stats.DonorsCount)
+	}
+	if err == nil {
+		err = forEachRow(metrics.WithQueryName(ctx, "list_school_updates"), a.db,
+			selectSchoolUpdates+"where u.school_id = $1 and not u.hidden order by u.created_date desc limit 50",
+			[]interface{}{schoolId},
+			func(rows pgx.Rows) error {
+				update, err := scanSchoolUpdate(rows)
+				if err != nil {
+					return err
+				}
+				if update.PhotoUrl != "" {
+					profile.Photos = append(profile.Photos, *update)
+				} else {
+					profile.ThankYouNotes = append(profile.ThankYouNotes, *update)
+				}
+				return nil
+			})
+	}
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	// fulfilled history shows the most recently completed needs first
+	sort.SliceStable(profile.FulfilledNeeds, func(i, j int) bool {
+		return profile.FulfilledNeeds[i].ModifiedDate.After(profile.FulfilledNeeds[j].ModifiedDate)
+	})
+	profile.Stats.NeedsFulfilled = len(profile.FulfilledNeeds)
+
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	if err := render.Render(w, r, response.SchoolProfilesResponse{SchoolProfiles: profile}); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+const selectSchoolUpdates = `select u.update_id,u.school_id,coalesce(u.supply_id::text,''),coalesce(su.title,''),
+	coalesce(nullif(a.display_name,''),nullif(a.user_name,''),'Teacher'),coalesce(u.body,''),u.photo_key is not null,
+	u.created_date
+	from helpschool.school_updates as u
+	inner join helpschool.users as a on a.id = u.author_id
+	left join helpschool.supplies as su on su.supply_id = u.supply_id `
+
+func scanSchoolUpdate(row pgx.Row) (*dto.SchoolUpdates, error) {
+	update := &dto.SchoolUpdates{}
+	var hasPhoto bool
+	err := row.Scan(&update.UpdateId, &update.SchoolId, &update.SupplyId, &update.Title, &update.AuthorName,
+		&update.Body, &hasPhoto, &update.CreatedDate)
+	if hasPhoto {
+		update.PhotoUrl = "/api/schools/" + update.SchoolId + "/updates/" + update.UpdateId + "/photo"
+	}
+	return update, err
+}
+
+// CreateSchoolUpdates posts a thank-you note or delivery photo on the page
+// of a school, as a multipart form with the fields "body", "photo" and
+// optionally "supply_id" of the need it is about. Only the school's
+// verified teachers and moderators may post. The route must be wrapped in
+// UsersService.Provision.
+func (a *SchoolProfilesServiceInternal) CreateSchoolUpdates(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	schoolId, err := uuid.Parse(chi.URLParam(r, "schoolId"))
+	if err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	ctx := r.Context()
+	if allowed, err := canManageSchool(ctx, a.db, user.UserId, schoolId.String()); err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	} else if !allowed {
+		render.Render(w, r, util.ErrForbidden)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageSize+1<<20)
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("expected a multipart form of at most 5MB")))
+		return
+	}
+	body := strings.TrimSpace(r.FormValue("body"))
+	if len(body) > maxUpdateLength {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("body is longer than 4000 characters")))
+		return
+	}
+	var supplyId *uuid.UUID
+	if v := r.FormValue("supply_id"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(errors.New("invalid supply_id")))
+			return
+		}
+		var exists bool
+		if err := a.db.QueryRow(metrics.WithQueryName(ctx, "school_need_exists"),
+			`select exists (select 1 from helpschool.school_supplies where school_id = $1 and supply_id = $2)`,
+			schoolId, id).Scan(&exists); err != nil {
+			render.Render(w, r, util.ErrInternal(err))
+			return
+		}
+		if !exists {
+			render.Render(w, r, util.ErrInvalidRequest(errors.New("the school has no such need")))
+			return
+		}
+		supplyId = &id
+	}
+
+	var photoKey string
+	file, _, err := r.FormFile("photo")
+	if err == nil {
+		defer file.Close()
+		photo, ext, err := sniffImage(file)
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(err))
+			return
+		}
+		photoKey = path.Join("schools", schoolId.String(), uuid.New().String()+ext)
+		if err := a.store.Put(ctx, photoKey, photo); err != nil {
+			logging.FromContext(ctx).Error("store school photo failed", "err", err)
+			render.Render(w, r, util.ErrInternal(err))
+			return
+		}
+	} else if !errors.Is(err, http.ErrMissingFile) {
+		render.Render(w, r, util.ErrInvalidRequest(errImageType))
+		return
+	}
+	if body == "" && photoKey == "" {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("post a body, a photo or both")))
+		return
+	}
+
+	var updateId string
+	if err := a.db.QueryRow(metrics.WithQueryName(ctx, "create_school_update"),
+		`INSERT INTO helpschool.school_updates( school_id,supply_id,author_id,body,photo_key)
+			VALUES ( $1, $2, $3, nullif($4,''), nullif($5,'')) returning update_id`,
+		schoolId, supplyId, user.UserId, body, photoKey).Scan(&updateId); err != nil {
+		logging.FromContext(ctx).Error("create school update failed", "err", err)
+		if photoKey != "" {
+			_ = a.store.Delete(ctx, photoKey)
+		}
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	render.DefaultResponder(w, r, render.M{"status": "created", "update_id": updateId})
+}
+
+// GetSchoolUpdatePhoto serves the photo of a school update.
+func (a *SchoolProfilesServiceInternal) GetSchoolUpdatePhoto(w http.ResponseWriter, r *http.Request) {
+	updateId, err := uuid.Parse(chi.URLParam(r, "updateId"))
+	if err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	var key string
+	err = a.db.QueryRow(metrics.WithQueryName(r.Context(), "get_school_update_photo"),
+		`select photo_key from helpschool.school_updates
+			where update_id = $1 and school_id::text = $2 and photo_key is not null and not hidden`,
+		updateId, chi.URLParam(r, "schoolId")).Scan(&key)
+	if errors.Is(err, pgx.ErrNoRows) {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	serveImage(w, r, a.store, key)
+}
+
+// HideSchoolUpdates takes an update down from the page of its school.
+func (a *SchoolProfilesServiceInternal) HideSchoolUpdates(w http.ResponseWriter, r *http.Request) {
+	updateId, err := uuid.Parse(chi.URLParam(r, "updateId"))
+	if err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	tag, err := a.db.Exec(metrics.WithQueryName(r.Context(), "hide_school_update"),
+		"update helpschool.school_updates set hidden = true, modified_date = now() where update_id = $1", updateId)
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	render.DefaultResponder(w, r, render.M{"status": "hidden"})
+}
@@ -1,18 +1,26 @@
 package service
 
 import (
-	"context"
 	"errors"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/affiliate"
 	"github.com/venkata6/helpschool/api/dto"
+	"github.com/venkata6/helpschool/api/geo"
+	"github.com/venkata6/helpschool/api/i18n"
+	"github.com/venkata6/helpschool/api/logging"
+	"github.com/venkata6/helpschool/api/metrics"
+	"github.com/venkata6/helpschool/api/needs"
 	"github.com/venkata6/helpschool/api/request"
 	"github.com/venkata6/helpschool/api/response"
 	"github.com/venkata6/helpschool/api/util"
 	"net/http"
+	neturl "net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -20,20 +28,55 @@ type SchoolSuppliesService interface {
 	CreateSchoolSupplies(w http.ResponseWriter, r *http.Request)
 	GetSchoolSupplies(w http.ResponseWriter, r *http.Request)
 	GetFeaturedSchoolSupplies(w http.ResponseWriter, r *http.Request)
+	RenewSchoolSupplies(w http.ResponseWriter, r *http.Request)
+	CloseSchoolSupplies(w http.ResponseWriter, r *http.Request)
 	DeleteSchoolSupplies(w http.ResponseWriter, r *http.Request)
 }
 
 type SchoolSuppliesServiceInternal struct {
-	db *pgxpool.Pool
+	db        *pgxpool.Pool
+	centroids geo.Centroids
+	rewriter  *affiliate.Rewriter
+	publicURL string
 }
 
-func NewSchoolSuppliesService(db *pgxpool.Pool) SchoolSuppliesService {
-	return &SchoolSuppliesServiceInternal{db: db}
+// NewSchoolSuppliesService creates the service, centroids resolve postal
+// codes in "needs near me" queries and rewriter the vendor links of needs
+// of schools that did not turn affiliate links off. Needs link to the
+// click-through redirect below publicURL.
+func NewSchoolSuppliesService(db *pgxpool.Pool, centroids geo.Centroids, rewriter *affiliate.Rewriter, publicURL string) SchoolSuppliesService {
+	return &SchoolSuppliesServiceInternal{db: db, centroids: centroids, rewriter: rewriter, publicURL: strings.TrimSuffix(publicURL, "/")}
 }
 
-// CreateCountries persists the posted Article and returns it
-// back to the client as an acknowledgement.
+// needOffer selects the offer of a need's own supply url, linked to
+// through the click-through redirect.
+const needOffer = `coalesce((select o.offer_id::text from helpschool.supply_offers as o
+	where o.supply_id = ss.supply_id and o.url = su.url),'')`
+
+// vendorLink is the link to buy a need at: the click-through redirect of
+// its offer, which logs the click, or without one the vendor link,
+// rewritten through the affiliate rules unless the school turned them off.
+func (a *SchoolSuppliesServiceInternal) vendorLink(r *http.Request, offerId, schoolId, countryId, url string, disabled bool) string {
+	if offerId != "" {
+		return a.publicURL + "/go/" + offerId + "?school=" + neturl.QueryEscape(schoolId)
+	}
+	if disabled {
+		return url
+	}
+	return a.rewriter.Rewrite(r.Context(), countryId, url)
+}
+
+// CreateSchoolSupplies adds or updates a need of a school, with bundle_id a
+// need for bundles which is expanded into the needs for their items.
+// Posting a need re-opens it, until needed_by when given. Only
+// teachers with an approved affiliation to the school and moderators may
+// post needs. The route must be wrapped in UsersService.Provision.
 func (a *SchoolSuppliesServiceInternal) CreateSchoolSupplies(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
 	data := &request.SchoolSuppliesRequest{}
 	if err := render.Bind(r, data); err != nil {
 		render.Render(w, r, util.ErrInvalidRequest(err))
@@ -43,38 +86,93 @@ func (a *SchoolSuppliesServiceInternal) CreateSchoolSupplies(w http.ResponseWrit
 		render.Render(w, r, util.ErrInvalidRequest(errors.New("empty SchoolId")))
 		return
 	}
-	if len(data.SupplyId) == 0 {
+	if len(data.SupplyId) == 0 && len(data.BundleId) == 0 {
 		render.Render(w, r, util.ErrInvalidRequest(errors.New("empty SupplyId")))
 		return
 	}
-	schoolId, _ := uuid.Parse(data.SchoolId)
+	schoolId, err := uuid.Parse(data.SchoolId)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("invalid SchoolId")))
+		return
+	}
 	supplyId, _ := uuid.Parse(data.SupplyId)
 
-	if _, err := a.db.Exec(context.Background(),
-		`INSERT INTO helpschool.school_supplies( school_id,supply_id,quantity,fulfilled_count,extra_info)
-				VALUES ( $1, $2, $3, $4, $5) on conflict (school_id,supply_id) do update 
-					set quantity=excluded.quantity, fulfilled_count=excluded.fulfilled_count`,
-		schoolId, supplyId, data.Quantity, data.FulfilledCount, data.ExtraInfo); err == nil {
+	if allowed, err := canManageSchool(r.Context(), a.db, user.UserId, schoolId.String()); err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	} else if !allowed {
+		render.Render(w, r, util.ErrForbidden)
+		return
+	}
+	if len(data.BundleId) > 0 {
+		a.createSchoolBundle(w, r, schoolId, data)
+		return
+	}
+
+	if _, err := a.db.Exec(metrics.WithQueryName(r.Context(), "upsert_school_supply"),
+		`INSERT INTO helpschool.school_supplies( school_id,supply_id,quantity,extra_info,item_id,needed_by,status)
+				VALUES ( $1, $2, $3, $4, (select item_id from helpschool.supplies where supply_id = $2), nullif($5,'')::date, $6)
+				on conflict (school_id,supply_id) where bundle_id is null do update 
+					set quantity=excluded.quantity, needed_by=excluded.needed_by,
+						status=excluded.status, expired_date=null, expiry_notified_date=null, modified_date=now()`,
+		schoolId, supplyId, data.Quantity, data.ExtraInfo, data.NeededBy, needs.Open); err == nil {
 		w.WriteHeader(http.StatusCreated)
 		render.DefaultResponder(w, r, render.M{"status": "created"})
 	} else {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		render.DefaultResponder(w, r, render.M{"status": "not created"})
+		logging.FromContext(r.Context()).Error("create school supply failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
 	}
 }
+
+// createSchoolBundle posts the need of a school for data.Quantity bundles.
+func (a *SchoolSuppliesServiceInternal) createSchoolBundle(w http.ResponseWriter, r *http.Request, schoolId uuid.UUID, data *request.SchoolSuppliesRequest) {
+	bundleId, err := uuid.Parse(data.BundleId)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("invalid BundleId")))
+		return
+	}
+	quantity, err := strconv.Atoi(data.Quantity)
+	if err != nil || quantity < 0 {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("quantity must be a number of bundles")))
+		return
+	}
+
+	err = expandSchoolBundle(r.Context(), a.db, schoolId, bundleId, quantity, data.ExtraInfo)
+	if errors.Is(err, errUnknownBundle) || errors.Is(err, errUnlistedBundle) {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("create school bundle failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	render.DefaultResponder(w, r, render.M{"status": "created", "bundle_id": bundleId.String()})
+}
+
+// GetSchoolSupplies lists the open needs of a school, with status the
+// expired or closed ones, or all of them with status=all.
 func (a *SchoolSuppliesServiceInternal) GetSchoolSupplies(w http.ResponseWriter, r *http.Request) {
 
 	schoolId := chi.URLParam(r, "schoolId")
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = needs.Open
+	}
 	var count int
-	rowCount, err := a.db.Query(context.Background(), "select count(*) as count from" +
-			"  helpschool.school_supplies where school_id = $1 ",schoolId)
+	rowCount, err := a.db.Query(metrics.WithQueryName(r.Context(), "count_school_supplies"), "select count(*) as count from" +
+			"  helpschool.school_supplies where school_id = $1 and ($2 = 'all' or status = $2)",schoolId,status)
 	for rowCount.Next() {
 		_ = rowCount.Scan(&count)
 		//checkErr(err)
 	}
-	rows, err := a.db.Query(context.Background(), "select su.title,su.description,su.url,ss.school_id,ss.supply_id," +
-		"ss.quantity,ss.fulfilled_count,ss.extra_info,ss.created_date from helpschool.school_supplies as ss" +
-		" inner join helpschool.supplies as su on ss.supply_id = su.supply_id where  ss.school_id = $1",schoolId)
+	rows, err := a.db.Query(metrics.WithQueryName(r.Context(), "list_school_supplies"), "select helpschool.localized(su.title_translations,su.title,$2),su.description,su.url,ss.school_id,ss.supply_id," +
+		"ss.quantity,ss.fulfilled_count,ss.extra_info,ss.created_date,ss.item_id,su.country_id::text,s.affiliate_links_disabled,coalesce(ss.bundle_id::text,'')," +
+		"coalesce(to_char(ss.needed_by,'YYYY-MM-DD'),''),ss.status," + needOffer + " from helpschool.school_supplies as ss" +
+		" inner join helpschool.supplies as su on ss.supply_id = su.supply_id" +
+		" inner join helpschool.schools as s on s.school_id = ss.school_id where  ss.school_id = $1 and ($3 = 'all' or ss.status = $3)",schoolId,
+		i18n.FromContext(r.Context()).Chain, status)
 	defer rows.Close()
 
 	schoolSupplies := make([]response.SchoolSuppliesResponse, count)
@@ -90,18 +188,30 @@ func (a *SchoolSuppliesServiceInternal) GetSchoolSupplies(w http.ResponseWriter,
 		var fulfilledCount int
 		var extraInfo string
 		var postedDate time.Time
+		var itemId string
+		var countryId string
+		var affiliateLinksDisabled bool
+		var bundleId string
+		var neededBy string
+		var status string
+		var offerId string
 
-		err = rows.Scan( &title,&description,&url,&schoolId,&supplyId, &quantity, &fulfilledCount, &extraInfo,&postedDate)
+		err = rows.Scan( &title,&description,&url,&schoolId,&supplyId, &quantity, &fulfilledCount, &extraInfo,&postedDate,&itemId,
+			&countryId,&affiliateLinksDisabled,&bundleId,&neededBy,&status,&offerId)
 		schoolSupplies[i].SchoolSupplies = &dto.SchoolSupplies{} // allocate space
 		schoolSupplies[i].Title = title
 		schoolSupplies[i].Description = description
-		schoolSupplies[i].Url = url
+		schoolSupplies[i].Url = a.vendorLink(r, offerId, schoolId, countryId, url, affiliateLinksDisabled)
 		schoolSupplies[i].SupplyId = supplyId
 		schoolSupplies[i].SchoolId = schoolId
 		schoolSupplies[i].Quantity = strconv.Itoa(quantity)
 		schoolSupplies[i].FulfilledCount = strconv.Itoa(fulfilledCount)
 		schoolSupplies[i].ExtraInfo = extraInfo
 		schoolSupplies[i].PostedDate = postedDate
+		schoolSupplies[i].ItemId = itemId
+		schoolSupplies[i].BundleId = bundleId
+		schoolSupplies[i].NeededBy = neededBy
+		schoolSupplies[i].Status = status
 
 		if err != nil {
 			return
@@ -118,14 +228,26 @@ func (a *SchoolSuppliesServiceInternal) GetSchoolSupplies(w http.ResponseWriter,
 	}
 }
 
+// GetFeaturedSchoolSupplies returns the newest needs, or with near the open
+// needs of schools close by.
 func (a *SchoolSuppliesServiceInternal) GetFeaturedSchoolSupplies(w http.ResponseWriter, r *http.Request) {
+	if point, radius, ok, err := parseNear(r, a.centroids); err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	} else if ok {
+		a.getNearbySchoolSupplies(w, r, point, radius)
+		return
+	}
 
 	// let us return 3 newest entries as featured for now
 
 	var count =3
-	rows, err := a.db.Query(context.Background(), "select su.title,su.description,su.url,ss.school_id," +
-		"ss.supply_id,ss.quantity,ss.fulfilled_count,ss.extra_info,ss.created_date from helpschool.school_supplies as " +
-		"ss inner join helpschool.supplies as su on ss.supply_id = su.supply_id order by ss.created_date desc limit 3")
+	rows, err := a.db.Query(metrics.WithQueryName(r.Context(), "list_featured_school_supplies"), "select helpschool.localized(su.title_translations,su.title,$1),su.description,su.url,ss.school_id," +
+		"ss.supply_id,ss.quantity,ss.fulfilled_count,ss.extra_info,ss.created_date,ss.item_id,su.country_id::text,s.affiliate_links_disabled,coalesce(ss.bundle_id::text,'')," +
+		"coalesce(to_char(ss.needed_by,'YYYY-MM-DD'),''),ss.status," + needOffer + " from helpschool.school_supplies as " +
+		"ss inner join helpschool.supplies as su on ss.supply_id = su.supply_id" +
+		" inner join helpschool.schools as s on s.school_id = ss.school_id where ss.status = $2 order by ss.created_date desc limit 3",
+		i18n.FromContext(r.Context()).Chain, needs.Open)
 	defer rows.Close()
 
 	schoolSupplies := make([]response.SchoolSuppliesResponse, count)
@@ -141,18 +263,30 @@ func (a *SchoolSuppliesServiceInternal) GetFeaturedSchoolSupplies(w http.Respons
 		var fulfilledCount int
 		var extraInfo string
 		var postedDate time.Time
+		var itemId string
+		var countryId string
+		var affiliateLinksDisabled bool
+		var bundleId string
+		var neededBy string
+		var status string
+		var offerId string
 
-		err = rows.Scan( &title,&description,&url,&schoolId,&supplyId, &quantity, &fulfilledCount, &extraInfo,&postedDate)
+		err = rows.Scan( &title,&description,&url,&schoolId,&supplyId, &quantity, &fulfilledCount, &extraInfo,&postedDate,&itemId,
+			&countryId,&affiliateLinksDisabled,&bundleId,&neededBy,&status,&offerId)
 		schoolSupplies[i].SchoolSupplies = &dto.SchoolSupplies{} // allocate space
 		schoolSupplies[i].Title = title
 		schoolSupplies[i].Description = description
-		schoolSupplies[i].Url = url
+		schoolSupplies[i].Url = a.vendorLink(r, offerId, schoolId, countryId, url, affiliateLinksDisabled)
 		schoolSupplies[i].SupplyId = supplyId
 		schoolSupplies[i].SchoolId = schoolId
 		schoolSupplies[i].Quantity = strconv.Itoa(quantity)
 		schoolSupplies[i].FulfilledCount = strconv.Itoa(fulfilledCount)
 		schoolSupplies[i].ExtraInfo = extraInfo
 		schoolSupplies[i].PostedDate = postedDate
+		schoolSupplies[i].ItemId = itemId
+		schoolSupplies[i].BundleId = bundleId
+		schoolSupplies[i].NeededBy = neededBy
+		schoolSupplies[i].Status = status
 
 		if err != nil {
 			return
@@ -169,6 +303,107 @@ func (a *SchoolSuppliesServiceInternal) GetFeaturedSchoolSupplies(w http.Respons
 	}
 }
 
+// getNearbySchoolSupplies lists the open needs of schools within radius
+// meters of point, closest school first.
+func (a *SchoolSuppliesServiceInternal) getNearbySchoolSupplies(w http.ResponseWriter, r *http.Request, point geo.Point, radius float64) {
+	schoolSupplies := []response.SchoolSuppliesResponse{}
+	err := forEachRow(metrics.WithQueryName(r.Context(), "list_nearby_school_supplies"), a.db,
+		`select helpschool.localized(su.title_translations,su.title,$4),coalesce(su.description,''),su.url,ss.school_id,ss.supply_id,ss.quantity,
+			coalesce(ss.fulfilled_count,0),coalesce(ss.extra_info::text,''),ss.created_date,`+earthDistance+` / 1000,
+			ss.item_id::text,su.country_id::text,s.affiliate_links_disabled,coalesce(ss.bundle_id::text,''),
+			coalesce(to_char(ss.needed_by,'YYYY-MM-DD'),''),ss.status,`+needOffer+`
+		from helpschool.school_supplies as ss
+		inner join helpschool.supplies as su on su.supply_id = ss.supply_id
+		inner join helpschool.schools as s on s.school_id = ss.school_id
+		where ss.quantity > coalesce(ss.fulfilled_count,0) and ss.status = $5 and `+earthWithin+`
+		order by 10, ss.created_date desc limit 50`, []interface{}{point.Lat, point.Lng, radius, i18n.FromContext(r.Context()).Chain, needs.Open},
+		func(rows pgx.Rows) error {
+			supply := &dto.SchoolSupplies{}
+			var quantity, fulfilledCount int
+			var countryId, offerId string
+			var affiliateLinksDisabled bool
+			if err := rows.Scan(&supply.Title, &supply.Description, &supply.Url, &supply.SchoolId, &supply.SupplyId,
+				&quantity, &fulfilledCount, &supply.ExtraInfo, &supply.PostedDate, &supply.DistanceKm, &supply.ItemId,
+				&countryId, &affiliateLinksDisabled, &supply.BundleId, &supply.NeededBy, &supply.Status, &offerId); err != nil {
+				return err
+			}
+			supply.Url = a.vendorLink(r, offerId, supply.SchoolId, countryId, supply.Url, affiliateLinksDisabled)
+			supply.Quantity = strconv.Itoa(quantity)
+			supply.FulfilledCount = strconv.Itoa(fulfilledCount)
+			schoolSupplies = append(schoolSupplies, response.SchoolSuppliesResponse{SchoolSupplies: supply})
+			return nil
+		})
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if err := render.RenderList(w, r, NewSchoolSuppliesListResponse(schoolSupplies)); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+// RenewSchoolSupplies re-opens an expired or closed need of a school, until
+// needed_by when given. The route must be wrapped in UsersService.Provision.
+func (a *SchoolSuppliesServiceInternal) RenewSchoolSupplies(w http.ResponseWriter, r *http.Request) {
+	data := &request.NeedRenewalsRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	a.setNeedStatus(w, r, needs.Open, data.NeededBy)
+}
+
+// CloseSchoolSupplies takes a need the school no longer has off the
+// listings. The route must be wrapped in UsersService.Provision.
+func (a *SchoolSuppliesServiceInternal) CloseSchoolSupplies(w http.ResponseWriter, r *http.Request) {
+	a.setNeedStatus(w, r, needs.Closed, "")
+}
+
+// setNeedStatus sets the status of the need in the route for the teachers
+// of the school and moderators, renewing it until neededBy when open.
+func (a *SchoolSuppliesServiceInternal) setNeedStatus(w http.ResponseWriter, r *http.Request, status, neededBy string) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	schoolId, err := uuid.Parse(chi.URLParam(r, "schoolId"))
+	if err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	supplyId, err := uuid.Parse(chi.URLParam(r, "supplyId"))
+	if err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	if allowed, err := canManageSchool(r.Context(), a.db, user.UserId, schoolId.String()); err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	} else if !allowed {
+		render.Render(w, r, util.ErrForbidden)
+		return
+	}
+
+	tag, err := a.db.Exec(metrics.WithQueryName(r.Context(), "update_school_supply_status"),
+		`update helpschool.school_supplies set status = $3,
+			needed_by = case when $3 = $5 then nullif($4,'')::date else needed_by end,
+			expired_date = null, expiry_notified_date = null, modified_date = now()
+		where school_id = $1 and supply_id = $2 and bundle_id is null`,
+		schoolId, supplyId, status, neededBy, needs.Open)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("update school supply status failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	render.DefaultResponder(w, r, render.M{"status": status})
+}
+
 func (a *SchoolSuppliesServiceInternal) DeleteSchoolSupplies(w http.ResponseWriter, r *http.Request) {
 	//render.RenderList(w, r, NewCountriesListResponse(articles))
 }
@@ -1,13 +1,16 @@
 package service
 
 import (
-	"context"
 	"errors"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/venkata6/helpschool/api/dto"
+	"github.com/venkata6/helpschool/api/geo"
+	"github.com/venkata6/helpschool/api/logging"
+	"github.com/venkata6/helpschool/api/metrics"
 	"github.com/venkata6/helpschool/api/request"
 	"github.com/venkata6/helpschool/api/response"
 	"github.com/venkata6/helpschool/api/util"
@@ -18,14 +21,18 @@ type SchoolsService interface {
 	CreateSchools(w http.ResponseWriter, r *http.Request)
 	GetSchools(w http.ResponseWriter, r *http.Request)
 	DeleteSchools(w http.ResponseWriter, r *http.Request)
+	GetNearbySchools(w http.ResponseWriter, r *http.Request)
 }
 
 type SchoolsServiceInternal struct {
-	db *pgxpool.Pool
+	db        *pgxpool.Pool
+	centroids geo.Centroids
 }
 
-func NewSchoolsService(db *pgxpool.Pool) SchoolsService {
-	return &SchoolsServiceInternal{db: db}
+// NewSchoolsService creates the service, new schools are located by the
+// centroid of their postal code.
+func NewSchoolsService(db *pgxpool.Pool, centroids geo.Centroids) SchoolsService {
+	return &SchoolsServiceInternal{db: db, centroids: centroids}
 }
 
 // CreateCountries persists the posted Article and returns it
@@ -36,18 +43,74 @@ func (a *SchoolsServiceInternal) CreateSchools(w http.ResponseWriter, r *http.Re
 		render.Render(w, r, util.ErrInvalidRequest(err))
 		return
 	}
-	if len(data.DistrictId) == 0 {
+	if len(data.DistrictId) == 0 && len(data.RegionId) == 0 {
 		render.Render(w, r, util.ErrInvalidRequest(errors.New("empty districtId")))
 		return
 	}
-	districtId,_ := uuid.Parse(data.DistrictId)
-	if _, err := a.db.Exec(context.Background(),
-		`INSERT INTO helpschool.schools( school_id,name,place,address,district_id,govt_id,extra_info)
-					VALUES ( $1, $2, $3, $4, $5,$6,$7)`, uuid.New(), data.Name,data.Place,data.Address,
-		districtId,data.GovtId,data.ExtraInfo); err == nil {
+	var districtId, regionId interface{}
+	if len(data.DistrictId) > 0 {
+		districtId,_ = uuid.Parse(data.DistrictId)
+	}
+	if len(data.RegionId) > 0 {
+		id, err := uuid.Parse(data.RegionId)
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(errors.New("invalid region_id")))
+			return
+		}
+		regionId = id
+
+		// the school's district is the region's, which must agree with district_id
+		var found bool
+		var regionDistrict string
+		if err := a.db.QueryRow(metrics.WithQueryName(r.Context(), "get_region_district"),
+			`select exists(select 1 from helpschool.regions where region_id = $1),
+				coalesce((select p.ancestor_id::text from helpschool.region_paths as p
+					inner join helpschool.regions as d on d.region_id = p.ancestor_id
+					where p.descendant_id = $1 and d.level = 'district'),'')`, id).Scan(&found, &regionDistrict); err != nil {
+			render.Render(w, r, util.ErrInternal(err))
+			return
+		}
+		if !found {
+			render.Render(w, r, util.ErrInvalidRequest(errors.New("unknown region_id")))
+			return
+		}
+		if regionDistrict == "" {
+			render.Render(w, r, util.ErrInvalidRequest(errors.New("region_id must be a district or a region below one")))
+			return
+		}
+		if districtId != nil && districtId.(uuid.UUID).String() != regionDistrict {
+			render.Render(w, r, util.ErrInvalidRequest(errors.New("region_id is not in district_id")))
+			return
+		}
+		districtId = regionDistrict
+	}
+
+	var latitude, longitude *float64
+	var geocodedBy string
+	postalCode := data.PostalCode
+	if data.Latitude != nil && data.Longitude != nil {
+		if _, err := geo.NewPoint(*data.Latitude, *data.Longitude); err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(err))
+			return
+		}
+		latitude, longitude, geocodedBy = data.Latitude, data.Longitude, "manual"
+	} else if point, code, ok := a.centroids.Locate(data.PostalCode, data.Address); ok {
+		latitude, longitude, geocodedBy, postalCode = &point.Lat, &point.Lng, geo.GeocodedByPostalCode, code
+	}
+	if postalCode == "" {
+		postalCode = geo.PostalCodeFrom(data.Address)
+	}
+
+	if _, err := a.db.Exec(metrics.WithQueryName(r.Context(), "create_school"),
+		`INSERT INTO helpschool.schools( school_id,name,place,address,district_id,govt_id,extra_info,
+					postal_code,latitude,longitude,geocoded_by,region_id)
+					VALUES ( $1, $2, $3, $4, $5::uuid,
+					$6,$7, nullif($8,''), $9, $10, nullif($11,''), coalesce($12::uuid, $5::uuid))`, uuid.New(), data.Name,data.Place,data.Address,
+		districtId,data.GovtId,data.ExtraInfo,postalCode,latitude,longitude,geocodedBy,regionId); err == nil {
 		w.WriteHeader(http.StatusCreated)
 		render.DefaultResponder(w, r, render.M{"status": "created"})
 	} else {
+		logging.FromContext(r.Context()).Error("create school failed", "err", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		render.DefaultResponder(w, r, render.M{"status": "not created"})
 	}
@@ -56,13 +119,13 @@ func (a *SchoolsServiceInternal) GetSchools(w http.ResponseWriter, r *http.Reque
 
 	var count int
 	districtId := chi.URLParam(r, "districtId")
-	rowCount, err := a.db.Query(context.Background(), "select count(*) as count from  helpschool.schools " +
+	rowCount, err := a.db.Query(metrics.WithQueryName(r.Context(), "count_schools"), "select count(*) as count from  helpschool.schools " +
 									"where district_id = $1",districtId)
 	for rowCount.Next() {
 		_ = rowCount.Scan(&count)
 		//checkErr(err)
 	}
-	rows, err := a.db.Query(context.Background(), "select name,place,address,school_id,district_id,govt_id," +
+	rows, err := a.db.Query(metrics.WithQueryName(r.Context(), "list_schools"), "select name,place,address,school_id,district_id,govt_id," +
 		"extra_info from helpschool.schools where district_id = $1",districtId)
 	defer rows.Close()
 
@@ -103,6 +166,44 @@ func (a *SchoolsServiceInternal) GetSchools(w http.ResponseWriter, r *http.Reque
 	}
 }
 
+// GetNearbySchools lists the located schools within radius km (25 by
+// default) of lat and lng, or of near, closest first.
+func (a *SchoolsServiceInternal) GetNearbySchools(w http.ResponseWriter, r *http.Request) {
+	point, radius, ok, err := parseNear(r, a.centroids)
+	if err == nil && !ok {
+		err = errors.New("lat and lng or near are required")
+	}
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	schools := []response.SchoolsResponse{}
+	err = forEachRow(metrics.WithQueryName(r.Context(), "list_nearby_schools"), a.db,
+		`select s.name,coalesce(s.place,''),coalesce(s.address,''),s.school_id,s.district_id,coalesce(s.govt_id,''),
+			coalesce(s.postal_code,''),s.latitude,s.longitude,`+earthDistance+` / 1000
+		from helpschool.schools as s
+		where `+earthWithin+`
+		order by 10 limit 50`, []interface{}{point.Lat, point.Lng, radius},
+		func(rows pgx.Rows) error {
+			school := &dto.Schools{}
+			if err := rows.Scan(&school.Name, &school.Place, &school.Address, &school.SchoolId, &school.DistrictId,
+				&school.GovtId, &school.PostalCode, &school.Latitude, &school.Longitude, &school.DistanceKm); err != nil {
+				return err
+			}
+			schools = append(schools, response.SchoolsResponse{Schools: school})
+			return nil
+		})
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if err := render.RenderList(w, r, NewSchoolsListResponse(schools)); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
 func (a *SchoolsServiceInternal) DeleteSchools(w http.ResponseWriter, r *http.Request) {
 	//render.RenderList(w, r, NewCountriesListResponse(articles))
 }
@@ -1,13 +1,14 @@
 package service
 
 import (
-	"context"
 	"errors"
-	"fmt"
 	"github.com/go-chi/render"
 	"github.com/google/uuid"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/venkata6/helpschool/api/dto"
+	"github.com/venkata6/helpschool/api/i18n"
+	"github.com/venkata6/helpschool/api/logging"
+	"github.com/venkata6/helpschool/api/metrics"
 	"github.com/venkata6/helpschool/api/request"
 	"github.com/venkata6/helpschool/api/response"
 	"github.com/venkata6/helpschool/api/util"
@@ -41,13 +42,14 @@ func (a *StatesServiceInternal) CreateStates(w http.ResponseWriter, r *http.Requ
 		return
 	}
 	id, _ := uuid.Parse(data.CountryId)
-	if _, err := a.db.Exec(context.Background(),
+	if _, err := a.db.Exec(metrics.WithQueryName(r.Context(), "create_state"),
 		`INSERT INTO helpschool.states( state_id,name,country_id,govt_id,extra_info)
 					VALUES ( $1, $2, $3, $4, $5)`, uuid.New(), data.Name,
 		id, data.GovtId, data.ExtraInfo); err == nil {
 		w.WriteHeader(http.StatusCreated)
 		render.DefaultResponder(w, r, render.M{"status": "created"})
 	} else {
+		logging.FromContext(r.Context()).Error("create state failed", "err", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		render.DefaultResponder(w, r, render.M{"status": "not created"})
 	}
@@ -56,12 +58,17 @@ func (a *StatesServiceInternal) CreateStates(w http.ResponseWriter, r *http.Requ
 func (a *StatesServiceInternal) GetStates(w http.ResponseWriter, r *http.Request) {
 
 	var count int
-	rowCount, err := a.db.Query(context.Background(), "select count(*) as count from  helpschool.states")
+	rowCount, err := a.db.Query(metrics.WithQueryName(r.Context(), "count_states"), "select count(*) as count from  helpschool.states")
 	for rowCount.Next() {
 		_ = rowCount.Scan(&count)
 		//checkErr(err)
 	}
-	rows, err := a.db.Query(context.Background(), "select name,state_id,country_id,govt_id,extra_info from helpschool.states")
+	// names in the language of the request, sorted the way it sorts
+	locale := i18n.FromContext(r.Context())
+	rows, err := a.db.Query(metrics.WithQueryName(r.Context(), "list_states"), "select helpschool.localized(g.name_translations,s.name,$1)," +
+		"s.state_id,s.country_id,s.govt_id,s.extra_info from helpschool.states as s " +
+		"left join helpschool.regions as g on g.region_id = s.state_id " +
+		"order by helpschool.localized(g.name_translations,s.name,$1) collate " + locale.Collation(), locale.Chain)
 	defer rows.Close()
 	states := make([]response.StatesResponse, count)
 	i := 0
@@ -82,14 +89,16 @@ func (a *StatesServiceInternal) GetStates(w http.ResponseWriter, r *http.Request
 		states[i].ExtraInfo = extraInfo
 
 		if err != nil {
-			fmt.Printf("Error doing 'scan' states -  %v  \n",  err )
+			logging.FromContext(r.Context()).Error("scan states failed", "err", err)
+			render.Render(w, r, util.ErrInternal(err))
 			return
 		}
 		i++
 	}
 	// Any errors encountered by rows.Next or rows.Scan will be returned here
 	if rows.Err() != nil {
-		fmt.Printf("Error doing 'select' states -  %v  %v \n", rows.Err(), err )
+		logging.FromContext(r.Context()).Error("select states failed", "err", rows.Err())
+		render.Render(w, r, util.ErrInternal(rows.Err()))
 		return
 	}
 	if err := render.RenderList(w, r, NewStatesListResponse(states)); err != nil {
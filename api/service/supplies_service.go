@@ -1,16 +1,21 @@
 package service
 
 import (
-	"context"
 	"errors"
 	"github.com/go-chi/render"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/affiliate"
 	"github.com/venkata6/helpschool/api/dto"
+	"github.com/venkata6/helpschool/api/i18n"
+	"github.com/venkata6/helpschool/api/logging"
+	"github.com/venkata6/helpschool/api/metrics"
 	"github.com/venkata6/helpschool/api/request"
 	"github.com/venkata6/helpschool/api/response"
 	"github.com/venkata6/helpschool/api/util"
 	"net/http"
+	"strings"
 )
 
 type SuppliesService interface {
@@ -20,11 +25,16 @@ type SuppliesService interface {
 }
 
 type SuppliesServiceInternal struct {
-	db *pgxpool.Pool
+	db        *pgxpool.Pool
+	rewriter  *affiliate.Rewriter
+	publicURL string
 }
 
-func NewSuppliesService(db *pgxpool.Pool) SuppliesService {
-	return &SuppliesServiceInternal{db: db}
+// NewSuppliesService creates the service, supplies link to the
+// click-through redirect of their offer below publicURL, or without one to
+// the vendor through the affiliate rules of rewriter.
+func NewSuppliesService(db *pgxpool.Pool, rewriter *affiliate.Rewriter, publicURL string) SuppliesService {
+	return &SuppliesServiceInternal{db: db, rewriter: rewriter, publicURL: strings.TrimSuffix(publicURL, "/")}
 }
 
 // CreateCountries persists the posted Article and returns it
@@ -40,57 +50,94 @@ func (a *SuppliesServiceInternal) CreateSupplies(w http.ResponseWriter, r *http.
 		return
 	}
 	id, _ := uuid.Parse(data.CountryId)
+	var itemId, categoryId interface{}
+	for _, ref := range []struct {
+		value string
+		dst   *interface{}
+		err   error
+	}{
+		{data.ItemId, &itemId, errors.New("invalid item_id")},
+		{data.CategoryId, &categoryId, errors.New("invalid category_id")},
+	} {
+		if ref.value != "" {
+			parsed, err := uuid.Parse(ref.value)
+			if err != nil {
+				render.Render(w, r, util.ErrInvalidRequest(ref.err))
+				return
+			}
+			*ref.dst = parsed
+		}
+	}
 
-	if _, err := a.db.Exec(context.Background(),
-		`INSERT INTO helpschool.supplies( supply_id,title,country_id,url,description,extra_info)
-					VALUES ( $1, $2, $3, $4, $5,$6)`, uuid.New(), data.Title, id,
-		data.Url, data.Description, data.ExtraInfo); err == nil {
+	// a listing without a canonical item gets one of its own, sharing its id,
+	// and its url is its first offer, as migration 012 did for older ones
+	_, err := a.db.Exec(metrics.WithQueryName(r.Context(), "create_supply"),
+		`with item as (
+			INSERT INTO helpschool.catalog_items( item_id,category_id,unit_id,title,description)
+				select $1, $8, coalesce(nullif($9,''),'piece'), $2, nullif($5,'') where $10::uuid is null
+				returning item_id
+		), supply as (
+			INSERT INTO helpschool.supplies( supply_id,title,country_id,url,description,extra_info,price,item_id)
+					VALUES ( $1, $2, $3, $4, $5,$6,$7, coalesce($10::uuid, (select item_id from item)))
+				returning supply_id,url,price
+		)
+		INSERT INTO helpschool.supply_offers( supply_id,vendor,url,price)
+			select supply_id, coalesce(substring(url from '://(?:www\.)?([^/:]+)'), 'unknown'), url, price
+			from supply where url <> ''`, uuid.New(), data.Title, id,
+		data.Url, data.Description, data.ExtraInfo, data.Price, categoryId, data.UnitId, itemId)
+	if sqlState(err) == foreignKeyViolation {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("unknown item_id, category_id or unit_id")))
+		return
+	}
+	if err == nil {
 		w.WriteHeader(http.StatusCreated)
 		render.DefaultResponder(w, r, render.M{"status": "created"})
 	} else {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		render.DefaultResponder(w, r, render.M{"status": "not created"})
+		logging.FromContext(r.Context()).Error("create supply failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
 	}
 
 }
-func (a *SuppliesServiceInternal) GetSupplies(w http.ResponseWriter, r *http.Request) {
 
-	var count int
-	rowCount, err := a.db.Query(context.Background(), "select count(*) as count from  helpschool.supplies")
-	for rowCount.Next() {
-		_ = rowCount.Scan(&count)
-		//checkErr(err)
+// GetSupplies lists the supplies with titles in the language of the
+// request, sorted the way it sorts. With category only the supplies whose
+// item is in the category, given by slug or id, or a category below it.
+func (a *SuppliesServiceInternal) GetSupplies(w http.ResponseWriter, r *http.Request) {
+	var category interface{}
+	if v := r.URL.Query().Get("category"); v != "" {
+		category = v
 	}
-	rows, err := a.db.Query(context.Background(), "select supply_id,title,country_id,url,description,extra_info from helpschool.supplies")
-	defer rows.Close()
-
-	supplies := make([]response.SuppliesResponse, count)
-	i := 0
-	for rows.Next() {
-		// Read
-		var title string
-		var supplyId string
-		var countryId string
-		var url string
-		var description string
-		var extraInfo string
-
-		err = rows.Scan(&supplyId, &title, &countryId, &url, &description, &extraInfo)
-		supplies[i].Supplies = &dto.Supplies{} // allocate space
-		supplies[i].Title = title
-		supplies[i].SupplyId = supplyId
-		supplies[i].CountryId = countryId
-		supplies[i].Url = url
-		supplies[i].Description = description
-		supplies[i].ExtraInfo = extraInfo
 
-		if err != nil {
-			return
-		}
-		i++
-	}
-	// Any errors encountered by rows.Next or rows.Scan will be returned here
-	if rows.Err() != nil {
+	locale := i18n.FromContext(r.Context())
+	supplies := []response.SuppliesResponse{}
+	err := forEachRow(metrics.WithQueryName(r.Context(), "list_supplies"), a.db,
+		`select s.supply_id,helpschool.localized(s.title_translations,s.title,$1),s.country_id,s.url,
+			coalesce(s.description,''),coalesce(s.extra_info::text,''),s.price::float8,
+			s.item_id::text,coalesce(i.category_id::text,''),i.unit_id,
+			coalesce((select o.offer_id::text from helpschool.supply_offers as o
+				where o.supply_id = s.supply_id and o.url = s.url),'')
+		from helpschool.supplies as s
+		inner join helpschool.catalog_items as i on i.item_id = s.item_id
+		where $2::text is null or i.category_id in (`+categoryTree("$2")+`)
+		order by helpschool.localized(s.title_translations,s.title,$1) collate `+locale.Collation(),
+		[]interface{}{locale.Chain, category},
+		func(rows pgx.Rows) error {
+			supply := &dto.Supplies{}
+			var offerId string
+			if err := rows.Scan(&supply.SupplyId, &supply.Title, &supply.CountryId, &supply.Url, &supply.Description,
+				&supply.ExtraInfo, &supply.Price, &supply.ItemId, &supply.CategoryId, &supply.UnitId, &offerId); err != nil {
+				return err
+			}
+			if offerId != "" {
+				supply.Url = a.publicURL + "/go/" + offerId
+			} else {
+				supply.Url = a.rewriter.Rewrite(r.Context(), supply.CountryId, supply.Url)
+			}
+			supplies = append(supplies, response.SuppliesResponse{Supplies: supply})
+			return nil
+		})
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
 		return
 	}
 	if err := render.RenderList(w, r, NewSuppliesListResponse(supplies)); err != nil {
@@ -0,0 +1,253 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/affiliate"
+	"github.com/venkata6/helpschool/api/dto"
+	"github.com/venkata6/helpschool/api/logging"
+	"github.com/venkata6/helpschool/api/metrics"
+	"github.com/venkata6/helpschool/api/request"
+	"github.com/venkata6/helpschool/api/response"
+	"github.com/venkata6/helpschool/api/util"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type SupplyOffersService interface {
+	GetSupplyOffers(w http.ResponseWriter, r *http.Request)
+	GetBestSupplyOffer(w http.ResponseWriter, r *http.Request)
+	CreateSupplyOffers(w http.ResponseWriter, r *http.Request)
+	UpdateSupplyOffers(w http.ResponseWriter, r *http.Request)
+}
+
+type SupplyOffersServiceInternal struct {
+	db        *pgxpool.Pool
+	rewriter  *affiliate.Rewriter
+	publicURL string
+}
+
+// NewSupplyOffersService creates the service, offers link to the vendor
+// through rewriter and to the click-through redirect below publicURL.
+func NewSupplyOffersService(db *pgxpool.Pool, rewriter *affiliate.Rewriter, publicURL string) SupplyOffersService {
+	return &SupplyOffersServiceInternal{db: db, rewriter: rewriter, publicURL: strings.TrimSuffix(publicURL, "/")}
+}
+
+// rankedOffers lists the offers of every supply listing the same item as
+// supply $1, best first for postal code $2: those in the currency of the
+// supply's own first offer, as prices are not converted, deliverable ones,
+// then those checked within a week, then the cheapest with shipping and
+// the fastest.
+const rankedOffers = `with home as (
+		select coalesce((select currency from helpschool.supply_offers where supply_id = $1
+			order by created_date limit 1), 'INR') as currency
+	)
+	select o.offer_id::text,o.supply_id::text,o.vendor,o.url,o.price::float8,o.currency,
+		o.shipping_cost::float8,o.shipping_days,o.delivery_regions,o.in_stock,o.last_checked,
+		(o.price + o.shipping_cost)::float8,
+		o.in_stock and (cardinality(o.delivery_regions) = 0 or exists(
+			select 1 from unnest(o.delivery_regions) as d(prefix) where $2 <> '' and $2 like d.prefix || '%')),
+		s.country_id::text,o.currency = home.currency
+	from helpschool.supply_offers as o
+	inner join helpschool.supplies as s on s.supply_id = o.supply_id
+	cross join home
+	where s.item_id = (select item_id from helpschool.supplies where supply_id = $1)
+	order by 15 desc, 13 desc, o.last_checked > now() - interval '7 days' desc, 12 nulls last,
+		o.shipping_days nulls last, o.last_checked desc`
+
+// rankOffers returns the offers for supplyId ranked for postalCode, the
+// first one marked Best when it is deliverable and in the supply's
+// currency. The offers link to the
+// vendor through the affiliate rules, unless affiliateLinksDisabled, and
+// to the click-through redirect for schoolId.
+func (a *SupplyOffersServiceInternal) rankOffers(ctx context.Context, supplyId uuid.UUID, postalCode, schoolId string,
+	affiliateLinksDisabled bool) ([]*dto.SupplyOffers, error) {
+	offers := []*dto.SupplyOffers{}
+	homeFirst := false
+	err := forEachRow(metrics.WithQueryName(ctx, "list_supply_offers"), a.db, rankedOffers,
+		[]interface{}{supplyId, strings.ToUpper(strings.ReplaceAll(postalCode, " ", ""))},
+		func(rows pgx.Rows) error {
+			offer := &dto.SupplyOffers{}
+			var countryId string
+			var homeCurrency bool
+			if err := rows.Scan(&offer.OfferId, &offer.SupplyId, &offer.Vendor, &offer.Url, &offer.Price, &offer.Currency,
+				&offer.ShippingCost, &offer.ShippingDays, &offer.DeliveryRegions, &offer.InStock, &offer.LastChecked,
+				&offer.Total, &offer.Deliverable, &countryId, &homeCurrency); err != nil {
+				return err
+			}
+			if len(offers) == 0 {
+				homeFirst = homeCurrency
+			}
+			if !affiliateLinksDisabled {
+				offer.Url = a.rewriter.Rewrite(ctx, countryId, offer.Url)
+			}
+			offer.GoUrl = a.publicURL + "/go/" + offer.OfferId
+			if schoolId != "" {
+				offer.GoUrl += "?school=" + url.QueryEscape(schoolId)
+			}
+			offers = append(offers, offer)
+			return nil
+		})
+	if len(offers) > 0 && offers[0].Deliverable && homeFirst {
+		offers[0].Best = true
+	}
+	return offers, err
+}
+
+// GetSupplyOffers lists the offers for a supply and identical items, best
+// first for the postal code in pincode.
+func (a *SupplyOffersServiceInternal) GetSupplyOffers(w http.ResponseWriter, r *http.Request) {
+	supplyId, err := uuid.Parse(chi.URLParam(r, "supplyId"))
+	if err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	offers, err := a.rankOffers(r.Context(), supplyId, r.URL.Query().Get("pincode"), "", false)
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	list := []render.Renderer{}
+	for _, offer := range offers {
+		list = append(list, response.SupplyOffersResponse{SupplyOffers: offer})
+	}
+	if err := render.RenderList(w, r, list); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+// GetBestSupplyOffer returns the offer to buy a school's need from, for
+// the postal code of the school.
+func (a *SupplyOffersServiceInternal) GetBestSupplyOffer(w http.ResponseWriter, r *http.Request) {
+	schoolId, err := uuid.Parse(chi.URLParam(r, "schoolId"))
+	if err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	supplyId, err := uuid.Parse(chi.URLParam(r, "supplyId"))
+	if err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	var postalCode string
+	var affiliateLinksDisabled bool
+	err = a.db.QueryRow(metrics.WithQueryName(r.Context(), "get_school_postal_code"),
+		`select coalesce(postal_code,''),affiliate_links_disabled from helpschool.schools where school_id = $1`,
+		schoolId).Scan(&postalCode, &affiliateLinksDisabled)
+	if errors.Is(err, pgx.ErrNoRows) {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	offers, err := a.rankOffers(r.Context(), supplyId, postalCode, schoolId.String(), affiliateLinksDisabled)
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if len(offers) == 0 || !offers[0].Best {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	if err := render.Render(w, r, response.SupplyOffersResponse{SupplyOffers: offers[0]}); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+// CreateSupplyOffers adds a vendor's offer for a supply.
+func (a *SupplyOffersServiceInternal) CreateSupplyOffers(w http.ResponseWriter, r *http.Request) {
+	supplyId, err := uuid.Parse(chi.URLParam(r, "supplyId"))
+	if err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	data := &request.SupplyOffersRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	if data.Url == nil {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("url must be an http or https link")))
+		return
+	}
+	if data.DeliveryRegions == nil {
+		data.DeliveryRegions = []string{}
+	}
+
+	var offerId string
+	err = a.db.QueryRow(metrics.WithQueryName(r.Context(), "create_supply_offer"),
+		`INSERT INTO helpschool.supply_offers( supply_id,vendor,url,price,currency,shipping_cost,shipping_days,delivery_regions,in_stock)
+			VALUES ( $1, $2, $3, $4, coalesce($5,'INR'), coalesce($6,0), $7, $8, coalesce($9,true))
+			returning offer_id::text`,
+		supplyId, data.Vendor, data.Url, data.Price, data.Currency, data.ShippingCost, data.ShippingDays,
+		data.DeliveryRegions, data.InStock).Scan(&offerId)
+	switch sqlState(err) {
+	case "":
+	case uniqueViolation:
+		render.Render(w, r, util.ErrConflict(errors.New("the supply already has an offer with this url")))
+		return
+	case foreignKeyViolation:
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("create supply offer failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	render.DefaultResponder(w, r, render.M{"status": "created", "offer_id": offerId})
+}
+
+// UpdateSupplyOffers changes the fields given of an offer, typically its
+// price and stock after checking the listing, and records the check.
+func (a *SupplyOffersServiceInternal) UpdateSupplyOffers(w http.ResponseWriter, r *http.Request) {
+	supplyId, err := uuid.Parse(chi.URLParam(r, "supplyId"))
+	if err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	offerId, err := uuid.Parse(chi.URLParam(r, "offerId"))
+	if err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	data := &request.SupplyOffersRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	tag, err := a.db.Exec(metrics.WithQueryName(r.Context(), "update_supply_offer"),
+		`update helpschool.supply_offers set vendor = coalesce($3,vendor), url = coalesce($4,url),
+			price = coalesce($5,price), currency = coalesce($6,currency), shipping_cost = coalesce($7,shipping_cost),
+			shipping_days = coalesce($8,shipping_days), delivery_regions = coalesce($9,delivery_regions),
+			in_stock = coalesce($10,in_stock), last_checked = now(), modified_date = now()
+		where offer_id = $1 and supply_id = $2`,
+		offerId, supplyId, data.Vendor, data.Url, data.Price, data.Currency, data.ShippingCost, data.ShippingDays,
+		data.DeliveryRegions, data.InStock)
+	if sqlState(err) == uniqueViolation {
+		render.Render(w, r, util.ErrConflict(errors.New("the supply already has an offer with this url")))
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("update supply offer failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	render.DefaultResponder(w, r, render.M{"status": "updated"})
+}
@@ -0,0 +1,504 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/auth"
+	"github.com/venkata6/helpschool/api/dto"
+	"github.com/venkata6/helpschool/api/logging"
+	"github.com/venkata6/helpschool/api/mail"
+	"github.com/venkata6/helpschool/api/metrics"
+	"github.com/venkata6/helpschool/api/request"
+	"github.com/venkata6/helpschool/api/response"
+	"github.com/venkata6/helpschool/api/storage"
+	"github.com/venkata6/helpschool/api/util"
+	"math/big"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+type TeacherAffiliationsService interface {
+	CreateTeacherAffiliations(w http.ResponseWriter, r *http.Request)
+	GetTeacherAffiliations(w http.ResponseWriter, r *http.Request)
+	UploadEvidence(w http.ResponseWriter, r *http.Request)
+	VerifyCode(w http.ResponseWriter, r *http.Request)
+
+	// moderation
+	ListTeacherAffiliations(w http.ResponseWriter, r *http.Request)
+	GetEvidence(w http.ResponseWriter, r *http.Request)
+	MailCode(w http.ResponseWriter, r *http.Request)
+	ReviewTeacherAffiliations(w http.ResponseWriter, r *http.Request)
+}
+
+type TeacherAffiliationsServiceInternal struct {
+	db     *pgxpool.Pool
+	store  storage.Store
+	mailer mail.Sender
+}
+
+func NewTeacherAffiliationsService(db *pgxpool.Pool, store storage.Store, mailer mail.Sender) TeacherAffiliationsService {
+	return &TeacherAffiliationsServiceInternal{db: db, store: store, mailer: mailer}
+}
+
+const (
+	// guesses at a code and emailed codes are counted per day, see codeWindow
+	maxCodeAttempts    = 5
+	maxEmailedCodes    = 3
+	emailCodeTTL       = 24 * time.Hour
+	mailedCodeTTL      = 60 * 24 * time.Hour
+	selectAffiliations = `select a.affiliation_id,a.user_id,coalesce(u.display_name,u.user_name,''),coalesce(u.user_email,''),
+	a.school_id,s.name,a.method,a.status,coalesce(a.school_email,''),a.evidence_key is not null,a.code_verified,
+	coalesce(a.review_note,''),a.created_date,a.reviewed_date
+	from helpschool.teacher_affiliations as a
+	inner join helpschool.users as u on u.id = a.user_id
+	inner join helpschool.schools as s on s.school_id = a.school_id `
+)
+
+// errTooManyCodes is returned when the day's emailed codes are used up.
+var errTooManyCodes = errors.New("too many codes today, try again tomorrow")
+
+// codeWindow is the start of the day code_attempts and codes_issued are
+// counted in, a new one once the last is over.
+const codeWindow = `case when code_window_start > now() - interval '1 day' then code_window_start else now() end`
+
+// inCodeWindow is column counted in the current day, 0 once it is over.
+func inCodeWindow(column string) string {
+	return `(case when code_window_start > now() - interval '1 day' then ` + column + ` else 0 end)`
+}
+
+// isVerifiedTeacher reports whether the user has an approved affiliation with the school.
+func isVerifiedTeacher(ctx context.Context, db *pgxpool.Pool, userId, schoolId string) (bool, error) {
+	var verified bool
+	err := db.QueryRow(metrics.WithQueryName(ctx, "is_verified_teacher"),
+		`select exists (select 1 from helpschool.teacher_affiliations
+			where user_id = $1 and school_id = $2 and status = 'approved')`, userId, schoolId).Scan(&verified)
+	return verified, err
+}
+
+// canManageSchool reports whether the caller may post needs and updates for
+// the school: its verified teachers and moderators.
+func canManageSchool(ctx context.Context, db *pgxpool.Pool, userId, schoolId string) (bool, error) {
+	identity, _ := auth.IdentityFromContext(ctx)
+	if identity.HasRole(auth.RoleModerator) || identity.HasRole(auth.RoleAdmin) {
+		return true, nil
+	}
+	return isVerifiedTeacher(ctx, db, userId, schoolId)
+}
+
+// CreateTeacherAffiliations starts linking the caller to a school. For the
+// school_email method a code is sent to the given address right away.
+func (a *TeacherAffiliationsServiceInternal) CreateTeacherAffiliations(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	data := &request.TeacherAffiliationsRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	schoolId, err := uuid.Parse(data.SchoolId)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("invalid SchoolId")))
+		return
+	}
+
+	ctx := r.Context()
+	var emailDomain string
+	err = a.db.QueryRow(metrics.WithQueryName(ctx, "get_school_email_domain"),
+		"select coalesce(email_domain,'') from helpschool.schools where school_id = $1", schoolId).Scan(&emailDomain)
+	if errors.Is(err, pgx.ErrNoRows) {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("unknown school")))
+		return
+	} else if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+
+	switch data.Method {
+	case dto.AffiliationStaffId, dto.AffiliationMailedCode:
+		data.SchoolEmail = ""
+	case dto.AffiliationSchoolEmail:
+		if emailDomain == "" {
+			render.Render(w, r, util.ErrInvalidRequest(errors.New("the school has no official email domain, use another method")))
+			return
+		}
+		email, err := normalizeEmail(data.SchoolEmail)
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(err))
+			return
+		}
+		if !strings.HasSuffix(email, "@"+strings.ToLower(emailDomain)) {
+			render.Render(w, r, util.ErrInvalidRequest(errors.New("school_email must be an address at the school's email domain")))
+			return
+		}
+		data.SchoolEmail = email
+	default:
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("method must be staff_id, school_email or mailed_code")))
+		return
+	}
+
+	// a rejected or unfinished affiliation can be started over, an approved
+	// one stays; the day's guesses and codes still count
+	var affiliationId string
+	err = a.db.QueryRow(metrics.WithQueryName(ctx, "create_teacher_affiliation"),
+		`INSERT INTO helpschool.teacher_affiliations( user_id,school_id,method,school_email)
+			VALUES ( $1, $2, $3, nullif($4,''))
+			on conflict (user_id,school_id) do update set method = excluded.method, school_email = excluded.school_email,
+				status = 'pending', evidence_key = null, code_hash = null, code_expires = null,
+				code_verified = false, reviewed_by = null, review_note = null, reviewed_date = null, modified_date = now()
+			where teacher_affiliations.status <> 'approved'
+			returning affiliation_id`, user.UserId, schoolId, data.Method, data.SchoolEmail).Scan(&affiliationId)
+	if errors.Is(err, pgx.ErrNoRows) {
+		render.Render(w, r, util.ErrConflict(errors.New("already verified for this school")))
+		return
+	} else if err != nil {
+		logging.FromContext(ctx).Error("create teacher affiliation failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+
+	if data.Method == dto.AffiliationSchoolEmail {
+		code, err := a.issueCode(ctx, affiliationId, emailCodeTTL, maxEmailedCodes)
+		if errors.Is(err, errTooManyCodes) {
+			render.Render(w, r, util.ErrTooManyRequests(err))
+			return
+		}
+		if err == nil {
+			err = a.mailer.Send(ctx, mail.Message{
+				To:      data.SchoolEmail,
+				Subject: "Your helpschool verification code",
+				Body: fmt.Sprintf("Enter this code on helpschool to confirm you work at the school: %s\n\n"+
+					"The code expires in 24 hours. If you did not ask for it, ignore this email.", code),
+			})
+		}
+		if err != nil {
+			logging.FromContext(ctx).Error("send verification code failed", "err", err)
+			render.Render(w, r, util.ErrInternal(err))
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	render.DefaultResponder(w, r, render.M{"status": "created", "affiliation_id": affiliationId})
+}
+
+// issueCode stores the hash of a new one-time code and returns the code,
+// or errTooManyCodes when limit codes were already issued today. A limit
+// of 0 is no limit, for the codes moderators mail.
+func (a *TeacherAffiliationsServiceInternal) issueCode(ctx context.Context, affiliationId string, ttl time.Duration, limit int) (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	code := fmt.Sprintf("%06d", n.Int64())
+	tag, err := a.db.Exec(metrics.WithQueryName(ctx, "issue_affiliation_code"),
+		`update helpschool.teacher_affiliations set code_hash = $2, code_expires = $3,
+			code_attempts = `+inCodeWindow("code_attempts")+`, codes_issued = `+inCodeWindow("codes_issued")+` + 1,
+			code_window_start = `+codeWindow+`, modified_date = now()
+			where affiliation_id = $1 and ($4 = 0 or `+inCodeWindow("codes_issued")+` < $4)`,
+		affiliationId, hashCode(affiliationId, code), time.Now().Add(ttl), limit)
+	if err == nil && tag.RowsAffected() == 0 {
+		err = errTooManyCodes
+	}
+	return code, err
+}
+
+func hashCode(affiliationId, code string) string {
+	sum := sha256.Sum256([]byte(affiliationId + ":" + code))
+	return hex.EncodeToString(sum[:])
+}
+
+// GetTeacherAffiliations lists the caller's affiliations.
+func (a *TeacherAffiliationsServiceInternal) GetTeacherAffiliations(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	a.renderAffiliations(metrics.WithQueryName(r.Context(), "list_my_teacher_affiliations"), w, r,
+		selectAffiliations+"where a.user_id = $1 order by a.created_date desc", user.UserId)
+}
+
+// ListTeacherAffiliations lists affiliations for moderators, by default
+// the ones waiting for review.
+func (a *TeacherAffiliationsServiceInternal) ListTeacherAffiliations(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = dto.AffiliationSubmitted
+	}
+	a.renderAffiliations(metrics.WithQueryName(r.Context(), "list_teacher_affiliations"), w, r,
+		selectAffiliations+"where a.status = $1 order by a.created_date", status)
+}
+
+func (a *TeacherAffiliationsServiceInternal) renderAffiliations(ctx context.Context, w http.ResponseWriter, r *http.Request, sql string, args ...interface{}) {
+	rows, err := a.db.Query(ctx, sql, args...)
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	defer rows.Close()
+
+	affiliations := []render.Renderer{}
+	for rows.Next() {
+		affiliation := &dto.TeacherAffiliations{}
+		if err := rows.Scan(&affiliation.AffiliationId, &affiliation.UserId, &affiliation.TeacherName,
+			&affiliation.TeacherEmail, &affiliation.SchoolId, &affiliation.SchoolName, &affiliation.Method,
+			&affiliation.Status, &affiliation.SchoolEmail, &affiliation.HasEvidence, &affiliation.CodeVerified,
+			&affiliation.ReviewNote, &affiliation.CreatedDate, &affiliation.ReviewedDate); err != nil {
+			render.Render(w, r, util.ErrInternal(err))
+			return
+		}
+		affiliations = append(affiliations, response.TeacherAffiliationsResponse{TeacherAffiliations: affiliation})
+	}
+	// Any errors encountered by rows.Next or rows.Scan will be returned here
+	if rows.Err() != nil {
+		render.Render(w, r, util.ErrInternal(rows.Err()))
+		return
+	}
+	if err := render.RenderList(w, r, affiliations); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+// UploadEvidence stores the staff ID photo of a staff_id affiliation,
+// posted as the "photo" field of a multipart form, and queues it for review.
+func (a *TeacherAffiliationsServiceInternal) UploadEvidence(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	affiliationId, err := uuid.Parse(chi.URLParam(r, "affiliationId"))
+	if err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxImageSize+1<<20)
+	file, _, err := r.FormFile("photo")
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("expected a photo file of at most 5MB")))
+		return
+	}
+	defer file.Close()
+
+	body, ext, err := sniffImage(file)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	ctx := r.Context()
+	var oldKey string
+	err = a.db.QueryRow(metrics.WithQueryName(ctx, "get_affiliation_evidence"),
+		`select coalesce(evidence_key,'') from helpschool.teacher_affiliations
+			where affiliation_id = $1 and user_id = $2 and method = 'staff_id' and status in ('pending','submitted')`,
+		affiliationId, user.UserId).Scan(&oldKey)
+	if errors.Is(err, pgx.ErrNoRows) {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+
+	key := path.Join("verification", affiliationId.String(), uuid.New().String()+ext)
+	if err := a.store.Put(ctx, key, body); err != nil {
+		logging.FromContext(ctx).Error("store evidence failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if _, err := a.db.Exec(metrics.WithQueryName(ctx, "set_affiliation_evidence"),
+		`update helpschool.teacher_affiliations set evidence_key = $2, status = 'submitted', modified_date = now()
+			where affiliation_id = $1`, affiliationId, key); err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if oldKey != "" {
+		_ = a.store.Delete(ctx, oldKey)
+	}
+	render.DefaultResponder(w, r, render.M{"status": dto.AffiliationSubmitted})
+}
+
+// VerifyCode checks the one-time code of a school_email or mailed_code
+// affiliation, a matching code queues the affiliation for review.
+func (a *TeacherAffiliationsServiceInternal) VerifyCode(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	affiliationId, err := uuid.Parse(chi.URLParam(r, "affiliationId"))
+	if err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	data := &request.AffiliationCodeRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	ctx := r.Context()
+	// every guess counts before it is checked, so parallel guesses cannot
+	// get past maxCodeAttempts a day
+	var codeHash string
+	var expires *time.Time
+	err = a.db.QueryRow(metrics.WithQueryName(ctx, "count_affiliation_code_attempt"),
+		`update helpschool.teacher_affiliations set code_attempts = `+inCodeWindow("code_attempts")+` + 1,
+			code_window_start = `+codeWindow+`
+			where affiliation_id = $1 and user_id = $2 and status = 'pending' and `+inCodeWindow("code_attempts")+` < $3
+			returning coalesce(code_hash,''),code_expires`,
+		affiliationId, user.UserId, maxCodeAttempts).Scan(&codeHash, &expires)
+	if errors.Is(err, pgx.ErrNoRows) {
+		var pending bool
+		if err := a.db.QueryRow(metrics.WithQueryName(ctx, "get_affiliation_pending"),
+			`select exists (select 1 from helpschool.teacher_affiliations
+				where affiliation_id = $1 and user_id = $2 and status = 'pending')`,
+			affiliationId, user.UserId).Scan(&pending); err != nil {
+			render.Render(w, r, util.ErrInternal(err))
+			return
+		}
+		if !pending {
+			render.Render(w, r, util.ErrNotFound)
+			return
+		}
+		render.Render(w, r, util.ErrTooManyRequests(errors.New("too many attempts today, try again tomorrow")))
+		return
+	} else if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if codeHash == "" || expires == nil || time.Now().After(*expires) {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("no valid code, ask for a new one")))
+		return
+	}
+	if hashCode(affiliationId.String(), strings.TrimSpace(data.Code)) != codeHash {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("wrong code")))
+		return
+	}
+
+	if _, err := a.db.Exec(metrics.WithQueryName(ctx, "verify_affiliation_code"),
+		`update helpschool.teacher_affiliations set code_verified = true, code_hash = null, status = 'submitted',
+			modified_date = now() where affiliation_id = $1 and code_hash = $2`, affiliationId, codeHash); err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	render.DefaultResponder(w, r, render.M{"status": dto.AffiliationSubmitted})
+}
+
+// GetEvidence streams the staff ID photo of an affiliation to a moderator.
+func (a *TeacherAffiliationsServiceInternal) GetEvidence(w http.ResponseWriter, r *http.Request) {
+	affiliationId, err := uuid.Parse(chi.URLParam(r, "affiliationId"))
+	if err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	var key string
+	err = a.db.QueryRow(metrics.WithQueryName(r.Context(), "get_affiliation_evidence_key"),
+		"select evidence_key from helpschool.teacher_affiliations where affiliation_id = $1 and evidence_key is not null",
+		affiliationId).Scan(&key)
+	if errors.Is(err, pgx.ErrNoRows) {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	serveImage(w, r, a.store, key)
+}
+
+// MailCode issues the one-time code of a mailed_code affiliation and returns
+// it, with the school's address, for the moderator to post to the school.
+func (a *TeacherAffiliationsServiceInternal) MailCode(w http.ResponseWriter, r *http.Request) {
+	affiliationId, err := uuid.Parse(chi.URLParam(r, "affiliationId"))
+	if err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	ctx := r.Context()
+	var schoolName, place, address string
+	err = a.db.QueryRow(metrics.WithQueryName(ctx, "get_affiliation_school_address"),
+		`select s.name,coalesce(s.place,''),coalesce(s.address,'') from helpschool.teacher_affiliations as a
+			inner join helpschool.schools as s on s.school_id = a.school_id
+			where a.affiliation_id = $1 and a.method = 'mailed_code' and a.status = 'pending'`,
+		affiliationId).Scan(&schoolName, &place, &address)
+	if errors.Is(err, pgx.ErrNoRows) {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	code, err := a.issueCode(ctx, affiliationId.String(), mailedCodeTTL, 0)
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	render.DefaultResponder(w, r, render.M{
+		"code":        code,
+		"school_name": schoolName,
+		"place":       place,
+		"address":     address,
+		"expires":     time.Now().Add(mailedCodeTTL),
+	})
+}
+
+// ReviewTeacherAffiliations approves or rejects an affiliation.
+func (a *TeacherAffiliationsServiceInternal) ReviewTeacherAffiliations(w http.ResponseWriter, r *http.Request) {
+	moderator, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	affiliationId, err := uuid.Parse(chi.URLParam(r, "affiliationId"))
+	if err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	data := &request.AffiliationReviewRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+
+	var sql string
+	switch data.Decision {
+	case "approve":
+		// only affiliations with evidence can be approved
+		sql = `update helpschool.teacher_affiliations set status = 'approved', reviewed_by = $2, review_note = nullif($3,''),
+			reviewed_date = now(), modified_date = now() where affiliation_id = $1 and status = 'submitted'`
+	case "reject":
+		sql = `update helpschool.teacher_affiliations set status = 'rejected', reviewed_by = $2, review_note = nullif($3,''),
+			reviewed_date = now(), modified_date = now() where affiliation_id = $1 and status <> 'rejected'`
+	default:
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("decision must be approve or reject")))
+		return
+	}
+	tag, err := a.db.Exec(metrics.WithQueryName(r.Context(), "review_teacher_affiliation"), sql,
+		affiliationId, moderator.UserId, data.Note)
+	if err != nil {
+		logging.FromContext(r.Context()).Error("review teacher affiliation failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		render.Render(w, r, util.ErrConflict(errors.New("affiliation is not waiting for this decision")))
+		return
+	}
+	render.DefaultResponder(w, r, render.M{"status": "reviewed"})
+}
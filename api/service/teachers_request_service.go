@@ -3,10 +3,14 @@ package service
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/venkata6/helpschool/api/dto"
+	"github.com/venkata6/helpschool/api/logging"
+	"github.com/venkata6/helpschool/api/metrics"
+	"github.com/venkata6/helpschool/api/pii"
 	"github.com/venkata6/helpschool/api/request"
 	"github.com/venkata6/helpschool/api/response"
 	"github.com/venkata6/helpschool/api/util"
@@ -21,11 +25,12 @@ type TeachersRequestService interface {
 }
 
 type TeachersRequestServiceInternal struct {
-	db *pgxpool.Pool
+	db     *pgxpool.Pool
+	cipher *pii.Cipher
 }
 
-func NewTeachersRequestService(db *pgxpool.Pool) TeachersRequestService {
-	return &TeachersRequestServiceInternal{db: db}
+func NewTeachersRequestService(db *pgxpool.Pool, cipher *pii.Cipher) TeachersRequestService {
+	return &TeachersRequestServiceInternal{db: db, cipher: cipher}
 }
 
 // CreateCountries persists the posted Article and returns it
@@ -52,13 +57,35 @@ func (a *TeachersRequestServiceInternal) CreateTeachersRequest(w http.ResponseWr
 	}
 	// Validate the form data
 
-	if _, err := a.db.Exec(context.Background(),
-		`INSERT INTO helpschool.teacher_requests( teacher_name,teacher_phone,teacher_email,url,quantity_needed,address,place,district,state,country,zipcode,extra_info,photo_link)
-					VALUES ( $1, $2, $3, $4, $5,$6,$7,$8,$9,$10,$11,$12,$13)`, data.TeacherName,data.TeacherPhone,data.TeacherEmail,data.Url,data.QuantityNeeded,data.Address,data.Place,
-					        data.District,data.State,data.Country,data.ZipCode,data.ExtraInfo,data.PhotoLink); err == nil {
+	// the teacher's phone, email and address are stored encrypted, see pii.TeacherRequests
+	t := pii.TeacherRequests
+	phone, err := a.cipher.Encrypt(r.Context(), t.AAD("teacher_phone"), data.TeacherPhone)
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(fmt.Errorf("encrypt teacher_phone: %w", err)))
+		return
+	}
+	email, err := a.cipher.Encrypt(r.Context(), t.AAD("teacher_email"), data.TeacherEmail)
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(fmt.Errorf("encrypt teacher_email: %w", err)))
+		return
+	}
+	address, err := a.cipher.Encrypt(r.Context(), t.AAD("address"), data.Address)
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(fmt.Errorf("encrypt address: %w", err)))
+		return
+	}
+
+	if _, err := a.db.Exec(metrics.WithQueryName(r.Context(), "create_teacher_request"),
+		`INSERT INTO helpschool.teacher_requests( teacher_name,teacher_phone,teacher_email,url,quantity_needed,address,place,district,state,country,zipcode,extra_info,photo_link,
+					teacher_phone_bidx,teacher_email_bidx,pii_key_id)
+					VALUES ( $1, nullif($2,''), nullif($3,''), $4, $5,$6,$7,$8,$9,$10,$11,$12,$13,nullif($14,''),nullif($15,''),$16)`, data.TeacherName,phone,email,data.Url,data.QuantityNeeded,address,data.Place,
+					        data.District,data.State,data.Country,data.ZipCode,data.ExtraInfo,data.PhotoLink,
+					        a.cipher.Index(pii.Phone,data.TeacherPhone),a.cipher.Index(pii.Email,data.TeacherEmail),a.cipher.KeyID()); err == nil {
+		metrics.TeacherRequestsSubmitted.Inc()
 		w.WriteHeader(http.StatusCreated)
 		render.DefaultResponder(w, r, render.M{"status": "created"})
 	} else {
+		logging.FromContext(r.Context()).Error("create teacher request failed", "err", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		render.DefaultResponder(w, r, render.M{"status": "not created"})
 	}
@@ -72,7 +99,7 @@ func (a *TeachersRequestServiceInternal) GetTeachersRequest(w http.ResponseWrite
 		return
 	}
 	rowId,_ := strconv.Atoi(id) // convert to integer
-	rows, err := a.db.Query(context.Background(), "select id,teacher_name,teacher_phone,teacher_email,url,quantity_needed,address,place,district,state,country,zipcode,extra_info,photo_link from helpschool.teacher_requests where id =$1",rowId)
+	rows, err := a.db.Query(metrics.WithQueryName(r.Context(), "get_teacher_request"), "select id,teacher_name,coalesce(teacher_phone,''),coalesce(teacher_email,''),url,quantity_needed,coalesce(address,''),place,district,state,country,zipcode,extra_info,coalesce(photo_link,''),pii_key_id is not null from helpschool.teacher_requests where id =$1",rowId)
 	defer rows.Close()
 	// Any errors encountered by rows.Next or rows.Scan will be returned here
 	if rows.Err() != nil {
@@ -81,24 +108,54 @@ func (a *TeachersRequestServiceInternal) GetTeachersRequest(w http.ResponseWrite
 	}
 
 	// let us keep it as array for now as later on GET may return mulitiple records .. here it returns just one
-	rows.Next(); // get the row
+	if !rows.Next() { // get the row
+		if rows.Err() != nil {
+			render.Render(w, r, util.ErrInternal(rows.Err()))
+		} else {
+			render.Render(w, r, util.ErrNotFound)
+		}
+		return
+	}
 	teachersSupplies := make([]response.TeachersSuppliesResponse, 1)
 	teachersSupplies[0].TeacherRequests = &dto.TeacherRequests{}
 
     i := 0  // only one object here as we queried by ID
+	var encrypted bool
 
 	err = rows.Scan(&teachersSupplies[i].Id,&teachersSupplies[i].TeacherName,&teachersSupplies[i].TeacherPhone,&teachersSupplies[i].TeacherEmail,&teachersSupplies[i].Url,&teachersSupplies[i].QuantityNeeded,
                    &teachersSupplies[i].Address,&teachersSupplies[i].Place,&teachersSupplies[i].District,&teachersSupplies[i].State,&teachersSupplies[i].Country,
-                   &teachersSupplies[i].ZipCode,&teachersSupplies[i].ExtraInfo,&teachersSupplies[i].PhotoLink)
+                   &teachersSupplies[i].ZipCode,&teachersSupplies[i].ExtraInfo,&teachersSupplies[i].PhotoLink,&encrypted)
     if err != nil {
+        render.Render(w, r, util.ErrInternal(err))
         return
     }
+	if encrypted {
+		if err := a.decrypt(r.Context(), teachersSupplies[i].TeacherRequests); err != nil {
+			render.Render(w, r, util.ErrInternal(fmt.Errorf("decrypt teacher request %d: %w", rowId, err)))
+			return
+		}
+	}
 	if err := render.RenderList(w, r, NewTeachersSuppliesResponse(teachersSupplies)); err != nil {
 		render.Render(w, r, util.ErrRender(err))
 		return
 	}
 }
 
+// decrypt replaces the encrypted phone, email and address of req with
+// their plaintext.
+func (a *TeachersRequestServiceInternal) decrypt(ctx context.Context, req *dto.TeacherRequests) error {
+	t := pii.TeacherRequests
+	var err error
+	if req.TeacherPhone, err = a.cipher.Decrypt(ctx, t.AAD("teacher_phone"), req.TeacherPhone); err != nil {
+		return err
+	}
+	if req.TeacherEmail, err = a.cipher.Decrypt(ctx, t.AAD("teacher_email"), req.TeacherEmail); err != nil {
+		return err
+	}
+	req.Address, err = a.cipher.Decrypt(ctx, t.AAD("address"), req.Address)
+	return err
+}
+
 func (a *TeachersRequestServiceInternal) DeleteTeachersRequest(w http.ResponseWriter, r *http.Request) {
 	//render.RenderList(w, r, NewCountriesListResponse(articles))
 }
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/logging"
+	"github.com/venkata6/helpschool/api/metrics"
+	"github.com/venkata6/helpschool/api/request"
+	"github.com/venkata6/helpschool/api/util"
+	"net/http"
+)
+
+type TranslationsService interface {
+	UpdateRegionNames(w http.ResponseWriter, r *http.Request)
+	UpdateSupplyTitles(w http.ResponseWriter, r *http.Request)
+}
+
+type TranslationsServiceInternal struct {
+	db *pgxpool.Pool
+}
+
+func NewTranslationsService(db *pgxpool.Pool) TranslationsService {
+	return &TranslationsServiceInternal{db: db}
+}
+
+// UpdateRegionNames merges translated names into a region, countries,
+// states and districts included.
+func (a *TranslationsServiceInternal) UpdateRegionNames(w http.ResponseWriter, r *http.Request) {
+	a.updateTranslations(w, r, "regionId", "update_region_names",
+		`update helpschool.regions set name_translations = (name_translations || $2::jsonb) - $3::text[],
+			modified_date = now() where region_id = $1 returning name_translations`)
+}
+
+// UpdateSupplyTitles merges translated titles into a supply.
+func (a *TranslationsServiceInternal) UpdateSupplyTitles(w http.ResponseWriter, r *http.Request) {
+	a.updateTranslations(w, r, "supplyId", "update_supply_titles",
+		`update helpschool.supplies set title_translations = (title_translations || $2::jsonb) - $3::text[],
+			modified_date = now() where supply_id = $1 returning title_translations`)
+}
+
+// updateTranslations runs sql with the id in param, the translations to
+// set and the languages to remove, and answers with all translations.
+func (a *TranslationsServiceInternal) updateTranslations(w http.ResponseWriter, r *http.Request, param, queryName, sql string) {
+	id, err := uuid.Parse(chi.URLParam(r, param))
+	if err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	data := request.TranslationsRequest{}
+	if err := render.Bind(r, &data); err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	set := map[string]string{}
+	removed := []string{}
+	for lang, text := range data {
+		if text == "" {
+			removed = append(removed, lang)
+		} else {
+			set[lang] = text
+		}
+	}
+	setJSON, err := json.Marshal(set)
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+
+	translations := map[string]string{}
+	err = a.db.QueryRow(metrics.WithQueryName(r.Context(), queryName), sql, id, string(setJSON), removed).Scan(&translations)
+	if errors.Is(err, pgx.ErrNoRows) {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	if err != nil {
+		logging.FromContext(r.Context()).Error("update translations failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	render.DefaultResponder(w, r, translations)
+}
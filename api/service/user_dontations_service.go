@@ -6,13 +6,16 @@ import (
 	"github.com/go-chi/chi"
 	"github.com/go-chi/render"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/venkata6/helpschool/api/dto"
+	"github.com/venkata6/helpschool/api/logging"
+	"github.com/venkata6/helpschool/api/metrics"
+	"github.com/venkata6/helpschool/api/needs"
 	"github.com/venkata6/helpschool/api/request"
 	"github.com/venkata6/helpschool/api/response"
 	"github.com/venkata6/helpschool/api/util"
 	"net/http"
-	"time"
 )
 
 type UserDonationsService interface {
@@ -20,6 +23,7 @@ type UserDonationsService interface {
 	GetUserDonations(w http.ResponseWriter, r *http.Request)
 	UpdateUserDonations(w http.ResponseWriter, r *http.Request)
 	DeleteUserDonations(w http.ResponseWriter, r *http.Request)
+	GetSchoolDonors(w http.ResponseWriter, r *http.Request)
 }
 
 type UserDonationsServiceInternal struct {
@@ -30,125 +34,333 @@ func NewUserDonationsService(db *pgxpool.Pool) UserDonationsService {
 	return &UserDonationsServiceInternal{db: db}
 }
 
-// CreateCountries persists the posted Article and returns it
-// back to the client as an acknowledgement.
+// CreateUserDonations pledges a donation of the authenticated user, with
+// bundle_id one for each item of the bundles. The routes must be wrapped in
+// UsersService.Provision.
 func (a *UserDonationsServiceInternal) CreateUserDonations(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
 	data := &request.UserDonationsRequest{}
 	if err := render.Bind(r, data); err != nil {
 		render.Render(w, r, util.ErrInvalidRequest(err))
 		return
 	}
 
-	if len(data.UserEmail) == 0 {
-		render.Render(w, r, util.ErrInvalidRequest(errors.New("empty UserEmail")))
+	schoolId, err := uuid.Parse(data.SchoolId)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("invalid SchoolId")))
 		return
 	}
-
-	if len(data.SchoolId) == 0 {
-		render.Render(w, r, util.ErrInvalidRequest(errors.New("empty SchoolId")))
+	if data.BundleId != "" {
+		a.createBundleDonations(w, r, user.UserId, schoolId, data)
+		return
+	}
+	supplyId, err := uuid.Parse(data.SupplyId)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("invalid SupplyId")))
 		return
 	}
-	if len(data.SupplyId) == 0 {
-		render.Render(w, r, util.ErrInvalidRequest(errors.New("empty SupplyId")))
+	if data.Quantity <= 0 {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("quantity must be positive")))
 		return
 	}
-	schoolId, _ := uuid.Parse(data.SchoolId)
-	supplyId, _ := uuid.Parse(data.SupplyId)
 
-	if _, err := a.db.Exec(context.Background(),
-		`INSERT INTO helpschool.users_donations( user_email,user_id,user_name,school_id,supply_id,quantity,status,tracking_url,extra_info)
-				VALUES ( $1, $2, $3, $4, $5, $6,$7,$8,$9)`,data.UserEmail,data.UserId,data.UserName, schoolId, supplyId,
-				data.Quantity, data.Status, data.TrackingUrl, data.ExtraInfo); err == nil {
+	var donationId string
+	if err := a.db.QueryRow(metrics.WithQueryName(r.Context(), "create_user_donation"),
+		`INSERT INTO helpschool.users_donations( user_id,school_id,supply_id,quantity,tracking_url,extra_info,anonymous,confirmed_date,click_id)
+				select $1::uuid, $2::uuid, $3::uuid, $4::integer, nullif($5,''), nullif($6,'')::jsonb, coalesce($7,false), now(),
+					`+attributedClick("$8", "$3")+`
+				where `+openNeed("$2", "$3", "$9")+` returning donation_id`,
+		user.UserId, schoolId, supplyId, data.Quantity, data.TrackingUrl, data.ExtraInfo, data.Anonymous, clickOf(r), needs.Open).Scan(&donationId); err == nil {
+		metrics.PledgesCreated.Inc()
 		w.WriteHeader(http.StatusCreated)
-		render.DefaultResponder(w, r, render.M{"status": "created"})
+		render.DefaultResponder(w, r, render.M{"status": "created", "donation_id": donationId})
+	} else if errors.Is(err, pgx.ErrNoRows) {
+		render.Render(w, r, util.ErrInvalidRequest(errNeedNotOpen))
 	} else {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		render.DefaultResponder(w, r, render.M{"status": "not created"})
+		logging.FromContext(r.Context()).Error("create user donation failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
 	}
 }
-func (a *UserDonationsServiceInternal) GetUserDonations(w http.ResponseWriter, r *http.Request) {
 
-	schoolId := chi.URLParam(r, "schoolId")
-	var count int
-	rowCount, err := a.db.Query(context.Background(), "select count(*) as count from" +
-			"  helpschool.school_supplies where school_id = $1 ",schoolId)
-	for rowCount.Next() {
-		_ = rowCount.Scan(&count)
-		//checkErr(err)
-	}
-	rows, err := a.db.Query(context.Background(), "select su.title,su.description,su.url,ss.school_id,ss.supply_id," +
-		"ss.quantity,ss.fulfilled_count,ss.extra_info,ss.created_date from helpschool.school_supplies as ss" +
-		" inner join helpschool.supplies as su on ss.supply_id = su.supply_id where  ss.school_id = $1",schoolId)
+// errNeedNotOpen is returned for pledges to needs that are not open: met,
+// expired or closed ones, and those the school does not have.
+var errNeedNotOpen = errors.New("the school has no such open need")
+
+// openNeed is the condition that school $school has an open need for
+// supply $supply, $status being needs.Open.
+func openNeed(school, supply, status string) string {
+	return `exists (select 1 from helpschool.school_supplies
+		where school_id = ` + school + ` and supply_id = ` + supply + ` and status = ` + status + `)`
+}
+
+// createBundleDonations pledges data.Quantity bundles of a school's bundle
+// need, one donation per open item for the per-bundle quantity of it times
+// the bundles. Pledges are capped at the bundles still needed, a bundle
+// being pledged as far as its least pledged item, as GetSchoolBundles
+// counts them.
+func (a *UserDonationsServiceInternal) createBundleDonations(w http.ResponseWriter, r *http.Request, userId string, schoolId uuid.UUID, data *request.UserDonationsRequest) {
+	bundleId, err := uuid.Parse(data.BundleId)
+	if err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("invalid BundleId")))
+		return
+	}
+	if data.Quantity <= 0 {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("quantity must be positive")))
+		return
+	}
+
+	donationIds := []string{}
+	var bundles int
+	err = forEachRow(metrics.WithQueryName(r.Context(), "create_bundle_donations"), a.db,
+		`with items as (
+			select ss.supply_id, ss.status, bi.quantity as per_bundle,
+				(select coalesce(sum(d.quantity),0) from helpschool.users_donations as d
+					where d.school_id = ss.school_id and d.supply_id = ss.supply_id and d.bundle_id = ss.bundle_id
+						and d.confirmed_date is not null and d.status <> $9) as pledged
+			from helpschool.school_supplies as ss
+			inner join helpschool.bundle_items as bi on bi.bundle_id = ss.bundle_id and bi.item_id = ss.item_id
+			where ss.school_id = $2::uuid and ss.bundle_id = $3::uuid
+		), remaining as (
+			select least($4::integer, sb.quantity - coalesce((select min(pledged / per_bundle) from items),0))::integer as bundles
+			from helpschool.school_bundles as sb
+			where sb.school_id = $2::uuid and sb.bundle_id = $3::uuid
+		), pledges as (
+			INSERT INTO helpschool.users_donations( user_id,school_id,supply_id,quantity,tracking_url,extra_info,anonymous,confirmed_date,bundle_id)
+			select $1::uuid, $2::uuid, i.supply_id, rb.bundles * i.per_bundle, nullif($5,''), nullif($6,'')::jsonb, coalesce($7,false), now(), $3::uuid
+			from items as i, remaining as rb
+			where i.status = $8 and rb.bundles > 0
+			returning donation_id
+		)
+		select p.donation_id::text, rb.bundles from pledges as p, remaining as rb`,
+		[]interface{}{userId, schoolId, bundleId, data.Quantity, data.TrackingUrl, data.ExtraInfo, data.Anonymous,
+			needs.Open, dto.DonationCancelled},
+		func(rows pgx.Rows) error {
+			var donationId string
+			err := rows.Scan(&donationId, &bundles)
+			donationIds = append(donationIds, donationId)
+			return err
+		})
+	if err != nil {
+		logging.FromContext(r.Context()).Error("create bundle donations failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if len(donationIds) == 0 {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("the school has no such open bundle need")))
+		return
+	}
+	metrics.PledgesCreated.Add(float64(len(donationIds)))
+	w.WriteHeader(http.StatusCreated)
+	render.DefaultResponder(w, r, render.M{"status": "created", "bundle_id": bundleId.String(), "quantity": bundles,
+		"donation_ids": donationIds})
+}
+
+// GetUserDonations lists the donations of the authenticated user, newest first.
+func (a *UserDonationsServiceInternal) GetUserDonations(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	rows, err := a.db.Query(metrics.WithQueryName(r.Context(), "list_user_donations"),
+		selectDonations+"where d.user_id = $1 order by d.created_date desc", user.UserId)
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
 	defer rows.Close()
 
-	schoolSupplies := make([]response.UserDonationsResponse, count)
-	i := 0
+	donations := []response.UserDonationsResponse{}
 	for rows.Next() {
-		// Read
-		var title string
-		var description string
-		var url string
-		var supplyId string
-		var schoolId string
-		var quantity int
-		var fulfilledCount int
-		var extraInfo string
-		var postedDate time.Time
-
-		err = rows.Scan( &title,&description,&url,&schoolId,&supplyId, &quantity, &fulfilledCount, &extraInfo,&postedDate)
-
+		donation, err := scanDonation(rows)
 		if err != nil {
+			render.Render(w, r, util.ErrInternal(err))
 			return
 		}
-		i++
+		donations = append(donations, response.UserDonationsResponse{UserDonations: donation})
 	}
 	// Any errors encountered by rows.Next or rows.Scan will be returned here
 	if rows.Err() != nil {
+		render.Render(w, r, util.ErrInternal(rows.Err()))
 		return
 	}
-	if err := render.RenderList(w, r, NewUserDonationsListResponse(schoolSupplies)); err != nil {
+	if err := render.RenderList(w, r, NewUserDonationsListResponse(donations)); err != nil {
 		render.Render(w, r, util.ErrRender(err))
 		return
 	}
 }
 
+const selectDonations = `select d.donation_id,coalesce(d.user_id::text,''),d.school_id,s.name,d.supply_id,
+	coalesce(d.bundle_id::text,''),su.title,
+	coalesce(d.quantity,0),d.status,coalesce(d.tracking_url,''),coalesce(d.extra_info::text,''),d.anonymous,
+	d.created_date,coalesce(d.modified_date,d.created_date)
+	from helpschool.users_donations as d
+	inner join helpschool.schools as s on s.school_id = d.school_id
+	inner join helpschool.supplies as su on su.supply_id = d.supply_id `
+
+func scanDonation(row pgx.Row) (*dto.UserDonations, error) {
+	donation := &dto.UserDonations{}
+	err := row.Scan(&donation.DonationId, &donation.UserId, &donation.SchoolId, &donation.SchoolName,
+		&donation.SupplyId, &donation.BundleId, &donation.Title, &donation.Quantity, &donation.Status, &donation.TrackingUrl,
+		&donation.ExtraInfo, &donation.Anonymous, &donation.CreatedDate, &donation.ModifiedDate)
+	return donation, err
+}
+
+var donationStatuses = map[string]bool{
+	dto.DonationOrdered:   true,
+	dto.DonationShipped:   true,
+	dto.DonationDelivered: true,
+	dto.DonationCancelled: true,
+}
+
+// UpdateUserDonations changes the status, tracking url or anonymity of one
+// of the authenticated user's donations.
 func (a *UserDonationsServiceInternal) UpdateUserDonations(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	donationId, err := uuid.Parse(chi.URLParam(r, "donationId"))
+	if err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	data := &request.UserDonationsRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	if data.Status != "" && !donationStatuses[data.Status] {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("unknown status")))
+		return
+	}
+
+	err = updateDonation(r.Context(), a.db, donationId, user.UserId, data)
+	if errors.Is(err, pgx.ErrNoRows) {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	} else if errors.Is(err, errUnconfirmedPledge) {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("update user donation failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	render.DefaultResponder(w, r, render.M{"status": "updated"})
+}
+
+// errUnconfirmedPledge is returned for delivering a guest pledge whose
+// donor never confirmed it.
+var errUnconfirmedPledge = errors.New("confirm the pledge from the emailed link first")
+
+// updateDonation applies a status, tracking url or anonymity change to a
+// pledge of userId, or to a guest pledge when userId is empty. The quantity
+// of a pledge is added to the fulfilled count of the need when it becomes
+// delivered and taken off again when it stops being delivered. It returns
+// pgx.ErrNoRows for unknown pledges.
+func updateDonation(ctx context.Context, db *pgxpool.Pool, donationId uuid.UUID, userId string, data *request.UserDonationsRequest) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
 
-	// let us return 3 newest entries as featured for now
+	var oldStatus string
+	var quantity int
+	var schoolId, supplyId string
+	var bundleId *string
+	var confirmed bool
+	if err := tx.QueryRow(metrics.WithQueryName(ctx, "lock_user_donation"),
+		`select status,coalesce(quantity,0),school_id,supply_id,bundle_id::text,confirmed_date is not null
+			from helpschool.users_donations
+			where donation_id = $1 and user_id is not distinct from nullif($2,'')::uuid for update`, donationId, userId).
+		Scan(&oldStatus, &quantity, &schoolId, &supplyId, &bundleId, &confirmed); err != nil {
+		return err
+	}
+	newStatus := oldStatus
+	if data.Status != "" {
+		newStatus = data.Status
+	}
+	if newStatus == dto.DonationDelivered && !confirmed {
+		return errUnconfirmedPledge
+	}
 
-	var count =3
-	rows, err := a.db.Query(context.Background(), "select su.title,su.description,su.url,ss.school_id," +
-		"ss.supply_id,ss.quantity,ss.fulfilled_count,ss.extra_info,ss.created_date from helpschool.school_supplies as " +
-		"ss inner join helpschool.supplies as su on ss.supply_id = su.supply_id order by ss.created_date desc limit 3")
+	if _, err := tx.Exec(metrics.WithQueryName(ctx, "update_user_donation"),
+		`update helpschool.users_donations set status = coalesce(nullif($2,''),status),
+			tracking_url = coalesce(nullif($3,''),tracking_url), anonymous = coalesce($4,anonymous),
+			delivered_date = case when coalesce(nullif($2,''),status) = $5 then coalesce(delivered_date,now()) end,
+			modified_date = now() where donation_id = $1`,
+		donationId, data.Status, data.TrackingUrl, data.Anonymous, dto.DonationDelivered); err != nil {
+		return err
+	}
+	delivered := newStatus == dto.DonationDelivered && oldStatus != dto.DonationDelivered
+	undelivered := oldStatus == dto.DonationDelivered && newStatus != dto.DonationDelivered
+	if delivered || undelivered {
+		delta := quantity
+		if undelivered {
+			delta = -quantity
+		}
+		if _, err := tx.Exec(metrics.WithQueryName(ctx, "fulfil_school_supply"),
+			`update helpschool.school_supplies set fulfilled_count = greatest(coalesce(fulfilled_count,0) + $3, 0),
+				modified_date = now() where school_id = $1 and supply_id = $2 and bundle_id is not distinct from $4::uuid`,
+			schoolId, supplyId, delta, bundleId); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	if delivered {
+		metrics.DeliveriesConfirmed.Inc()
+	}
+	return nil
+}
+
+// GetSchoolDonors lists the confirmed pledges for a school, newest first.
+// Donors who asked to stay anonymous and guest donors are shown as Anonymous.
+func (a *UserDonationsServiceInternal) GetSchoolDonors(w http.ResponseWriter, r *http.Request) {
+	schoolId, err := uuid.Parse(chi.URLParam(r, "schoolId"))
+	if err != nil {
+		render.Render(w, r, util.ErrNotFound)
+		return
+	}
+	rows, err := a.db.Query(metrics.WithQueryName(r.Context(), "list_school_donors"),
+		`select case when d.anonymous or u.id is null then $2
+				else coalesce(nullif(u.display_name,''),nullif(u.user_name,''),$2) end,
+			d.supply_id,su.title,coalesce(d.quantity,0),d.status,d.created_date
+		from helpschool.users_donations as d
+		inner join helpschool.supplies as su on su.supply_id = d.supply_id
+		left join helpschool.users as u on u.id = d.user_id
+		where d.school_id = $1 and d.confirmed_date is not null and d.status <> $3
+		order by d.created_date desc limit 100`, schoolId, dto.AnonymousDonor, dto.DonationCancelled)
+	if err != nil {
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
 	defer rows.Close()
 
-	schoolSupplies := make([]response.UserDonationsResponse, count)
-	i := 0
+	donors := []render.Renderer{}
 	for rows.Next() {
-		// Read
-		var title string
-		var description string
-		var url string
-		var supplyId string
-		var schoolId string
-		var quantity int
-		var fulfilledCount int
-		var extraInfo string
-		var postedDate time.Time
-
-		err = rows.Scan( &title,&description,&url,&schoolId,&supplyId, &quantity, &fulfilledCount, &extraInfo,&postedDate)
-		schoolSupplies[i].UserDonations = &dto.UserDonations{} // allocate space
-
-		if err != nil {
+		donor := &dto.Donor{}
+		if err := rows.Scan(&donor.DonorName, &donor.SupplyId, &donor.Title, &donor.Quantity, &donor.Status,
+			&donor.CreatedDate); err != nil {
+			render.Render(w, r, util.ErrInternal(err))
 			return
 		}
-		i++
+		donors = append(donors, response.DonorResponse{Donor: donor})
 	}
 	// Any errors encountered by rows.Next or rows.Scan will be returned here
 	if rows.Err() != nil {
+		render.Render(w, r, util.ErrInternal(rows.Err()))
 		return
 	}
-	if err := render.RenderList(w, r, NewUserDonationsListResponse(schoolSupplies)); err != nil {
+	if err := render.RenderList(w, r, donors); err != nil {
 		render.Render(w, r, util.ErrRender(err))
 		return
 	}
@@ -158,10 +370,10 @@ func (a *UserDonationsServiceInternal) DeleteUserDonations(w http.ResponseWriter
 	//render.RenderList(w, r, NewCountriesListResponse(articles))
 }
 
-func NewUserDonationsListResponse(schoolSupplies []response.UserDonationsResponse) []render.Renderer {
+func NewUserDonationsListResponse(donations []response.UserDonationsResponse) []render.Renderer {
 	list := []render.Renderer{}
-	for _, schoolSupply := range schoolSupplies {
-		list = append(list, schoolSupply)
+	for _, donation := range donations {
+		list = append(list, donation)
 	}
 	return list
 }
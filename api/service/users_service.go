@@ -0,0 +1,213 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"github.com/go-chi/render"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/audit"
+	"github.com/venkata6/helpschool/api/auth"
+	"github.com/venkata6/helpschool/api/dto"
+	"github.com/venkata6/helpschool/api/i18n"
+	"github.com/venkata6/helpschool/api/logging"
+	"github.com/venkata6/helpschool/api/metrics"
+	"github.com/venkata6/helpschool/api/request"
+	"github.com/venkata6/helpschool/api/response"
+	"github.com/venkata6/helpschool/api/util"
+	"golang.org/x/text/language"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+type UsersService interface {
+	Provision(next http.Handler) http.Handler
+	GetMe(w http.ResponseWriter, r *http.Request)
+	UpdateMe(w http.ResponseWriter, r *http.Request)
+}
+
+type UsersServiceInternal struct {
+	db *pgxpool.Pool
+}
+
+func NewUsersService(db *pgxpool.Pool) UsersService {
+	return &UsersServiceInternal{db: db}
+}
+
+type userKey struct{}
+
+// UserFromContext returns the caller's account stored by Provision.
+func UserFromContext(ctx context.Context) (*dto.Users, bool) {
+	user, ok := ctx.Value(userKey{}).(*dto.Users)
+	return user, ok
+}
+
+// Provision must run after the auth middleware. It looks up the account of
+// the token's issuer and subject, creating it on the first authenticated
+// request, and stores it in the request context.
+func (a *UsersServiceInternal) Provision(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := auth.IdentityFromContext(r.Context())
+		if !ok {
+			render.Render(w, r, util.ErrUnauthorized)
+			return
+		}
+		user, err := a.provision(r.Context(), identity)
+		if err != nil {
+			logging.FromContext(r.Context()).Error("provision user failed", "err", err)
+			render.Render(w, r, util.ErrInternal(err))
+			return
+		}
+		logging.SetUserID(r.Context(), user.UserId)
+		audit.SetUserID(r.Context(), user.UserId)
+		ctx := context.WithValue(r.Context(), userKey{}, user)
+		if r.Header.Get("Accept-Language") == "" && r.URL.Query().Get("lang") == "" {
+			// without a browser preference users are answered in their own
+			locale := i18n.Negotiate(user.PreferredLanguage)
+			w.Header().Set("Content-Language", locale.Tag.String())
+			ctx = i18n.WithLocale(ctx, locale)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+const selectUser = `select id,coalesce(user_email,''),coalesce(user_name,''),coalesce(display_name,''),
+	preferred_language,notification_prefs,coalesce(handle,''),public_profile,created_date from helpschool.users `
+
+func scanUser(row pgx.Row) (*dto.Users, error) {
+	user := &dto.Users{}
+	err := row.Scan(&user.UserId, &user.Email, &user.Name, &user.DisplayName, &user.PreferredLanguage,
+		&user.NotificationPrefs, &user.Handle, &user.PublicProfile, &user.CreatedDate)
+	return user, err
+}
+
+func (a *UsersServiceInternal) provision(ctx context.Context, identity *auth.Identity) (*dto.Users, error) {
+	user, err := scanUser(a.db.QueryRow(metrics.WithQueryName(ctx, "get_user_by_subject"),
+		selectUser+"where issuer = $1 and subject = $2", identity.Issuer, identity.Subject))
+	if errors.Is(err, pgx.ErrNoRows) {
+		// concurrent first requests may race here, the unique (issuer, subject) keeps one row
+		if _, err := a.db.Exec(metrics.WithQueryName(ctx, "create_user"),
+			`INSERT INTO helpschool.users( issuer,subject,user_email,user_name)
+				VALUES ( $1, $2, nullif($3,''), nullif($4,'')) on conflict (issuer,subject) do nothing`,
+			identity.Issuer, identity.Subject, identity.Email, identity.Name); err != nil {
+			return nil, err
+		}
+		return scanUser(a.db.QueryRow(metrics.WithQueryName(ctx, "get_user_by_subject"),
+			selectUser+"where issuer = $1 and subject = $2", identity.Issuer, identity.Subject))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// keep email and name in sync with the identity provider
+	if (identity.Email != "" && identity.Email != user.Email) || (identity.Name != "" && identity.Name != user.Name) {
+		if _, err := a.db.Exec(metrics.WithQueryName(ctx, "refresh_user"),
+			`update helpschool.users set user_email = coalesce(nullif($2,''),user_email),
+				user_name = coalesce(nullif($3,''),user_name), modified_date = now() where id = $1`,
+			user.UserId, identity.Email, identity.Name); err != nil {
+			return nil, err
+		}
+		if identity.Email != "" {
+			user.Email = identity.Email
+		}
+		if identity.Name != "" {
+			user.Name = identity.Name
+		}
+	}
+	return user, nil
+}
+
+// GetMe returns the caller's profile.
+func (a *UsersServiceInternal) GetMe(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	if err := render.Render(w, r, response.UsersResponse{Users: user}); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
+
+var handlePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{2,31}$`)
+
+// SQLSTATEs of a duplicate key and of a reference to a missing row.
+const (
+	uniqueViolation     = "23505"
+	foreignKeyViolation = "23503"
+)
+
+// sqlState returns the SQLSTATE of a database error, "" for other errors.
+func sqlState(err error) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+	return ""
+}
+
+// UpdateMe changes the display name, preferred language, notification
+// preferences or public profile of the caller.
+func (a *UsersServiceInternal) UpdateMe(w http.ResponseWriter, r *http.Request) {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		render.Render(w, r, util.ErrUnauthorized)
+		return
+	}
+	data := &request.UsersRequest{}
+	if err := render.Bind(r, data); err != nil {
+		render.Render(w, r, util.ErrInvalidRequest(err))
+		return
+	}
+	if data.DisplayName != nil && len(*data.DisplayName) > 256 {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("display_name is longer than 256 characters")))
+		return
+	}
+	if data.Handle != nil {
+		handle := strings.ToLower(*data.Handle)
+		if !handlePattern.MatchString(handle) {
+			render.Render(w, r, util.ErrInvalidRequest(errors.New("handle must be 3 to 32 letters, digits, - or _")))
+			return
+		}
+		data.Handle = &handle
+	}
+	if data.PublicProfile != nil && *data.PublicProfile && data.Handle == nil && user.Handle == "" {
+		render.Render(w, r, util.ErrInvalidRequest(errors.New("choose a handle for the public profile")))
+		return
+	}
+	if data.PreferredLanguage != nil {
+		tag, err := language.Parse(*data.PreferredLanguage)
+		if err != nil {
+			render.Render(w, r, util.ErrInvalidRequest(errors.New("invalid preferred_language")))
+			return
+		}
+		lang := tag.String()
+		data.PreferredLanguage = &lang
+	}
+
+	updated, err := scanUser(a.db.QueryRow(metrics.WithQueryName(r.Context(), "update_user_profile"),
+		`update helpschool.users set display_name = coalesce($2,display_name),
+			preferred_language = coalesce($3,preferred_language),
+			notification_prefs = notification_prefs || coalesce($4,'{}'::jsonb),
+			handle = coalesce($5,handle), public_profile = coalesce($6,public_profile),
+			modified_date = now()
+		where id = $1 returning id,coalesce(user_email,''),coalesce(user_name,''),coalesce(display_name,''),
+			preferred_language,notification_prefs,coalesce(handle,''),public_profile,created_date`,
+		user.UserId, data.DisplayName, data.PreferredLanguage, data.NotificationPrefs, data.Handle, data.PublicProfile))
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		render.Render(w, r, util.ErrConflict(errors.New("handle is already taken")))
+		return
+	} else if err != nil {
+		logging.FromContext(r.Context()).Error("update user profile failed", "err", err)
+		render.Render(w, r, util.ErrInternal(err))
+		return
+	}
+	if err := render.Render(w, r, response.UsersResponse{Users: updated}); err != nil {
+		render.Render(w, r, util.ErrRender(err))
+		return
+	}
+}
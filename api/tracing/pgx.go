@@ -0,0 +1,62 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/venkata6/helpschool/api/metrics"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// PgxTracer turns pgx's "Query" and "Exec" log events into client spans.
+// pgx v4 only reports a statement once it has completed, so the span is
+// recorded after the fact using the elapsed time pgx measured.
+type PgxTracer struct{}
+
+func NewPgxTracer() *PgxTracer {
+	return &PgxTracer{}
+}
+
+func (t *PgxTracer) Log(ctx context.Context, level pgx.LogLevel, msg string, data map[string]interface{}) {
+	if msg != "Query" && msg != "Exec" {
+		return
+	}
+	if !trace.SpanFromContext(ctx).SpanContext().IsValid() {
+		// keep background queries from producing orphan root spans
+		return
+	}
+	end := time.Now()
+	elapsed, _ := data["time"].(time.Duration)
+	sql, _ := data["sql"].(string)
+
+	_, span := Tracer().Start(ctx, "db "+metrics.QueryName(ctx),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithTimestamp(end.Add(-elapsed)),
+		trace.WithAttributes(
+			semconv.DBSystemPostgreSQL,
+			semconv.DBStatement(sql),
+			semconv.DBOperation(operation(sql)),
+		))
+	if rows, ok := data["rowCount"].(int); ok {
+		span.SetAttributes(attribute.Int("db.row_count", rows))
+	}
+	if level == pgx.LogLevelError {
+		span.SetStatus(codes.Error, fmt.Sprint(data["err"]))
+	}
+	span.End(trace.WithTimestamp(end))
+}
+
+// operation returns the leading SQL keyword, e.g. SELECT or INSERT.
+func operation(sql string) string {
+	fields := strings.Fields(sql)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToUpper(fields[0])
+}
@@ -0,0 +1,197 @@
+package transparency
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/venkata6/helpschool/api/export"
+	"github.com/venkata6/helpschool/api/metrics"
+	"github.com/venkata6/helpschool/api/storage"
+)
+
+// Totals are the needs, pledges and deliveries of a month. They are counts
+// and sums only, the report names no donor, teacher or pledge.
+type Totals struct {
+	NeedsPosted       int64 `json:"needs_posted"`
+	QuantityNeeded    int64 `json:"quantity_needed"`
+	Pledges           int64 `json:"pledges"`
+	QuantityPledged   int64 `json:"quantity_pledged"`
+	Donors            int64 `json:"donors"`
+	Deliveries        int64 `json:"deliveries"`
+	QuantityDelivered int64 `json:"quantity_delivered"`
+	SchoolsHelped     int64 `json:"schools_helped"`
+}
+
+func (t *Totals) add(o Totals) {
+	t.NeedsPosted += o.NeedsPosted
+	t.QuantityNeeded += o.QuantityNeeded
+	t.Pledges += o.Pledges
+	t.QuantityPledged += o.QuantityPledged
+	t.Deliveries += o.Deliveries
+	t.QuantityDelivered += o.QuantityDelivered
+	t.SchoolsHelped += o.SchoolsHelped
+}
+
+// StateTotals are the Totals of the schools of a state.
+type StateTotals struct {
+	Country string `json:"country"`
+	State   string `json:"state"`
+	Totals
+}
+
+// Report is the transparency report of a month.
+type Report struct {
+	Month       string        `json:"month"`
+	GeneratedAt time.Time     `json:"generated_at"`
+	Totals      Totals        `json:"totals"`
+	States      []StateTotals `json:"states"`
+}
+
+// monthly adds up per state the needs posted, the confirmed pledges made
+// and the pledges delivered between $1 and $2. Donors are counted per
+// state, the total is counted apart since a donor may give in several.
+const monthly = `with events as (
+		select school_id, 'need' as kind, quantity, null::text as donor
+		from helpschool.school_supplies where created_date >= $1 and created_date < $2
+		union all
+		select school_id, 'pledge', coalesce(quantity,0), coalesce(user_id::text, guest_email)
+		from helpschool.users_donations
+		where created_date >= $1 and created_date < $2 and confirmed_date is not null and status <> 'Cancelled'
+		union all
+		select school_id, 'delivery', coalesce(quantity,0), null
+		from helpschool.users_donations
+		where delivered_date >= $1 and delivered_date < $2 and confirmed_date is not null
+	)
+	select c.name,st.name,
+		count(*) filter (where e.kind = 'need'),coalesce(sum(e.quantity) filter (where e.kind = 'need'),0),
+		count(*) filter (where e.kind = 'pledge'),coalesce(sum(e.quantity) filter (where e.kind = 'pledge'),0),
+		count(distinct e.donor),
+		count(*) filter (where e.kind = 'delivery'),coalesce(sum(e.quantity) filter (where e.kind = 'delivery'),0),
+		count(distinct e.school_id) filter (where e.kind = 'delivery')
+	from events as e
+	inner join helpschool.schools as sc on sc.school_id = e.school_id
+	inner join helpschool.districts as d on d.district_id = sc.district_id
+	inner join helpschool.states as st on st.state_id = d.state_id
+	inner join helpschool.countries as c on c.country_id = st.country_id
+	group by c.name,st.name
+	order by c.name,st.name`
+
+// Key is the storage key of the report of month in format.
+func Key(month time.Time, format string) string {
+	return "transparency/" + month.Format("2006-01") + "." + format
+}
+
+// Compute adds up the report of the month that starts at month.
+func Compute(ctx context.Context, db *pgxpool.Pool, month time.Time) (*Report, error) {
+	end := month.AddDate(0, 1, 0)
+	report := &Report{Month: month.Format("2006-01"), GeneratedAt: time.Now().UTC(), States: []StateTotals{}}
+	rows, err := db.Query(metrics.WithQueryName(ctx, "transparency_by_state"), monthly, month, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s StateTotals
+		if err := rows.Scan(&s.Country, &s.State, &s.NeedsPosted, &s.QuantityNeeded, &s.Pledges,
+			&s.QuantityPledged, &s.Donors, &s.Deliveries, &s.QuantityDelivered, &s.SchoolsHelped); err != nil {
+			return nil, err
+		}
+		report.Totals.add(s.Totals)
+		report.States = append(report.States, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	err = db.QueryRow(metrics.WithQueryName(ctx, "transparency_donors"),
+		`select count(distinct coalesce(user_id::text, guest_email)) from helpschool.users_donations
+		where created_date >= $1 and created_date < $2 and confirmed_date is not null and status <> 'Cancelled'`,
+		month, end).Scan(&report.Totals.Donors)
+	return report, err
+}
+
+// Publish writes the report of month to store, as JSON and as a CSV of
+// the states, and lists it in transparency_reports.
+func Publish(ctx context.Context, db *pgxpool.Pool, store storage.Store, month time.Time) error {
+	report, err := Compute(ctx, db, month)
+	if err != nil {
+		return err
+	}
+	doc, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := store.Put(ctx, Key(month, "json"), bytes.NewReader(doc)); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	w, err := export.New("csv", &buf, []string{"country", "state", "needs_posted", "quantity_needed", "pledges",
+		"quantity_pledged", "donors", "deliveries", "quantity_delivered", "schools_helped"})
+	if err != nil {
+		return err
+	}
+	for _, s := range report.States {
+		if err := w.Write(s.Country, s.State, s.NeedsPosted, s.QuantityNeeded, s.Pledges, s.QuantityPledged,
+			s.Donors, s.Deliveries, s.QuantityDelivered, s.SchoolsHelped); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := store.Put(ctx, Key(month, "csv"), &buf); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(metrics.WithQueryName(ctx, "upsert_transparency_report"),
+		`INSERT INTO helpschool.transparency_reports( month,totals,json_key,csv_key)
+			VALUES ( $1, $2, $3, $4)
+			on conflict (month) do update set totals = excluded.totals, created_date = now()`,
+		month, report.Totals, Key(month, "json"), Key(month, "csv"))
+	return err
+}
+
+// PublishDue publishes the report of the last month unless it is
+// published already.
+func PublishDue(ctx context.Context, db *pgxpool.Pool, store storage.Store) error {
+	now := time.Now().UTC()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -1, 0)
+	var created time.Time
+	err := db.QueryRow(metrics.WithQueryName(ctx, "get_transparency_report"),
+		`select created_date from helpschool.transparency_reports where month = $1`, month).Scan(&created)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+	if err := Publish(ctx, db, store, month); err != nil {
+		return fmt.Errorf("publish %s: %w", month.Format("2006-01"), err)
+	}
+	slog.InfoContext(ctx, "published transparency report", "month", month.Format("2006-01"))
+	return nil
+}
+
+// Run publishes the report of the last month, checking every interval,
+// until ctx is done.
+func Run(ctx context.Context, db *pgxpool.Pool, store storage.Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := PublishDue(ctx, db, store); err != nil {
+			slog.ErrorContext(ctx, "publish transparency report failed", "err", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package util
 
+import "context"
 import "net/http"
 import "github.com/go-chi/render"
+import "github.com/venkata6/helpschool/api/i18n"
+import "github.com/venkata6/helpschool/api/logging"
 
 //--
 // Error response payloads & renderers
@@ -21,11 +24,24 @@ type ErrResponse struct {
 	ErrorText  string `json:"error,omitempty"` // application-level error message, for debugging
 }
 
+// Render logs the cause of server errors, which the client is not told.
 func (e *ErrResponse) Render(w http.ResponseWriter, r *http.Request) error {
+	if e.HTTPStatusCode >= 500 && e.Err != nil {
+		logging.FromContext(r.Context()).Error("request failed", "status", e.HTTPStatusCode, "err", e.Err)
+	}
 	render.Status(r, e.HTTPStatusCode)
 	return nil
 }
 
+// Localized returns a copy of e with its messages translated to the
+// language of the request, the shared errors like ErrNotFound stay English.
+func (e *ErrResponse) Localized(ctx context.Context) *ErrResponse {
+	localized := *e
+	localized.StatusText = i18n.T(ctx, e.StatusText)
+	localized.ErrorText = i18n.T(ctx, e.ErrorText)
+	return &localized
+}
+
 func ErrInvalidRequest(err error) render.Renderer {
 	return &ErrResponse{
 		Err:            err,
@@ -45,3 +61,35 @@ func ErrRender(err error) render.Renderer {
 }
 
 var ErrNotFound = &ErrResponse{HTTPStatusCode: 404, StatusText: "Resource not found."}
+
+func ErrConflict(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 409,
+		StatusText:     "Conflict.",
+		ErrorText:      err.Error(),
+	}
+}
+
+// ErrInternal hides the underlying error from the client, Render logs it
+// instead.
+func ErrInternal(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 500,
+		StatusText:     "Internal server error.",
+	}
+}
+
+// ErrTooManyRequests is answered to callers over a rate limit.
+func ErrTooManyRequests(err error) render.Renderer {
+	return &ErrResponse{
+		Err:            err,
+		HTTPStatusCode: 429,
+		StatusText:     "Too many requests.",
+		ErrorText:      err.Error(),
+	}
+}
+
+var ErrUnauthorized = &ErrResponse{HTTPStatusCode: 401, StatusText: "Authentication required."}
+var ErrForbidden = &ErrResponse{HTTPStatusCode: 403, StatusText: "Not allowed."}
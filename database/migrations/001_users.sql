@@ -0,0 +1,119 @@
+--
+-- Users keyed on the identity provider (issuer) and its subject, and
+-- donations referencing them by id instead of repeating email and name.
+--
+-- Apply after database/helpschool.sql:
+--   psql "$DB_CONN" -f database/migrations/001_users.sql
+--
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS helpschool.users (
+    id uuid DEFAULT gen_random_uuid() NOT NULL,
+    user_email character varying(256),
+    user_name character varying(256),
+    extra_info jsonb,
+    created_date timestamp with time zone DEFAULT now() NOT NULL,
+    modified_date timestamp with time zone DEFAULT now(),
+    CONSTRAINT users_pkey PRIMARY KEY (id)
+);
+
+-- the users table of helpschool.sql has no id default, created_date of
+-- type time and, in some copies, no primary key
+ALTER TABLE helpschool.users ALTER COLUMN id SET DEFAULT gen_random_uuid();
+
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns
+               WHERE table_schema = 'helpschool' AND table_name = 'users'
+                 AND column_name = 'created_date' AND data_type = 'time with time zone') THEN
+        -- the day was never kept, use the last change or the migration day
+        ALTER TABLE helpschool.users ALTER COLUMN created_date DROP DEFAULT;
+        ALTER TABLE helpschool.users ALTER COLUMN created_date TYPE timestamp with time zone
+            USING coalesce(modified_date, current_date + created_date);
+    END IF;
+    IF NOT EXISTS (SELECT 1 FROM pg_constraint
+                   WHERE conrelid = 'helpschool.users'::regclass AND contype = 'p') THEN
+        ALTER TABLE helpschool.users ADD CONSTRAINT users_pkey PRIMARY KEY (id);
+    END IF;
+END $$;
+
+UPDATE helpschool.users SET created_date = coalesce(modified_date, now()) WHERE created_date IS NULL;
+ALTER TABLE helpschool.users ALTER COLUMN created_date SET DEFAULT now();
+ALTER TABLE helpschool.users ALTER COLUMN created_date SET NOT NULL;
+
+ALTER TABLE helpschool.users
+    ADD COLUMN IF NOT EXISTS issuer character varying(1024),
+    ADD COLUMN IF NOT EXISTS subject character varying(256),
+    ADD COLUMN IF NOT EXISTS display_name character varying(256),
+    ADD COLUMN IF NOT EXISTS preferred_language character varying(16) DEFAULT 'en' NOT NULL,
+    ADD COLUMN IF NOT EXISTS notification_prefs jsonb DEFAULT '{}'::jsonb NOT NULL;
+
+ALTER TABLE helpschool.users ALTER COLUMN user_email DROP NOT NULL;
+
+COMMENT ON COLUMN helpschool.users.issuer IS 'iss claim of the identity provider the user signs in with';
+COMMENT ON COLUMN helpschool.users.subject IS 'sub claim, unique per issuer';
+COMMENT ON COLUMN helpschool.users.user_email IS 'comes from the identity provider, refreshed on sign in';
+COMMENT ON COLUMN helpschool.users.user_name IS 'comes from the identity provider, refreshed on sign in';
+COMMENT ON COLUMN helpschool.users.display_name IS 'chosen by the user, shown instead of user_name when set';
+
+-- users created before issuer/subject existed were all Auth0 users
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns
+               WHERE table_schema = 'helpschool' AND table_name = 'users' AND column_name = 'user_id') THEN
+        UPDATE helpschool.users
+            SET issuer = 'https://helpschool.us.auth0.com/', subject = coalesce(user_id, 'email|' || user_email)
+            WHERE issuer IS NULL;
+    END IF;
+END $$;
+
+--
+-- users_donations: one row per pledge, referencing users(id)
+--
+
+ALTER TABLE helpschool.users_donations DROP CONSTRAINT IF EXISTS users_donations_pkey;
+ALTER TABLE helpschool.users_donations
+    ADD COLUMN IF NOT EXISTS donation_id uuid DEFAULT gen_random_uuid() NOT NULL;
+ALTER TABLE helpschool.users_donations ADD CONSTRAINT users_donations_pkey PRIMARY KEY (donation_id);
+
+-- move the denormalized donor columns to users, when the table still has them
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns
+               WHERE table_schema = 'helpschool' AND table_name = 'users_donations'
+                 AND column_name = 'user_email') THEN
+
+        INSERT INTO helpschool.users (issuer, subject, user_email, user_name)
+            SELECT DISTINCT ON (subject) 'https://helpschool.us.auth0.com/', subject, user_email, user_name
+            FROM (SELECT coalesce(user_id, 'email|' || user_email) AS subject, user_email, user_name
+                  FROM helpschool.users_donations) d
+            WHERE NOT EXISTS (SELECT 1 FROM helpschool.users u
+                              WHERE u.issuer = 'https://helpschool.us.auth0.com/' AND u.subject = d.subject);
+
+        ALTER TABLE helpschool.users_donations RENAME COLUMN user_id TO legacy_user_id;
+        ALTER TABLE helpschool.users_donations ADD COLUMN user_id uuid;
+        UPDATE helpschool.users_donations d SET user_id = u.id
+            FROM helpschool.users u
+            WHERE u.issuer = 'https://helpschool.us.auth0.com/'
+              AND u.subject = coalesce(d.legacy_user_id, 'email|' || d.user_email);
+        ALTER TABLE helpschool.users_donations
+            DROP COLUMN legacy_user_id,
+            DROP COLUMN user_email,
+            DROP COLUMN user_name,
+            ALTER COLUMN user_id SET NOT NULL;
+    END IF;
+END $$;
+
+ALTER TABLE helpschool.users DROP COLUMN IF EXISTS user_id;
+ALTER TABLE helpschool.users ALTER COLUMN issuer SET NOT NULL;
+ALTER TABLE helpschool.users ALTER COLUMN subject SET NOT NULL;
+ALTER TABLE helpschool.users DROP CONSTRAINT IF EXISTS users_issuer_subject;
+ALTER TABLE helpschool.users ADD CONSTRAINT users_issuer_subject UNIQUE (issuer, subject);
+
+ALTER TABLE helpschool.users_donations DROP CONSTRAINT IF EXISTS users_id;
+ALTER TABLE helpschool.users_donations
+    ADD CONSTRAINT users_id FOREIGN KEY (user_id) REFERENCES helpschool.users(id);
+CREATE INDEX IF NOT EXISTS fki_user_user_id ON helpschool.users_donations USING btree (user_id);
+
+COMMIT;
@@ -0,0 +1,46 @@
+--
+-- Teachers link their account to a school and prove they work there, a
+-- moderator approves the link. Only approved teachers may post needs for
+-- their school.
+--
+
+BEGIN;
+
+ALTER TABLE helpschool.schools
+    ADD COLUMN IF NOT EXISTS email_domain character varying(256);
+
+COMMENT ON COLUMN helpschool.schools.email_domain IS 'official email domain of the school staff, used to verify teachers';
+
+CREATE TABLE helpschool.teacher_affiliations (
+    affiliation_id uuid DEFAULT gen_random_uuid() NOT NULL,
+    user_id uuid NOT NULL,
+    school_id uuid NOT NULL,
+    method character varying(32) NOT NULL,
+    status character varying(32) DEFAULT 'pending' NOT NULL,
+    evidence_key character varying(1024),
+    school_email character varying(256),
+    code_hash character varying(128),
+    code_expires timestamp with time zone,
+    code_attempts integer DEFAULT 0 NOT NULL,
+    code_verified boolean DEFAULT false NOT NULL,
+    reviewed_by uuid,
+    review_note character varying(4096),
+    reviewed_date timestamp with time zone,
+    created_date timestamp with time zone DEFAULT now() NOT NULL,
+    modified_date timestamp with time zone DEFAULT now(),
+    CONSTRAINT teacher_affiliations_pkey PRIMARY KEY (affiliation_id),
+    CONSTRAINT teacher_affiliations_user_school UNIQUE (user_id, school_id),
+    CONSTRAINT teacher_affiliations_method CHECK (method IN ('staff_id', 'school_email', 'mailed_code')),
+    CONSTRAINT teacher_affiliations_status CHECK (status IN ('pending', 'submitted', 'approved', 'rejected')),
+    CONSTRAINT users_user_id FOREIGN KEY (user_id) REFERENCES helpschool.users(id),
+    CONSTRAINT schools_school_id FOREIGN KEY (school_id) REFERENCES helpschool.schools(school_id),
+    CONSTRAINT users_reviewed_by FOREIGN KEY (reviewed_by) REFERENCES helpschool.users(id)
+);
+
+COMMENT ON TABLE helpschool.teacher_affiliations IS 'teachers claiming to work at a school, with the evidence for the claim';
+COMMENT ON COLUMN helpschool.teacher_affiliations.evidence_key IS 'storage key of the uploaded staff ID photo';
+COMMENT ON COLUMN helpschool.teacher_affiliations.code_hash IS 'sha256 of the one-time code emailed or mailed to the school';
+
+CREATE INDEX teacher_affiliations_status_idx ON helpschool.teacher_affiliations USING btree (status);
+
+COMMIT;
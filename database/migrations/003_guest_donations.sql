@@ -0,0 +1,31 @@
+--
+-- Guest pledges: donations made with only an email address, confirmed and
+-- managed through an emailed link and later claimed into an account.
+--
+--   psql "$DB_CONN" -f database/migrations/003_guest_donations.sql
+--
+
+BEGIN;
+
+ALTER TABLE helpschool.users_donations
+    ALTER COLUMN user_id DROP NOT NULL,
+    ADD COLUMN IF NOT EXISTS guest_email character varying(256),
+    ADD COLUMN IF NOT EXISTS confirmed_date timestamp with time zone,
+    ADD COLUMN IF NOT EXISTS anonymous boolean DEFAULT false NOT NULL;
+
+COMMENT ON COLUMN helpschool.users_donations.guest_email IS 'donor of a guest pledge, cleared when the pledge is claimed into an account';
+COMMENT ON COLUMN helpschool.users_donations.confirmed_date IS 'when the guest donor first opened the emailed link, null for unconfirmed guest pledges';
+COMMENT ON COLUMN helpschool.users_donations.anonymous IS 'shown as Anonymous in public donor lists';
+
+-- pledges of signed in users count as confirmed
+UPDATE helpschool.users_donations SET confirmed_date = created_date
+    WHERE confirmed_date IS NULL AND user_id IS NOT NULL;
+
+ALTER TABLE helpschool.users_donations DROP CONSTRAINT IF EXISTS users_donations_donor;
+ALTER TABLE helpschool.users_donations
+    ADD CONSTRAINT users_donations_donor CHECK (user_id IS NOT NULL OR guest_email IS NOT NULL);
+
+CREATE INDEX IF NOT EXISTS users_donations_guest_email ON helpschool.users_donations
+    USING btree (lower(guest_email)) WHERE user_id IS NULL;
+
+COMMIT;
@@ -0,0 +1,29 @@
+--
+-- Opt-in public donor profiles at /api/donors/{handle} and the badges
+-- awarded by the background job in api/badges.
+--
+--   psql "$DB_CONN" -f database/migrations/004_donor_profiles.sql
+--
+
+BEGIN;
+
+ALTER TABLE helpschool.users
+    ADD COLUMN IF NOT EXISTS handle character varying(32),
+    ADD COLUMN IF NOT EXISTS public_profile boolean DEFAULT false NOT NULL;
+
+COMMENT ON COLUMN helpschool.users.handle IS 'lower case name of the public profile, /api/donors/{handle}';
+COMMENT ON COLUMN helpschool.users.public_profile IS 'the donor opted in to show their impact publicly';
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_handle ON helpschool.users USING btree (handle);
+
+CREATE TABLE IF NOT EXISTS helpschool.user_badges (
+    user_id uuid NOT NULL,
+    badge character varying(64) NOT NULL,
+    awarded_date timestamp with time zone DEFAULT now() NOT NULL,
+    CONSTRAINT user_badges_pkey PRIMARY KEY (user_id, badge),
+    CONSTRAINT user_badges_user_id FOREIGN KEY (user_id) REFERENCES helpschool.users(id) ON DELETE CASCADE
+);
+
+COMMENT ON TABLE helpschool.user_badges IS 'badges are defined in api/badges, awarded badges are kept';
+
+COMMIT;
@@ -0,0 +1,32 @@
+--
+-- Public updates on a school's profile page posted by its verified teachers:
+-- delivery photos and thank-you notes, optionally about one of its needs.
+--
+--   psql "$DB_CONN" -f database/migrations/005_school_updates.sql
+--
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS helpschool.school_updates (
+    update_id uuid DEFAULT gen_random_uuid() NOT NULL,
+    school_id uuid NOT NULL,
+    supply_id uuid,
+    author_id uuid NOT NULL,
+    body text,
+    photo_key character varying(1024),
+    hidden boolean DEFAULT false NOT NULL,
+    created_date timestamp with time zone DEFAULT now() NOT NULL,
+    modified_date timestamp with time zone DEFAULT now(),
+    CONSTRAINT school_updates_pkey PRIMARY KEY (update_id),
+    CONSTRAINT school_updates_school_id FOREIGN KEY (school_id) REFERENCES helpschool.schools(school_id),
+    CONSTRAINT school_updates_author_id FOREIGN KEY (author_id) REFERENCES helpschool.users(id),
+    CONSTRAINT school_updates_content CHECK (body IS NOT NULL OR photo_key IS NOT NULL)
+);
+
+COMMENT ON COLUMN helpschool.school_updates.photo_key IS 'delivery photo in the file storage, see api/storage';
+COMMENT ON COLUMN helpschool.school_updates.hidden IS 'taken down by a moderator';
+
+CREATE INDEX IF NOT EXISTS school_updates_school_id ON helpschool.school_updates
+    USING btree (school_id, created_date DESC) WHERE NOT hidden;
+
+COMMIT;
@@ -0,0 +1,64 @@
+--
+-- Moderated messaging between donors and the verified teachers of a school,
+-- about one of its needs or a donation.
+--
+--   psql "$DB_CONN" -f database/migrations/006_messages.sql
+--
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS helpschool.message_threads (
+    thread_id uuid DEFAULT gen_random_uuid() NOT NULL,
+    school_id uuid NOT NULL,
+    supply_id uuid,
+    donation_id uuid,
+    donor_id uuid NOT NULL,
+    subject character varying(256) NOT NULL,
+    created_date timestamp with time zone DEFAULT now() NOT NULL,
+    last_message_date timestamp with time zone DEFAULT now() NOT NULL,
+    CONSTRAINT message_threads_pkey PRIMARY KEY (thread_id),
+    CONSTRAINT message_threads_school_id FOREIGN KEY (school_id) REFERENCES helpschool.schools(school_id),
+    CONSTRAINT message_threads_donation_id FOREIGN KEY (donation_id) REFERENCES helpschool.users_donations(donation_id),
+    CONSTRAINT message_threads_donor_id FOREIGN KEY (donor_id) REFERENCES helpschool.users(id)
+);
+
+COMMENT ON COLUMN helpschool.message_threads.donor_id IS 'the donor side of the thread, the school side are its verified teachers';
+
+CREATE INDEX IF NOT EXISTS message_threads_donor_id ON helpschool.message_threads USING btree (donor_id);
+CREATE INDEX IF NOT EXISTS message_threads_school_id ON helpschool.message_threads USING btree (school_id);
+
+CREATE TABLE IF NOT EXISTS helpschool.messages (
+    message_id uuid DEFAULT gen_random_uuid() NOT NULL,
+    thread_id uuid NOT NULL,
+    author_id uuid NOT NULL,
+    body text NOT NULL,
+    attachment_key character varying(1024),
+    status character varying(16) DEFAULT 'visible' NOT NULL,
+    filter_reasons character varying(256),
+    moderated_by uuid,
+    created_date timestamp with time zone DEFAULT now() NOT NULL,
+    modified_date timestamp with time zone DEFAULT now(),
+    CONSTRAINT messages_pkey PRIMARY KEY (message_id),
+    CONSTRAINT messages_thread_id FOREIGN KEY (thread_id) REFERENCES helpschool.message_threads(thread_id),
+    CONSTRAINT messages_author_id FOREIGN KEY (author_id) REFERENCES helpschool.users(id),
+    CONSTRAINT messages_status CHECK (status IN ('visible', 'held', 'removed'))
+);
+
+COMMENT ON COLUMN helpschool.messages.status IS 'held messages wait for a moderator, removed ones were taken down';
+COMMENT ON COLUMN helpschool.messages.filter_reasons IS 'why the content filter held or changed the message';
+
+CREATE INDEX IF NOT EXISTS messages_thread_id ON helpschool.messages USING btree (thread_id, created_date);
+CREATE INDEX IF NOT EXISTS messages_held ON helpschool.messages USING btree (created_date) WHERE status = 'held';
+
+-- what each participant has read and was last emailed about
+CREATE TABLE IF NOT EXISTS helpschool.message_reads (
+    thread_id uuid NOT NULL,
+    user_id uuid NOT NULL,
+    read_date timestamp with time zone,
+    notified_date timestamp with time zone,
+    CONSTRAINT message_reads_pkey PRIMARY KEY (thread_id, user_id),
+    CONSTRAINT message_reads_thread_id FOREIGN KEY (thread_id) REFERENCES helpschool.message_threads(thread_id),
+    CONSTRAINT message_reads_user_id FOREIGN KEY (user_id) REFERENCES helpschool.users(id) ON DELETE CASCADE
+);
+
+COMMIT;
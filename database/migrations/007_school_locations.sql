@@ -0,0 +1,30 @@
+--
+-- Coordinates of schools and teacher requests, filled from postal codes by
+-- `server -geocode` using the bundled centroids in api/geo, and the
+-- earthdistance index behind /api/schools/nearby.
+--
+--   psql "$DB_CONN" -f database/migrations/007_school_locations.sql
+--
+
+BEGIN;
+
+CREATE EXTENSION IF NOT EXISTS cube;
+CREATE EXTENSION IF NOT EXISTS earthdistance;
+
+ALTER TABLE helpschool.schools
+    ADD COLUMN IF NOT EXISTS postal_code character varying(16),
+    ADD COLUMN IF NOT EXISTS latitude double precision,
+    ADD COLUMN IF NOT EXISTS longitude double precision,
+    ADD COLUMN IF NOT EXISTS geocoded_by character varying(16);
+
+COMMENT ON COLUMN helpschool.schools.postal_code IS 'taken from the address when not given';
+COMMENT ON COLUMN helpschool.schools.geocoded_by IS 'postal_code for centroids of the bundled dataset, manual for exact coordinates';
+
+ALTER TABLE helpschool.teacher_requests
+    ADD COLUMN IF NOT EXISTS latitude double precision,
+    ADD COLUMN IF NOT EXISTS longitude double precision;
+
+CREATE INDEX IF NOT EXISTS schools_location ON helpschool.schools
+    USING gist (ll_to_earth(latitude, longitude)) WHERE latitude IS NOT NULL AND longitude IS NOT NULL;
+
+COMMIT;
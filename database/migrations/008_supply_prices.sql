@@ -0,0 +1,18 @@
+--
+-- Unit price of a supply, the value of open needs on the map is the
+-- remaining quantity times this price.
+--
+--   psql "$DB_CONN" -f database/migrations/008_supply_prices.sql
+--
+
+BEGIN;
+
+ALTER TABLE helpschool.supplies
+    ADD COLUMN IF NOT EXISTS price numeric(12,2);
+
+COMMENT ON COLUMN helpschool.supplies.price IS 'unit price in the currency of the supply''s country';
+
+CREATE INDEX IF NOT EXISTS school_supplies_open ON helpschool.school_supplies (school_id)
+    WHERE quantity > coalesce(fulfilled_count, 0);
+
+COMMIT;
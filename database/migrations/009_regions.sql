@@ -0,0 +1,97 @@
+--
+-- Regions of any depth: countries, states and districts as before, and
+-- below them blocks, taluks or municipalities. region_paths is the closure
+-- table of the tree, kept by a trigger, so a subtree is one indexed lookup.
+-- countries, states and districts stay the tables behind their routes and
+-- are mirrored into regions on insert, keeping their ids.
+--
+--   psql "$DB_CONN" -f database/migrations/009_regions.sql
+--
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS helpschool.regions (
+    region_id uuid DEFAULT gen_random_uuid() NOT NULL,
+    parent_id uuid,
+    level character varying(32) NOT NULL,
+    name character varying(512) NOT NULL,
+    govt_id character varying(1024),
+    extra_info jsonb,
+    created_date timestamp with time zone DEFAULT now() NOT NULL,
+    modified_date timestamp with time zone DEFAULT now(),
+    CONSTRAINT regions_pkey PRIMARY KEY (region_id),
+    CONSTRAINT regions_parent_fkey FOREIGN KEY (parent_id) REFERENCES helpschool.regions (region_id),
+    CONSTRAINT regions_level_check CHECK (level ~ '^[a-z_]+$')
+);
+
+COMMENT ON COLUMN helpschool.regions.level IS 'country, state, district, block, taluk, municipality, ...';
+
+CREATE INDEX IF NOT EXISTS regions_parent ON helpschool.regions (parent_id, name);
+
+CREATE TABLE IF NOT EXISTS helpschool.region_paths (
+    ancestor_id uuid NOT NULL,
+    descendant_id uuid NOT NULL,
+    depth integer NOT NULL,
+    CONSTRAINT region_paths_pkey PRIMARY KEY (ancestor_id, descendant_id),
+    CONSTRAINT region_paths_ancestor_fkey FOREIGN KEY (ancestor_id) REFERENCES helpschool.regions (region_id) ON DELETE CASCADE,
+    CONSTRAINT region_paths_descendant_fkey FOREIGN KEY (descendant_id) REFERENCES helpschool.regions (region_id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS region_paths_descendant ON helpschool.region_paths (descendant_id, depth);
+
+-- a region is its own ancestor at depth 0 and inherits its parent's paths,
+-- regions are not moved once created
+CREATE OR REPLACE FUNCTION helpschool.regions_paths() RETURNS trigger AS $$
+BEGIN
+    INSERT INTO helpschool.region_paths (ancestor_id, descendant_id, depth)
+    SELECT ancestor_id, NEW.region_id, depth + 1 FROM helpschool.region_paths WHERE descendant_id = NEW.parent_id
+    UNION ALL
+    SELECT NEW.region_id, NEW.region_id, 0;
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS regions_paths ON helpschool.regions;
+CREATE TRIGGER regions_paths AFTER INSERT ON helpschool.regions
+    FOR EACH ROW EXECUTE FUNCTION helpschool.regions_paths();
+
+-- mirror_region(level, id column, parent id column) copies a row of
+-- countries, states or districts into regions
+CREATE OR REPLACE FUNCTION helpschool.mirror_region() RETURNS trigger AS $$
+DECLARE
+    fields jsonb := to_jsonb(NEW);
+BEGIN
+    INSERT INTO helpschool.regions (region_id, parent_id, level, name, govt_id)
+    VALUES ((fields->>TG_ARGV[1])::uuid, (fields->>TG_ARGV[2])::uuid, TG_ARGV[0], NEW.name, fields->>'govt_id')
+    ON CONFLICT (region_id) DO NOTHING;
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+INSERT INTO helpschool.regions (region_id, parent_id, level, name, created_date)
+    SELECT country_id, NULL, 'country', name, created_date FROM helpschool.countries
+    ON CONFLICT (region_id) DO NOTHING;
+INSERT INTO helpschool.regions (region_id, parent_id, level, name, govt_id, created_date)
+    SELECT state_id, country_id, 'state', name, govt_id, created_date FROM helpschool.states
+    ON CONFLICT (region_id) DO NOTHING;
+INSERT INTO helpschool.regions (region_id, parent_id, level, name, govt_id, created_date)
+    SELECT district_id, state_id, 'district', name, govt_id, created_date FROM helpschool.districts
+    ON CONFLICT (region_id) DO NOTHING;
+
+DROP TRIGGER IF EXISTS countries_region ON helpschool.countries;
+CREATE TRIGGER countries_region AFTER INSERT ON helpschool.countries
+    FOR EACH ROW EXECUTE FUNCTION helpschool.mirror_region('country', 'country_id', 'parent_id');
+DROP TRIGGER IF EXISTS states_region ON helpschool.states;
+CREATE TRIGGER states_region AFTER INSERT ON helpschool.states
+    FOR EACH ROW EXECUTE FUNCTION helpschool.mirror_region('state', 'state_id', 'country_id');
+DROP TRIGGER IF EXISTS districts_region ON helpschool.districts;
+CREATE TRIGGER districts_region AFTER INSERT ON helpschool.districts
+    FOR EACH ROW EXECUTE FUNCTION helpschool.mirror_region('district', 'district_id', 'state_id');
+
+-- the region a school is in, its district or a region below it
+ALTER TABLE helpschool.schools
+    ADD COLUMN IF NOT EXISTS region_id uuid;
+UPDATE helpschool.schools SET region_id = district_id WHERE region_id IS NULL;
+CREATE INDEX IF NOT EXISTS schools_region ON helpschool.schools (region_id);
+
+COMMIT;
@@ -0,0 +1,26 @@
+--
+-- Translated names of regions (countries, states and districts included,
+-- they share their ids) and titles of supplies, as {"ta": "...", "hi-IN": "..."}.
+-- localized() picks the first translation along the request's language
+-- chain and falls back to the untranslated column.
+--
+--   psql "$DB_CONN" -f database/migrations/010_translations.sql
+--
+
+BEGIN;
+
+ALTER TABLE helpschool.regions
+    ADD COLUMN IF NOT EXISTS name_translations jsonb DEFAULT '{}'::jsonb NOT NULL;
+
+ALTER TABLE helpschool.supplies
+    ADD COLUMN IF NOT EXISTS title_translations jsonb DEFAULT '{}'::jsonb NOT NULL;
+
+CREATE OR REPLACE FUNCTION helpschool.localized(translations jsonb, fallback text, locales text[])
+RETURNS text LANGUAGE sql IMMUTABLE AS $$
+    SELECT coalesce(
+        (SELECT translations->>l.locale FROM unnest(locales) WITH ORDINALITY AS l(locale, position)
+            WHERE translations ? l.locale ORDER BY l.position LIMIT 1),
+        fallback)
+$$;
+
+COMMIT;
@@ -0,0 +1,110 @@
+--
+-- Supply catalog: categories in a tree, units of measure and canonical
+-- items, which may be variants (size, grade, language) of a base item.
+-- supplies become vendor listings of a canonical item and needs in
+-- school_supplies reference the item. Existing supplies each get an item
+-- with the supply's id, title and description.
+--
+--   psql "$DB_CONN" -f database/migrations/011_catalog.sql
+--
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS helpschool.supply_categories (
+    category_id uuid DEFAULT gen_random_uuid() NOT NULL,
+    parent_id uuid,
+    slug character varying(64) NOT NULL,
+    name character varying(256) NOT NULL,
+    name_translations jsonb DEFAULT '{}'::jsonb NOT NULL,
+    position integer DEFAULT 0 NOT NULL,
+    created_date timestamp with time zone DEFAULT now() NOT NULL,
+    CONSTRAINT supply_categories_pkey PRIMARY KEY (category_id),
+    CONSTRAINT supply_categories_slug_key UNIQUE (slug),
+    CONSTRAINT supply_categories_parent_fkey FOREIGN KEY (parent_id) REFERENCES helpschool.supply_categories (category_id),
+    CONSTRAINT supply_categories_slug_check CHECK (slug ~ '^[a-z0-9-]+$')
+);
+
+INSERT INTO helpschool.supply_categories (slug, name, position) VALUES
+    ('stationery', 'Stationery', 1),
+    ('furniture', 'Furniture', 2),
+    ('sports', 'Sports', 3),
+    ('digital', 'Digital', 4),
+    ('hygiene', 'Hygiene', 5)
+    ON CONFLICT (slug) DO NOTHING;
+
+INSERT INTO helpschool.supply_categories (parent_id, slug, name, position)
+    SELECT p.category_id, c.slug, c.name, c.position
+    FROM (VALUES
+        ('stationery', 'notebooks', 'Notebooks', 1),
+        ('stationery', 'textbooks', 'Textbooks', 2),
+        ('stationery', 'writing', 'Pens and pencils', 3),
+        ('stationery', 'paper', 'Paper', 4),
+        ('furniture', 'desks', 'Desks and benches', 1),
+        ('sports', 'sports-equipment', 'Balls and equipment', 1),
+        ('digital', 'computers', 'Computers and tablets', 1),
+        ('digital', 'projectors', 'Projectors', 2),
+        ('hygiene', 'sanitary', 'Sanitary products', 1),
+        ('hygiene', 'cleaning', 'Soap and cleaning', 2)
+    ) AS c(parent, slug, name, position)
+    INNER JOIN helpschool.supply_categories AS p ON p.slug = c.parent
+    ON CONFLICT (slug) DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS helpschool.supply_units (
+    unit_id character varying(32) NOT NULL,
+    name character varying(64) NOT NULL,
+    name_translations jsonb DEFAULT '{}'::jsonb NOT NULL,
+    CONSTRAINT supply_units_pkey PRIMARY KEY (unit_id)
+);
+
+INSERT INTO helpschool.supply_units (unit_id, name) VALUES
+    ('piece', 'pieces'),
+    ('pack', 'packs'),
+    ('ream', 'reams'),
+    ('set', 'sets'),
+    ('box', 'boxes'),
+    ('kg', 'kilograms'),
+    ('litre', 'litres')
+    ON CONFLICT (unit_id) DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS helpschool.catalog_items (
+    item_id uuid DEFAULT gen_random_uuid() NOT NULL,
+    parent_item_id uuid,
+    category_id uuid,
+    unit_id character varying(32) DEFAULT 'piece' NOT NULL,
+    pack_size integer DEFAULT 1 NOT NULL,
+    title character varying(1024) NOT NULL,
+    title_translations jsonb DEFAULT '{}'::jsonb NOT NULL,
+    description character varying(4096),
+    variant jsonb DEFAULT '{}'::jsonb NOT NULL,
+    created_date timestamp with time zone DEFAULT now() NOT NULL,
+    modified_date timestamp with time zone DEFAULT now(),
+    CONSTRAINT catalog_items_pkey PRIMARY KEY (item_id),
+    CONSTRAINT catalog_items_parent_fkey FOREIGN KEY (parent_item_id) REFERENCES helpschool.catalog_items (item_id),
+    CONSTRAINT catalog_items_category_fkey FOREIGN KEY (category_id) REFERENCES helpschool.supply_categories (category_id),
+    CONSTRAINT catalog_items_unit_fkey FOREIGN KEY (unit_id) REFERENCES helpschool.supply_units (unit_id),
+    CONSTRAINT catalog_items_pack_size_check CHECK (pack_size > 0)
+);
+
+COMMENT ON COLUMN helpschool.catalog_items.variant IS 'size, grade and language of a variant of parent_item_id';
+
+CREATE UNIQUE INDEX IF NOT EXISTS catalog_items_variant ON helpschool.catalog_items (parent_item_id, variant)
+    WHERE parent_item_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS catalog_items_category ON helpschool.catalog_items (category_id);
+
+INSERT INTO helpschool.catalog_items (item_id, title, description, created_date)
+    SELECT supply_id, title, description, created_date FROM helpschool.supplies
+    ON CONFLICT (item_id) DO NOTHING;
+
+ALTER TABLE helpschool.supplies
+    ADD COLUMN IF NOT EXISTS item_id uuid REFERENCES helpschool.catalog_items (item_id);
+UPDATE helpschool.supplies SET item_id = supply_id WHERE item_id IS NULL;
+ALTER TABLE helpschool.supplies ALTER COLUMN item_id SET NOT NULL;
+CREATE INDEX IF NOT EXISTS supplies_item ON helpschool.supplies (item_id);
+
+ALTER TABLE helpschool.school_supplies
+    ADD COLUMN IF NOT EXISTS item_id uuid REFERENCES helpschool.catalog_items (item_id);
+UPDATE helpschool.school_supplies AS ss SET item_id = s.item_id
+    FROM helpschool.supplies AS s WHERE s.supply_id = ss.supply_id AND ss.item_id IS NULL;
+ALTER TABLE helpschool.school_supplies ALTER COLUMN item_id SET NOT NULL;
+
+COMMIT;
@@ -0,0 +1,41 @@
+--
+-- Vendor offers for supplies. Offers of every supply listing the same
+-- canonical item compete, the best one for a school is in stock, delivers
+-- to its postal code and is cheapest with shipping. delivery_regions holds
+-- postal code prefixes ('56', '6000'), empty for all of the country.
+-- Existing supplies get their url as a first offer.
+--
+--   psql "$DB_CONN" -f database/migrations/012_supply_offers.sql
+--
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS helpschool.supply_offers (
+    offer_id uuid DEFAULT gen_random_uuid() NOT NULL,
+    supply_id uuid NOT NULL,
+    vendor character varying(256) NOT NULL,
+    url character varying(4096) NOT NULL,
+    price numeric(12,2),
+    currency character(3) DEFAULT 'INR' NOT NULL,
+    shipping_cost numeric(12,2) DEFAULT 0 NOT NULL,
+    shipping_days integer,
+    delivery_regions text[] DEFAULT '{}'::text[] NOT NULL,
+    in_stock boolean DEFAULT true NOT NULL,
+    last_checked timestamp with time zone DEFAULT now() NOT NULL,
+    created_date timestamp with time zone DEFAULT now() NOT NULL,
+    modified_date timestamp with time zone DEFAULT now(),
+    CONSTRAINT supply_offers_pkey PRIMARY KEY (offer_id),
+    CONSTRAINT supply_offers_supply_fkey FOREIGN KEY (supply_id) REFERENCES helpschool.supplies (supply_id) ON DELETE CASCADE,
+    CONSTRAINT supply_offers_url_key UNIQUE (supply_id, url),
+    CONSTRAINT supply_offers_price_check CHECK (price >= 0 AND shipping_cost >= 0)
+);
+
+CREATE INDEX IF NOT EXISTS supply_offers_supply ON helpschool.supply_offers (supply_id);
+
+INSERT INTO helpschool.supply_offers (supply_id, vendor, url, price, last_checked)
+    SELECT supply_id, coalesce(substring(url from '://(?:www\.)?([^/:]+)'), 'unknown'), url, price,
+        coalesce(modified_date, created_date)
+    FROM helpschool.supplies WHERE url <> ''
+    ON CONFLICT (supply_id, url) DO NOTHING;
+
+COMMIT;
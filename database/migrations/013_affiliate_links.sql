@@ -0,0 +1,48 @@
+--
+-- Affiliate and referral rules per vendor domain, per country or for all
+-- countries, applied to outbound vendor links unless the school opted out.
+-- /go/{offerId} logs a click before redirecting, pledges made within a
+-- week of a click on an offer for the same item are attributed to it.
+--
+--   psql "$DB_CONN" -f database/migrations/013_affiliate_links.sql
+--
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS helpschool.affiliate_rules (
+    rule_id uuid DEFAULT gen_random_uuid() NOT NULL,
+    country_id uuid,
+    domain character varying(256) NOT NULL,
+    params jsonb DEFAULT '{}'::jsonb NOT NULL,
+    template character varying(2048),
+    enabled boolean DEFAULT true NOT NULL,
+    created_date timestamp with time zone DEFAULT now() NOT NULL,
+    modified_date timestamp with time zone DEFAULT now(),
+    CONSTRAINT affiliate_rules_pkey PRIMARY KEY (rule_id),
+    CONSTRAINT affiliate_rules_template_check CHECK (template IS NULL OR template LIKE '%{url}%')
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS affiliate_rules_domain ON helpschool.affiliate_rules
+    (coalesce(country_id, '00000000-0000-0000-0000-000000000000'::uuid), domain);
+
+ALTER TABLE helpschool.schools
+    ADD COLUMN IF NOT EXISTS affiliate_links_disabled boolean DEFAULT false NOT NULL;
+
+CREATE TABLE IF NOT EXISTS helpschool.offer_clicks (
+    click_id uuid DEFAULT gen_random_uuid() NOT NULL,
+    offer_id uuid NOT NULL,
+    school_id uuid,
+    rule_id uuid,
+    created_date timestamp with time zone DEFAULT now() NOT NULL,
+    CONSTRAINT offer_clicks_pkey PRIMARY KEY (click_id),
+    CONSTRAINT offer_clicks_offer_fkey FOREIGN KEY (offer_id) REFERENCES helpschool.supply_offers (offer_id) ON DELETE CASCADE
+);
+
+COMMENT ON COLUMN helpschool.offer_clicks.rule_id IS 'the affiliate rule the link was rewritten by, null when it was not';
+
+CREATE INDEX IF NOT EXISTS offer_clicks_created ON helpschool.offer_clicks (created_date);
+
+ALTER TABLE helpschool.users_donations
+    ADD COLUMN IF NOT EXISTS click_id uuid REFERENCES helpschool.offer_clicks (click_id) ON DELETE SET NULL;
+
+COMMIT;
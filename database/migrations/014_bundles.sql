@@ -0,0 +1,62 @@
+--
+-- Bundles, or classroom kits: catalog items with the quantity of each in
+-- one bundle. A school's need for N bundles is kept in school_bundles and
+-- expanded into component needs in school_supplies, marked with the
+-- bundle, so a school may need notebooks both on their own and in a kit.
+-- Pledges for a bundle are one donation per component, marked alike.
+--
+--   psql "$DB_CONN" -f database/migrations/014_bundles.sql
+--
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS helpschool.bundles (
+    bundle_id uuid DEFAULT gen_random_uuid() NOT NULL,
+    title character varying(512) NOT NULL,
+    title_translations jsonb DEFAULT '{}'::jsonb NOT NULL,
+    description character varying(4096),
+    created_by uuid,
+    created_date timestamp with time zone DEFAULT now() NOT NULL,
+    modified_date timestamp with time zone DEFAULT now(),
+    CONSTRAINT bundles_pkey PRIMARY KEY (bundle_id),
+    CONSTRAINT bundles_created_by FOREIGN KEY (created_by) REFERENCES helpschool.users(id) ON DELETE SET NULL
+);
+
+CREATE TABLE IF NOT EXISTS helpschool.bundle_items (
+    bundle_id uuid NOT NULL,
+    item_id uuid NOT NULL,
+    quantity integer NOT NULL,
+    CONSTRAINT bundle_items_pkey PRIMARY KEY (bundle_id, item_id),
+    CONSTRAINT bundle_items_bundle_fkey FOREIGN KEY (bundle_id) REFERENCES helpschool.bundles (bundle_id) ON DELETE CASCADE,
+    CONSTRAINT bundle_items_item_fkey FOREIGN KEY (item_id) REFERENCES helpschool.catalog_items (item_id),
+    CONSTRAINT bundle_items_quantity_check CHECK (quantity > 0)
+);
+
+CREATE TABLE IF NOT EXISTS helpschool.school_bundles (
+    school_id uuid NOT NULL,
+    bundle_id uuid NOT NULL,
+    quantity integer DEFAULT 0 NOT NULL,
+    extra_info jsonb,
+    created_date timestamp with time zone DEFAULT now() NOT NULL,
+    modified_date timestamp with time zone DEFAULT now(),
+    CONSTRAINT school_bundles_pkey PRIMARY KEY (school_id, bundle_id),
+    CONSTRAINT school_bundles_school_fkey FOREIGN KEY (school_id) REFERENCES helpschool.schools (school_id),
+    CONSTRAINT school_bundles_bundle_fkey FOREIGN KEY (bundle_id) REFERENCES helpschool.bundles (bundle_id)
+);
+
+ALTER TABLE helpschool.school_supplies ADD COLUMN IF NOT EXISTS bundle_id uuid;
+ALTER TABLE helpschool.school_supplies DROP CONSTRAINT IF EXISTS school_supplies_bundle_fkey;
+ALTER TABLE helpschool.school_supplies
+    ADD CONSTRAINT school_supplies_bundle_fkey FOREIGN KEY (school_id, bundle_id)
+    REFERENCES helpschool.school_bundles (school_id, bundle_id) ON DELETE CASCADE;
+
+-- a need is unique per supply on its own and per supply within a bundle
+ALTER TABLE helpschool.school_supplies DROP CONSTRAINT IF EXISTS school_supplies_pkey;
+CREATE UNIQUE INDEX IF NOT EXISTS school_supplies_need ON helpschool.school_supplies (school_id, supply_id)
+    WHERE bundle_id IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS school_supplies_bundle_need ON helpschool.school_supplies (school_id, bundle_id, supply_id)
+    WHERE bundle_id IS NOT NULL;
+
+ALTER TABLE helpschool.users_donations ADD COLUMN IF NOT EXISTS bundle_id uuid;
+
+COMMIT;
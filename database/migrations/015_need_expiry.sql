@@ -0,0 +1,56 @@
+--
+-- Needs get an optional needed_by date and a status. Open needs past their
+-- date expire and the school's teachers are emailed to renew or close
+-- them, only open needs are listed to donors. need_recurrences are
+-- templates that re-open a need every year on a month and day, e.g. at the
+-- start of the academic year.
+--
+--   psql "$DB_CONN" -f database/migrations/015_need_expiry.sql
+--
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS helpschool.need_recurrences (
+    recurrence_id uuid DEFAULT gen_random_uuid() NOT NULL,
+    school_id uuid NOT NULL,
+    supply_id uuid NOT NULL,
+    quantity integer NOT NULL,
+    extra_info jsonb,
+    open_month integer NOT NULL,
+    open_day integer DEFAULT 1 NOT NULL,
+    needed_within_days integer,
+    last_opened date,
+    created_by uuid,
+    created_date timestamp with time zone DEFAULT now() NOT NULL,
+    CONSTRAINT need_recurrences_pkey PRIMARY KEY (recurrence_id),
+    CONSTRAINT need_recurrences_need_key UNIQUE (school_id, supply_id),
+    CONSTRAINT need_recurrences_school_fkey FOREIGN KEY (school_id) REFERENCES helpschool.schools (school_id) ON DELETE CASCADE,
+    CONSTRAINT need_recurrences_supply_fkey FOREIGN KEY (supply_id) REFERENCES helpschool.supplies (supply_id),
+    CONSTRAINT need_recurrences_created_by FOREIGN KEY (created_by) REFERENCES helpschool.users(id) ON DELETE SET NULL,
+    CONSTRAINT need_recurrences_quantity_check CHECK (quantity > 0),
+    CONSTRAINT need_recurrences_month_check CHECK (open_month BETWEEN 1 AND 12),
+    CONSTRAINT need_recurrences_day_check CHECK (open_day BETWEEN 1 AND 28),
+    CONSTRAINT need_recurrences_within_check CHECK (needed_within_days > 0)
+);
+
+COMMENT ON COLUMN helpschool.need_recurrences.open_day IS 'at most 28 so that every month has the day';
+
+ALTER TABLE helpschool.school_supplies
+    ADD COLUMN IF NOT EXISTS needed_by date,
+    ADD COLUMN IF NOT EXISTS status character varying(16) DEFAULT 'open' NOT NULL,
+    ADD COLUMN IF NOT EXISTS expired_date timestamp with time zone,
+    ADD COLUMN IF NOT EXISTS expiry_notified_date timestamp with time zone,
+    ADD COLUMN IF NOT EXISTS recurrence_id uuid;
+
+ALTER TABLE helpschool.school_supplies DROP CONSTRAINT IF EXISTS school_supplies_status;
+ALTER TABLE helpschool.school_supplies
+    ADD CONSTRAINT school_supplies_status CHECK (status IN ('open', 'expired', 'closed'));
+ALTER TABLE helpschool.school_supplies DROP CONSTRAINT IF EXISTS school_supplies_recurrence_fkey;
+ALTER TABLE helpschool.school_supplies
+    ADD CONSTRAINT school_supplies_recurrence_fkey FOREIGN KEY (recurrence_id)
+    REFERENCES helpschool.need_recurrences (recurrence_id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS school_supplies_needed_by ON helpschool.school_supplies (needed_by)
+    WHERE status = 'open' AND needed_by IS NOT NULL;
+
+COMMIT;
@@ -0,0 +1,151 @@
+--
+-- Append-only audit log of every insert, update and delete on the tables
+-- the services change. Triggers record the row before and after (only the
+-- changed columns for updates) with the actor the API sets on its
+-- connections: user, client IP, request ID and the X-Audit-Reason header.
+-- Each event hashes the previous event's hash, so an edited or removed
+-- event breaks the chain; /api/audit-events/verify walks it.
+--
+--   psql "$DB_CONN" -f database/migrations/016_audit_events.sql
+--
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS helpschool.audit_events (
+    event_id bigserial NOT NULL,
+    occurred_at timestamp with time zone DEFAULT now() NOT NULL,
+    user_id uuid,
+    ip character varying(64),
+    request_id character varying(128),
+    reason character varying(1024),
+    entity character varying(64) NOT NULL,
+    entity_id character varying(256) NOT NULL,
+    action character varying(8) NOT NULL,
+    before jsonb,
+    after jsonb,
+    prev_hash bytea,
+    hash bytea NOT NULL,
+    CONSTRAINT audit_events_pkey PRIMARY KEY (event_id),
+    CONSTRAINT audit_events_action CHECK (action IN ('create', 'update', 'delete'))
+);
+
+CREATE INDEX IF NOT EXISTS audit_events_entity ON helpschool.audit_events (entity, entity_id);
+CREATE INDEX IF NOT EXISTS audit_events_user ON helpschool.audit_events (user_id);
+CREATE INDEX IF NOT EXISTS audit_events_occurred ON helpschool.audit_events (occurred_at);
+
+-- the hash of an event chained to the hash of the event before it
+CREATE OR REPLACE FUNCTION helpschool.audit_event_hash(prev_hash bytea, e helpschool.audit_events) RETURNS bytea
+    LANGUAGE sql STABLE AS $$
+    SELECT sha256(coalesce(prev_hash, ''::bytea) || convert_to(concat_ws('|',
+        to_char(e.occurred_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.US'),
+        coalesce(e.user_id::text, ''), coalesce(e.ip, ''), coalesce(e.request_id, ''), coalesce(e.reason, ''),
+        e.entity, e.entity_id, e.action, coalesce(e.before::text, ''), coalesce(e.after::text, '')), 'UTF8'))
+$$;
+
+-- audit_row records a change of a row. TG_ARGV[0] lists the key columns
+-- of the table, comma separated, TG_ARGV[1] the columns whose values must
+-- not be copied into the log.
+CREATE OR REPLACE FUNCTION helpschool.audit_row() RETURNS trigger
+    LANGUAGE plpgsql AS $$
+DECLARE
+    old_row jsonb;
+    new_row jsonb;
+    redacted text[] := string_to_array(coalesce(TG_ARGV[1], ''), ',');
+    e helpschool.audit_events;
+BEGIN
+    IF TG_OP <> 'INSERT' THEN
+        old_row := to_jsonb(OLD) - 'modified_date';
+    END IF;
+    IF TG_OP <> 'DELETE' THEN
+        new_row := to_jsonb(NEW) - 'modified_date';
+    END IF;
+
+    e.entity := TG_TABLE_NAME;
+    SELECT string_agg(coalesce(new_row, old_row) ->> k, '/') INTO e.entity_id
+        FROM unnest(string_to_array(TG_ARGV[0], ',')) AS k;
+    IF TG_OP = 'UPDATE' THEN
+        e.action := 'update';
+        SELECT jsonb_object_agg(o.key, o.value), jsonb_object_agg(n.key, n.value) INTO e.before, e.after
+            FROM jsonb_each(old_row) AS o INNER JOIN jsonb_each(new_row) AS n ON n.key = o.key
+            WHERE n.value IS DISTINCT FROM o.value;
+        IF e.after IS NULL THEN
+            RETURN NULL;
+        END IF;
+    ELSIF TG_OP = 'INSERT' THEN
+        e.action := 'create';
+        e.after := new_row;
+    ELSE
+        e.action := 'delete';
+        e.before := old_row;
+    END IF;
+    e.before := (SELECT jsonb_object_agg(key, CASE WHEN key = ANY (redacted) THEN '"redacted"'::jsonb ELSE value END)
+        FROM jsonb_each(e.before));
+    e.after := (SELECT jsonb_object_agg(key, CASE WHEN key = ANY (redacted) THEN '"redacted"'::jsonb ELSE value END)
+        FROM jsonb_each(e.after));
+
+    e.occurred_at := now();
+    e.user_id := nullif(current_setting('helpschool.audit_user', true), '')::uuid;
+    e.ip := nullif(current_setting('helpschool.audit_ip', true), '');
+    e.request_id := nullif(current_setting('helpschool.audit_request', true), '');
+    e.reason := nullif(current_setting('helpschool.audit_reason', true), '');
+
+    -- one writer at a time extends the chain
+    PERFORM pg_advisory_xact_lock(hashtext('helpschool.audit_events'));
+    SELECT hash INTO e.prev_hash FROM helpschool.audit_events ORDER BY event_id DESC LIMIT 1;
+    e.hash := helpschool.audit_event_hash(e.prev_hash, e);
+
+    INSERT INTO helpschool.audit_events (occurred_at, user_id, ip, request_id, reason, entity, entity_id, action,
+            before, after, prev_hash, hash)
+        VALUES (e.occurred_at, e.user_id, e.ip, e.request_id, e.reason, e.entity, e.entity_id, e.action,
+            e.before, e.after, e.prev_hash, e.hash);
+    RETURN NULL;
+END
+$$;
+
+CREATE OR REPLACE FUNCTION helpschool.audit_append_only() RETURNS trigger
+    LANGUAGE plpgsql AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only';
+END
+$$;
+
+DROP TRIGGER IF EXISTS audit_events_append_only ON helpschool.audit_events;
+CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON helpschool.audit_events
+    FOR EACH STATEMENT EXECUTE FUNCTION helpschool.audit_append_only();
+
+DO $$
+DECLARE
+    t record;
+BEGIN
+    FOR t IN SELECT * FROM (VALUES
+        ('countries', 'country_id', ''),
+        ('states', 'state_id', ''),
+        ('districts', 'district_id', ''),
+        ('regions', 'region_id', ''),
+        ('schools', 'school_id', ''),
+        ('supplies', 'supply_id', ''),
+        ('supply_categories', 'category_id', ''),
+        ('catalog_items', 'item_id', ''),
+        ('supply_offers', 'offer_id', ''),
+        ('affiliate_rules', 'rule_id', ''),
+        ('bundles', 'bundle_id', ''),
+        ('bundle_items', 'bundle_id,item_id', ''),
+        ('school_bundles', 'school_id,bundle_id', ''),
+        ('school_supplies', 'school_id,supply_id,bundle_id', ''),
+        ('need_recurrences', 'recurrence_id', ''),
+        ('users', 'id', ''),
+        ('users_donations', 'donation_id', ''),
+        ('teacher_affiliations', 'affiliation_id', 'code_hash'),
+        ('school_updates', 'update_id', ''),
+        ('message_threads', 'thread_id', ''),
+        ('messages', 'message_id', '')
+    ) AS v(name, keys, redacted)
+    LOOP
+        EXECUTE format('DROP TRIGGER IF EXISTS %I ON helpschool.%I', t.name || '_audit', t.name);
+        EXECUTE format('CREATE TRIGGER %I AFTER INSERT OR UPDATE OR DELETE ON helpschool.%I
+            FOR EACH ROW EXECUTE FUNCTION helpschool.audit_row(%L, %L)', t.name || '_audit', t.name, t.keys, t.redacted);
+    END LOOP;
+END
+$$;
+
+COMMIT;
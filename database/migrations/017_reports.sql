@@ -0,0 +1,28 @@
+--
+-- Pledges remember when they were delivered, for the deliveries export,
+-- and transparency_reports lists the monthly public reports of needs,
+-- pledges and deliveries written to storage, aggregates only.
+--
+--   psql "$DB_CONN" -f database/migrations/017_reports.sql
+--
+
+BEGIN;
+
+ALTER TABLE helpschool.users_donations
+    ADD COLUMN IF NOT EXISTS delivered_date timestamp with time zone;
+UPDATE helpschool.users_donations SET delivered_date = coalesce(modified_date, created_date)
+    WHERE status = 'Delivered' AND delivered_date IS NULL;
+CREATE INDEX IF NOT EXISTS users_donations_delivered ON helpschool.users_donations (delivered_date)
+    WHERE delivered_date IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS helpschool.transparency_reports (
+    month date NOT NULL,
+    totals jsonb NOT NULL,
+    json_key character varying(256) NOT NULL,
+    csv_key character varying(256) NOT NULL,
+    created_date timestamp with time zone DEFAULT now() NOT NULL,
+    CONSTRAINT transparency_reports_pkey PRIMARY KEY (month),
+    CONSTRAINT transparency_reports_month_check CHECK (extract(day from month) = 1)
+);
+
+COMMIT;
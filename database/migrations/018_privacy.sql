@@ -0,0 +1,85 @@
+--
+-- Data subject rights. privacy_requests logs the exports and erasures of
+-- personal data, made by users themselves or by admins on their behalf.
+-- Erased users keep their row, with nothing left that identifies them, so
+-- that their pledges still count. teacher_requests lose the teacher's
+-- name, phone, email, address and photo after the retention period.
+--
+-- The audit log no longer copies emails, names, message bodies and the
+-- like, and those already copied are redacted. Redacting rewrites the hash
+-- chain once, so note the new head hash from /api/audit-events/verify.
+--
+--   psql "$DB_CONN" -f database/migrations/018_privacy.sql
+--
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS helpschool.privacy_requests (
+    request_id uuid DEFAULT gen_random_uuid() NOT NULL,
+    kind character varying(16) NOT NULL,
+    user_id uuid,
+    email_hash character varying(64),
+    handled_by uuid,
+    note character varying(4096),
+    created_date timestamp with time zone DEFAULT now() NOT NULL,
+    CONSTRAINT privacy_requests_pkey PRIMARY KEY (request_id),
+    CONSTRAINT privacy_requests_kind CHECK (kind IN ('export', 'erasure')),
+    CONSTRAINT privacy_requests_subject CHECK (user_id IS NOT NULL OR email_hash IS NOT NULL)
+);
+
+COMMENT ON COLUMN helpschool.privacy_requests.email_hash IS 'sha256 of the lower case email of a guest donor, the email itself is not kept';
+COMMENT ON COLUMN helpschool.privacy_requests.handled_by IS 'the admin acting on behalf of the user, null when users asked themselves';
+
+CREATE INDEX IF NOT EXISTS privacy_requests_user ON helpschool.privacy_requests (user_id);
+
+ALTER TABLE helpschool.users
+    ADD COLUMN IF NOT EXISTS erased_date timestamp with time zone;
+
+COMMENT ON COLUMN helpschool.users.erased_date IS 'when the personal data of the user was erased, issuer is then erased and subject the id';
+
+-- requests from before this migration count as made when it ran
+ALTER TABLE helpschool.teacher_requests
+    ADD COLUMN IF NOT EXISTS created_date timestamp with time zone DEFAULT now() NOT NULL,
+    ADD COLUMN IF NOT EXISTS pii_purged_date timestamp with time zone;
+
+-- what the audit log must not copy
+CREATE TEMPORARY TABLE audit_redactions (name text, keys text, redacted text) ON COMMIT DROP;
+INSERT INTO audit_redactions VALUES
+    ('users', 'id', 'user_email,user_name,display_name,subject,extra_info'),
+    ('users_donations', 'donation_id', 'guest_email,tracking_url,extra_info'),
+    ('teacher_affiliations', 'affiliation_id', 'code_hash,school_email,evidence_key,review_note'),
+    ('message_threads', 'thread_id', 'subject'),
+    ('messages', 'message_id', 'body,attachment_key');
+
+DO $$
+DECLARE
+    t record;
+    e helpschool.audit_events;
+    prev bytea;
+BEGIN
+    FOR t IN SELECT * FROM audit_redactions
+    LOOP
+        EXECUTE format('DROP TRIGGER IF EXISTS %I ON helpschool.%I', t.name || '_audit', t.name);
+        EXECUTE format('CREATE TRIGGER %I AFTER INSERT OR UPDATE OR DELETE ON helpschool.%I
+            FOR EACH ROW EXECUTE FUNCTION helpschool.audit_row(%L, %L)', t.name || '_audit', t.name, t.keys, t.redacted);
+    END LOOP;
+
+    ALTER TABLE helpschool.audit_events DISABLE TRIGGER audit_events_append_only;
+    UPDATE helpschool.audit_events AS a
+        SET before = a.before || coalesce((SELECT jsonb_object_agg(k, '"redacted"'::jsonb)
+                FROM unnest(string_to_array(r.redacted, ',')) AS k WHERE a.before ? k), '{}'::jsonb),
+            after = a.after || coalesce((SELECT jsonb_object_agg(k, '"redacted"'::jsonb)
+                FROM unnest(string_to_array(r.redacted, ',')) AS k WHERE a.after ? k), '{}'::jsonb)
+        FROM audit_redactions AS r
+        WHERE r.name = a.entity;
+    FOR e IN SELECT * FROM helpschool.audit_events ORDER BY event_id
+    LOOP
+        e.hash := helpschool.audit_event_hash(prev, e);
+        UPDATE helpschool.audit_events SET prev_hash = prev, hash = e.hash WHERE event_id = e.event_id;
+        prev := e.hash;
+    END LOOP;
+    ALTER TABLE helpschool.audit_events ENABLE TRIGGER audit_events_append_only;
+END
+$$;
+
+COMMIT;
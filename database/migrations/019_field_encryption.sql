@@ -0,0 +1,33 @@
+--
+-- Application-level encryption of the teacher's phone, email and address
+-- in teacher_requests. The api encrypts them, so the columns become text
+-- to fit the ciphertext, and keeps blind indexes (keyed hashes of the
+-- normalised phone and email) for looking rows up by equality.
+--
+-- pii_key_id names the key a row is encrypted under. Existing rows have
+-- none and stay readable as plaintext until the api's re-encryption job,
+-- which runs at start, encrypts them under the current key.
+--
+--   psql "$DB_CONN" -f database/migrations/019_field_encryption.sql
+--
+
+BEGIN;
+
+ALTER TABLE helpschool.teacher_requests ALTER COLUMN teacher_phone TYPE text;
+ALTER TABLE helpschool.teacher_requests ALTER COLUMN teacher_email TYPE text;
+ALTER TABLE helpschool.teacher_requests ALTER COLUMN address TYPE text;
+ALTER TABLE helpschool.teacher_requests ALTER COLUMN address DROP NOT NULL;
+
+ALTER TABLE helpschool.teacher_requests ADD COLUMN IF NOT EXISTS teacher_phone_bidx character varying(64);
+ALTER TABLE helpschool.teacher_requests ADD COLUMN IF NOT EXISTS teacher_email_bidx character varying(64);
+ALTER TABLE helpschool.teacher_requests ADD COLUMN IF NOT EXISTS pii_key_id character varying(64);
+
+CREATE INDEX IF NOT EXISTS teacher_requests_phone_bidx ON helpschool.teacher_requests (teacher_phone_bidx);
+CREATE INDEX IF NOT EXISTS teacher_requests_email_bidx ON helpschool.teacher_requests (teacher_email_bidx);
+CREATE INDEX IF NOT EXISTS teacher_requests_pii_key_id ON helpschool.teacher_requests (pii_key_id);
+
+COMMENT ON COLUMN helpschool.teacher_requests.teacher_phone_bidx IS 'HMAC-SHA256 of the normalised phone, for equality lookups on the encrypted teacher_phone';
+COMMENT ON COLUMN helpschool.teacher_requests.teacher_email_bidx IS 'HMAC-SHA256 of the lower case email, for equality lookups on the encrypted teacher_email';
+COMMENT ON COLUMN helpschool.teacher_requests.pii_key_id IS 'key the phone, email and address are encrypted under, null while still plaintext';
+
+COMMIT;
@@ -0,0 +1,97 @@
+--
+-- Keep regions in step with countries, states and districts after they
+-- are created: renames, moves and deletes are mirrored too, and a region
+-- that moves takes its subtree's paths along. schools.region_id must name
+-- a region.
+--
+--   psql "$DB_CONN" -f database/migrations/020_region_sync.sql
+--
+
+BEGIN;
+
+-- a region moved to another parent leaves the paths to its old ancestors
+-- and gains those to the new ones, for itself and every region below it
+CREATE OR REPLACE FUNCTION helpschool.regions_move() RETURNS trigger AS $$
+BEGIN
+    IF NEW.parent_id IS NOT DISTINCT FROM OLD.parent_id THEN
+        RETURN NEW;
+    END IF;
+    IF EXISTS (SELECT 1 FROM helpschool.region_paths
+               WHERE ancestor_id = NEW.region_id AND descendant_id = NEW.parent_id) THEN
+        RAISE EXCEPTION 'region % cannot move below itself', NEW.region_id;
+    END IF;
+    DELETE FROM helpschool.region_paths AS p
+    WHERE p.descendant_id IN (SELECT descendant_id FROM helpschool.region_paths WHERE ancestor_id = NEW.region_id)
+      AND p.ancestor_id NOT IN (SELECT descendant_id FROM helpschool.region_paths WHERE ancestor_id = NEW.region_id);
+    INSERT INTO helpschool.region_paths (ancestor_id, descendant_id, depth)
+    SELECT up.ancestor_id, down.descendant_id, up.depth + down.depth + 1
+    FROM helpschool.region_paths AS up, helpschool.region_paths AS down
+    WHERE up.descendant_id = NEW.parent_id AND down.ancestor_id = NEW.region_id;
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS regions_move ON helpschool.regions;
+CREATE TRIGGER regions_move AFTER UPDATE OF parent_id ON helpschool.regions
+    FOR EACH ROW EXECUTE FUNCTION helpschool.regions_move();
+
+-- mirror_region(level, id column, parent id column) copies an inserted or
+-- updated row of countries, states or districts into regions and deletes
+-- the region of a deleted one, which fails while regions or schools are
+-- below it
+CREATE OR REPLACE FUNCTION helpschool.mirror_region() RETURNS trigger AS $$
+DECLARE
+    fields jsonb;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        DELETE FROM helpschool.regions WHERE region_id = (to_jsonb(OLD)->>TG_ARGV[1])::uuid;
+        RETURN OLD;
+    END IF;
+    fields := to_jsonb(NEW);
+    IF TG_OP = 'UPDATE' THEN
+        UPDATE helpschool.regions
+            SET parent_id = (fields->>TG_ARGV[2])::uuid, name = NEW.name, govt_id = fields->>'govt_id',
+                modified_date = now()
+            WHERE region_id = (fields->>TG_ARGV[1])::uuid;
+        IF FOUND THEN
+            RETURN NEW;
+        END IF;
+    END IF;
+    INSERT INTO helpschool.regions (region_id, parent_id, level, name, govt_id)
+    VALUES ((fields->>TG_ARGV[1])::uuid, (fields->>TG_ARGV[2])::uuid, TG_ARGV[0], NEW.name, fields->>'govt_id')
+    ON CONFLICT (region_id) DO NOTHING;
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS countries_region ON helpschool.countries;
+CREATE TRIGGER countries_region AFTER INSERT OR UPDATE OR DELETE ON helpschool.countries
+    FOR EACH ROW EXECUTE FUNCTION helpschool.mirror_region('country', 'country_id', 'parent_id');
+DROP TRIGGER IF EXISTS states_region ON helpschool.states;
+CREATE TRIGGER states_region AFTER INSERT OR UPDATE OR DELETE ON helpschool.states
+    FOR EACH ROW EXECUTE FUNCTION helpschool.mirror_region('state', 'state_id', 'country_id');
+DROP TRIGGER IF EXISTS districts_region ON helpschool.districts;
+CREATE TRIGGER districts_region AFTER INSERT OR UPDATE OR DELETE ON helpschool.districts
+    FOR EACH ROW EXECUTE FUNCTION helpschool.mirror_region('district', 'district_id', 'state_id');
+
+-- catch up with the changes made since migration 009
+UPDATE helpschool.regions AS g SET name = c.name, modified_date = now()
+    FROM helpschool.countries AS c WHERE g.region_id = c.country_id AND g.name <> c.name;
+UPDATE helpschool.regions AS g SET parent_id = s.country_id, name = s.name, govt_id = s.govt_id, modified_date = now()
+    FROM helpschool.states AS s
+    WHERE g.region_id = s.state_id
+      AND (g.parent_id IS DISTINCT FROM s.country_id OR g.name <> s.name OR g.govt_id IS DISTINCT FROM s.govt_id);
+UPDATE helpschool.regions AS g SET parent_id = d.state_id, name = d.name, govt_id = d.govt_id, modified_date = now()
+    FROM helpschool.districts AS d
+    WHERE g.region_id = d.district_id
+      AND (g.parent_id IS DISTINCT FROM d.state_id OR g.name <> d.name OR g.govt_id IS DISTINCT FROM d.govt_id);
+
+-- schools whose region is gone fall back to their district
+UPDATE helpschool.schools AS s SET region_id = s.district_id
+    WHERE s.region_id IS NOT NULL
+      AND NOT EXISTS (SELECT 1 FROM helpschool.regions AS g WHERE g.region_id = s.region_id);
+ALTER TABLE helpschool.schools DROP CONSTRAINT IF EXISTS schools_region_fkey;
+ALTER TABLE helpschool.schools
+    ADD CONSTRAINT schools_region_fkey FOREIGN KEY (region_id) REFERENCES helpschool.regions (region_id);
+
+COMMIT;
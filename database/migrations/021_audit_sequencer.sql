@@ -0,0 +1,131 @@
+--
+-- Audited writes no longer wait for each other. Migration 016 extended the
+-- hash chain inside every audit trigger under one advisory lock, which
+-- serialized every audited write in the database until its transaction
+-- committed, and could deadlock with transactions holding row locks.
+-- Triggers now append events unchained; a single sequencer, audit_chain(),
+-- called by the api's audit job, links them afterwards in the order of
+-- chain_seq. Only the sequencer takes the lock.
+--
+-- An unchained event can still be edited until it is chained, a window of
+-- seconds; /api/audit-events/verify reports how many are unchained.
+--
+--   psql "$DB_CONN" -f database/migrations/021_audit_sequencer.sql
+--
+
+BEGIN;
+
+ALTER TABLE helpschool.audit_events ALTER COLUMN hash DROP NOT NULL;
+ALTER TABLE helpschool.audit_events ADD COLUMN IF NOT EXISTS chain_seq bigint;
+
+COMMENT ON COLUMN helpschool.audit_events.chain_seq IS 'position in the hash chain, set with prev_hash and hash by audit_chain()';
+
+CREATE OR REPLACE FUNCTION helpschool.audit_append_only() RETURNS trigger
+    LANGUAGE plpgsql AS $$
+BEGIN
+    -- the sequencer sets prev_hash, hash and chain_seq of an unchained event once
+    IF TG_OP = 'UPDATE' AND OLD.hash IS NULL AND NEW.hash IS NOT NULL
+        AND to_jsonb(OLD) - ARRAY['prev_hash', 'hash', 'chain_seq'] = to_jsonb(NEW) - ARRAY['prev_hash', 'hash', 'chain_seq'] THEN
+        RETURN NEW;
+    END IF;
+    RAISE EXCEPTION 'audit_events is append-only';
+END
+$$;
+
+-- the events so far were chained in the order of event_id
+ALTER TABLE helpschool.audit_events DISABLE TRIGGER audit_events_append_only;
+UPDATE helpschool.audit_events SET chain_seq = event_id WHERE chain_seq IS NULL AND hash IS NOT NULL;
+ALTER TABLE helpschool.audit_events ENABLE TRIGGER audit_events_append_only;
+
+DROP TRIGGER IF EXISTS audit_events_append_only ON helpschool.audit_events;
+CREATE TRIGGER audit_events_append_only BEFORE UPDATE OR DELETE ON helpschool.audit_events
+    FOR EACH ROW EXECUTE FUNCTION helpschool.audit_append_only();
+DROP TRIGGER IF EXISTS audit_events_no_truncate ON helpschool.audit_events;
+CREATE TRIGGER audit_events_no_truncate BEFORE TRUNCATE ON helpschool.audit_events
+    FOR EACH STATEMENT EXECUTE FUNCTION helpschool.audit_append_only();
+
+CREATE UNIQUE INDEX IF NOT EXISTS audit_events_chain ON helpschool.audit_events (chain_seq);
+CREATE INDEX IF NOT EXISTS audit_events_unchained ON helpschool.audit_events (event_id) WHERE hash IS NULL;
+
+-- audit_row records a change of a row, unchained. TG_ARGV[0] lists the
+-- key columns of the table, comma separated, TG_ARGV[1] the columns whose
+-- values must not be copied into the log.
+CREATE OR REPLACE FUNCTION helpschool.audit_row() RETURNS trigger
+    LANGUAGE plpgsql AS $$
+DECLARE
+    old_row jsonb;
+    new_row jsonb;
+    redacted text[] := string_to_array(coalesce(TG_ARGV[1], ''), ',');
+    e helpschool.audit_events;
+BEGIN
+    IF TG_OP <> 'INSERT' THEN
+        old_row := to_jsonb(OLD) - 'modified_date';
+    END IF;
+    IF TG_OP <> 'DELETE' THEN
+        new_row := to_jsonb(NEW) - 'modified_date';
+    END IF;
+
+    e.entity := TG_TABLE_NAME;
+    SELECT string_agg(coalesce(new_row, old_row) ->> k, '/') INTO e.entity_id
+        FROM unnest(string_to_array(TG_ARGV[0], ',')) AS k;
+    IF TG_OP = 'UPDATE' THEN
+        e.action := 'update';
+        SELECT jsonb_object_agg(o.key, o.value), jsonb_object_agg(n.key, n.value) INTO e.before, e.after
+            FROM jsonb_each(old_row) AS o INNER JOIN jsonb_each(new_row) AS n ON n.key = o.key
+            WHERE n.value IS DISTINCT FROM o.value;
+        IF e.after IS NULL THEN
+            RETURN NULL;
+        END IF;
+    ELSIF TG_OP = 'INSERT' THEN
+        e.action := 'create';
+        e.after := new_row;
+    ELSE
+        e.action := 'delete';
+        e.before := old_row;
+    END IF;
+    e.before := (SELECT jsonb_object_agg(key, CASE WHEN key = ANY (redacted) THEN '"redacted"'::jsonb ELSE value END)
+        FROM jsonb_each(e.before));
+    e.after := (SELECT jsonb_object_agg(key, CASE WHEN key = ANY (redacted) THEN '"redacted"'::jsonb ELSE value END)
+        FROM jsonb_each(e.after));
+
+    INSERT INTO helpschool.audit_events (occurred_at, user_id, ip, request_id, reason, entity, entity_id, action,
+            before, after)
+        VALUES (now(), nullif(current_setting('helpschool.audit_user', true), '')::uuid,
+            nullif(current_setting('helpschool.audit_ip', true), ''),
+            nullif(current_setting('helpschool.audit_request', true), ''),
+            nullif(current_setting('helpschool.audit_reason', true), ''),
+            e.entity, e.entity_id, e.action, e.before, e.after);
+    RETURN NULL;
+END
+$$;
+
+-- audit_chain links up to batch committed unchained events to the end of
+-- the chain, oldest first, and returns how many. It does nothing while
+-- another call is chaining.
+CREATE OR REPLACE FUNCTION helpschool.audit_chain(batch integer) RETURNS integer
+    LANGUAGE plpgsql AS $$
+DECLARE
+    e helpschool.audit_events;
+    prev bytea;
+    seq bigint;
+    n integer := 0;
+BEGIN
+    IF NOT pg_try_advisory_xact_lock(hashtext('helpschool.audit_chain')) THEN
+        RETURN 0;
+    END IF;
+    SELECT hash, chain_seq INTO prev, seq FROM helpschool.audit_events
+        WHERE chain_seq IS NOT NULL ORDER BY chain_seq DESC LIMIT 1;
+    FOR e IN SELECT * FROM helpschool.audit_events WHERE hash IS NULL ORDER BY event_id LIMIT batch
+    LOOP
+        seq := coalesce(seq, 0) + 1;
+        e.hash := helpschool.audit_event_hash(prev, e);
+        UPDATE helpschool.audit_events SET prev_hash = prev, hash = e.hash, chain_seq = seq
+            WHERE event_id = e.event_id;
+        prev := e.hash;
+        n := n + 1;
+    END LOOP;
+    RETURN n;
+END
+$$;
+
+COMMIT;
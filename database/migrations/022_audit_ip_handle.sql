@@ -0,0 +1,50 @@
+--
+-- The audit log keeps less about people. Public handles are redacted like
+-- names, and client IPs are kept truncated to their network, /24 for IPv4
+-- and /48 for IPv6, by the api and here for the events already logged,
+-- so that an erased user's events no longer point at their address.
+-- Redacting rewrites the hash chain once, so note the new head hash from
+-- /api/audit-events/verify.
+--
+--   psql "$DB_CONN" -f database/migrations/022_audit_ip_handle.sql
+--
+
+BEGIN;
+
+DROP TRIGGER IF EXISTS users_audit ON helpschool.users;
+CREATE TRIGGER users_audit AFTER INSERT OR UPDATE OR DELETE ON helpschool.users
+    FOR EACH ROW EXECUTE FUNCTION helpschool.audit_row('id', 'user_email,user_name,display_name,subject,extra_info,handle');
+
+CREATE OR REPLACE FUNCTION pg_temp.truncate_ip(ip text) RETURNS text
+    LANGUAGE plpgsql AS $$
+BEGIN
+    RETURN host(network(set_masklen(ip::inet, CASE WHEN family(ip::inet) = 4 THEN 24 ELSE 48 END)));
+EXCEPTION WHEN others THEN
+    RETURN NULL;
+END
+$$;
+
+DO $$
+DECLARE
+    e helpschool.audit_events;
+    prev bytea;
+BEGIN
+    -- keep the sequencer out while the chain is rewritten
+    PERFORM pg_advisory_xact_lock(hashtext('helpschool.audit_chain'));
+    ALTER TABLE helpschool.audit_events DISABLE TRIGGER audit_events_append_only;
+    UPDATE helpschool.audit_events SET ip = pg_temp.truncate_ip(ip) WHERE ip IS NOT NULL;
+    UPDATE helpschool.audit_events
+        SET before = CASE WHEN before ? 'handle' THEN before || '{"handle": "redacted"}'::jsonb ELSE before END,
+            after = CASE WHEN after ? 'handle' THEN after || '{"handle": "redacted"}'::jsonb ELSE after END
+        WHERE entity = 'users' AND (before ? 'handle' OR after ? 'handle');
+    FOR e IN SELECT * FROM helpschool.audit_events WHERE chain_seq IS NOT NULL ORDER BY chain_seq
+    LOOP
+        e.hash := helpschool.audit_event_hash(prev, e);
+        UPDATE helpschool.audit_events SET prev_hash = prev, hash = e.hash WHERE event_id = e.event_id;
+        prev := e.hash;
+    END LOOP;
+    ALTER TABLE helpschool.audit_events ENABLE TRIGGER audit_events_append_only;
+END
+$$;
+
+COMMIT;
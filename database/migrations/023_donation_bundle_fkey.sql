@@ -0,0 +1,23 @@
+--
+-- Pledges for a bundle reference it, like the school's needs do, so a
+-- donation cannot name a bundle that does not exist. Donations naming one
+-- that was never created are first detached from it.
+--
+--   psql "$DB_CONN" -f database/migrations/023_donation_bundle_fkey.sql
+--
+
+BEGIN;
+
+UPDATE helpschool.users_donations AS d SET bundle_id = NULL
+    WHERE d.bundle_id IS NOT NULL
+        AND NOT EXISTS (SELECT 1 FROM helpschool.bundles AS b WHERE b.bundle_id = d.bundle_id);
+
+ALTER TABLE helpschool.users_donations DROP CONSTRAINT IF EXISTS users_donations_bundle_fkey;
+ALTER TABLE helpschool.users_donations
+    ADD CONSTRAINT users_donations_bundle_fkey FOREIGN KEY (bundle_id)
+    REFERENCES helpschool.bundles (bundle_id);
+
+CREATE INDEX IF NOT EXISTS users_donations_bundle ON helpschool.users_donations (bundle_id)
+    WHERE bundle_id IS NOT NULL;
+
+COMMIT;
@@ -0,0 +1,16 @@
+--
+-- Guesses at an affiliation's code and emailed codes are counted per day
+-- and no longer reset when the affiliation is started over or a new code
+-- is sent, so a 6 digit code cannot be brute-forced by starting again.
+--
+--   psql "$DB_CONN" -f database/migrations/024_affiliation_code_window.sql
+--
+
+BEGIN;
+
+ALTER TABLE helpschool.teacher_affiliations ADD COLUMN IF NOT EXISTS code_window_start timestamp with time zone;
+ALTER TABLE helpschool.teacher_affiliations ADD COLUMN IF NOT EXISTS codes_issued integer DEFAULT 0 NOT NULL;
+
+COMMENT ON COLUMN helpschool.teacher_affiliations.code_window_start IS 'start of the day code_attempts and codes_issued are counted in';
+
+COMMIT;
@@ -0,0 +1,20 @@
+--
+-- Hits counted per key and window for the rate limits of the api, such as
+-- the guest pledges mailed per client network and per recipient. Keys hold
+-- hashes, not addresses, and rows are dropped once their window is over.
+--
+--   psql "$DB_CONN" -f database/migrations/025_rate_limits.sql
+--
+
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS helpschool.rate_limits (
+    key character varying(256) NOT NULL,
+    window_start timestamp with time zone DEFAULT now() NOT NULL,
+    hits integer DEFAULT 0 NOT NULL,
+    CONSTRAINT rate_limits_pkey PRIMARY KEY (key)
+);
+
+CREATE INDEX IF NOT EXISTS rate_limits_window_start ON helpschool.rate_limits (window_start);
+
+COMMIT;
@@ -0,0 +1,17 @@
+--
+-- Teacher requests join the audit log. What the privacy job purges from
+-- them, the teacher's name, encrypted phone, email and address, their
+-- blind indexes and the photo, is redacted, so the log never holds the
+-- plaintext or anything to look a teacher up by.
+--
+--   psql "$DB_CONN" -f database/migrations/026_audit_teacher_requests.sql
+--
+
+BEGIN;
+
+DROP TRIGGER IF EXISTS teacher_requests_audit ON helpschool.teacher_requests;
+CREATE TRIGGER teacher_requests_audit AFTER INSERT OR UPDATE OR DELETE ON helpschool.teacher_requests
+    FOR EACH ROW EXECUTE FUNCTION helpschool.audit_row('id',
+        'teacher_name,teacher_phone,teacher_email,address,photo_link,teacher_phone_bidx,teacher_email_bidx');
+
+COMMIT;